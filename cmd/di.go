@@ -18,12 +18,14 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
 	"net/url"
 	"path/filepath"
 	"reflect"
+	"sync"
 	"time"
 
 	"github.com/ethereum/go-ethereum/accounts/keystore"
@@ -140,9 +142,12 @@ type Dependencies struct {
 
 	ServicesManager *service.Manager
 	ServiceRegistry *service.Registry
-	ServiceSessions *service.SessionPool
+	ServiceSessions service.Storage
 	ServiceFirewall firewall.IncomingTrafficFirewall
 
+	sessionManagers     map[service.ID]*service.SessionManager
+	sessionManagersLock sync.Mutex
+
 	NATPinger  traversal.NATPinger
 	NATTracker *event.Tracker
 	PortPool   *port.Pool
@@ -163,17 +168,19 @@ type Dependencies struct {
 	LogCollector *logconfig.Collector
 	Reporter     *feedback.Reporter
 
-	ProviderInvoiceStorage   *pingpong.ProviderInvoiceStorage
-	ConsumerTotalsStorage    *pingpong.ConsumerTotalsStorage
-	HermesPromiseStorage     *pingpong.HermesPromiseStorage
-	ConsumerBalanceTracker   *pingpong.ConsumerBalanceTracker
-	HermesChannelRepository  *pingpong.HermesChannelRepository
-	HermesPromiseSettler     pingpong.HermesPromiseSettler
-	HermesURLGetter          *pingpong.HermesURLGetter
-	HermesCaller             *pingpong.HermesCaller
-	ChannelAddressCalculator *pingpong.ChannelAddressCalculator
-	HermesPromiseHandler     *pingpong.HermesPromiseHandler
-	SettlementHistoryStorage *pingpong.SettlementHistoryStorage
+	ProviderInvoiceStorage      *pingpong.ProviderInvoiceStorage
+	ConsumerTotalsStorage       *pingpong.ConsumerTotalsStorage
+	HermesPromiseStorage        *pingpong.HermesPromiseStorage
+	HermesPromiseRequestStorage *pingpong.HermesPromiseRequestStorage
+	ConsumerBalanceTracker      *pingpong.ConsumerBalanceTracker
+	HermesChannelRepository     *pingpong.HermesChannelRepository
+	HermesPromiseSettler        pingpong.HermesPromiseSettler
+	HermesURLGetter             *pingpong.HermesURLGetter
+	HermesCaller                *pingpong.HermesCaller
+	HermesHTTPClient            *requests.HTTPClient
+	ChannelAddressCalculator    *pingpong.ChannelAddressCalculator
+	HermesPromiseHandler        *pingpong.HermesPromiseHandler
+	SettlementHistoryStorage    *pingpong.SettlementHistoryStorage
 
 	MMN         *mmn.MMN
 	PilvytisAPI *pilvytis.API
@@ -361,11 +368,18 @@ func (di *Dependencies) Shutdown() (err error) {
 		}
 	}
 
+	// The nil pointers must not end up in the interfaces, as they would not be nil anymore.
+	var services servicesKiller
 	if di.ServicesManager != nil {
-		if err := di.ServicesManager.Kill(); err != nil {
-			errs = append(errs, err)
-		}
+		services = di.ServicesManager
+	}
+	var promises promiseHandlerShutdowner
+	if di.HermesPromiseHandler != nil {
+		promises = di.HermesPromiseHandler
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), paymentsShutdownTimeout)
+	errs = append(errs, shutdownServicePayments(ctx, di.sessionShutdowners(), services, promises)...)
+	cancel()
 
 	if di.PolicyOracle != nil {
 		di.PolicyOracle.Stop()
@@ -426,6 +440,7 @@ func (di *Dependencies) bootstrapStorage(path string) error {
 	di.ProviderInvoiceStorage = pingpong.NewProviderInvoiceStorage(invoiceStorage)
 	di.ConsumerTotalsStorage = pingpong.NewConsumerTotalsStorage(di.Storage, di.EventBus)
 	di.HermesPromiseStorage = pingpong.NewHermesPromiseStorage(di.Storage)
+	di.HermesPromiseRequestStorage = pingpong.NewHermesPromiseRequestStorage(di.Storage)
 	di.SessionStorage = consumer_session.NewSessionStorage(di.Storage)
 	di.SettlementHistoryStorage = pingpong.NewSettlementHistoryStorage(di.Storage)
 	return di.SessionStorage.Subscribe(di.EventBus)
@@ -460,7 +475,11 @@ func (di *Dependencies) bootstrapNodeComponents(nodeOptions node.Options, tequil
 		return err
 	}
 
-	di.HermesCaller = pingpong.NewHermesCaller(di.HTTPClient, hermesURL)
+	di.HermesHTTPClient, err = pingpong.NewHermesHTTPClient(di.HTTPClient, di.HTTPTransport, hermesCallerConfig(nodeOptions.Hermes))
+	if err != nil {
+		return err
+	}
+	di.HermesCaller = di.newHermesCaller(hermesURL, nodeOptions.Hermes)
 
 	if err := di.bootstrapHermesPromiseSettler(nodeOptions); err != nil {
 		return err
@@ -495,14 +514,20 @@ func (di *Dependencies) bootstrapNodeComponents(nodeOptions node.Options, tequil
 	}
 
 	di.HermesPromiseHandler = pingpong.NewHermesPromiseHandler(pingpong.HermesPromiseHandlerDeps{
-		HermesPromiseStorage: di.HermesPromiseStorage,
+		HermesPromiseStorage:  di.HermesPromiseStorage,
+		PendingRequestStorage: di.HermesPromiseRequestStorage,
 		HermesCallerFactory: func(hermesURL string) pingpong.HermesHTTPRequester {
-			return pingpong.NewHermesCaller(di.HTTPClient, hermesURL)
+			return di.newHermesCaller(hermesURL, nodeOptions.Hermes)
 		},
-		HermesURLGetter: di.HermesURLGetter,
-		FeeProvider:     di.Transactor,
-		Encryption:      di.Keystore,
-		EventBus:        di.EventBus,
+		HermesURLGetter:         di.HermesURLGetter,
+		HermesSignerGetter:      di.BCHelper,
+		ProviderChannelGetter:   di.BCHelper,
+		FeeProvider:             di.Transactor,
+		Encryption:              di.Keystore,
+		EventBus:                di.EventBus,
+		AllowedChainIDs:         []int64{config.GetInt64(config.FlagChainID)},
+		PlaintextRecovery:       plaintextRecovery(),
+		MaxAgreementTotalGrowth: config.GetInt64(config.FlagPaymentsHermesMaxAgreementGrowth),
 	})
 
 	if err := di.HermesPromiseHandler.Subscribe(di.EventBus); err != nil {
@@ -568,6 +593,18 @@ func (di *Dependencies) bootstrapNodeComponents(nodeOptions node.Options, tequil
 	return nil
 }
 
+func (di *Dependencies) newHermesCaller(hermesURL string, options node.OptionsHermes) *pingpong.HermesCaller {
+	return pingpong.NewHermesCallerWithConfig(di.HermesHTTPClient, hermesURL, hermesCallerConfig(options))
+}
+
+func hermesCallerConfig(options node.OptionsHermes) pingpong.HermesCallerConfig {
+	return pingpong.HermesCallerConfig{
+		Timeout:  options.Timeout,
+		Retries:  options.Retries,
+		ProxyURL: options.ProxyURL,
+	}
+}
+
 func (di *Dependencies) bootstrapTequilapi(nodeOptions node.Options, listener net.Listener) (tequilapi.APIServer, error) {
 	if !nodeOptions.TequilapiEnabled {
 		return tequilapi.NewNoopAPIServer(), nil
@@ -708,6 +745,19 @@ func (di *Dependencies) bootstrapNetworkComponents(options node.Options) (err er
 	return di.IdentityRegistry.Subscribe(di.EventBus)
 }
 
+// plaintextRecovery returns true if the R recovery details may be sent to hermes unencrypted,
+// which is only allowed against the local network.
+func plaintextRecovery() bool {
+	if !config.GetBool(config.FlagPaymentsHermesPlaintextRecovery) {
+		return false
+	}
+	if !config.GetBool(config.FlagLocalnet) {
+		log.Error().Msgf("Ignoring --%s, it is only allowed with --%s", config.FlagPaymentsHermesPlaintextRecovery.Name, config.FlagLocalnet.Name)
+		return false
+	}
+	return true
+}
+
 func (di *Dependencies) bootstrapEventBus() {
 	di.EventBus = eventbus.New()
 }
@@ -32,6 +32,7 @@ import (
 	"github.com/mysteriumnetwork/node/identity/registry"
 	"github.com/mysteriumnetwork/node/market"
 	"github.com/mysteriumnetwork/node/mmn"
+	"github.com/mysteriumnetwork/node/money"
 	"github.com/mysteriumnetwork/node/nat"
 	"github.com/mysteriumnetwork/node/p2p"
 	service_noop "github.com/mysteriumnetwork/node/services/noop"
@@ -200,7 +201,7 @@ func (di *Dependencies) bootstrapHermesPromiseSettler(nodeOptions node.Options)
 	settler := pingpong.NewHermesPromiseSettler(
 		di.Transactor,
 		func(hermesURL string) pingpong.HermesHTTPRequester {
-			return pingpong.NewHermesCaller(di.HTTPClient, hermesURL)
+			return di.newHermesCaller(hermesURL, nodeOptions.Hermes)
 		},
 		di.HermesURLGetter,
 		di.HermesChannelRepository,
@@ -230,7 +231,15 @@ func (di *Dependencies) bootstrapServiceComponents(nodeOptions node.Options) err
 	}
 	di.ServiceRegistry = service.NewRegistry()
 
-	di.ServiceSessions = service.NewSessionPool(di.EventBus)
+	if config.GetBool(config.FlagSessionPersist) {
+		sessions := service.NewPersistentSessionPool(di.EventBus, di.Storage)
+		if err := sessions.Load(); err != nil {
+			log.Error().Err(err).Msg("Failed to load persisted sessions")
+		}
+		di.ServiceSessions = sessions
+	} else {
+		di.ServiceSessions = service.NewSessionPool(di.EventBus)
+	}
 
 	di.PolicyOracle = policy.NewOracle(
 		di.HTTPClient,
@@ -254,15 +263,19 @@ func (di *Dependencies) bootstrapServiceComponents(nodeOptions node.Options) err
 			di.HermesPromiseHandler,
 			common.HexToAddress(nodeOptions.Hermes.HermesID),
 		)
-		return service.NewSessionManager(
+		cfg := sessionManagerConfig()
+		cfg.HealthProvider = service.ServiceSessionsHealth{Sessions: di.ServiceSessions, ServiceID: serviceInstance.ID}
+		sessionManager := service.NewSessionManager(
 			serviceInstance,
 			di.ServiceSessions,
 			paymentEngineFactory,
 			di.NATTracker,
 			di.EventBus,
 			channel,
-			service.DefaultConfig(),
+			cfg,
 		)
+		di.trackSessionManager(serviceInstance.ID, sessionManager)
+		return sessionManager
 	}
 
 	di.ServicesManager = service.NewManager(
@@ -283,6 +296,17 @@ func (di *Dependencies) bootstrapServiceComponents(nodeOptions node.Options) err
 	return nil
 }
 
+// sessionManagerConfig returns the session manager config with the options set by the flags.
+func sessionManagerConfig() service.Config {
+	cfg := service.DefaultConfig()
+	cfg.StartRate = config.GetFloat64(config.FlagSessionStartRate)
+	cfg.StartBurst = config.GetInt(config.FlagSessionStartBurst)
+	cfg.ChainCurrencies = map[int64][]money.Currency{
+		config.GetInt64(config.FlagChainID): {money.Currency(config.GetString(config.FlagDefaultCurrency))},
+	}
+	return cfg
+}
+
 func (di *Dependencies) registerConnections(nodeOptions node.Options) {
 	di.registerOpenvpnConnection(nodeOptions)
 	di.registerNoopConnection()
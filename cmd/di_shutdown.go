@@ -0,0 +1,95 @@
+/*
+ * Copyright (C) 2020 The "MysteriumNetwork/node" Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cmd
+
+import (
+	"context"
+	"time"
+
+	"github.com/mysteriumnetwork/node/core/service"
+)
+
+// paymentsShutdownTimeout limits the time the node waits for the promises of the sessions on shutdown.
+const paymentsShutdownTimeout = 30 * time.Second
+
+type sessionShutdowner interface {
+	Shutdown(ctx context.Context, drainer service.PromiseDrainer) error
+}
+
+type servicesKiller interface {
+	Kill() error
+}
+
+type promiseHandlerShutdowner interface {
+	service.PromiseDrainer
+	Shutdown(ctx context.Context) error
+}
+
+// trackSessionManager keeps the latest session manager of the service, so that the sessions of the service
+// can be shut down along with the node. Every manager can shut down all the sessions of its service.
+func (di *Dependencies) trackSessionManager(id service.ID, manager *service.SessionManager) {
+	di.sessionManagersLock.Lock()
+	defer di.sessionManagersLock.Unlock()
+
+	if di.sessionManagers == nil {
+		di.sessionManagers = make(map[service.ID]*service.SessionManager)
+	}
+	di.sessionManagers[id] = manager
+}
+
+func (di *Dependencies) sessionShutdowners() []sessionShutdowner {
+	di.sessionManagersLock.Lock()
+	defer di.sessionManagersLock.Unlock()
+
+	shutdowners := make([]sessionShutdowner, 0, len(di.sessionManagers))
+	for _, manager := range di.sessionManagers {
+		shutdowners = append(shutdowners, manager)
+	}
+	return shutdowners
+}
+
+// shutdownServicePayments stops the services without losing the promises requested for their sessions:
+//  1. the sessions are shut down, draining their promise requests, while the promise handler still runs;
+//  2. the services are killed;
+//  3. the promise handler is shut down, persisting the requests it could not process in time.
+//
+// The storage must not be closed before it returns. Either the services or the promise handler may be nil.
+func shutdownServicePayments(ctx context.Context, sessions []sessionShutdowner, services servicesKiller, promises promiseHandlerShutdowner) (errs []error) {
+	var drainer service.PromiseDrainer
+	if promises != nil {
+		drainer = promises
+	}
+	for _, manager := range sessions {
+		if err := manager.Shutdown(ctx, drainer); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if services != nil {
+		if err := services.Kill(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if promises != nil {
+		if err := promises.Shutdown(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright (C) 2020 The "MysteriumNetwork/node" Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mysteriumnetwork/node/core/service"
+	"github.com/stretchr/testify/assert"
+)
+
+type shutdownRecorder struct {
+	calls []string
+}
+
+type mockSessionShutdowner struct {
+	recorder *shutdownRecorder
+	name     string
+	drainer  service.PromiseDrainer
+	err      error
+}
+
+func (m *mockSessionShutdowner) Shutdown(_ context.Context, drainer service.PromiseDrainer) error {
+	m.recorder.calls = append(m.recorder.calls, m.name)
+	m.drainer = drainer
+	return m.err
+}
+
+type mockServicesKiller struct {
+	recorder *shutdownRecorder
+}
+
+func (m *mockServicesKiller) Kill() error {
+	m.recorder.calls = append(m.recorder.calls, "services")
+	return nil
+}
+
+type mockPromiseHandlerShutdowner struct {
+	recorder *shutdownRecorder
+}
+
+func (m *mockPromiseHandlerShutdowner) DrainSessions(_ context.Context, _ []string) error {
+	return nil
+}
+
+func (m *mockPromiseHandlerShutdowner) Shutdown(_ context.Context) error {
+	m.recorder.calls = append(m.recorder.calls, "promises")
+	return nil
+}
+
+func Test_shutdownServicePayments(t *testing.T) {
+	recorder := &shutdownRecorder{}
+	wireguard := &mockSessionShutdowner{recorder: recorder, name: "wireguard", err: errors.New("session not destroyed")}
+	openvpn := &mockSessionShutdowner{recorder: recorder, name: "openvpn"}
+	promises := &mockPromiseHandlerShutdowner{recorder: recorder}
+
+	errs := shutdownServicePayments(context.Background(), []sessionShutdowner{wireguard, openvpn}, &mockServicesKiller{recorder: recorder}, promises)
+
+	// the sessions drain their promises before the services and the promise handler are stopped.
+	assert.Equal(t, []string{"wireguard", "openvpn", "services", "promises"}, recorder.calls)
+	assert.Equal(t, []error{wireguard.err}, errs)
+	assert.Equal(t, promises, wireguard.drainer)
+	assert.Equal(t, promises, openvpn.drainer)
+}
+
+func Test_shutdownServicePayments_WithoutPromiseHandler(t *testing.T) {
+	recorder := &shutdownRecorder{}
+	sessions := &mockSessionShutdowner{recorder: recorder, name: "sessions"}
+
+	errs := shutdownServicePayments(context.Background(), []sessionShutdowner{sessions}, nil, nil)
+
+	assert.Empty(t, errs)
+	assert.Equal(t, []string{"sessions"}, recorder.calls)
+	assert.Nil(t, sessions.drainer)
+}
@@ -29,6 +29,24 @@ var (
 		Usage: "hermes contract address used to register identity",
 		Value: metadata.DefaultNetwork.HermesID,
 	}
+	// FlagHermesTimeout determines the timeout of hermes requests
+	FlagHermesTimeout = cli.DurationFlag{
+		Name:  "hermes.timeout",
+		Usage: "timeout of requests to hermes, the default HTTP client timeout is used if zero",
+		Value: 0,
+	}
+	// FlagHermesRetries determines the number of retries of rate limited hermes requests
+	FlagHermesRetries = cli.IntFlag{
+		Name:  "hermes.retries",
+		Usage: "number of times the rate limited requests to hermes are retried",
+		Value: 3,
+	}
+	// FlagHermesProxy determines the proxy used to reach hermes
+	FlagHermesProxy = cli.StringFlag{
+		Name:  "hermes.proxy",
+		Usage: "proxy URL the requests to hermes are sent through",
+		Value: "",
+	}
 )
 
 // RegisterFlagsHermes function register network flags to flag list
@@ -36,10 +54,16 @@ func RegisterFlagsHermes(flags *[]cli.Flag) {
 	*flags = append(
 		*flags,
 		&FlagHermesID,
+		&FlagHermesTimeout,
+		&FlagHermesRetries,
+		&FlagHermesProxy,
 	)
 }
 
 // ParseFlagsHermes function fills in hermes options from CLI context
 func ParseFlagsHermes(ctx *cli.Context) {
 	Current.ParseStringFlag(ctx, FlagHermesID)
+	Current.ParseDurationFlag(ctx, FlagHermesTimeout)
+	Current.ParseIntFlag(ctx, FlagHermesRetries)
+	Current.ParseStringFlag(ctx, FlagHermesProxy)
 }
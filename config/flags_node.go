@@ -225,6 +225,25 @@ var (
 		Value: "0:0",
 	}
 
+	// FlagSessionStartRate limits the number of session starts per second of a single consumer identity.
+	FlagSessionStartRate = cli.Float64Flag{
+		Name:  "session.start-rate",
+		Usage: "Number of session starts per second allowed for a single consumer, value of 0 means unlimited",
+		Value: 0,
+	}
+	// FlagSessionStartBurst sets the number of session starts a single consumer identity can make at once.
+	FlagSessionStartBurst = cli.IntFlag{
+		Name:  "session.start-burst",
+		Usage: "Number of session starts a single consumer can make at once before the start rate applies",
+		Value: 0,
+	}
+	// FlagSessionPersist keeps a copy of the provider sessions in the local storage, so that they can be reconciled after a restart.
+	FlagSessionPersist = cli.BoolFlag{
+		Name:  "session.persist",
+		Usage: "Persist the provider sessions to reconcile them after a restart",
+		Value: false,
+	}
+
 	//FlagConsumer sets to run as consumer only which allows to skip bootstrap for some of the dependencies.
 	FlagConsumer = cli.BoolFlag{
 		Name:  "consumer",
@@ -287,6 +306,9 @@ func RegisterFlagsNode(flags *[]cli.Flag) error {
 		&FlagUserMode,
 		&FlagVendorID,
 		&FlagP2PListenPorts,
+		&FlagSessionStartRate,
+		&FlagSessionStartBurst,
+		&FlagSessionPersist,
 		&FlagConsumer,
 		&FlagDefaultCurrency,
 	)
@@ -337,6 +359,9 @@ func ParseFlagsNode(ctx *cli.Context) {
 	Current.ParseBoolFlag(ctx, FlagUserMode)
 	Current.ParseStringFlag(ctx, FlagVendorID)
 	Current.ParseStringFlag(ctx, FlagP2PListenPorts)
+	Current.ParseFloat64Flag(ctx, FlagSessionStartRate)
+	Current.ParseIntFlag(ctx, FlagSessionStartBurst)
+	Current.ParseBoolFlag(ctx, FlagSessionPersist)
 	Current.ParseBoolFlag(ctx, FlagConsumer)
 	Current.ParseStringFlag(ctx, FlagDefaultCurrency)
 
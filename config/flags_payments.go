@@ -109,6 +109,19 @@ var (
 		Usage: "sets the upper limit of session payment value before forcing an invoice. If this value is exceeded before a payment interval is reached, an invoice is sent.",
 		Value: "30000000000000000",
 	}
+	// FlagPaymentsHermesPlaintextRecovery sends the R recovery details to hermes unencrypted, for local test hermes only.
+	FlagPaymentsHermesPlaintextRecovery = cli.BoolFlag{
+		Name:   "payments.hermes.plaintext-recovery",
+		Usage:  "Sends the R recovery details to hermes unencrypted. Only for a local test hermes, ignored unless --localnet is set",
+		Value:  false,
+		Hidden: true,
+	}
+	// FlagPaymentsHermesMaxAgreementGrowth sets the multiple by which the agreement total may grow between two promises.
+	FlagPaymentsHermesMaxAgreementGrowth = cli.Int64Flag{
+		Name:  "payments.hermes.max-agreement-growth",
+		Usage: "Rejects the promise requests whose agreement total exceeds the given multiple of the previous promise total. 0 disables the check",
+		Value: 0,
+	}
 )
 
 // RegisterFlagsPayments function register payments flags to flag list.
@@ -129,6 +142,8 @@ func RegisterFlagsPayments(flags *[]cli.Flag) {
 		&FlagPaymentsMaxUnpaidInvoiceValue,
 		&FlagPaymentsWethAddress,
 		&FlagPaymentsDaiAddress,
+		&FlagPaymentsHermesPlaintextRecovery,
+		&FlagPaymentsHermesMaxAgreementGrowth,
 	)
 }
 
@@ -148,4 +163,6 @@ func ParseFlagsPayments(ctx *cli.Context) {
 	Current.ParseStringFlag(ctx, FlagPaymentsMaxUnpaidInvoiceValue)
 	Current.ParseStringFlag(ctx, FlagPaymentsWethAddress)
 	Current.ParseStringFlag(ctx, FlagPaymentsDaiAddress)
+	Current.ParseBoolFlag(ctx, FlagPaymentsHermesPlaintextRecovery)
+	Current.ParseInt64Flag(ctx, FlagPaymentsHermesMaxAgreementGrowth)
 }
@@ -75,6 +75,8 @@ type KeepAliveConfig struct {
 	SendInterval    time.Duration
 	SendTimeout     time.Duration
 	MaxSendErrCount int
+	// CompactPings offers the provider to exchange the compact keep-alive pings, which are used if the provider accepts them.
+	CompactPings bool
 }
 
 // Config contains common configuration options for connection manager.
@@ -94,6 +96,7 @@ func DefaultConfig() Config {
 			SendInterval:    20 * time.Second,
 			SendTimeout:     5 * time.Second,
 			MaxSendErrCount: 5,
+			CompactPings:    true,
 		},
 	}
 }
@@ -144,6 +147,8 @@ type connectionManager struct {
 	acknowledge            func()
 	cancel                 func()
 	channel                p2p.Channel
+	// compactKeepAlive is set once the provider negotiated the compact keep-alive pings of the session.
+	compactKeepAlive bool
 
 	discoLock      sync.Mutex
 	connectOptions ConnectOptions
@@ -244,7 +249,8 @@ func (m *connectionManager) Connect(consumerID identity.Identity, hermesID commo
 	}
 
 	traceStart := tracer.StartStage("Consumer session creation (start)")
-	go m.keepAliveLoop(m.channel, sessionID)
+	m.compactKeepAlive = m.config.KeepAlive.CompactPings && sessionDTO.GetCompactKeepAlive()
+	go m.keepAliveLoop(m.channel, sessionID, m.compactKeepAlive)
 	m.setStatus(func(status *connectionstate.Status) {
 		status.SessionID = sessionID
 	})
@@ -464,6 +470,7 @@ func (m *connectionManager) createP2PSession(ctx context.Context, c Connection,
 			Location: &pb.LocationInfo{
 				Country: m.Status().ConsumerLocation.Country,
 			},
+			CompactKeepAlive: m.config.KeepAlive.CompactPings,
 		},
 		ProposalID: int64(proposal.ID),
 		Config:     config,
@@ -663,7 +670,7 @@ func (m *connectionManager) Disconnect() error {
 }
 
 func (m *connectionManager) CheckChannel(ctx context.Context) error {
-	if err := m.sendKeepAlivePing(ctx, m.channel, m.Status().SessionID); err != nil {
+	if err := m.sendKeepAlivePing(ctx, m.channel, m.Status().SessionID, m.compactKeepAlive); err != nil {
 		return fmt.Errorf("keep alive ping failed: %w", err)
 	}
 	return nil
@@ -764,15 +771,16 @@ func (m *connectionManager) publishStateEvent(state connectionstate.State) {
 	})
 }
 
-func (m *connectionManager) keepAliveLoop(channel p2p.Channel, sessionID session.ID) {
+// keepAliveLoop exchanges the keep-alive pings with the provider, the compact ones if they were negotiated at the session start.
+func (m *connectionManager) keepAliveLoop(channel p2p.Channel, sessionID session.ID, compact bool) {
 	// Register handler for handling p2p keep alive pings from provider.
 	channel.Handle(p2p.TopicKeepAlive, func(c p2p.Context) error {
-		var ping pb.P2PKeepAlivePing
-		if err := c.Request().UnmarshalProto(&ping); err != nil {
+		pingSessionID, err := c.Request().UnmarshalKeepAlivePing(compact)
+		if err != nil {
 			return err
 		}
 
-		log.Debug().Msgf("Received p2p keepalive ping with SessionID=%s", ping.SessionID)
+		log.Debug().Msgf("Received p2p keepalive ping with SessionID=%s", pingSessionID)
 		return c.OK()
 	})
 
@@ -785,7 +793,7 @@ func (m *connectionManager) keepAliveLoop(channel p2p.Channel, sessionID session
 			return
 		case <-time.After(m.config.KeepAlive.SendInterval):
 			ctx, cancel := context.WithTimeout(context.Background(), m.config.KeepAlive.SendTimeout)
-			if err := m.sendKeepAlivePing(ctx, channel, sessionID); err != nil {
+			if err := m.sendKeepAlivePing(ctx, channel, sessionID, compact); err != nil {
 				log.Err(err).Msgf("Failed to send p2p keepalive ping. SessionID=%s", sessionID)
 				errCount++
 				if errCount == m.config.KeepAlive.MaxSendErrCount {
@@ -802,12 +810,24 @@ func (m *connectionManager) keepAliveLoop(channel p2p.Channel, sessionID session
 	}
 }
 
-func (m *connectionManager) sendKeepAlivePing(ctx context.Context, channel p2p.Channel, sessionID session.ID) error {
-	msg := &pb.P2PKeepAlivePing{
-		SessionID: string(sessionID),
+func (m *connectionManager) sendKeepAlivePing(ctx context.Context, channel p2p.Channel, sessionID session.ID, compact bool) error {
+	reply, err := channel.Send(ctx, p2p.TopicKeepAlive, p2p.KeepAlivePingMessage(string(sessionID), compact))
+	if err != nil {
+		return err
+	}
+
+	// Older providers reply without the health, it is decoded as an empty pong then.
+	var pong pb.P2PKeepAlivePong
+	if reply != nil {
+		if err := reply.UnmarshalProto(&pong); err != nil {
+			log.Warn().Err(err).Msgf("Received malformed p2p keepalive pong. SessionID=%s", sessionID)
+			return nil
+		}
 	}
-	_, err := channel.Send(ctx, p2p.TopicKeepAlive, p2p.ProtoMessage(msg))
-	return err
+	if pong.Draining {
+		log.Warn().Msgf("Provider is draining, the session may be closed soon. SessionID=%s", sessionID)
+	}
+	return nil
 }
 
 func (m *connectionManager) currentCtx() context.Context {
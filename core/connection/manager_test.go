@@ -751,3 +751,33 @@ type mockLocationResolver struct{}
 func (mlr *mockLocationResolver) GetOrigin() locationstate.Location {
 	return consumerLocation
 }
+
+type mockKeepAliveChannel struct {
+	mockP2PChannel
+	pings []*p2p.Message
+}
+
+func (m *mockKeepAliveChannel) Send(_ context.Context, topic string, msg *p2p.Message) (*p2p.Message, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if topic == p2p.TopicKeepAlive {
+		m.pings = append(m.pings, msg)
+	}
+	return nil, nil
+}
+
+func TestConnectionManager_CheckChannel_UsesNegotiatedPings(t *testing.T) {
+	sessionID := session.ID("f04d5a3f-3b8c-4bde-9e5a-8b1a3b0b5f7e")
+	for _, compact := range []bool{true, false} {
+		channel := &mockKeepAliveChannel{}
+		m := &connectionManager{
+			channel:          channel,
+			compactKeepAlive: compact,
+			status:           connectionstate.Status{SessionID: sessionID},
+		}
+
+		assert.NoError(t, m.CheckChannel(context.Background()))
+		assert.Len(t, channel.pings, 1)
+		assert.Equal(t, p2p.KeepAlivePingMessage(string(sessionID), compact).Data, channel.pings[0].Data)
+	}
+}
@@ -24,6 +24,11 @@ const (
 	StatusStarted Status = "Started"
 	// StatusStopped is published once node is stopped
 	StatusStopped Status = "Stopped"
+
+	// AppTopicNodeWarning represents the topic node warnings are published on
+	AppTopicNodeWarning = "NodeWarning"
+	// WarningTelemetryUnavailable is published once node is not able to report to MMN
+	WarningTelemetryUnavailable Warning = "TelemetryUnavailable"
 )
 
 // Status represents the various states of node
@@ -33,3 +38,12 @@ type Status string
 type Payload struct {
 	Status Status
 }
+
+// Warning represents the various degraded states of node
+type Warning string
+
+// WarningPayload is the payload we'll send once a node warning is published
+type WarningPayload struct {
+	Warning Warning
+	Reason  string
+}
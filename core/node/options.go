@@ -165,6 +165,9 @@ func GetOptions() *Options {
 		},
 		Hermes: OptionsHermes{
 			HermesID: config.GetString(config.FlagHermesID),
+			Timeout:  config.GetDuration(config.FlagHermesTimeout),
+			Retries:  uint64(config.GetInt(config.FlagHermesRetries)),
+			ProxyURL: config.GetString(config.FlagHermesProxy),
 		},
 		Openvpn: wrapper{nodeOptions: openvpn_core.NodeOptions{
 			BinaryPath: config.GetString(config.FlagOpenvpnBinary),
@@ -17,7 +17,15 @@
 
 package node
 
+import "time"
+
 // OptionsHermes describes possible parameters for interaction with Hermes
 type OptionsHermes struct {
 	HermesID string
+	// Timeout is the timeout of requests to hermes. The default HTTP client timeout is used if zero.
+	Timeout time.Duration
+	// Retries is the number of times the rate limited requests to hermes are retried.
+	Retries uint64
+	// ProxyURL is the proxy the requests to hermes are sent through. Optional.
+	ProxyURL string
 }
@@ -19,12 +19,14 @@ package service
 
 import (
 	"sync"
+	"time"
 
 	"github.com/mysteriumnetwork/node/core/policy"
 	"github.com/mysteriumnetwork/node/core/service/servicestate"
 	"github.com/mysteriumnetwork/node/identity"
 	"github.com/mysteriumnetwork/node/market"
 	"github.com/mysteriumnetwork/node/p2p"
+	"github.com/mysteriumnetwork/node/session"
 	"github.com/mysteriumnetwork/node/utils"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
@@ -155,6 +157,60 @@ type Instance struct {
 	eventPublisher  Publisher
 	p2pChannelsLock sync.Mutex
 	p2pChannels     []p2p.Channel
+
+	proposalLock      sync.RWMutex
+	previousProposal  *market.ServiceProposal
+	proposalUpdatedAt time.Time
+
+	// sessionSlots are the sessions occupying the capacity of the service, shared by all its session managers.
+	sessionSlots     map[session.ID]struct{}
+	sessionSlotsLock sync.Mutex
+
+	// starting are the session starts in progress, shared by all the session managers.
+	starting     map[startKey]*startProgress
+	startingLock sync.Mutex
+
+	// startLimiter limits the session starts of the consumers, shared by all the session managers.
+	startLimiter     *consumerRateLimiter
+	startLimiterOnce sync.Once
+
+	// staleCleanup limits the stale sessions closed at once, shared by all the session managers.
+	staleCleanup     chan struct{}
+	staleCleanupOnce sync.Once
+}
+
+// UpdateProposal replaces the proposal of the service.
+// The replaced proposal is remembered, so that consumers holding it can still be served for a while.
+func (i *Instance) UpdateProposal(proposal market.ServiceProposal) {
+	i.proposalLock.Lock()
+	defer i.proposalLock.Unlock()
+
+	previous := i.Proposal
+	i.previousProposal = &previous
+	i.Proposal = proposal
+	i.proposalUpdatedAt = time.Now()
+}
+
+func (i *Instance) currentProposal() market.ServiceProposal {
+	i.proposalLock.RLock()
+	defer i.proposalLock.RUnlock()
+
+	return i.Proposal
+}
+
+// proposalByID returns the current proposal of the service if its ID matches,
+// or the previous one if it matches and was replaced no longer than the given window ago.
+func (i *Instance) proposalByID(id int, window time.Duration) (market.ServiceProposal, bool) {
+	i.proposalLock.RLock()
+	defer i.proposalLock.RUnlock()
+
+	if i.Proposal.ID == id {
+		return i.Proposal, true
+	}
+	if i.previousProposal != nil && i.previousProposal.ID == id && time.Since(i.proposalUpdatedAt) <= window {
+		return *i.previousProposal, true
+	}
+	return market.ServiceProposal{}, false
 }
 
 // Service returns the running service implementation.
@@ -0,0 +1,107 @@
+/*
+ * Copyright (C) 2020 The "MysteriumNetwork/node" Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package service
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mysteriumnetwork/node/identity"
+)
+
+// maxIdleBuckets is the number of buckets after which the fully refilled ones are forgotten.
+const maxIdleBuckets = 1000
+
+// consumerRateLimiter is a token bucket rate limiter keyed by the consumer identity.
+type consumerRateLimiter struct {
+	rate  float64
+	burst int
+	now   func() time.Time
+
+	lock    sync.Mutex
+	buckets map[identity.Identity]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// newConsumerRateLimiter returns a limiter which allows the given number of events per second
+// with the given burst for every consumer.
+func newConsumerRateLimiter(rate float64, burst int) *consumerRateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &consumerRateLimiter{
+		rate:    rate,
+		burst:   burst,
+		now:     time.Now,
+		buckets: make(map[identity.Identity]*tokenBucket),
+	}
+}
+
+// Allow takes a token of the consumer and returns false if there is none left.
+func (l *consumerRateLimiter) Allow(consumerID identity.Identity) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := l.now()
+	bucket, ok := l.buckets[consumerID]
+	if !ok {
+		l.forgetIdle(now)
+		bucket = &tokenBucket{tokens: float64(l.burst), updated: now}
+		l.buckets[consumerID] = bucket
+	}
+	l.refill(bucket, now)
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+func (l *consumerRateLimiter) refill(bucket *tokenBucket, now time.Time) {
+	elapsed := now.Sub(bucket.updated).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+
+	bucket.tokens += elapsed * l.rate
+	if bucket.tokens > float64(l.burst) {
+		bucket.tokens = float64(l.burst)
+	}
+	bucket.updated = now
+}
+
+// forgetIdle removes the fully refilled buckets once there are too many of them,
+// a forgotten consumer starts again with a full bucket anyway.
+func (l *consumerRateLimiter) forgetIdle(now time.Time) {
+	if len(l.buckets) < maxIdleBuckets {
+		return
+	}
+
+	for consumerID, bucket := range l.buckets {
+		l.refill(bucket, now)
+		if bucket.tokens >= float64(l.burst) {
+			delete(l.buckets, consumerID)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright (C) 2020 The "MysteriumNetwork/node" Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package service
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mysteriumnetwork/node/identity"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsumerRateLimiter_Allow(t *testing.T) {
+	now := time.Now()
+	limiter := newConsumerRateLimiter(2, 3)
+	limiter.now = func() time.Time { return now }
+
+	// the burst is allowed at once.
+	for i := 0; i < 3; i++ {
+		assert.True(t, limiter.Allow(consumerID))
+	}
+	assert.False(t, limiter.Allow(consumerID))
+
+	// other consumers have their own buckets.
+	assert.True(t, limiter.Allow(identity.FromAddress("other")))
+
+	// steady traffic at the configured rate passes.
+	for i := 0; i < 10; i++ {
+		now = now.Add(500 * time.Millisecond)
+		assert.True(t, limiter.Allow(consumerID))
+		assert.False(t, limiter.Allow(consumerID))
+	}
+
+	// the bucket refills up to the burst only.
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		assert.True(t, limiter.Allow(consumerID))
+	}
+	assert.False(t, limiter.Allow(consumerID))
+}
+
+func TestConsumerRateLimiter_ForgetsIdleBuckets(t *testing.T) {
+	now := time.Now()
+	limiter := newConsumerRateLimiter(1, 1)
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < maxIdleBuckets; i++ {
+		assert.True(t, limiter.Allow(identity.FromAddress(fmt.Sprint(i))))
+	}
+	assert.Len(t, limiter.buckets, maxIdleBuckets)
+
+	now = now.Add(time.Second)
+	assert.True(t, limiter.Allow(consumerID))
+	assert.Len(t, limiter.buckets, 1)
+}
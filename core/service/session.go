@@ -18,6 +18,8 @@
 package service
 
 import (
+	"context"
+	"fmt"
 	"sync"
 	"time"
 
@@ -29,9 +31,29 @@ import (
 	"github.com/mysteriumnetwork/node/session"
 	"github.com/mysteriumnetwork/node/session/event"
 	"github.com/mysteriumnetwork/node/trace"
+	"github.com/mysteriumnetwork/node/utils"
 	"github.com/rs/zerolog/log"
 )
 
+// State is the lifecycle state of the session.
+type State string
+
+const (
+	// StateCreated is the state of the session which is started, but not acknowledged by the consumer yet.
+	StateCreated State = "created"
+	// StateAcknowledged is the state of the session which is acknowledged by the consumer.
+	StateAcknowledged State = "acknowledged"
+	// StateDestroyed is the final state of the session.
+	StateDestroyed State = "destroyed"
+)
+
+// stateTransitions are the states each state can move to.
+// The acknowledged session can be acknowledged again, as the consumer may repeat the acknowledgement.
+var stateTransitions = map[State][]State{
+	StateCreated:      {StateAcknowledged, StateDestroyed},
+	StateAcknowledged: {StateAcknowledged, StateDestroyed},
+}
+
 // Session structure holds all required information about current session between service consumer and provider.
 type Session struct {
 	ID               session.ID
@@ -41,18 +63,215 @@ type Session struct {
 	Proposal         market.ServiceProposal
 	ServiceID        string
 	CreatedAt        time.Time
-	request          *pb.SessionRequest
-	done             chan struct{}
-	cleanupLock      sync.Mutex
-	cleanup          []func() error
-	tracer           *trace.Tracer
-	once             sync.Once
+	NATTraversal     *event.NATTraversalContext
+	// Metadata holds the service specific metadata of the session, e.g. the assigned IP or the QoS tier.
+	// It is set once the session is created and must not be modified afterwards.
+	Metadata    map[string]string
+	request     *pb.SessionRequest
+	done        chan struct{}
+	ctx         context.Context
+	cancel      context.CancelFunc
+	cleanupLock sync.Mutex
+	cleanup     []func() error
+	tracer      *trace.Tracer
+	once        sync.Once
+
+	rttLock    sync.Mutex
+	rttSamples []time.Duration
+
+	suspendLock  sync.Mutex
+	suspendTimer *time.Timer
+
+	pauseLock     sync.Mutex
+	pauseTimer    *time.Timer
+	paymentEngine PaymentEngine
+
+	reconcile bool
+
+	stateLock sync.Mutex
+	state     State
+
+	// compactKeepAlive is set when the consumer and the provider negotiated the compact keep-alive pings at the session start.
+	compactKeepAlive bool
+}
+
+// State returns the current lifecycle state of the session.
+func (s *Session) State() State {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+
+	return s.currentState()
+}
+
+// currentState returns the state of the session, the sessions which are not created by newSession are in the created state.
+// The stateLock must be held.
+func (s *Session) currentState() State {
+	if s.state == "" {
+		return StateCreated
+	}
+	return s.state
+}
+
+// markAcknowledged moves the session to the acknowledged state.
+// It fails if the session is destroyed, e.g. torn down by the keep-alive.
+func (s *Session) markAcknowledged() error {
+	return s.transition(StateAcknowledged)
+}
+
+// markDestroyed moves the session to the destroyed state. It fails if the session is already destroyed.
+func (s *Session) markDestroyed() error {
+	return s.transition(StateDestroyed)
+}
+
+func (s *Session) transition(to State) error {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+
+	from := s.currentState()
+	for _, allowed := range stateTransitions[from] {
+		if allowed == to {
+			s.state = to
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot move session %s from %s to %s: %w", s.ID, from, to, ErrorInvalidStateTransition)
+}
+
+// NeedsReconciliation returns true if the session was restored from the persistent storage
+// and has no live payment engine.
+func (s *Session) NeedsReconciliation() bool {
+	return s.reconcile
+}
+
+// Paused returns true if the consumer has paused the session.
+func (s *Session) Paused() bool {
+	s.pauseLock.Lock()
+	defer s.pauseLock.Unlock()
+
+	return s.pauseTimer != nil
+}
+
+// pause marks the session as paused and closes it unless it is unpaused within the given duration.
+// It returns false if the session is already paused.
+func (s *Session) pause(maxDuration time.Duration) bool {
+	s.pauseLock.Lock()
+	defer s.pauseLock.Unlock()
+
+	if s.pauseTimer != nil {
+		return false
+	}
+	s.pauseTimer = time.AfterFunc(maxDuration, s.Close)
+	if engine, ok := s.paymentEngine.(PausablePaymentEngine); ok {
+		engine.Pause()
+	}
+	return true
+}
+
+// unpause cancels the pause of the session. It returns false if the session was not paused.
+func (s *Session) unpause() bool {
+	s.pauseLock.Lock()
+	defer s.pauseLock.Unlock()
+
+	if s.pauseTimer == nil || !s.pauseTimer.Stop() {
+		return false
+	}
+	s.pauseTimer = nil
+	if engine, ok := s.paymentEngine.(PausablePaymentEngine); ok {
+		engine.Resume()
+	}
+	return true
+}
+
+func (s *Session) getPaymentEngine() PaymentEngine {
+	s.pauseLock.Lock()
+	defer s.pauseLock.Unlock()
+
+	return s.paymentEngine
+}
+
+func (s *Session) setPaymentEngine(engine PaymentEngine) {
+	s.pauseLock.Lock()
+	defer s.pauseLock.Unlock()
+
+	s.paymentEngine = engine
+}
+
+// Suspended returns true if the session lost its p2p channel and is waiting to be resumed.
+func (s *Session) Suspended() bool {
+	s.suspendLock.Lock()
+	defer s.suspendLock.Unlock()
+
+	return s.suspendTimer != nil
+}
+
+// suspend marks the session as suspended and closes it unless it is resumed within the grace period.
+func (s *Session) suspend(gracePeriod time.Duration) {
+	s.suspendLock.Lock()
+	defer s.suspendLock.Unlock()
+
+	if s.suspendTimer != nil {
+		return
+	}
+	s.suspendTimer = time.AfterFunc(gracePeriod, s.Close)
+}
+
+// resume cancels the suspension of the session. It returns false if the session was not suspended.
+func (s *Session) resume() bool {
+	s.suspendLock.Lock()
+	defer s.suspendLock.Unlock()
+
+	if s.suspendTimer == nil || !s.suspendTimer.Stop() {
+		return false
+	}
+	s.suspendTimer = nil
+	return true
+}
+
+// keepAliveRTTWindow is the number of keep-alive round-trip samples used for the moving average.
+const keepAliveRTTWindow = 10
+
+// KeepAliveRTT returns the last keep-alive round-trip time and the moving average of the recent ones.
+func (s *Session) KeepAliveRTT() (last, average time.Duration) {
+	s.rttLock.Lock()
+	defer s.rttLock.Unlock()
+
+	if len(s.rttSamples) == 0 {
+		return 0, 0
+	}
+
+	var sum time.Duration
+	for _, sample := range s.rttSamples {
+		sum += sample
+	}
+	return s.rttSamples[len(s.rttSamples)-1], sum / time.Duration(len(s.rttSamples))
+}
+
+func (s *Session) recordKeepAliveRTT(rtt time.Duration) {
+	s.rttLock.Lock()
+	defer s.rttLock.Unlock()
+
+	s.rttSamples = append(s.rttSamples, rtt)
+	if len(s.rttSamples) > keepAliveRTTWindow {
+		s.rttSamples = s.rttSamples[len(s.rttSamples)-keepAliveRTTWindow:]
+	}
 }
 
 // Close ends session.
 func (s *Session) Close() {
+	s.close()
+}
+
+// close ends session and returns the errors of its cleanups, if any.
+func (s *Session) close() error {
+	errCleanup := utils.ErrorCollection{}
 	s.once.Do(func() {
+		if err := s.markDestroyed(); err != nil {
+			log.Warn().Err(err).Msg("Could not mark the session destroyed")
+		}
 		close(s.done)
+		if s.cancel != nil {
+			s.cancel()
+		}
 
 		s.cleanupLock.Lock()
 		defer s.cleanupLock.Unlock()
@@ -62,10 +281,20 @@ func (s *Session) Close() {
 			err := s.cleanup[i]()
 			if err != nil {
 				log.Warn().Err(err).Msg("Cleanup error")
+				errCleanup.Add(err)
 			}
 		}
 		s.cleanup = nil
 	})
+	return errCleanup.Errorf("Session cleanup failed: %s", ", ")
+}
+
+// context returns the context which is cancelled once the session is closed.
+func (s *Session) context() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
 }
 
 // Done returns readonly done channel.
@@ -81,7 +310,7 @@ func (s *Session) addCleanup(fn func() error) {
 }
 
 func (s *Session) toEvent(status event.Status) event.AppEventSession {
-	return event.AppEventSession{
+	ev := event.AppEventSession{
 		Status: status,
 		Service: event.ServiceContext{
 			ID: s.ServiceID,
@@ -93,33 +322,115 @@ func (s *Session) toEvent(status event.Status) event.AppEventSession {
 			ConsumerLocation: s.ConsumerLocation,
 			HermesID:         s.HermesID,
 			Proposal:         s.Proposal,
+			NATTraversal:     s.NATTraversal,
+			Metadata:         s.metadataCopy(),
 		},
 	}
+	if status == event.RemovedStatus {
+		ev.Session.Duration = time.Since(s.CreatedAt)
+		ev.Session.Usage = s.usage()
+	}
+	return ev
+}
+
+// SessionInfo is a snapshot of a session, it does not change along with the session.
+type SessionInfo struct {
+	ID               session.ID
+	ConsumerID       identity.Identity
+	ConsumerLocation market.Location
+	HermesID         common.Address
+	Proposal         market.ServiceProposal
+	ServiceID        string
+	CreatedAt        time.Time
+	State            State
+	Metadata         map[string]string
+}
+
+// info returns a snapshot of the session.
+func (s *Session) info() SessionInfo {
+	return SessionInfo{
+		ID:               s.ID,
+		ConsumerID:       s.ConsumerID,
+		ConsumerLocation: s.ConsumerLocation,
+		HermesID:         s.HermesID,
+		Proposal:         s.Proposal,
+		ServiceID:        s.ServiceID,
+		CreatedAt:        s.CreatedAt,
+		State:            s.State(),
+		Metadata:         s.metadataCopy(),
+	}
+}
+
+// metadataCopy returns a copy of the session metadata, nil if there is none.
+func (s *Session) metadataCopy() map[string]string {
+	if len(s.Metadata) == 0 {
+		return nil
+	}
+
+	metadata := make(map[string]string, len(s.Metadata))
+	for key, value := range s.Metadata {
+		metadata[key] = value
+	}
+	return metadata
+}
+
+// usage returns the usage reported by the payment engine, nil if the engine does not report it.
+func (s *Session) usage() *event.UsageContext {
+	engine, ok := s.getPaymentEngine().(UsageReportingPaymentEngine)
+	if !ok {
+		return nil
+	}
+
+	usage := engine.Usage()
+	return &event.UsageContext{
+		Up:     usage.Up,
+		Down:   usage.Down,
+		Tokens: usage.Tokens,
+	}
+}
+
+// GenerateUUID generates a random session ID.
+func GenerateUUID() (session.ID, error) {
+	uid, err := uuid.NewV4()
+	if err != nil {
+		return "", err
+	}
+	return session.ID(uid.String()), nil
 }
 
 // NewSession creates a blank new session with an ID.
 func NewSession(service *Instance, request *pb.SessionRequest, tracer *trace.Tracer) (*Session, error) {
-	uid, err := uuid.NewV4()
+	id, err := GenerateUUID()
 	if err != nil {
 		return nil, err
 	}
 
+	return newSession(id, service, request, tracer), nil
+}
+
+func newSession(id session.ID, service *Instance, request *pb.SessionRequest, tracer *trace.Tracer) *Session {
+	s := &Session{ID: id}
+	s.init(service, request, tracer)
+	return s
+}
+
+// init sets up the session for the given service and request, keeping its ID and the fields not related to them.
+func (s *Session) init(service *Instance, request *pb.SessionRequest, tracer *trace.Tracer) {
 	var consumerLocation market.Location
 	if location := request.GetConsumer().GetLocation(); location != nil {
 		consumerLocation.Country = location.GetCountry()
 	}
 
-	return &Session{
-		ID:               session.ID(uid.String()),
-		ConsumerID:       identity.FromAddress(request.GetConsumer().GetId()),
-		ConsumerLocation: consumerLocation,
-		HermesID:         common.HexToAddress(request.GetConsumer().GetHermesID()),
-		Proposal:         service.Proposal,
-		ServiceID:        string(service.ID),
-		CreatedAt:        time.Now().UTC(),
-		request:          request,
-		done:             make(chan struct{}),
-		cleanup:          make([]func() error, 0),
-		tracer:           tracer,
-	}, nil
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.ConsumerID = identity.FromAddress(request.GetConsumer().GetId())
+	s.ConsumerLocation = consumerLocation
+	s.HermesID = common.HexToAddress(request.GetConsumer().GetHermesID())
+	s.Proposal = service.currentProposal()
+	s.ServiceID = string(service.ID)
+	s.CreatedAt = time.Now().UTC()
+	s.request = request
+	s.done = make(chan struct{})
+	s.cleanup = make([]func() error, 0)
+	s.tracer = tracer
+	s.state = StateCreated
 }
@@ -21,18 +21,25 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"math/big"
+	"math/rand"
 	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/mysteriumnetwork/node/config"
 	"github.com/mysteriumnetwork/node/identity"
 	"github.com/mysteriumnetwork/node/market"
+	"github.com/mysteriumnetwork/node/money"
 	"github.com/mysteriumnetwork/node/nat/event"
 	"github.com/mysteriumnetwork/node/p2p"
 	"github.com/mysteriumnetwork/node/pb"
 	"github.com/mysteriumnetwork/node/session"
 	sevent "github.com/mysteriumnetwork/node/session/event"
+	"github.com/mysteriumnetwork/node/utils"
 	"github.com/mysteriumnetwork/payments/crypto"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
@@ -45,11 +52,93 @@ var (
 	ErrorSessionNotExists = errors.New("session does not exists")
 	// ErrorWrongSessionOwner returned when consumer tries to destroy session that does not belongs to him
 	ErrorWrongSessionOwner = errors.New("wrong session owner")
+	// ErrorSessionNotSuspended returned when consumer tries to resume session that is not suspended
+	ErrorSessionNotSuspended = errors.New("session is not suspended")
+	// ErrorSessionNotResumable returned when consumer tries to resume session which payment engine can not move to another p2p channel
+	ErrorSessionNotResumable = errors.New("session can not be resumed")
+	// ErrorSessionAlreadyPaused returned when consumer tries to pause session that is already paused
+	ErrorSessionAlreadyPaused = errors.New("session is already paused")
+	// ErrorSessionNotPaused returned when consumer tries to unpause session that is not paused
+	ErrorSessionNotPaused = errors.New("session is not paused")
+	// ErrorSessionStartInProgress returned when consumer tries to start a session while another start for the same service is not finished yet
+	ErrorSessionStartInProgress = errors.New("session start already in progress")
+	// ErrorTooManySessions returned when consumer already has the maximum number of sessions allowed
+	ErrorTooManySessions = errors.New("too many sessions for consumer")
+	// ErrorUnsupportedCurrency returned when the proposal price currency can not be settled on the chain in use
+	ErrorUnsupportedCurrency = errors.New("proposal currency is not supported on chain")
+	// ErrorConsumerNotAllowed returned when the consumer is rejected by the consumer filter
+	ErrorConsumerNotAllowed = errors.New("consumer is not allowed")
+	// ErrorCapacityReached returned when the service already has the maximum number of concurrent sessions
+	ErrorCapacityReached = errors.New("service session capacity reached")
+	// ErrorRateLimited returned when consumer starts sessions more often than allowed
+	ErrorRateLimited = errors.New("too many session starts for consumer")
+	// ErrorNoPaymentEngine returned when the payment engine factory of the service returns no engine
+	ErrorNoPaymentEngine = errors.New("payment engine factory returned no engine")
+	// ErrorFinalPaymentNotSupported returned when the payment engine of the session can not produce the final payment
+	ErrorFinalPaymentNotSupported = errors.New("payment engine does not support the final payment")
+	// ErrorInvalidStateTransition returned when the session can not move to the requested state, e.g. acknowledging a destroyed session
+	ErrorInvalidStateTransition = errors.New("invalid session state transition")
 )
 
+// SessionNotExistsError is returned when the session is not found.
+// It wraps ErrorSessionNotExists.
+type SessionNotExistsError struct {
+	SessionID string
+	// Destroyed is true if the session existed, but was already destroyed.
+	Destroyed bool
+}
+
+func (e *SessionNotExistsError) Error() string {
+	if e.Destroyed {
+		return fmt.Sprintf("session %s is already destroyed", e.SessionID)
+	}
+	return fmt.Sprintf("session %s does not exist", e.SessionID)
+}
+
+// Unwrap returns the sentinel error.
+func (e *SessionNotExistsError) Unwrap() error {
+	return ErrorSessionNotExists
+}
+
+// WrongSessionOwnerError is returned when the session belongs to another consumer.
+// It wraps ErrorWrongSessionOwner.
+type WrongSessionOwnerError struct {
+	SessionID string
+	Owner     identity.Identity
+}
+
+func (e *WrongSessionOwnerError) Error() string {
+	return fmt.Sprintf("session %s belongs to %s: %v", e.SessionID, e.Owner.Address, ErrorWrongSessionOwner)
+}
+
+// Unwrap returns the sentinel error.
+func (e *WrongSessionOwnerError) Unwrap() error {
+	return ErrorWrongSessionOwner
+}
+
+// UnsupportedCurrencyError is returned when the proposal is priced in a currency which the chain does not support.
+// It wraps ErrorUnsupportedCurrency.
+type UnsupportedCurrencyError struct {
+	Currency money.Currency
+	ChainID  int64
+}
+
+func (e *UnsupportedCurrencyError) Error() string {
+	return fmt.Sprintf("proposal is priced in %s which is not supported on chain %d: %v", e.Currency, e.ChainID, ErrorUnsupportedCurrency)
+}
+
+// Unwrap returns ErrorUnsupportedCurrency, so that the error can be checked with errors.Is.
+func (e *UnsupportedCurrencyError) Unwrap() error {
+	return ErrorUnsupportedCurrency
+}
+
 // IDGenerator defines method for session id generation
 type IDGenerator func() (session.ID, error)
 
+// SessionFactory creates the sessions started by the session manager, e.g. to preset their ID or fields.
+// The fields of the session request are filled in by the session manager, the ID is generated if the factory leaves it empty.
+type SessionFactory func() (*Session, error)
+
 // ConfigParams session configuration parameters
 type ConfigParams struct {
 	SessionServiceConfig   ServiceConfiguration
@@ -69,21 +158,124 @@ type KeepAliveConfig struct {
 	SendInterval    time.Duration
 	SendTimeout     time.Duration
 	MaxSendErrCount int
+	// InitialGracePeriod is the time after the session start during which failed pings are not counted.
+	InitialGracePeriod time.Duration
+	// SendIntervalJitter randomizes each send interval by up to the given duration in either direction.
+	SendIntervalJitter time.Duration
+	// MaxMalformedPings is the number of malformed pings from the consumer after which the sessions are flagged.
+	// Zero disables flagging.
+	MaxMalformedPings uint64
+	// CompactPings accepts the compact keep-alive pings offered by the consumer at the session start.
+	// The proto pings are exchanged with the consumers which do not support them.
+	CompactPings bool
+}
+
+// nextSendInterval returns the time to wait before sending the next ping.
+func (c KeepAliveConfig) nextSendInterval() time.Duration {
+	if c.SendIntervalJitter <= 0 {
+		return c.SendInterval
+	}
+
+	jitter := time.Duration(rand.Int63n(2*int64(c.SendIntervalJitter)+1)) - c.SendIntervalJitter
+	if interval := c.SendInterval + jitter; interval > 0 {
+		return interval
+	}
+	return c.SendInterval
 }
 
 // Config contains common configuration options for session manager.
 type Config struct {
 	KeepAlive KeepAliveConfig
+	// SuspendGracePeriod is the time a session which lost its p2p channel is kept for the consumer to resume it.
+	// Sessions are not suspended if the grace period is zero.
+	SuspendGracePeriod time.Duration
+	// MaxPauseDuration is the time a session can stay paused before it is destroyed.
+	MaxPauseDuration time.Duration
+	// FirstInvoiceTimeout is the time the consumer has to pay the first invoice.
+	FirstInvoiceTimeout time.Duration
+	// FirstInvoiceTimeoutByServiceType overrides FirstInvoiceTimeout for the given service types.
+	FirstInvoiceTimeoutByServiceType map[string]time.Duration
+	// PreviousProposalWindow is the time the previous proposal of the service is still accepted after it was updated.
+	PreviousProposalWindow time.Duration
+	// MaxSessionsPerConsumer limits the number of sessions a single consumer identity can have across all services.
+	// Zero means unlimited.
+	MaxSessionsPerConsumer int
+	// MaxConcurrentSessions limits the number of concurrent sessions of the service. Zero means unlimited.
+	MaxConcurrentSessions int
+	// MaxSessionDuration is the time after the session creation when it is destroyed regardless of its health.
+	// Zero means unlimited.
+	MaxSessionDuration time.Duration
+	// ChainCurrencies lists the currencies which can be settled on the given chain.
+	// Proposals are not validated against chains which are not listed, none are listed by default.
+	ChainCurrencies map[int64][]money.Currency
+	// SynchronousStaleCleanup destroys the stale sessions of the consumer before the new session is added,
+	// instead of destroying them in the background.
+	SynchronousStaleCleanup bool
+	// StaleCleanupConcurrency limits the number of stale sessions of the service destroyed in the background at once,
+	// so that many reconnecting consumers do not stop all of their payment engines at the same time. Zero means unlimited.
+	StaleCleanupConcurrency int
+	// StartRate limits the number of session starts per second of a single consumer identity.
+	// Zero means unlimited.
+	StartRate float64
+	// StartBurst is the number of session starts a single consumer identity can make at once before StartRate applies.
+	StartBurst int
+	// IdleTimeout is the time after the last traffic of the session when it is destroyed, paused sessions are not affected.
+	// The traffic is reported by the payment engine, see ActivityReportingPaymentEngine. Zero means unlimited.
+	IdleTimeout time.Duration
+	// OnFirstInvoicePaid is called synchronously once the consumer has paid the first invoice of the session,
+	// before the session is reported as started. It is called without holding any lock and must not block.
+	OnFirstInvoicePaid func(*Session)
+	// IDGenerator generates the IDs of the sessions. Defaults to GenerateUUID.
+	IDGenerator IDGenerator
+	// SessionFactory creates the sessions instead of NewSession. Optional.
+	SessionFactory SessionFactory
+	// HealthProvider provides the node health sent to the consumers in reply to their keep-alive pings. Optional.
+	HealthProvider HealthProvider
+	// ConsumerFilter decides which consumers are allowed to start sessions. Defaults to AllowAllConsumers.
+	ConsumerFilter ConsumerFilter
+	// ShutdownDrainTimeout is the time Shutdown waits for the promise requests of the sessions to be processed.
+	ShutdownDrainTimeout time.Duration
+	// ForceSettleTimeout is the time ForceSettleAndDestroy waits for the final promise of the session to be accepted.
+	ForceSettleTimeout time.Duration
+}
+
+func (c Config) supportsCurrency(chainID int64, currency money.Currency) bool {
+	currencies, ok := c.ChainCurrencies[chainID]
+	if !ok {
+		return true
+	}
+	for _, supported := range currencies {
+		if supported == currency {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Config) firstInvoiceTimeout(serviceType string) time.Duration {
+	if timeout, ok := c.FirstInvoiceTimeoutByServiceType[serviceType]; ok {
+		return timeout
+	}
+	return c.FirstInvoiceTimeout
 }
 
 // DefaultConfig returns default params.
 func DefaultConfig() Config {
 	return Config{
 		KeepAlive: KeepAliveConfig{
-			SendInterval:    14 * time.Second,
-			SendTimeout:     5 * time.Second,
-			MaxSendErrCount: 5,
+			SendInterval:       14 * time.Second,
+			SendTimeout:        5 * time.Second,
+			MaxSendErrCount:    5,
+			InitialGracePeriod: 30 * time.Second,
+			MaxMalformedPings:  3,
+			CompactPings:       true,
 		},
+		MaxPauseDuration:        10 * time.Minute,
+		FirstInvoiceTimeout:     30 * time.Second,
+		PreviousProposalWindow:  5 * time.Minute,
+		ShutdownDrainTimeout:    10 * time.Second,
+		ForceSettleTimeout:      30 * time.Second,
+		StaleCleanupConcurrency: 4,
 	}
 }
 
@@ -113,52 +305,274 @@ type PaymentEngine interface {
 	Stop()
 }
 
+// PromiseDrainer waits for the promise requests of the sessions to be processed, e.g. the hermes promise handler.
+type PromiseDrainer interface {
+	DrainSessions(ctx context.Context, sessionIDs []string) error
+}
+
+// PromiseSubmitter exchanges the payment of the session for a hermes promise and waits for it to be accepted,
+// e.g. the hermes promise handler.
+type PromiseSubmitter interface {
+	SubmitPromise(ctx context.Context, r []byte, em crypto.ExchangeMessage, providerID identity.Identity, sessionID string) error
+}
+
+// FinalPayment is the last payment of the session, which is ready to be exchanged for a hermes promise.
+type FinalPayment struct {
+	R               []byte
+	ExchangeMessage crypto.ExchangeMessage
+}
+
+// FinalizingPaymentEngine is a payment engine which is able to produce the final payment of the session,
+// e.g. by invoicing the consumer for the usage which is not paid yet.
+// The sessions with engines which do not implement it can not be force settled.
+type FinalizingPaymentEngine interface {
+	FinalPayment(ctx context.Context) (FinalPayment, error)
+}
+
+// PausablePaymentEngine is a payment engine which is able to stop invoicing while the session is paused.
+// Engines which do not implement it keep invoicing while the session is paused.
+type PausablePaymentEngine interface {
+	Pause()
+	Resume()
+}
+
+// RebindablePaymentEngine is a payment engine which can move to another p2p channel of the consumer,
+// e.g. when a suspended session is resumed. The sessions with engines which do not implement it can not be resumed.
+type RebindablePaymentEngine interface {
+	Rebind(channel p2p.ChannelSender, exchangeChan chan crypto.ExchangeMessage)
+}
+
+// ConnRebindingService is a service which can move the connection of the session to another p2p channel of the consumer.
+// The services which do not implement it keep using the connection of the channel the session was started over.
+type ConnRebindingService interface {
+	RebindConn(sessionID string, conn *net.UDPConn) error
+}
+
+// UsageReportingPaymentEngine is a payment engine which reports the usage of the session.
+// The usage of the sessions with engines which do not implement it is not reported.
+type UsageReportingPaymentEngine interface {
+	Usage() Usage
+}
+
+// ActivityReportingPaymentEngine is a payment engine which reports the last time the session carried any traffic.
+// The sessions with engines which do not implement it are never considered idle.
+type ActivityReportingPaymentEngine interface {
+	LastActivity() time.Time
+}
+
+// Usage represents the total usage of the session.
+type Usage struct {
+	// Up and Down are the bytes transferred.
+	Up, Down uint64
+	// Tokens is the amount the consumer agreed to pay.
+	Tokens *big.Int
+}
+
 // NATEventGetter lets us access the last known traversal event
 type NATEventGetter interface {
 	LastEvent() *event.Event
 }
 
+// HealthProvider provides the node health, which is sent to the consumers in reply to their keep-alive pings.
+type HealthProvider interface {
+	Health() Health
+}
+
+// Health represents the node health.
+type Health struct {
+	// Load is the system load average.
+	Load float64
+	// ActiveSessions is the number of the active sessions of the service.
+	ActiveSessions int
+	// Draining is set when the node is shutting down and does not accept new sessions.
+	Draining bool
+}
+
+// ServiceSessionsHealth is a health provider which reports the number of the active sessions of a single service.
+type ServiceSessionsHealth struct {
+	Sessions  Storage
+	ServiceID ID
+}
+
+// Health returns the number of the active sessions of the service.
+func (ssh ServiceSessionsHealth) Health() Health {
+	count := 0
+	for _, session := range ssh.Sessions.GetAll() {
+		if session.ServiceID == string(ssh.ServiceID) {
+			count++
+		}
+	}
+	return Health{ActiveSessions: count}
+}
+
+// ConsumerFilter decides which consumers are allowed to start sessions.
+type ConsumerFilter interface {
+	Allow(consumerID identity.Identity) (bool, error)
+}
+
+// AllowAllConsumers is a consumer filter which allows every consumer.
+type AllowAllConsumers struct{}
+
+// Allow allows the given consumer.
+func (AllowAllConsumers) Allow(identity.Identity) (bool, error) {
+	return true, nil
+}
+
 // NewSessionManager returns new session SessionManager
 func NewSessionManager(
 	service *Instance,
-	sessionStorage *SessionPool,
+	sessionStorage Storage,
 	paymentEngineFactory PaymentEngineFactory,
 	natEventGetter NATEventGetter,
 	publisher publisher,
 	channel p2p.Channel,
 	config Config,
 ) *SessionManager {
+	idGenerator := config.IDGenerator
+	if idGenerator == nil {
+		idGenerator = GenerateUUID
+	}
+	consumerFilter := config.ConsumerFilter
+	if consumerFilter == nil {
+		consumerFilter = AllowAllConsumers{}
+	}
+
 	return &SessionManager{
 		service:              service,
 		sessionStorage:       sessionStorage,
 		natEventGetter:       natEventGetter,
+		healthProvider:       config.HealthProvider,
+		consumerFilter:       consumerFilter,
 		publisher:            publisher,
 		paymentEngineFactory: paymentEngineFactory,
 		paymentEngineChan:    make(chan crypto.ExchangeMessage, 1),
 		channel:              channel,
 		config:               config,
+		idGenerator:          idGenerator,
+		sessionFactory:       config.SessionFactory,
+		channelSessions:      make(map[session.ID]struct{}),
 	}
 }
 
 // SessionManager knows how to start and provision session
 type SessionManager struct {
+	// stats go first to keep the atomically accessed counters 64-bit aligned.
+	stats managerStats
+
 	service              *Instance
-	sessionStorage       *SessionPool
+	sessionStorage       Storage
 	paymentEngineFactory PaymentEngineFactory
 	paymentEngineChan    chan crypto.ExchangeMessage
 	natEventGetter       NATEventGetter
+	healthProvider       HealthProvider
+	consumerFilter       ConsumerFilter
 	publisher            publisher
 	channel              p2p.Channel
 	config               Config
+	idGenerator          IDGenerator
+	sessionFactory       SessionFactory
+
+	// channelSessions are the active sessions started over the p2p channel of the manager.
+	channelSessions     map[session.ID]struct{}
+	channelSessionsLock sync.Mutex
+	// compactKeepAlive is set to 1 once a session of the channel negotiated the compact keep-alive pings.
+	compactKeepAlive uint32
+}
+
+// Stats is a snapshot of the session manager counters.
+type Stats struct {
+	// Started is the number of sessions which had the first invoice paid.
+	Started uint64
+	// Acknowledged is the number of sessions acknowledged by the consumers.
+	Acknowledged uint64
+	// Destroyed is the number of sessions which were closed, for whatever reason.
+	Destroyed uint64
+	// KeepAliveTimeouts is the number of sessions which lost the connection with the consumer.
+	KeepAliveTimeouts uint64
+	// FirstInvoiceTimeouts is the number of sessions which did not have the first invoice paid in time.
+	FirstInvoiceTimeouts uint64
+	// MalformedPings is the number of malformed keepalive pings received from the consumer.
+	MalformedPings uint64
+	// Active is the number of currently active sessions of the managed service.
+	Active int
+}
+
+type managerStats struct {
+	started              uint64
+	acknowledged         uint64
+	destroyed            uint64
+	keepAliveTimeouts    uint64
+	firstInvoiceTimeouts uint64
+	malformedPings       uint64
 }
 
+// Stats returns a snapshot of the session manager counters. It is safe to call concurrently.
+func (manager *SessionManager) Stats() Stats {
+	return Stats{
+		Started:              atomic.LoadUint64(&manager.stats.started),
+		Acknowledged:         atomic.LoadUint64(&manager.stats.acknowledged),
+		Destroyed:            atomic.LoadUint64(&manager.stats.destroyed),
+		KeepAliveTimeouts:    atomic.LoadUint64(&manager.stats.keepAliveTimeouts),
+		FirstInvoiceTimeouts: atomic.LoadUint64(&manager.stats.firstInvoiceTimeouts),
+		MalformedPings:       atomic.LoadUint64(&manager.stats.malformedPings),
+		Active:               len(manager.activeSessions()),
+	}
+}
+
+type startKey struct {
+	consumerID  identity.Identity
+	serviceType string
+}
+
+// startProgress tracks a session start in progress, guarded by the startingLock of the service instance.
+type startProgress struct {
+	sessionID session.ID
+	// waitingSince is the time the first invoice wait began, zero if the start is not waiting for it.
+	waitingSince time.Time
+}
+
+// PendingStart describes a session start which waits for the consumer to pay the first invoice.
+type PendingStart struct {
+	ConsumerID  identity.Identity
+	ServiceType string
+	SessionID   string
+	// Elapsed is the time the provider has been waiting for the first invoice to be paid.
+	Elapsed time.Duration
+}
+
+// MetadataBuilder builds the service specific metadata of a created session, e.g. the assigned IP or the QoS tier.
+type MetadataBuilder func(session *Session) (map[string]string, error)
+
 // Start starts a session on the provider side for the given consumer.
-// Multiple sessions per peerID is possible in case different services are used
-func (manager *SessionManager) Start(request *pb.SessionRequest) (_ pb.SessionResponse, err error) {
-	session, err := NewSession(manager.service, request, manager.channel.Tracer())
+// Multiple sessions per peerID is possible in case different services are used.
+// The optional metadata builders are invoked once the session is created, their metadata is attached to the session.
+func (manager *SessionManager) Start(request *pb.SessionRequest, metadataBuilders ...MetadataBuilder) (_ pb.SessionResponse, err error) {
+	key := startKey{
+		consumerID:  identity.FromAddress(request.GetConsumer().GetId()),
+		serviceType: manager.service.Type,
+	}
+
+	if !manager.allowStart(key.consumerID) {
+		return pb.SessionResponse{}, ErrorRateLimited
+	}
+	allowed, err := manager.consumerFilter.Allow(key.consumerID)
+	if err != nil {
+		return pb.SessionResponse{}, errors.Wrap(err, "cannot check if consumer is allowed")
+	}
+	if !allowed {
+		return pb.SessionResponse{}, ErrorConsumerNotAllowed
+	}
+	if !manager.markStarting(key) {
+		return pb.SessionResponse{}, ErrorSessionStartInProgress
+	}
+	defer manager.unmarkStarting(key)
+
+	session, err := manager.newSession(request)
 	if err != nil {
-		return pb.SessionResponse{}, errors.Wrap(err, "cannot create new session")
+		return pb.SessionResponse{}, err
 	}
+	session.NATTraversal = manager.natTraversal()
+	session.compactKeepAlive = manager.config.KeepAlive.CompactPings && request.GetConsumer().GetCompactKeepAlive()
 	defer func() {
 		if err != nil {
 			log.Err(err).Msg("Session failed, disconnecting")
@@ -173,16 +587,127 @@ func (manager *SessionManager) Start(request *pb.SessionRequest) (_ pb.SessionRe
 		log.Debug().Msgf("Provider connection trace: %s", traceResult)
 	}()
 
-	if err = manager.startSession(session); err != nil {
+	if err = manager.startSession(session, metadataBuilders); err != nil {
 		return pb.SessionResponse{}, err
 	}
 	if err = manager.paymentLoop(session); err != nil {
 		return pb.SessionResponse{}, err
 	}
+	atomic.AddUint64(&manager.stats.started, 1)
+	manager.publisher.Publish(sevent.AppTopicSession, session.toEvent(sevent.StartedStatus))
+	manager.monitorActivity(session)
 
 	return manager.providerService(session, manager.channel)
 }
 
+// allowStart returns false if the consumer exceeded the allowed session start rate.
+// The limiter is kept by the service instance, so that reconnecting consumers do not get a fresh limit.
+func (manager *SessionManager) allowStart(consumerID identity.Identity) bool {
+	if manager.config.StartRate <= 0 {
+		return true
+	}
+
+	service := manager.service
+	service.startLimiterOnce.Do(func() {
+		service.startLimiter = newConsumerRateLimiter(manager.config.StartRate, manager.config.StartBurst)
+	})
+	return service.startLimiter.Allow(consumerID)
+}
+
+// newSession creates the session of the request with the session factory, if there is one.
+func (manager *SessionManager) newSession(request *pb.SessionRequest) (*Session, error) {
+	session := &Session{}
+	if manager.sessionFactory != nil {
+		var err error
+		if session, err = manager.sessionFactory(); err != nil {
+			return nil, errors.Wrap(err, "cannot create session")
+		}
+	}
+
+	if session.ID == "" {
+		id, err := manager.idGenerator()
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot generate session id")
+		}
+		session.ID = id
+	}
+	session.init(manager.service, request, manager.channel.Tracer())
+	return session, nil
+}
+
+// markStarting reserves the start for the given consumer and service type.
+// It returns false if another start is already in progress.
+// The starts are kept by the service instance, as the consumer may start over several p2p channels at once.
+func (manager *SessionManager) markStarting(key startKey) bool {
+	service := manager.service
+	service.startingLock.Lock()
+	defer service.startingLock.Unlock()
+
+	if _, ok := service.starting[key]; ok {
+		return false
+	}
+	if service.starting == nil {
+		service.starting = make(map[startKey]*startProgress)
+	}
+	service.starting[key] = &startProgress{}
+	return true
+}
+
+// markWaitingFirstInvoice records the start of the first invoice wait of the session, done clears it.
+func (manager *SessionManager) markWaitingFirstInvoice(key startKey, sessionID session.ID) (done func()) {
+	service := manager.service
+	service.startingLock.Lock()
+	defer service.startingLock.Unlock()
+
+	progress, ok := service.starting[key]
+	if !ok {
+		return func() {}
+	}
+	progress.sessionID = sessionID
+	progress.waitingSince = time.Now()
+
+	return func() {
+		service.startingLock.Lock()
+		defer service.startingLock.Unlock()
+
+		progress.waitingSince = time.Time{}
+	}
+}
+
+// PendingStarts returns the session starts of the service which wait for the consumers to pay the first invoice,
+// the longest waiting first. The starts of all the session managers of the service are included.
+func (manager *SessionManager) PendingStarts() []PendingStart {
+	service := manager.service
+	service.startingLock.Lock()
+	defer service.startingLock.Unlock()
+
+	now := time.Now()
+	pending := make([]PendingStart, 0)
+	for key, progress := range service.starting {
+		if progress.waitingSince.IsZero() {
+			continue
+		}
+		pending = append(pending, PendingStart{
+			ConsumerID:  key.consumerID,
+			ServiceType: key.serviceType,
+			SessionID:   string(progress.sessionID),
+			Elapsed:     now.Sub(progress.waitingSince),
+		})
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].Elapsed > pending[j].Elapsed
+	})
+	return pending
+}
+
+func (manager *SessionManager) unmarkStarting(key startKey) {
+	service := manager.service
+	service.startingLock.Lock()
+	defer service.startingLock.Unlock()
+
+	delete(service.starting, key)
+}
+
 // Acknowledge marks the session as successfully established as far as the consumer is concerned.
 func (manager *SessionManager) Acknowledge(consumerID identity.Identity, sessionID string) error {
 	session, found := manager.sessionStorage.Find(session.ID(sessionID))
@@ -192,47 +717,258 @@ func (manager *SessionManager) Acknowledge(consumerID identity.Identity, session
 	if session.ConsumerID != consumerID {
 		return ErrorWrongSessionOwner
 	}
+	if err := session.markAcknowledged(); err != nil {
+		return err
+	}
 
+	atomic.AddUint64(&manager.stats.acknowledged, 1)
 	manager.publisher.Publish(sevent.AppTopicSession, session.toEvent(sevent.AcknowledgedStatus))
 	return nil
 }
 
-func (manager *SessionManager) startSession(session *Session) error {
+// ActiveSessions returns a snapshot of the sessions of the managed service.
+func (manager *SessionManager) ActiveSessions() []SessionInfo {
+	sessions := make([]SessionInfo, 0)
+	for _, session := range manager.sessionStorage.List() {
+		if session.ServiceID == string(manager.service.ID) {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions
+}
+
+// activeSessions returns the sessions of the managed service.
+func (manager *SessionManager) activeSessions() []*Session {
+	sessions := make([]*Session, 0)
+	for _, session := range manager.sessionStorage.GetAll() {
+		if session.ServiceID == string(manager.service.ID) {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions
+}
+
+// UpdateProposal replaces the proposal of the managed service, e.g. once the provider changes the pricing.
+// The proposal is kept by the service instance, so the sessions started by all of its managers use the updated proposal.
+func (manager *SessionManager) UpdateProposal(proposal market.ServiceProposal) {
+	manager.service.UpdateProposal(proposal)
+}
+
+// CurrentProposal returns a copy of the current proposal of the managed service.
+func (manager *SessionManager) CurrentProposal() market.ServiceProposal {
+	return manager.service.currentProposal()
+}
+
+func (manager *SessionManager) startSession(session *Session, metadataBuilders []MetadataBuilder) error {
 	trace := session.tracer.StartStage("Provider session create (start)")
 	defer session.tracer.EndStage(trace)
 
 	if err := manager.validateSession(session); err != nil {
 		return err
 	}
+	if err := buildMetadata(session, metadataBuilders); err != nil {
+		return err
+	}
 
 	manager.clearStaleSession(session.ConsumerID, manager.service.Type)
 
+	if !manager.reserveSlot(session.ID) {
+		return ErrorCapacityReached
+	}
+	session.addCleanup(func() error {
+		manager.releaseSlot(session.ID)
+		return nil
+	})
+
 	manager.sessionStorage.Add(session)
 	session.addCleanup(func() error {
 		manager.sessionStorage.Remove(session.ID)
+		atomic.AddUint64(&manager.stats.destroyed, 1)
+		return nil
+	})
+	manager.addChannelSession(session.ID)
+	session.addCleanup(func() error {
+		manager.removeChannelSession(session.ID)
 		return nil
 	})
+	manager.scheduleExpiry(session)
 
 	go manager.keepAliveLoop(session, manager.channel)
 
 	return nil
 }
 
+// buildMetadata attaches the metadata of the given builders to the session, later builders override the earlier ones.
+func buildMetadata(session *Session, builders []MetadataBuilder) error {
+	for _, build := range builders {
+		metadata, err := build(session)
+		if err != nil {
+			return fmt.Errorf("cannot build session metadata: %w", err)
+		}
+		for key, value := range metadata {
+			if session.Metadata == nil {
+				session.Metadata = make(map[string]string)
+			}
+			session.Metadata[key] = value
+		}
+	}
+	return nil
+}
+
+// natTraversal returns the last known NAT traversal outcome, nil if there was none
+// or if the NAT events are not tracked at all.
+func (manager *SessionManager) natTraversal() *sevent.NATTraversalContext {
+	if manager.natEventGetter == nil {
+		return nil
+	}
+
+	last := manager.natEventGetter.LastEvent()
+	if last == nil {
+		return nil
+	}
+
+	traversal := &sevent.NATTraversalContext{
+		Stage:      last.Stage,
+		Successful: last.Successful,
+	}
+	if last.Error != nil {
+		traversal.Error = last.Error.Error()
+	}
+	return traversal
+}
+
+// scheduleExpiry destroys the session once it reaches the maximum session duration.
+func (manager *SessionManager) scheduleExpiry(session *Session) {
+	if manager.config.MaxSessionDuration <= 0 {
+		return
+	}
+
+	expiry := time.AfterFunc(time.Until(session.CreatedAt.Add(manager.config.MaxSessionDuration)), func() {
+		select {
+		case <-session.Done():
+			return
+		default:
+		}
+
+		log.Info().Msgf("Session %s reached the maximum duration, destroying it", session.ID)
+		expired := session.toEvent(sevent.ExpiredStatus)
+		expired.Reason = fmt.Sprintf("session exceeded the maximum duration of %s", manager.config.MaxSessionDuration)
+		manager.publisher.Publish(sevent.AppTopicSession, expired)
+		session.Close()
+	})
+	session.addCleanup(func() error {
+		expiry.Stop()
+		return nil
+	})
+}
+
+// monitorActivity destroys the session once it carries no traffic for the idle timeout.
+func (manager *SessionManager) monitorActivity(session *Session) {
+	timeout := manager.config.IdleTimeout
+	engine, ok := session.getPaymentEngine().(ActivityReportingPaymentEngine)
+	if timeout <= 0 || !ok {
+		return
+	}
+
+	go func() {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-session.Done():
+				return
+			case <-timer.C:
+			}
+
+			lastActivity := engine.LastActivity()
+			if lastActivity.Before(session.CreatedAt) {
+				lastActivity = session.CreatedAt
+			}
+			idle := time.Since(lastActivity)
+			if session.Paused() {
+				timer.Reset(timeout)
+				continue
+			}
+			if idle < timeout {
+				timer.Reset(timeout - idle)
+				continue
+			}
+
+			log.Info().Msgf("Session %s carried no traffic for %s, destroying it", session.ID, idle)
+			idleEvent := session.toEvent(sevent.IdleStatus)
+			idleEvent.Reason = fmt.Sprintf("session carried no traffic for %s", idle.Round(time.Second))
+			manager.publisher.Publish(sevent.AppTopicSession, idleEvent)
+			session.Close()
+			return
+		}
+	}()
+}
+
 func (manager *SessionManager) validateSession(session *Session) error {
-	if manager.service.Proposal.ID != int(session.request.GetProposalID()) {
+	proposal, ok := manager.service.proposalByID(int(session.request.GetProposalID()), manager.config.PreviousProposalWindow)
+	if !ok {
 		return ErrorInvalidProposal
 	}
+	session.Proposal = proposal
 
 	if !manager.service.Policies().IsIdentityAllowed(session.ConsumerID) {
 		return fmt.Errorf("consumer identity is not allowed: %s", session.ConsumerID.Address)
 	}
 
+	if err := manager.validateCurrency(session.Proposal); err != nil {
+		return err
+	}
+
+	if manager.config.MaxSessionsPerConsumer > 0 && manager.consumerSessionCount(session) >= manager.config.MaxSessionsPerConsumer {
+		return ErrorTooManySessions
+	}
+
 	return nil
 }
 
+// validateCurrency checks that the proposal price can be settled on the chain in use.
+func (manager *SessionManager) validateCurrency(proposal market.ServiceProposal) error {
+	if proposal.PaymentMethod == nil {
+		return nil
+	}
+
+	currency := proposal.PaymentMethod.GetPrice().Currency
+	if currency == "" {
+		return nil
+	}
+
+	chainID := manager.chainID()
+	if !manager.config.supportsCurrency(chainID, currency) {
+		return &UnsupportedCurrencyError{Currency: currency, ChainID: chainID}
+	}
+	return nil
+}
+
+func (manager *SessionManager) chainID() int64 {
+	return config.GetInt64(config.FlagChainID)
+}
+
+// consumerSessionCount counts the sessions of the given session consumer which will be kept after it starts.
+// Sessions of the same service type are not counted as they are cleaned up as stale.
+func (manager *SessionManager) consumerSessionCount(session *Session) int {
+	count := 0
+	for _, existing := range manager.sessionStorage.GetAll() {
+		if existing.ConsumerID != session.ConsumerID {
+			continue
+		}
+		if existing.Proposal.ServiceType == session.Proposal.ServiceType {
+			continue
+		}
+		count++
+	}
+	return count
+}
+
 func (manager *SessionManager) clearStaleSession(consumerID identity.Identity, serviceType string) {
 	// Reading stale session before starting the clean up in goroutine.
 	// This is required to make sure we are not cleaning the newly created session.
+	// With the synchronous cleanup the stale sessions, including their payment engines, are stopped before returning.
 	for _, session := range manager.sessionStorage.GetAll() {
 		if consumerID != session.ConsumerID {
 			continue
@@ -241,12 +977,94 @@ func (manager *SessionManager) clearStaleSession(consumerID identity.Identity, s
 			continue
 		}
 		log.Info().Msgf("Cleaning stale session %s for %s consumer", session.ID, consumerID.Address)
+		// the stale session gives up its slot right away, so that it does not take the slot of the new session.
+		manager.releaseSlot(session.ID)
+		if manager.config.SynchronousStaleCleanup {
+			session.Close()
+		} else {
+			manager.closeStaleSession(session)
+		}
+	}
+}
+
+// closeStaleSession closes the stale session in the background, at most StaleCleanupConcurrency sessions at once.
+// The limit is kept by the service instance, as the consumers may reconnect over different p2p channels.
+func (manager *SessionManager) closeStaleSession(session *Session) {
+	limit := manager.config.StaleCleanupConcurrency
+	if limit <= 0 {
 		go session.Close()
+		return
+	}
+
+	service := manager.service
+	service.staleCleanupOnce.Do(func() {
+		service.staleCleanup = make(chan struct{}, limit)
+	})
+	go func() {
+		service.staleCleanup <- struct{}{}
+		defer func() { <-service.staleCleanup }()
+
+		session.Close()
+	}()
+}
+
+// reserveSlot occupies a slot of the service capacity with the session. It returns false if the capacity is reached.
+// The slots are kept by the service instance, as every p2p channel of the service has its own session manager.
+// The capacity events are published under the lock, so that they are published in order.
+func (manager *SessionManager) reserveSlot(id session.ID) bool {
+	max := manager.config.MaxConcurrentSessions
+	if max <= 0 {
+		return true
+	}
+
+	service := manager.service
+	service.sessionSlotsLock.Lock()
+	defer service.sessionSlotsLock.Unlock()
+
+	if service.sessionSlots == nil {
+		service.sessionSlots = make(map[session.ID]struct{})
+	}
+	if len(service.sessionSlots) >= max {
+		return false
 	}
+
+	service.sessionSlots[id] = struct{}{}
+	if len(service.sessionSlots) == max {
+		log.Info().Msgf("Service %s reached the capacity of %v sessions", service.ID, max)
+		manager.publishCapacity(len(service.sessionSlots), true)
+	}
+	return true
 }
 
-// Destroy destroys session by given sessionID
-func (manager *SessionManager) Destroy(consumerID identity.Identity, sessionID string) error {
+// releaseSlot frees the slot of the session, if it has one.
+func (manager *SessionManager) releaseSlot(id session.ID) {
+	service := manager.service
+	service.sessionSlotsLock.Lock()
+	defer service.sessionSlotsLock.Unlock()
+
+	if _, ok := service.sessionSlots[id]; !ok {
+		return
+	}
+
+	wasFull := len(service.sessionSlots) >= manager.config.MaxConcurrentSessions
+	delete(service.sessionSlots, id)
+	if wasFull {
+		manager.publishCapacity(len(service.sessionSlots), false)
+	}
+}
+
+func (manager *SessionManager) publishCapacity(active int, full bool) {
+	manager.publisher.Publish(sevent.AppTopicSessionCapacity, sevent.AppEventSessionCapacity{
+		ServiceID: string(manager.service.ID),
+		Active:    active,
+		Max:       manager.config.MaxConcurrentSessions,
+		Full:      full,
+	})
+}
+
+// Resume re-attaches the given p2p channel to a suspended session.
+// The payment engine and the service connection of the session are moved to the channel as well.
+func (manager *SessionManager) Resume(consumerID identity.Identity, sessionID string, channel p2p.Channel) error {
 	session, found := manager.sessionStorage.Find(session.ID(sessionID))
 	if !found {
 		return ErrorSessionNotExists
@@ -254,22 +1072,178 @@ func (manager *SessionManager) Destroy(consumerID identity.Identity, sessionID s
 	if session.ConsumerID != consumerID {
 		return ErrorWrongSessionOwner
 	}
+	engine, ok := session.getPaymentEngine().(RebindablePaymentEngine)
+	if !ok {
+		return ErrorSessionNotResumable
+	}
+	if !session.resume() {
+		return ErrorSessionNotSuspended
+	}
+
+	log.Info().Msgf("Resuming session. SessionID=%s", sessionID)
+	if service, ok := manager.service.Service().(ConnRebindingService); ok {
+		if err := service.RebindConn(sessionID, channel.ServiceConn()); err != nil {
+			log.Err(err).Msgf("Could not rebind the service connection, closing session. SessionID=%s", sessionID)
+			session.Close()
+			return fmt.Errorf("cannot rebind service connection of session %s: %w", sessionID, err)
+		}
+	}
+	engine.Rebind(channel, manager.paymentEngineChan)
+
+	manager.addChannelSession(session.ID)
+	session.addCleanup(func() error {
+		manager.removeChannelSession(session.ID)
+		return nil
+	})
+
+	go manager.keepAliveLoop(session, channel)
+	return nil
+}
+
+// Pause pauses the metering and keep-alive of the session without destroying it.
+// The session is destroyed if it is not unpaused within the configured MaxPauseDuration.
+func (manager *SessionManager) Pause(consumerID identity.Identity, sessionID string) error {
+	session, found := manager.sessionStorage.Find(session.ID(sessionID))
+	if !found {
+		return ErrorSessionNotExists
+	}
+	if session.ConsumerID != consumerID {
+		return ErrorWrongSessionOwner
+	}
+	if !session.pause(manager.config.MaxPauseDuration) {
+		return ErrorSessionAlreadyPaused
+	}
+
+	log.Info().Msgf("Session paused. SessionID=%s", sessionID)
+	return nil
+}
+
+// Unpause resumes the metering and keep-alive of the paused session.
+func (manager *SessionManager) Unpause(consumerID identity.Identity, sessionID string) error {
+	session, found := manager.sessionStorage.Find(session.ID(sessionID))
+	if !found {
+		return ErrorSessionNotExists
+	}
+	if session.ConsumerID != consumerID {
+		return ErrorWrongSessionOwner
+	}
+	if !session.unpause() {
+		return ErrorSessionNotPaused
+	}
+
+	log.Info().Msgf("Session unpaused. SessionID=%s", sessionID)
+	return nil
+}
+
+// Destroy destroys session by given sessionID.
+// It returns SessionNotExistsError or WrongSessionOwnerError if the session can not be destroyed.
+func (manager *SessionManager) Destroy(consumerID identity.Identity, sessionID string) error {
+	id := session.ID(sessionID)
+	session, found := manager.sessionStorage.Find(id)
+	if !found {
+		return &SessionNotExistsError{
+			SessionID: sessionID,
+			Destroyed: manager.sessionStorage.WasRemoved(id),
+		}
+	}
+	if session.ConsumerID != consumerID {
+		return &WrongSessionOwnerError{
+			SessionID: sessionID,
+			Owner:     session.ConsumerID,
+		}
+	}
 
 	session.Close()
 	return nil
 }
 
+// ForceSettleAndDestroy secures the revenue of the session before destroying it, e.g. to eject the consumer.
+// The final payment is requested from the payment engine of the session and exchanged for a hermes promise through
+// the given submitter, waiting for no longer than the ForceSettleTimeout. The session is destroyed even if
+// the settlement fails, in which case the settlement error is returned.
+func (manager *SessionManager) ForceSettleAndDestroy(ctx context.Context, sessionID string, submitter PromiseSubmitter) error {
+	id := session.ID(sessionID)
+	session, found := manager.sessionStorage.Find(id)
+	if !found {
+		return &SessionNotExistsError{
+			SessionID: sessionID,
+			Destroyed: manager.sessionStorage.WasRemoved(id),
+		}
+	}
+	defer session.Close()
+
+	engine, ok := session.getPaymentEngine().(FinalizingPaymentEngine)
+	if !ok {
+		return ErrorFinalPaymentNotSupported
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, manager.config.ForceSettleTimeout)
+	defer cancel()
+
+	final, err := engine.FinalPayment(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot get the final payment of the session: %w", err)
+	}
+	if err := submitter.SubmitPromise(ctx, final.R, final.ExchangeMessage, manager.service.ProviderID, sessionID); err != nil {
+		return fmt.Errorf("cannot settle the final payment of the session: %w", err)
+	}
+	return nil
+}
+
+// Shutdown destroys all sessions of the managed service without losing the promises requested for them.
+// The shutdown is ordered as follows:
+//  1. the payment engines of the sessions are stopped, so that no more promises are requested for the sessions;
+//  2. the promise requests already made for the sessions are drained, for no longer than the ShutdownDrainTimeout;
+//  3. the sessions are destroyed.
+//
+// The promise drainer must not be stopped before Shutdown returns. The sessions are destroyed even if
+// the drain fails or times out, in which case the drain error is returned along with the destroy errors.
+func (manager *SessionManager) Shutdown(ctx context.Context, drainer PromiseDrainer) error {
+	sessions := manager.activeSessions()
+	sessionIDs := make([]string, 0, len(sessions))
+	for _, session := range sessions {
+		if engine := session.getPaymentEngine(); engine != nil {
+			engine.Stop()
+		}
+		sessionIDs = append(sessionIDs, string(session.ID))
+	}
+
+	errShutdown := utils.ErrorCollection{}
+	if drainer != nil && len(sessionIDs) > 0 {
+		drainCtx, cancel := context.WithTimeout(ctx, manager.config.ShutdownDrainTimeout)
+		errShutdown.Add(drainer.DrainSessions(drainCtx, sessionIDs))
+		cancel()
+	}
+	errShutdown.Add(manager.DestroyAll())
+	return errShutdown.Errorf("Sessions were not shut down cleanly: %s", ". ")
+}
+
+// DestroyAll destroys all sessions of the managed service.
+// It is safe to call during the service shutdown, errors of individual sessions are aggregated.
+func (manager *SessionManager) DestroyAll() error {
+	errDestroy := utils.ErrorCollection{}
+	for _, session := range manager.activeSessions() {
+		errDestroy.Add(session.close())
+		manager.sessionStorage.Remove(session.ID)
+	}
+	return errDestroy.Errorf("Some sessions were not destroyed cleanly: %s", ". ")
+}
+
 func (manager *SessionManager) paymentLoop(session *Session) error {
 	trace := session.tracer.StartStage("Provider session create (payment)")
 	defer session.tracer.EndStage(trace)
 
 	log.Info().Msg("Using new payments")
 
-	chainID := config.GetInt64(config.FlagChainID)
-	engine, err := manager.paymentEngineFactory(manager.service.ProviderID, session.ConsumerID, chainID, session.HermesID, string(session.ID), manager.paymentEngineChan)
+	engine, err := manager.paymentEngineFactory(manager.service.ProviderID, session.ConsumerID, manager.chainID(), session.HermesID, string(session.ID), manager.paymentEngineChan)
 	if err != nil {
 		return err
 	}
+	if engine == nil {
+		return ErrorNoPaymentEngine
+	}
+
+	session.setPaymentEngine(engine)
 
 	// stop the balance tracker once the session is finished
 	session.addCleanup(func() error {
@@ -277,22 +1251,48 @@ func (manager *SessionManager) paymentLoop(session *Session) error {
 		return nil
 	})
 
+	// only the first failure is published, a crashed engine usually fails the first invoice wait as well.
+	var failOnce sync.Once
+	fail := func(reason sevent.FailureReason, err error) {
+		failOnce.Do(func() {
+			manager.publishFailure(session, reason, err)
+		})
+	}
+
 	go func() {
 		err := engine.Start()
 		if err != nil {
 			log.Error().Err(err).Msg("Payment engine error")
+			fail(sevent.PaymentEngineFailure, err)
 			session.Close()
 		}
 	}()
 
 	log.Info().Msg("Waiting for a first invoice to be paid")
-	if err := engine.WaitFirstInvoice(30 * time.Second); err != nil {
+	waitDone := manager.markWaitingFirstInvoice(startKey{consumerID: session.ConsumerID, serviceType: manager.service.Type}, session.ID)
+	err = engine.WaitFirstInvoice(manager.config.firstInvoiceTimeout(manager.service.Type))
+	waitDone()
+	if err != nil {
+		atomic.AddUint64(&manager.stats.firstInvoiceTimeouts, 1)
+		fail(sevent.FirstInvoiceTimeoutFailure, err)
 		return fmt.Errorf("first invoice was not paid: %w", err)
 	}
+	if manager.config.OnFirstInvoicePaid != nil {
+		manager.config.OnFirstInvoicePaid(session)
+	}
 
 	return nil
 }
 
+// publishFailure publishes the failure of the session along with the error which caused it.
+func (manager *SessionManager) publishFailure(session *Session, reason sevent.FailureReason, err error) {
+	failed := session.toEvent(sevent.FailedStatus)
+	failed.Reason = err.Error()
+	failed.FailureReason = reason
+	failed.Error = err
+	manager.publisher.Publish(sevent.AppTopicSession, failed)
+}
+
 func (manager *SessionManager) providerService(session *Session, channel p2p.Channel) (pb.SessionResponse, error) {
 	trace := session.tracer.StartStage("Provider session create (configure)")
 	defer session.tracer.EndStage(trace)
@@ -315,26 +1315,29 @@ func (manager *SessionManager) providerService(session *Session, channel p2p.Cha
 	}
 
 	return pb.SessionResponse{
-		ID:          string(session.ID),
-		PaymentInfo: "v3",
-		Config:      data,
+		ID:               string(session.ID),
+		PaymentInfo:      "v3",
+		Config:           data,
+		CompactKeepAlive: session.compactKeepAlive,
 	}, nil
 }
 
 func (manager *SessionManager) keepAliveLoop(sess *Session, channel p2p.Channel) {
-	// Register handler for handling p2p keep alive pings from consumer.
-	channel.Handle(p2p.TopicKeepAlive, func(c p2p.Context) error {
-		var ping pb.P2PKeepAlivePing
-		if err := c.Request().UnmarshalProto(&ping); err != nil {
-			return err
-		}
-
-		log.Debug().Msgf("Received p2p keepalive ping with SessionID=%s", ping.SessionID)
-		return c.OK()
-	})
+	if sess.compactKeepAlive {
+		atomic.StoreUint32(&manager.compactKeepAlive, 1)
+	}
+	if err := manager.registerKeepAliveHandler(channel); err != nil {
+		log.Err(err).Msgf("Could not register p2p keepalive handler, closing session. SessionID=%s", sess.ID)
+		failed := sess.toEvent(sevent.FailedStatus)
+		failed.Reason = err.Error()
+		manager.publisher.Publish(sevent.AppTopicSession, failed)
+		sess.Close()
+		return
+	}
 
 	// Send pings to consumer.
 	var errCount int
+	graceUntil := time.Now().Add(manager.config.KeepAlive.InitialGracePeriod)
 	for {
 		select {
 		case <-sess.Done():
@@ -342,28 +1345,139 @@ func (manager *SessionManager) keepAliveLoop(sess *Session, channel p2p.Channel)
 			time.Sleep(10 * time.Second)
 			channel.Close()
 			return
-		case <-time.After(manager.config.KeepAlive.SendInterval):
-			if err := manager.sendKeepAlivePing(channel, sess.ID); err != nil {
+		case <-time.After(manager.config.KeepAlive.nextSendInterval()):
+			if sess.Paused() {
+				continue
+			}
+			rtt, err := manager.sendKeepAlivePing(sess.context(), channel, sess.ID, sess.compactKeepAlive)
+			if err != nil {
 				log.Err(err).Msgf("Failed to send p2p keepalive ping. SessionID=%s", sess.ID)
+				if time.Now().Before(graceUntil) {
+					log.Debug().Msgf("Ignoring p2p keepalive ping failure during the initial grace period. SessionID=%s", sess.ID)
+					continue
+				}
 				errCount++
 				if errCount == manager.config.KeepAlive.MaxSendErrCount {
 					log.Error().Msgf("Max p2p keepalive err count reached, closing p2p channel. SessionID=%s", sess.ID)
+					timedOut := sess.toEvent(sevent.TimedOutStatus)
+					timedOut.Reason = fmt.Sprintf("keep-alive failed %d times in a row: %v", errCount, err)
+					atomic.AddUint64(&manager.stats.keepAliveTimeouts, 1)
+					manager.publisher.Publish(sevent.AppTopicSession, timedOut)
 					channel.Close()
+					if manager.config.SuspendGracePeriod > 0 {
+						log.Info().Msgf("Suspending session for %s. SessionID=%s", manager.config.SuspendGracePeriod, sess.ID)
+						sess.suspend(manager.config.SuspendGracePeriod)
+					}
 					return
 				}
 			} else {
 				errCount = 0
+				sess.recordKeepAliveRTT(rtt)
 			}
 		}
 	}
 }
 
-func (manager *SessionManager) sendKeepAlivePing(channel p2p.Channel, sessionID session.ID) error {
-	ctx, cancel := context.WithTimeout(context.Background(), manager.config.KeepAlive.SendTimeout)
+// registerKeepAliveHandler registers handler for handling p2p keep alive pings from consumer.
+func (manager *SessionManager) registerKeepAliveHandler(channel p2p.Channel) (err error) {
+	if channel == nil {
+		return errors.New("p2p channel is not available")
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("p2p keepalive handler registration failed: %v", r)
+		}
+	}()
+
+	channel.Handle(p2p.TopicKeepAlive, manager.handleKeepAlivePing)
+	return nil
+}
+
+// handleKeepAlivePing replies to the keep-alive ping with the node health.
+// Older consumers ignore the reply, so it is safe to send it to them as well.
+// The compact pings are accepted once a session of the channel has negotiated them.
+func (manager *SessionManager) handleKeepAlivePing(c p2p.Context) error {
+	compact := atomic.LoadUint32(&manager.compactKeepAlive) == 1
+	sessionID, err := c.Request().UnmarshalKeepAlivePing(compact)
+	if err != nil {
+		manager.handleMalformedPing(err)
+		return c.Error(fmt.Errorf("malformed keepalive ping: %w", err))
+	}
+
+	log.Debug().Msgf("Received p2p keepalive ping with SessionID=%s", sessionID)
+	return c.OkWithReply(p2p.ProtoMessage(manager.keepAlivePong()))
+}
+
+// handleMalformedPing counts the malformed pings of the channel and flags its sessions once there are too many of them,
+// to tell the protocol mismatches from the network issues. The pings carry the session ID, so it is not known for the malformed ones.
+func (manager *SessionManager) handleMalformedPing(err error) {
+	count := atomic.AddUint64(&manager.stats.malformedPings, 1)
+	log.Debug().Err(err).Msgf("Received malformed p2p keepalive ping #%d", count)
+
+	max := manager.config.KeepAlive.MaxMalformedPings
+	if max == 0 || count != max {
+		return
+	}
+
+	sessionIDs := manager.channelSessionIDs()
+	log.Warn().Err(err).Msgf("Received %d malformed p2p keepalive pings for sessions %v, the consumer might use an incompatible protocol version", count, sessionIDs)
+	manager.publisher.Publish(sevent.AppTopicMalformedKeepAlive, sevent.AppEventMalformedKeepAlive{
+		ServiceID:  string(manager.service.ID),
+		SessionIDs: sessionIDs,
+		Count:      count,
+		Error:      err,
+	})
+}
+
+func (manager *SessionManager) addChannelSession(id session.ID) {
+	manager.channelSessionsLock.Lock()
+	defer manager.channelSessionsLock.Unlock()
+
+	manager.channelSessions[id] = struct{}{}
+}
+
+func (manager *SessionManager) removeChannelSession(id session.ID) {
+	manager.channelSessionsLock.Lock()
+	defer manager.channelSessionsLock.Unlock()
+
+	delete(manager.channelSessions, id)
+}
+
+func (manager *SessionManager) channelSessionIDs() []string {
+	manager.channelSessionsLock.Lock()
+	defer manager.channelSessionsLock.Unlock()
+
+	ids := make([]string, 0, len(manager.channelSessions))
+	for id := range manager.channelSessions {
+		ids = append(ids, string(id))
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (manager *SessionManager) keepAlivePong() *pb.P2PKeepAlivePong {
+	pong := &pb.P2PKeepAlivePong{}
+	if manager.healthProvider != nil {
+		health := manager.healthProvider.Health()
+		pong.Load = health.Load
+		pong.ActiveSessions = int32(health.ActiveSessions)
+		pong.Draining = health.Draining
+	}
+	return pong
+}
+
+// sendKeepAlivePing sends the ping and returns its round-trip time, which never exceeds the send timeout.
+// The ping is aborted once the given context is cancelled.
+func (manager *SessionManager) sendKeepAlivePing(ctx context.Context, channel p2p.Channel, sessionID session.ID, compact bool) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, manager.config.KeepAlive.SendTimeout)
 	defer cancel()
-	msg := &pb.P2PKeepAlivePing{
-		SessionID: string(sessionID),
+
+	start := time.Now()
+	_, err := channel.Send(ctx, p2p.TopicKeepAlive, p2p.KeepAlivePingMessage(string(sessionID), compact))
+	rtt := time.Since(start)
+	if rtt > manager.config.KeepAlive.SendTimeout {
+		rtt = manager.config.KeepAlive.SendTimeout
 	}
-	_, err := channel.Send(ctx, p2p.TopicKeepAlive, p2p.ProtoMessage(msg))
-	return err
+	return rtt, err
 }
@@ -20,19 +20,26 @@ package service
 import (
 	"context"
 	"errors"
+	"fmt"
+	"math/big"
 	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/mysteriumnetwork/node/config"
 	"github.com/mysteriumnetwork/node/core/policy"
 	"github.com/mysteriumnetwork/node/core/service/servicestate"
 	"github.com/mysteriumnetwork/node/identity"
 	"github.com/mysteriumnetwork/node/market"
 	"github.com/mysteriumnetwork/node/mocks"
+	"github.com/mysteriumnetwork/node/money"
 	"github.com/mysteriumnetwork/node/nat/event"
 	"github.com/mysteriumnetwork/node/p2p"
 	"github.com/mysteriumnetwork/node/pb"
+	"github.com/mysteriumnetwork/node/session"
 	sessionEvent "github.com/mysteriumnetwork/node/session/event"
 	"github.com/mysteriumnetwork/node/trace"
 	"github.com/mysteriumnetwork/payments/crypto"
@@ -76,12 +83,118 @@ func (m mockBalanceTracker) WaitFirstInvoice(time.Duration) error {
 	return m.firstPaymentError
 }
 
+type mockSlowPaymentEngine struct {
+	mockBalanceTracker
+	payDelay time.Duration
+}
+
+func (m mockSlowPaymentEngine) WaitFirstInvoice(timeout time.Duration) error {
+	if m.payDelay > timeout {
+		time.Sleep(timeout)
+		return errors.New("timed out")
+	}
+	time.Sleep(m.payDelay)
+	return nil
+}
+
+type mockBlockingPaymentEngine struct {
+	mockBalanceTracker
+	paid chan struct{}
+}
+
+func (m mockBlockingPaymentEngine) WaitFirstInvoice(time.Duration) error {
+	<-m.paid
+	return nil
+}
+
+type mockActivityPaymentEngine struct {
+	mockBalanceTracker
+	lastActivity func() time.Time
+}
+
+func (m mockActivityPaymentEngine) LastActivity() time.Time {
+	return m.lastActivity()
+}
+
+type mockPausablePaymentEngine struct {
+	mockBalanceTracker
+	lock   sync.Mutex
+	paused bool
+}
+
+func (m *mockPausablePaymentEngine) Pause() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.paused = true
+}
+
+func (m *mockPausablePaymentEngine) Resume() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.paused = false
+}
+
+func (m *mockPausablePaymentEngine) isPaused() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.paused
+}
+
+type mockRebindablePaymentEngine struct {
+	mockBalanceTracker
+	lock         sync.Mutex
+	channel      p2p.ChannelSender
+	exchangeChan chan crypto.ExchangeMessage
+}
+
+func (m *mockRebindablePaymentEngine) Rebind(channel p2p.ChannelSender, exchangeChan chan crypto.ExchangeMessage) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.channel = channel
+	m.exchangeChan = exchangeChan
+}
+
+func (m *mockRebindablePaymentEngine) bound() (p2p.ChannelSender, chan crypto.ExchangeMessage) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.channel, m.exchangeChan
+}
+
+type mockConnRebindingService struct {
+	mockService
+	rebindErr error
+	rebound   []string
+}
+
+func (m *mockConnRebindingService) RebindConn(sessionID string, _ *net.UDPConn) error {
+	m.rebound = append(m.rebound, sessionID)
+	return m.rebindErr
+}
+
 type mockP2PChannel struct {
 	tracer *trace.Tracer
+
+	lock     sync.Mutex
+	sendErr  error
+	sends    int
+	closes   int
+	messages []*p2p.Message
 }
 
-func (m *mockP2PChannel) Send(_ context.Context, _ string, _ *p2p.Message) (*p2p.Message, error) {
-	return nil, nil
+func (m *mockP2PChannel) Send(_ context.Context, _ string, msg *p2p.Message) (*p2p.Message, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.sends++
+	m.messages = append(m.messages, msg)
+	return nil, m.sendErr
+}
+
+func (m *mockP2PChannel) sentMessages() []*p2p.Message {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return append([]*p2p.Message(nil), m.messages...)
 }
 
 func (m *mockP2PChannel) Handle(topic string, handler p2p.HandlerFunc) {
@@ -95,7 +208,25 @@ func (m *mockP2PChannel) ServiceConn() *net.UDPConn { return nil }
 
 func (m *mockP2PChannel) Conn() *net.UDPConn { return nil }
 
-func (m *mockP2PChannel) Close() error { return nil }
+func (m *mockP2PChannel) Close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.closes++
+	return nil
+}
+
+func (m *mockP2PChannel) getSends() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.sends
+}
+
+func (m *mockP2PChannel) getCloses() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.closes
+}
 
 func TestManager_Start_StoresSession(t *testing.T) {
 	publisher := mocks.NewEventBus()
@@ -116,7 +247,7 @@ func TestManager_Start_StoresSession(t *testing.T) {
 
 	assert.Eventually(t, func() bool {
 		history := publisher.GetEventHistory()
-		if len(history) != 6 {
+		if len(history) != 7 {
 			return false
 		}
 
@@ -127,24 +258,31 @@ func TestManager_Start_StoresSession(t *testing.T) {
 		assert.Equal(t, hermesID, startEvent.Session.HermesID)
 		assert.Equal(t, currentProposal, startEvent.Session.Proposal)
 
-		assert.Equal(t, trace.AppTopicTraceEvent, history[1].Topic)
-		traceEvent1 := history[1].Event.(trace.Event)
-		assert.Equal(t, "Provider connect", traceEvent1.Key)
+		assert.Equal(t, sessionEvent.AppTopicSession, history[1].Topic)
+		paidEvent := history[1].Event.(sessionEvent.AppEventSession)
+		assert.Equal(t, sessionEvent.StartedStatus, paidEvent.Status)
+		assert.Equal(t, consumerID, paidEvent.Session.ConsumerID)
+		assert.Equal(t, hermesID, paidEvent.Session.HermesID)
+		assert.Equal(t, currentProposal, paidEvent.Session.Proposal)
 
 		assert.Equal(t, trace.AppTopicTraceEvent, history[2].Topic)
-		traceEvent2 := history[2].Event.(trace.Event)
-		assert.Equal(t, "Provider session create", traceEvent2.Key)
+		traceEvent1 := history[2].Event.(trace.Event)
+		assert.Equal(t, "Provider connect", traceEvent1.Key)
 
 		assert.Equal(t, trace.AppTopicTraceEvent, history[3].Topic)
-		traceEvent3 := history[3].Event.(trace.Event)
-		assert.Equal(t, "Provider session create (start)", traceEvent3.Key)
+		traceEvent2 := history[3].Event.(trace.Event)
+		assert.Equal(t, "Provider session create", traceEvent2.Key)
 
 		assert.Equal(t, trace.AppTopicTraceEvent, history[4].Topic)
-		traceEvent4 := history[4].Event.(trace.Event)
-		assert.Equal(t, "Provider session create (payment)", traceEvent4.Key)
+		traceEvent3 := history[4].Event.(trace.Event)
+		assert.Equal(t, "Provider session create (start)", traceEvent3.Key)
 
 		assert.Equal(t, trace.AppTopicTraceEvent, history[5].Topic)
-		traceEvent5 := history[5].Event.(trace.Event)
+		traceEvent4 := history[5].Event.(trace.Event)
+		assert.Equal(t, "Provider session create (payment)", traceEvent4.Key)
+
+		assert.Equal(t, trace.AppTopicTraceEvent, history[6].Topic)
+		traceEvent5 := history[6].Event.(trace.Event)
 		assert.Equal(t, "Provider session create (configure)", traceEvent5.Key)
 
 		return true
@@ -168,7 +306,7 @@ func TestManager_Start_DisconnectsOnPaymentError(t *testing.T) {
 	assert.EqualError(t, err, "first invoice was not paid: sorry, your money ended")
 	assert.Eventually(t, func() bool {
 		history := publisher.GetEventHistory()
-		if len(history) != 6 {
+		if len(history) != 7 {
 			return false
 		}
 
@@ -179,24 +317,30 @@ func TestManager_Start_DisconnectsOnPaymentError(t *testing.T) {
 		assert.Equal(t, hermesID, startEvent.Session.HermesID)
 		assert.Equal(t, currentProposal, startEvent.Session.Proposal)
 
-		assert.Equal(t, trace.AppTopicTraceEvent, history[1].Topic)
-		traceEvent1 := history[1].Event.(trace.Event)
-		assert.Equal(t, "Provider connect", traceEvent1.Key)
+		assert.Equal(t, sessionEvent.AppTopicSession, history[1].Topic)
+		failedEvent := history[1].Event.(sessionEvent.AppEventSession)
+		assert.Equal(t, sessionEvent.FailedStatus, failedEvent.Status)
+		assert.Equal(t, sessionEvent.FirstInvoiceTimeoutFailure, failedEvent.FailureReason)
+		assert.EqualError(t, failedEvent.Error, "sorry, your money ended")
 
 		assert.Equal(t, trace.AppTopicTraceEvent, history[2].Topic)
-		traceEvent2 := history[2].Event.(trace.Event)
-		assert.Equal(t, "Provider session create", traceEvent2.Key)
+		traceEvent1 := history[2].Event.(trace.Event)
+		assert.Equal(t, "Provider connect", traceEvent1.Key)
 
 		assert.Equal(t, trace.AppTopicTraceEvent, history[3].Topic)
-		traceEvent3 := history[3].Event.(trace.Event)
-		assert.Equal(t, "Provider session create (start)", traceEvent3.Key)
+		traceEvent2 := history[3].Event.(trace.Event)
+		assert.Equal(t, "Provider session create", traceEvent2.Key)
 
 		assert.Equal(t, trace.AppTopicTraceEvent, history[4].Topic)
-		traceEvent4 := history[4].Event.(trace.Event)
+		traceEvent3 := history[4].Event.(trace.Event)
+		assert.Equal(t, "Provider session create (start)", traceEvent3.Key)
+
+		assert.Equal(t, trace.AppTopicTraceEvent, history[5].Topic)
+		traceEvent4 := history[5].Event.(trace.Event)
 		assert.Equal(t, "Provider session create (payment)", traceEvent4.Key)
 
-		assert.Equal(t, sessionEvent.AppTopicSession, history[5].Topic)
-		closeEvent := history[5].Event.(sessionEvent.AppEventSession)
+		assert.Equal(t, sessionEvent.AppTopicSession, history[6].Topic)
+		closeEvent := history[6].Event.(sessionEvent.AppEventSession)
 		assert.Equal(t, sessionEvent.RemovedStatus, closeEvent.Status)
 		assert.Equal(t, consumerID, closeEvent.Session.ConsumerID)
 		assert.Equal(t, hermesID, closeEvent.Session.HermesID)
@@ -235,6 +379,253 @@ func TestManager_Start_Second_Session_Destroy_Stale_Session(t *testing.T) {
 	}, 2*time.Second, 10*time.Millisecond, "Waiting for session destroy")
 }
 
+type mockRecordingPaymentEngine struct {
+	mockBalanceTracker
+	name   string
+	record func(string)
+}
+
+func (m *mockRecordingPaymentEngine) Stop() {
+	m.record("stop " + m.name)
+}
+
+func TestManager_Start_SynchronousStaleCleanup(t *testing.T) {
+	sessionRequest := &pb.SessionRequest{
+		Consumer: &pb.ConsumerInfo{
+			Id:       consumerID.Address,
+			HermesID: hermesID.String(),
+		},
+		ProposalID: int64(currentProposalID),
+	}
+
+	var lock sync.Mutex
+	var events []string
+	record := func(event string) {
+		lock.Lock()
+		defer lock.Unlock()
+		events = append(events, event)
+	}
+
+	publisher := mocks.NewEventBus()
+	sessionStore := NewSessionPool(publisher)
+	manager := newManager(currentService, sessionStore, publisher, &mockBalanceTracker{})
+	manager.config.SynchronousStaleCleanup = true
+	var engines int
+	manager.paymentEngineFactory = func(_, _ identity.Identity, _ int64, _ common.Address, _ string, _ chan crypto.ExchangeMessage) (PaymentEngine, error) {
+		engines++
+		name := fmt.Sprintf("engine %d", engines)
+		record("start " + name)
+		return &mockRecordingPaymentEngine{name: name, record: record}, nil
+	}
+
+	_, err := manager.Start(sessionRequest)
+	assert.NoError(t, err)
+	sessionOld := sessionStore.GetAll()[0]
+
+	_, err = manager.Start(sessionRequest)
+	assert.NoError(t, err)
+
+	_, found := sessionStore.Find(sessionOld.ID)
+	assert.False(t, found)
+	assert.Len(t, sessionStore.GetAll(), 1)
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, []string{"start engine 1", "stop engine 1", "start engine 2"}, events)
+}
+
+type mockStoppingPaymentEngine struct {
+	mockBalanceTracker
+	stopping *int32
+	maxStops *int32
+	stopped  *int32
+	release  chan struct{}
+}
+
+func (m *mockStoppingPaymentEngine) Stop() {
+	current := atomic.AddInt32(m.stopping, 1)
+	defer atomic.AddInt32(m.stopping, -1)
+	for {
+		max := atomic.LoadInt32(m.maxStops)
+		if current <= max || atomic.CompareAndSwapInt32(m.maxStops, max, current) {
+			break
+		}
+	}
+	<-m.release
+	atomic.AddInt32(m.stopped, 1)
+}
+
+func TestManager_Start_StaleCleanupConcurrency(t *testing.T) {
+	service := NewInstance(
+		identity.FromAddress(currentProposal.ProviderID),
+		currentProposal.ServiceType,
+		struct{}{},
+		currentProposal,
+		servicestate.Running,
+		&mockService{},
+		policy.NewRepository(),
+		&mockDiscovery{},
+	)
+	publisher := mocks.NewEventBus()
+	sessionStore := NewSessionPool(publisher)
+	manager := newManager(service, sessionStore, publisher, &mockBalanceTracker{})
+	manager.config.StaleCleanupConcurrency = 2
+
+	var stopping, maxStops, stopped int32
+	release := make(chan struct{})
+	manager.paymentEngineFactory = func(_, _ identity.Identity, _ int64, _ common.Address, _ string, _ chan crypto.ExchangeMessage) (PaymentEngine, error) {
+		return &mockStoppingPaymentEngine{stopping: &stopping, maxStops: &maxStops, stopped: &stopped, release: release}, nil
+	}
+
+	const consumers = 10
+	requests := make([]*pb.SessionRequest, consumers)
+	for i := range requests {
+		requests[i] = &pb.SessionRequest{
+			Consumer: &pb.ConsumerInfo{
+				Id:       fmt.Sprintf("0x%040x", i+1),
+				HermesID: hermesID.String(),
+			},
+			ProposalID: int64(currentProposalID),
+		}
+		_, err := manager.Start(requests[i])
+		assert.NoError(t, err)
+	}
+
+	var wg sync.WaitGroup
+	for _, request := range requests {
+		wg.Add(1)
+		go func(request *pb.SessionRequest) {
+			defer wg.Done()
+			_, err := manager.Start(request)
+			assert.NoError(t, err)
+		}(request)
+	}
+	wg.Wait()
+
+	// the stale sessions wait for a cleanup slot while the first ones are stopping their engines.
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&stopping) == 2 }, 2*time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&maxStops))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&stopped))
+
+	close(release)
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&stopped) == consumers }, 2*time.Second, time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&maxStops))
+	assert.Eventually(t, func() bool { return len(sessionStore.GetAll()) == consumers }, 2*time.Second, time.Millisecond)
+}
+
+type mockConsumerFilter struct {
+	allowed bool
+	err     error
+}
+
+func (m *mockConsumerFilter) Allow(identity.Identity) (bool, error) {
+	return m.allowed, m.err
+}
+
+func TestManager_Start_ConsumerFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		filter  *mockConsumerFilter
+		wantErr string
+	}{
+		{
+			name:   "allows consumer",
+			filter: &mockConsumerFilter{allowed: true},
+		},
+		{
+			name:    "denies consumer",
+			filter:  &mockConsumerFilter{allowed: false},
+			wantErr: ErrorConsumerNotAllowed.Error(),
+		},
+		{
+			name:    "fails on filter error",
+			filter:  &mockConsumerFilter{err: errors.New("filter failed")},
+			wantErr: "cannot check if consumer is allowed: filter failed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			publisher := mocks.NewEventBus()
+			sessionStore := NewSessionPool(publisher)
+			manager := newManager(currentService, sessionStore, publisher, &mockBalanceTracker{})
+			manager.consumerFilter = tt.filter
+
+			_, err := manager.Start(&pb.SessionRequest{
+				Consumer: &pb.ConsumerInfo{
+					Id:       consumerID.Address,
+					HermesID: hermesID.String(),
+				},
+				ProposalID: int64(currentProposalID),
+			})
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				assert.Len(t, sessionStore.GetAll(), 0)
+			} else {
+				assert.NoError(t, err)
+				assert.Len(t, sessionStore.GetAll(), 1)
+			}
+		})
+	}
+}
+
+type mockUsageReportingPaymentEngine struct {
+	mockBalanceTracker
+	usage Usage
+}
+
+func (m *mockUsageReportingPaymentEngine) Usage() Usage {
+	return m.usage
+}
+
+func TestManager_Destroy_PublishesUsage(t *testing.T) {
+	tests := []struct {
+		name      string
+		engine    PaymentEngine
+		wantUsage *sessionEvent.UsageContext
+	}{
+		{
+			name:      "reports usage of engine",
+			engine:    &mockUsageReportingPaymentEngine{usage: Usage{Up: 1, Down: 2, Tokens: big.NewInt(3)}},
+			wantUsage: &sessionEvent.UsageContext{Up: 1, Down: 2, Tokens: big.NewInt(3)},
+		},
+		{
+			name:   "omits usage of engine which does not report it",
+			engine: &mockBalanceTracker{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			publisher := mocks.NewEventBus()
+			sessionStore := NewSessionPool(publisher)
+			manager := newManager(currentService, sessionStore, publisher, tt.engine)
+
+			started, err := manager.Start(&pb.SessionRequest{
+				Consumer: &pb.ConsumerInfo{
+					Id:       consumerID.Address,
+					HermesID: hermesID.String(),
+				},
+				ProposalID: int64(currentProposalID),
+			})
+			assert.NoError(t, err)
+			assert.NoError(t, manager.Destroy(consumerID, started.ID))
+
+			var removed *sessionEvent.AppEventSession
+			assert.Eventually(t, func() bool {
+				for _, e := range publisher.GetEventHistory() {
+					if ev, ok := e.Event.(sessionEvent.AppEventSession); ok && ev.Status == sessionEvent.RemovedStatus {
+						removed = &ev
+						return true
+					}
+				}
+				return false
+			}, 2*time.Second, 10*time.Millisecond)
+			assert.Equal(t, tt.wantUsage, removed.Session.Usage)
+			assert.True(t, removed.Session.Duration > 0)
+		})
+	}
+}
+
 func TestManager_Start_RejectsUnknownProposal(t *testing.T) {
 	publisher := mocks.NewEventBus()
 	sessionStore := NewSessionPool(mocks.NewEventBus())
@@ -272,77 +663,1969 @@ func TestManager_Start_RejectsUnknownProposal(t *testing.T) {
 	}, 2*time.Second, 10*time.Millisecond)
 }
 
-type MockNatEventTracker struct {
-}
-
-func (mnet *MockNatEventTracker) LastEvent() *event.Event {
-	return &event.Event{}
-}
-
-func TestManager_AcknowledgeSession_RejectsUnknown(t *testing.T) {
+func TestManager_ActiveSessions(t *testing.T) {
 	publisher := mocks.NewEventBus()
 	sessionStore := NewSessionPool(publisher)
 	manager := newManager(currentService, sessionStore, publisher, &mockBalanceTracker{})
+	assert.Len(t, manager.ActiveSessions(), 0)
 
-	err := manager.Acknowledge(consumerID, "")
-	assert.Exactly(t, err, ErrorSessionNotExists)
+	_, err := manager.Start(&pb.SessionRequest{
+		Consumer: &pb.ConsumerInfo{
+			Id:       consumerID.Address,
+			HermesID: hermesID.String(),
+		},
+		ProposalID: int64(currentProposalID),
+	})
+	assert.NoError(t, err)
+
+	otherService, _ := NewSession(&Instance{ID: "other"}, &pb.SessionRequest{}, trace.NewTracer(""))
+	sessionStore.Add(otherService)
+
+	sessions := manager.ActiveSessions()
+	assert.Len(t, sessions, 1)
+	assert.Equal(t, consumerID, sessions[0].ConsumerID)
+	assert.Equal(t, StateCreated, sessions[0].State)
+
+	// the snapshot does not share the metadata with the session.
+	sessions[0].Metadata = map[string]string{"changed": "true"}
+	stored, ok := sessionStore.Find(sessions[0].ID)
+	assert.True(t, ok)
+	assert.Empty(t, stored.Metadata["changed"])
+
+	// the snapshot is not affected by further changes in the storage.
+	sessionStore.Remove(sessions[0].ID)
+	assert.Len(t, sessions, 1)
+	assert.Len(t, manager.ActiveSessions(), 0)
 }
 
-func TestManager_AcknowledgeSession_RejectsBadClient(t *testing.T) {
-	publisher := mocks.NewEventBus()
-	sessionStore := NewSessionPool(mocks.NewEventBus())
-	manager := newManager(currentService, sessionStore, publisher, &mockBalanceTracker{})
+func TestManager_Start_FirstInvoiceTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  func(c *Config)
+		wantErr bool
+	}{
+		{
+			name: "pays within the timeout",
+			config: func(c *Config) {
+				c.FirstInvoiceTimeout = 100 * time.Millisecond
+			},
+		},
+		{
+			name: "times out",
+			config: func(c *Config) {
+				c.FirstInvoiceTimeout = 10 * time.Millisecond
+			},
+			wantErr: true,
+		},
+		{
+			name: "times out with service type override",
+			config: func(c *Config) {
+				c.FirstInvoiceTimeout = 100 * time.Millisecond
+				c.FirstInvoiceTimeoutByServiceType = map[string]time.Duration{currentProposal.ServiceType: 10 * time.Millisecond}
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			publisher := mocks.NewEventBus()
+			sessionStore := NewSessionPool(publisher)
+			manager := newManager(currentService, sessionStore, publisher, mockSlowPaymentEngine{payDelay: 50 * time.Millisecond})
+			tt.config(&manager.config)
 
-	session, err := manager.Start(&pb.SessionRequest{
+			_, err := manager.Start(&pb.SessionRequest{
+				Consumer: &pb.ConsumerInfo{
+					Id:       consumerID.Address,
+					HermesID: hermesID.String(),
+				},
+				ProposalID: int64(currentProposalID),
+			})
+			if tt.wantErr {
+				assert.EqualError(t, err, "first invoice was not paid: timed out")
+				assert.Len(t, sessionStore.GetAll(), 0)
+			} else {
+				assert.NoError(t, err)
+				assert.Len(t, sessionStore.GetAll(), 1)
+			}
+		})
+	}
+}
+
+func TestManager_Start_PublishesFailureReason(t *testing.T) {
+	engineErr := errors.New("engine crashed")
+	invoiceErr := errors.New("timed out")
+
+	tests := []struct {
+		name       string
+		engine     PaymentEngine
+		wantReason sessionEvent.FailureReason
+		wantErr    error
+	}{
+		{
+			name:       "payment engine fails to start",
+			engine:     mockBalanceTracker{paymentError: engineErr},
+			wantReason: sessionEvent.PaymentEngineFailure,
+			wantErr:    engineErr,
+		},
+		{
+			name:       "first invoice is not paid",
+			engine:     mockBalanceTracker{firstPaymentError: invoiceErr},
+			wantReason: sessionEvent.FirstInvoiceTimeoutFailure,
+			wantErr:    invoiceErr,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			publisher := mocks.NewEventBus()
+			sessionStore := NewSessionPool(publisher)
+			manager := newManager(currentService, sessionStore, publisher, tt.engine)
+
+			manager.Start(&pb.SessionRequest{
+				Consumer: &pb.ConsumerInfo{
+					Id:       consumerID.Address,
+					HermesID: hermesID.String(),
+				},
+				ProposalID: int64(currentProposalID),
+			})
+
+			var failed []sessionEvent.AppEventSession
+			assert.Eventually(t, func() bool {
+				failed = nil
+				for _, e := range publisher.GetEventHistory() {
+					if ev, ok := e.Event.(sessionEvent.AppEventSession); ok && ev.Status == sessionEvent.FailedStatus {
+						failed = append(failed, ev)
+					}
+				}
+				return len(failed) > 0
+			}, 2*time.Second, 10*time.Millisecond)
+			assert.Len(t, failed, 1)
+			assert.Equal(t, tt.wantReason, failed[0].FailureReason)
+			assert.Equal(t, tt.wantErr, failed[0].Error)
+			assert.Equal(t, tt.wantErr.Error(), failed[0].Reason)
+		})
+	}
+}
+
+func TestManager_Start_BuildsMetadata(t *testing.T) {
+	sessionRequest := &pb.SessionRequest{
 		Consumer: &pb.ConsumerInfo{
 			Id:       consumerID.Address,
 			HermesID: hermesID.String(),
 		},
 		ProposalID: int64(currentProposalID),
+	}
+
+	t.Run("attaches metadata", func(t *testing.T) {
+		publisher := mocks.NewEventBus()
+		sessionStore := NewSessionPool(publisher)
+		manager := newManager(currentService, sessionStore, publisher, &mockBalanceTracker{})
+
+		started, err := manager.Start(
+			sessionRequest,
+			func(session *Session) (map[string]string, error) {
+				return map[string]string{"ip": "10.0.0.2", "tier": "silver"}, nil
+			},
+			func(session *Session) (map[string]string, error) {
+				return map[string]string{"tier": "gold"}, nil
+			},
+		)
+		assert.NoError(t, err)
+
+		session, found := sessionStore.FindBy(FindOpts{Metadata: map[string]string{"ip": "10.0.0.2"}})
+		assert.True(t, found)
+		assert.Equal(t, started.ID, string(session.ID))
+		assert.Equal(t, map[string]string{"ip": "10.0.0.2", "tier": "gold"}, session.Metadata)
+
+		history := publisher.GetEventHistory()
+		assert.Equal(t, session.Metadata, history[0].Event.(sessionEvent.AppEventSession).Session.Metadata)
 	})
-	assert.Nil(t, err)
 
-	err = manager.Acknowledge(identity.FromAddress("some other id"), string(session.ID))
-	assert.Exactly(t, ErrorWrongSessionOwner, err)
+	t.Run("fails on builder error", func(t *testing.T) {
+		publisher := mocks.NewEventBus()
+		sessionStore := NewSessionPool(publisher)
+		manager := newManager(currentService, sessionStore, publisher, &mockBalanceTracker{})
+
+		_, err := manager.Start(sessionRequest, func(session *Session) (map[string]string, error) {
+			return nil, errors.New("no free IP")
+		})
+		assert.EqualError(t, err, "cannot build session metadata: no free IP")
+		assert.Len(t, sessionStore.GetAll(), 0)
+	})
 }
 
-func TestManager_AcknowledgeSession_PublishesEvent(t *testing.T) {
-	publisher := mocks.NewEventBus()
+func TestManager_Start_RateLimited(t *testing.T) {
+	sessionRequest := &pb.SessionRequest{
+		Consumer: &pb.ConsumerInfo{
+			Id:       consumerID.Address,
+			HermesID: hermesID.String(),
+		},
+		ProposalID: int64(currentProposalID),
+	}
 
-	sessionStore := NewSessionPool(publisher)
-	session, _ := NewSession(
-		currentService,
-		&pb.SessionRequest{Consumer: &pb.ConsumerInfo{Id: consumerID.Address}},
-		trace.NewTracer(""),
+	service := NewInstance(
+		identity.FromAddress(currentProposal.ProviderID),
+		currentProposal.ServiceType,
+		struct{}{},
+		currentProposal,
+		servicestate.Running,
+		&mockService{},
+		policy.NewRepository(),
+		&mockDiscovery{},
 	)
-	sessionStore.Add(session)
+	publisher := mocks.NewEventBus()
+	sessionStore := NewSessionPool(publisher)
+	// every p2p channel has its own session manager, the limit is shared by all of them.
+	newLimitedManager := func() *SessionManager {
+		manager := newManager(service, sessionStore, publisher, &mockBalanceTracker{})
+		manager.config.StartRate = 0.001
+		manager.config.StartBurst = 2
+		return manager
+	}
 
-	manager := newManager(currentService, sessionStore, publisher, &mockBalanceTracker{})
+	for i := 0; i < 2; i++ {
+		_, err := newLimitedManager().Start(sessionRequest)
+		assert.NoError(t, err)
+	}
+	_, err := newLimitedManager().Start(sessionRequest)
+	assert.Exactly(t, ErrorRateLimited, err)
 
-	err := manager.Acknowledge(consumerID, string(session.ID))
-	assert.Nil(t, err)
-	assert.Eventually(t, func() bool {
-		// Check that state event with StateIPNotChanged status was called.
-		history := publisher.GetEventHistory()
-		for _, v := range history {
-			if v.Topic == sessionEvent.AppTopicSession && v.Event.(sessionEvent.AppEventSession).Status == sessionEvent.AcknowledgedStatus {
-				return true
-			}
-		}
-		return false
-	}, 2*time.Second, 10*time.Millisecond)
+	// other consumers are not affected.
+	_, err = newLimitedManager().Start(&pb.SessionRequest{
+		Consumer: &pb.ConsumerInfo{
+			Id:       identity.FromAddress("other").Address,
+			HermesID: hermesID.String(),
+		},
+		ProposalID: int64(currentProposalID),
+	})
+	assert.NoError(t, err)
 }
 
-func newManager(service *Instance, sessions *SessionPool, publisher publisher, paymentEngine PaymentEngine) *SessionManager {
-	return NewSessionManager(
-		service,
-		sessions,
-		func(_, _ identity.Identity, _ int64, _ common.Address, _ string, _ chan crypto.ExchangeMessage) (PaymentEngine, error) {
-			return paymentEngine, nil
+func TestManager_Start_OnFirstInvoicePaid(t *testing.T) {
+	sessionRequest := &pb.SessionRequest{
+		Consumer: &pb.ConsumerInfo{
+			Id:       consumerID.Address,
+			HermesID: hermesID.String(),
 		},
-		&MockNatEventTracker{},
-		publisher,
+		ProposalID: int64(currentProposalID),
+	}
+
+	publisher := mocks.NewEventBus()
+	sessionStore := NewSessionPool(publisher)
+	manager := newManager(currentService, sessionStore, publisher, &mockBalanceTracker{})
+	var paid []*Session
+	manager.config.OnFirstInvoicePaid = func(session *Session) {
+		// the hook fires before the session is reported as started.
+		for _, e := range publisher.GetEventHistory() {
+			if ev, ok := e.Event.(sessionEvent.AppEventSession); ok {
+				assert.NotEqual(t, sessionEvent.StartedStatus, ev.Status)
+			}
+		}
+		paid = append(paid, session)
+	}
+
+	started, err := manager.Start(sessionRequest)
+	assert.NoError(t, err)
+	assert.Len(t, paid, 1)
+	assert.Equal(t, started.ID, string(paid[0].ID))
+
+	// the hook does not fire if the first invoice is not paid.
+	manager.paymentEngineFactory = func(_, _ identity.Identity, _ int64, _ common.Address, _ string, _ chan crypto.ExchangeMessage) (PaymentEngine, error) {
+		return &mockBalanceTracker{firstPaymentError: errors.New("not paid")}, nil
+	}
+	_, err = manager.Start(sessionRequest)
+	assert.Error(t, err)
+	assert.Len(t, paid, 1)
+}
+
+func TestManager_IdleTimeout(t *testing.T) {
+	sessionRequest := &pb.SessionRequest{
+		Consumer: &pb.ConsumerInfo{
+			Id:       consumerID.Address,
+			HermesID: hermesID.String(),
+		},
+		ProposalID: int64(currentProposalID),
+	}
+	stale := func() time.Time { return time.Now().Add(-time.Hour) }
+	active := func() time.Time { return time.Now() }
+
+	tests := []struct {
+		name         string
+		engine       PaymentEngine
+		pause        bool
+		wantDestroys bool
+	}{
+		{name: "destroys idle session", engine: mockActivityPaymentEngine{lastActivity: stale}, wantDestroys: true},
+		{name: "keeps active session", engine: mockActivityPaymentEngine{lastActivity: active}},
+		{name: "keeps paused idle session", engine: mockActivityPaymentEngine{lastActivity: stale}, pause: true},
+		{name: "keeps session of engine not reporting activity", engine: mockBalanceTracker{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			publisher := mocks.NewEventBus()
+			sessionStore := NewSessionPool(publisher)
+			manager := newManager(currentService, sessionStore, publisher, tt.engine)
+			manager.config.IdleTimeout = 50 * time.Millisecond
+
+			started, err := manager.Start(sessionRequest)
+			assert.NoError(t, err)
+			if tt.pause {
+				assert.NoError(t, manager.Pause(consumerID, started.ID))
+			}
+
+			idle := func() bool {
+				for _, e := range publisher.GetEventHistory() {
+					if ev, ok := e.Event.(sessionEvent.AppEventSession); ok && ev.Status == sessionEvent.IdleStatus {
+						return true
+					}
+				}
+				return false
+			}
+			if tt.wantDestroys {
+				assert.Eventually(t, func() bool {
+					return idle() && len(sessionStore.GetAll()) == 0
+				}, 2*time.Second, 10*time.Millisecond)
+			} else {
+				time.Sleep(200 * time.Millisecond)
+				assert.False(t, idle())
+				assert.Len(t, sessionStore.GetAll(), 1)
+			}
+		})
+	}
+}
+
+func TestManager_Start_MaxConcurrentSessions(t *testing.T) {
+	newRequest := func(consumer identity.Identity) *pb.SessionRequest {
+		return &pb.SessionRequest{
+			Consumer: &pb.ConsumerInfo{
+				Id:       consumer.Address,
+				HermesID: hermesID.String(),
+			},
+			ProposalID: int64(currentProposalID),
+		}
+	}
+	capacityEvents := func(publisher *mocks.EventBus) []sessionEvent.AppEventSessionCapacity {
+		var events []sessionEvent.AppEventSessionCapacity
+		for _, e := range publisher.GetEventHistory() {
+			if e.Topic == sessionEvent.AppTopicSessionCapacity {
+				events = append(events, e.Event.(sessionEvent.AppEventSessionCapacity))
+			}
+		}
+		return events
+	}
+
+	service := NewInstance(
+		identity.FromAddress(currentProposal.ProviderID),
+		currentProposal.ServiceType,
+		struct{}{},
+		currentProposal,
+		servicestate.Running,
+		&mockService{},
+		policy.NewRepository(),
+		&mockDiscovery{},
+	)
+	publisher := mocks.NewEventBus()
+	sessionStore := NewSessionPool(publisher)
+	engine := mockBlockingPaymentEngine{paid: make(chan struct{})}
+	// every p2p channel has its own session manager, the capacity is shared by all of them.
+	newCappedManager := func() *SessionManager {
+		manager := newManager(service, sessionStore, publisher, engine)
+		manager.config.MaxConcurrentSessions = 3
+		return manager
+	}
+
+	type result struct {
+		id  string
+		err error
+	}
+	results := make(chan result)
+	for i := 0; i < 5; i++ {
+		consumer := identity.FromAddress(fmt.Sprintf("0x%040d", i))
+		manager := newCappedManager()
+		go func() {
+			resp, err := manager.Start(newRequest(consumer))
+			results <- result{resp.ID, err}
+		}()
+	}
+
+	// the starts beyond the capacity are rejected right away.
+	for i := 0; i < 2; i++ {
+		r := <-results
+		assert.Exactly(t, ErrorCapacityReached, r.err)
+	}
+	close(engine.paid)
+	var started []string
+	for i := 0; i < 3; i++ {
+		r := <-results
+		assert.NoError(t, r.err)
+		started = append(started, r.id)
+	}
+	assert.Len(t, sessionStore.GetAll(), 3)
+	assert.Equal(t, []sessionEvent.AppEventSessionCapacity{
+		{ServiceID: string(service.ID), Active: 3, Max: 3, Full: true},
+	}, capacityEvents(publisher))
+
+	other := identity.FromAddress("0x0000000000000000000000000000000000000042")
+	_, err := newCappedManager().Start(newRequest(other))
+	assert.Exactly(t, ErrorCapacityReached, err)
+
+	// destroying a session frees up its slot.
+	owner, _ := sessionStore.Find(session.ID(started[0]))
+	assert.NoError(t, newCappedManager().Destroy(owner.ConsumerID, started[0]))
+	assert.Equal(t, sessionEvent.AppEventSessionCapacity{ServiceID: string(service.ID), Active: 2, Max: 3, Full: false}, capacityEvents(publisher)[1])
+
+	_, err = newCappedManager().Start(newRequest(other))
+	assert.NoError(t, err)
+	assert.Len(t, capacityEvents(publisher), 3)
+	assert.True(t, capacityEvents(publisher)[2].Full)
+}
+
+func TestManager_Start_RejectsDuplicateStart(t *testing.T) {
+	sessionRequest := &pb.SessionRequest{
+		Consumer: &pb.ConsumerInfo{
+			Id:       consumerID.Address,
+			HermesID: hermesID.String(),
+		},
+		ProposalID: int64(currentProposalID),
+	}
+
+	publisher := mocks.NewEventBus()
+	sessionStore := NewSessionPool(publisher)
+	engine := mockBlockingPaymentEngine{paid: make(chan struct{})}
+	manager := newManager(currentService, sessionStore, publisher, engine)
+
+	firstErr := make(chan error)
+	go func() {
+		_, err := manager.Start(sessionRequest)
+		firstErr <- err
+	}()
+
+	assert.Eventually(t, func() bool {
+		return len(sessionStore.GetAll()) == 1
+	}, 2*time.Second, 10*time.Millisecond)
+	first := sessionStore.GetAll()[0]
+
+	_, err := manager.Start(sessionRequest)
+	assert.Exactly(t, ErrorSessionStartInProgress, err)
+
+	// the consumer can not start over another p2p channel of the service either.
+	other := newManager(currentService, sessionStore, publisher, engine)
+	_, err = other.Start(sessionRequest)
+	assert.Exactly(t, ErrorSessionStartInProgress, err)
+
+	close(engine.paid)
+	assert.NoError(t, <-firstErr)
+
+	_, found := sessionStore.Find(first.ID)
+	assert.True(t, found)
+
+	// once the first start finished, the consumer is able to start again.
+	_, err = manager.Start(sessionRequest)
+	assert.NoError(t, err)
+}
+
+func TestManager_Resume(t *testing.T) {
+	for _, resume := range []bool{true, false} {
+		publisher := mocks.NewEventBus()
+		sessionStore := NewSessionPool(publisher)
+		manager := newManager(currentService, sessionStore, publisher, &mockBalanceTracker{})
+		manager.config.KeepAlive = KeepAliveConfig{
+			SendInterval:    5 * time.Millisecond,
+			SendTimeout:     5 * time.Millisecond,
+			MaxSendErrCount: 2,
+		}
+		manager.config.SuspendGracePeriod = 100 * time.Millisecond
+
+		session, err := NewSession(currentService, &pb.SessionRequest{Consumer: &pb.ConsumerInfo{Id: consumerID.Address}}, trace.NewTracer(""))
+		assert.NoError(t, err)
+		engine := &mockRebindablePaymentEngine{}
+		session.setPaymentEngine(engine)
+		sessionStore.Add(session)
+		session.addCleanup(func() error {
+			sessionStore.Remove(session.ID)
+			return nil
+		})
+
+		err = manager.Resume(consumerID, string(session.ID), &mockP2PChannel{tracer: trace.NewTracer("")})
+		assert.Exactly(t, ErrorSessionNotSuspended, err)
+
+		lostChannel := &mockP2PChannel{tracer: trace.NewTracer(""), sendErr: errors.New("consumer gone")}
+		go manager.keepAliveLoop(session, lostChannel)
+		assert.Eventually(t, session.Suspended, 2*time.Second, 5*time.Millisecond)
+
+		if resume {
+			// the session is resumed over the p2p channel of another session manager.
+			newChannel := &mockP2PChannel{tracer: trace.NewTracer("")}
+			other := newManager(currentService, sessionStore, publisher, &mockBalanceTracker{})
+			other.config.KeepAlive = manager.config.KeepAlive
+			err = other.Resume(identity.FromAddress("other"), string(session.ID), newChannel)
+			assert.Exactly(t, ErrorWrongSessionOwner, err)
+			err = other.Resume(consumerID, string(session.ID), newChannel)
+			assert.NoError(t, err)
+			assert.False(t, session.Suspended())
+
+			channel, exchangeChan := engine.bound()
+			assert.Equal(t, newChannel, channel)
+			assert.Equal(t, other.paymentEngineChan, exchangeChan)
+			assert.Equal(t, []string{string(session.ID)}, other.channelSessionIDs())
+
+			assert.Eventually(t, func() bool {
+				return newChannel.getSends() > 0
+			}, 2*time.Second, 5*time.Millisecond)
+			time.Sleep(150 * time.Millisecond)
+			_, found := sessionStore.Find(session.ID)
+			assert.True(t, found)
+			session.Close()
+			assert.Empty(t, other.channelSessionIDs())
+		} else {
+			select {
+			case <-session.Done():
+			case <-time.After(2 * time.Second):
+				t.Fatal("session was not closed after the grace period")
+			}
+			_, found := sessionStore.Find(session.ID)
+			assert.False(t, found)
+		}
+	}
+}
+
+func TestManager_Resume_RequiresRebindablePaymentEngine(t *testing.T) {
+	publisher := mocks.NewEventBus()
+	sessionStore := NewSessionPool(publisher)
+	manager := newManager(currentService, sessionStore, publisher, &mockBalanceTracker{})
+
+	session, err := NewSession(currentService, &pb.SessionRequest{Consumer: &pb.ConsumerInfo{Id: consumerID.Address}}, trace.NewTracer(""))
+	assert.NoError(t, err)
+	session.setPaymentEngine(&mockBalanceTracker{})
+	sessionStore.Add(session)
+	session.suspend(time.Minute)
+	defer session.Close()
+
+	err = manager.Resume(consumerID, string(session.ID), &mockP2PChannel{tracer: trace.NewTracer("")})
+	assert.Exactly(t, ErrorSessionNotResumable, err)
+	assert.True(t, session.Suspended())
+}
+
+func TestManager_Resume_RebindsServiceConn(t *testing.T) {
+	for _, rebindErr := range []error{nil, errors.New("port is gone")} {
+		svc := &mockConnRebindingService{rebindErr: rebindErr}
+		instance := NewInstance(
+			identity.FromAddress(currentProposal.ProviderID),
+			currentProposal.ServiceType,
+			struct{}{},
+			currentProposal,
+			servicestate.Running,
+			svc,
+			policy.NewRepository(),
+			&mockDiscovery{},
+		)
+		publisher := mocks.NewEventBus()
+		sessionStore := NewSessionPool(publisher)
+		manager := newManager(instance, sessionStore, publisher, &mockBalanceTracker{})
+
+		session, err := NewSession(instance, &pb.SessionRequest{Consumer: &pb.ConsumerInfo{Id: consumerID.Address}}, trace.NewTracer(""))
+		assert.NoError(t, err)
+		session.setPaymentEngine(&mockRebindablePaymentEngine{})
+		sessionStore.Add(session)
+		session.suspend(time.Minute)
+
+		err = manager.Resume(consumerID, string(session.ID), &mockP2PChannel{tracer: trace.NewTracer("")})
+		assert.Equal(t, []string{string(session.ID)}, svc.rebound)
+		if rebindErr == nil {
+			assert.NoError(t, err)
+			session.Close()
+		} else {
+			assert.True(t, errors.Is(err, rebindErr))
+			select {
+			case <-session.Done():
+			default:
+				t.Fatal("session was not closed after the failed rebind")
+			}
+		}
+	}
+}
+
+func TestManager_Start_UsesIDGenerator(t *testing.T) {
+	sessionRequest := &pb.SessionRequest{
+		Consumer: &pb.ConsumerInfo{
+			Id:       consumerID.Address,
+			HermesID: hermesID.String(),
+		},
+		ProposalID: int64(currentProposalID),
+	}
+
+	publisher := mocks.NewEventBus()
+	sessionStore := NewSessionPool(publisher)
+	manager := newManager(currentService, sessionStore, publisher, &mockBalanceTracker{})
+
+	var calls int
+	manager.idGenerator = func() (session.ID, error) {
+		calls++
+		return session.ID(fmt.Sprintf("session-%d", calls)), nil
+	}
+	resp, err := manager.Start(sessionRequest)
+	assert.NoError(t, err)
+	assert.Equal(t, "session-1", resp.ID)
+	assert.Equal(t, 1, calls)
+
+	var engineCreated bool
+	manager.paymentEngineFactory = func(_, _ identity.Identity, _ int64, _ common.Address, _ string, _ chan crypto.ExchangeMessage) (PaymentEngine, error) {
+		engineCreated = true
+		return &mockBalanceTracker{}, nil
+	}
+	manager.idGenerator = func() (session.ID, error) {
+		return "", errors.New("out of ids")
+	}
+	_, err = manager.Start(sessionRequest)
+	assert.EqualError(t, err, "cannot generate session id: out of ids")
+	assert.False(t, engineCreated)
+}
+
+func TestManager_Start_UsesSessionFactory(t *testing.T) {
+	publisher := mocks.NewEventBus()
+	sessionStore := NewSessionPool(publisher)
+	manager := newManager(currentService, sessionStore, publisher, &mockBalanceTracker{})
+	manager.idGenerator = func() (session.ID, error) {
+		return "", errors.New("id generator must not be used")
+	}
+
+	var calls int
+	manager.sessionFactory = func() (*Session, error) {
+		calls++
+		return &Session{ID: "fixed-session", Metadata: map[string]string{"preset": "true"}}, nil
+	}
+	resp, err := manager.Start(&pb.SessionRequest{
+		Consumer: &pb.ConsumerInfo{
+			Id:       consumerID.Address,
+			HermesID: hermesID.String(),
+		},
+		ProposalID: int64(currentProposalID),
+	})
+	assert.NoError(t, err)
+	defer manager.Destroy(consumerID, resp.ID)
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, "fixed-session", resp.ID)
+
+	stored, ok := sessionStore.Find("fixed-session")
+	assert.True(t, ok)
+	assert.Equal(t, "true", stored.Metadata["preset"])
+	assert.Equal(t, consumerID, stored.ConsumerID)
+	assert.Equal(t, hermesID, stored.HermesID)
+
+	manager.sessionFactory = func() (*Session, error) {
+		return nil, errors.New("no sessions")
+	}
+	_, err = manager.Start(&pb.SessionRequest{
+		Consumer: &pb.ConsumerInfo{
+			Id:       "0x0000000000000000000000000000000000000009",
+			HermesID: hermesID.String(),
+		},
+		ProposalID: int64(currentProposalID),
+	})
+	assert.EqualError(t, err, "cannot create session: no sessions")
+}
+
+func TestManager_Pause(t *testing.T) {
+	publisher := mocks.NewEventBus()
+	sessionStore := NewSessionPool(publisher)
+	engine := &mockPausablePaymentEngine{}
+	manager := newManager(currentService, sessionStore, publisher, engine)
+	manager.config.MaxPauseDuration = 100 * time.Millisecond
+
+	resp, err := manager.Start(&pb.SessionRequest{
+		Consumer: &pb.ConsumerInfo{
+			Id:       consumerID.Address,
+			HermesID: hermesID.String(),
+		},
+		ProposalID: int64(currentProposalID),
+	})
+	assert.NoError(t, err)
+	session, _ := sessionStore.Find(session.ID(resp.ID))
+
+	assert.Exactly(t, ErrorSessionNotPaused, manager.Unpause(consumerID, resp.ID))
+	assert.Exactly(t, ErrorWrongSessionOwner, manager.Pause(identity.FromAddress("other"), resp.ID))
+
+	assert.NoError(t, manager.Pause(consumerID, resp.ID))
+	assert.True(t, session.Paused())
+	assert.True(t, engine.isPaused())
+	assert.Exactly(t, ErrorSessionAlreadyPaused, manager.Pause(consumerID, resp.ID))
+
+	assert.NoError(t, manager.Unpause(consumerID, resp.ID))
+	assert.False(t, session.Paused())
+	assert.False(t, engine.isPaused())
+
+	// the session is destroyed if it stays paused for too long.
+	assert.NoError(t, manager.Pause(consumerID, resp.ID))
+	select {
+	case <-session.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("paused session was not destroyed")
+	}
+	_, found := sessionStore.Find(session.ID)
+	assert.False(t, found)
+}
+
+func TestManager_Destroy_Errors(t *testing.T) {
+	publisher := mocks.NewEventBus()
+	sessionStore := NewSessionPool(publisher)
+	manager := newManager(currentService, sessionStore, publisher, &mockBalanceTracker{})
+
+	err := manager.Destroy(consumerID, "unknown")
+	assert.True(t, errors.Is(err, ErrorSessionNotExists))
+	var notExists *SessionNotExistsError
+	assert.True(t, errors.As(err, &notExists))
+	assert.Equal(t, "unknown", notExists.SessionID)
+	assert.False(t, notExists.Destroyed)
+
+	resp, err := manager.Start(&pb.SessionRequest{
+		Consumer: &pb.ConsumerInfo{
+			Id:       consumerID.Address,
+			HermesID: hermesID.String(),
+		},
+		ProposalID: int64(currentProposalID),
+	})
+	assert.NoError(t, err)
+
+	err = manager.Destroy(identity.FromAddress("other"), resp.ID)
+	assert.True(t, errors.Is(err, ErrorWrongSessionOwner))
+	var wrongOwner *WrongSessionOwnerError
+	assert.True(t, errors.As(err, &wrongOwner))
+	assert.Equal(t, resp.ID, wrongOwner.SessionID)
+	assert.Equal(t, consumerID, wrongOwner.Owner)
+
+	assert.NoError(t, manager.Destroy(consumerID, resp.ID))
+
+	err = manager.Destroy(consumerID, resp.ID)
+	assert.True(t, errors.Is(err, ErrorSessionNotExists))
+	assert.True(t, errors.As(err, &notExists))
+	assert.True(t, notExists.Destroyed)
+}
+
+func TestManager_Destroy_Concurrent(t *testing.T) {
+	publisher := mocks.NewEventBus()
+	sessionStore := NewSessionPool(publisher)
+	manager := newManager(currentService, sessionStore, publisher, &mockBalanceTracker{})
+
+	resp, err := manager.Start(&pb.SessionRequest{
+		Consumer: &pb.ConsumerInfo{
+			Id:       consumerID.Address,
+			HermesID: hermesID.String(),
+		},
+		ProposalID: int64(currentProposalID),
+	})
+	assert.NoError(t, err)
+	started, found := sessionStore.Find(session.ID(resp.ID))
+	assert.True(t, found)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			err := manager.Destroy(consumerID, resp.ID)
+			if err != nil {
+				assert.True(t, errors.Is(err, ErrorSessionNotExists))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			started.Close()
+		}()
+	}
+	wg.Wait()
+
+	<-started.Done()
+	_, found = sessionStore.Find(started.ID)
+	assert.False(t, found)
+}
+
+func TestManager_DestroyAll(t *testing.T) {
+	publisher := mocks.NewEventBus()
+	sessionStore := NewSessionPool(publisher)
+	manager := newManager(currentService, sessionStore, publisher, &mockBalanceTracker{})
+
+	_, err := manager.Start(&pb.SessionRequest{
+		Consumer: &pb.ConsumerInfo{
+			Id:       consumerID.Address,
+			HermesID: hermesID.String(),
+		},
+		ProposalID: int64(currentProposalID),
+	})
+	assert.NoError(t, err)
+
+	otherService, _ := NewSession(&Instance{ID: "other"}, &pb.SessionRequest{}, trace.NewTracer(""))
+	sessionStore.Add(otherService)
+
+	failing, _ := NewSession(currentService, &pb.SessionRequest{}, trace.NewTracer(""))
+	failing.addCleanup(func() error {
+		return errors.New("cleanup failed")
+	})
+	sessionStore.Add(failing)
+
+	err = manager.DestroyAll()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "cleanup failed")
+
+	assert.Len(t, manager.ActiveSessions(), 0)
+	_, found := sessionStore.Find(otherService.ID)
+	assert.True(t, found)
+	select {
+	case <-failing.Done():
+	default:
+		t.Fatal("session was not closed")
+	}
+
+	assert.NoError(t, manager.DestroyAll())
+}
+
+func TestManager_Start_AcceptsPreviousProposalWithinWindow(t *testing.T) {
+	service := NewInstance(
+		identity.FromAddress(currentProposal.ProviderID),
+		currentProposal.ServiceType,
+		struct{}{},
+		currentProposal,
+		servicestate.Running,
+		&mockService{},
+		policy.NewRepository(),
+		&mockDiscovery{},
+	)
+	updatedProposal := currentProposal
+	updatedProposal.ID = currentProposalID + 1
+	service.UpdateProposal(updatedProposal)
+
+	publisher := mocks.NewEventBus()
+	sessionStore := NewSessionPool(publisher)
+	manager := newManager(service, sessionStore, publisher, &mockBalanceTracker{})
+
+	request := &pb.SessionRequest{
+		Consumer: &pb.ConsumerInfo{
+			Id:       consumerID.Address,
+			HermesID: hermesID.String(),
+		},
+		ProposalID: int64(currentProposalID),
+	}
+	resp, err := manager.Start(request)
+	assert.NoError(t, err)
+
+	started, found := sessionStore.Find(session.ID(resp.ID))
+	assert.True(t, found)
+	assert.Equal(t, currentProposal, started.Proposal)
+	assert.NoError(t, manager.Destroy(consumerID, resp.ID))
+
+	// the previous proposal is rejected once the window expires.
+	service.proposalLock.Lock()
+	service.proposalUpdatedAt = time.Now().Add(-manager.config.PreviousProposalWindow - time.Second)
+	service.proposalLock.Unlock()
+
+	_, err = manager.Start(request)
+	assert.Equal(t, ErrorInvalidProposal, err)
+
+	request.ProposalID = int64(updatedProposal.ID)
+	resp, err = manager.Start(request)
+	assert.NoError(t, err)
+	started, found = sessionStore.Find(session.ID(resp.ID))
+	assert.True(t, found)
+	assert.Equal(t, updatedProposal, started.Proposal)
+}
+
+func TestManager_Shutdown(t *testing.T) {
+	newShutdownManager := func(steps *shutdownSteps) (*SessionManager, *SessionPool) {
+		service := NewInstance(
+			identity.FromAddress(currentProposal.ProviderID),
+			currentProposal.ServiceType,
+			struct{}{},
+			currentProposal,
+			servicestate.Running,
+			&mockService{},
+			policy.NewRepository(),
+			&mockDiscovery{},
+		)
+		publisher := mocks.NewEventBus()
+		sessionStore := NewSessionPool(publisher)
+		manager := newManager(service, sessionStore, publisher, &mockShutdownPaymentEngine{steps: steps})
+		manager.config.ShutdownDrainTimeout = 50 * time.Millisecond
+
+		_, err := manager.Start(&pb.SessionRequest{
+			Consumer: &pb.ConsumerInfo{
+				Id:       consumerID.Address,
+				HermesID: hermesID.String(),
+			},
+			ProposalID: int64(currentProposalID),
+		})
+		assert.NoError(t, err)
+		return manager, sessionStore
+	}
+
+	t.Run("drains the promises before destroying the sessions", func(t *testing.T) {
+		steps := &shutdownSteps{}
+		manager, sessionStore := newShutdownManager(steps)
+		sessionIDs := []string{string(manager.ActiveSessions()[0].ID)}
+		drainer := &mockPromiseDrainer{steps: steps, drain: func(ctx context.Context) error {
+			// the sessions are still there while their promises are drained.
+			assert.Len(t, sessionStore.GetAll(), 1)
+			return nil
+		}}
+
+		assert.NoError(t, manager.Shutdown(context.Background(), drainer))
+		assert.Equal(t, sessionIDs, drainer.sessionIDs)
+		assert.Equal(t, []string{"engine stopped", "drained"}, steps.get()[:2])
+		assert.Empty(t, sessionStore.GetAll())
+	})
+
+	t.Run("destroys the sessions once the drain times out", func(t *testing.T) {
+		steps := &shutdownSteps{}
+		manager, sessionStore := newShutdownManager(steps)
+		drainer := &mockPromiseDrainer{steps: steps, drain: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}}
+
+		err := manager.Shutdown(context.Background(), drainer)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), context.DeadlineExceeded.Error())
+		assert.Empty(t, sessionStore.GetAll())
+	})
+}
+
+type shutdownSteps struct {
+	lock  sync.Mutex
+	steps []string
+}
+
+func (s *shutdownSteps) add(step string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.steps = append(s.steps, step)
+}
+
+func (s *shutdownSteps) get() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string{}, s.steps...)
+}
+
+type mockShutdownPaymentEngine struct {
+	mockBalanceTracker
+	steps *shutdownSteps
+}
+
+func (m *mockShutdownPaymentEngine) Stop() {
+	m.steps.add("engine stopped")
+}
+
+type mockPromiseDrainer struct {
+	steps      *shutdownSteps
+	drain      func(ctx context.Context) error
+	sessionIDs []string
+}
+
+func (m *mockPromiseDrainer) DrainSessions(ctx context.Context, sessionIDs []string) error {
+	m.sessionIDs = sessionIDs
+	err := m.drain(ctx)
+	m.steps.add("drained")
+	return err
+}
+
+func TestManager_Acknowledge_RejectsDestroyedSession(t *testing.T) {
+	publisher := mocks.NewEventBus()
+	sessionStore := NewSessionPool(publisher)
+	manager := newManager(currentService, sessionStore, publisher, &mockBalanceTracker{})
+
+	// the session is torn down by the keep-alive while the consumer acknowledges it.
+	session, err := NewSession(currentService, &pb.SessionRequest{Consumer: &pb.ConsumerInfo{Id: consumerID.Address}}, trace.NewTracer(""))
+	assert.NoError(t, err)
+	sessionStore.Add(session)
+	session.Close()
+
+	err = manager.Acknowledge(consumerID, string(session.ID))
+	assert.True(t, errors.Is(err, ErrorInvalidStateTransition), err)
+	assert.Equal(t, StateDestroyed, session.State())
+	assert.Equal(t, uint64(0), manager.Stats().Acknowledged)
+	for _, e := range publisher.GetEventHistory() {
+		if e.Topic == sessionEvent.AppTopicSession {
+			assert.NotEqual(t, sessionEvent.AcknowledgedStatus, e.Event.(sessionEvent.AppEventSession).Status)
+		}
+	}
+}
+
+func TestManager_PendingStarts(t *testing.T) {
+	publisher := mocks.NewEventBus()
+	sessionStore := NewSessionPool(publisher)
+	engine := mockBlockingPaymentEngine{paid: make(chan struct{})}
+	manager := newManager(currentService, sessionStore, publisher, engine)
+	assert.Empty(t, manager.PendingStarts())
+
+	started := make(chan *pb.SessionResponse)
+	go func() {
+		resp, err := manager.Start(&pb.SessionRequest{
+			Consumer: &pb.ConsumerInfo{
+				Id:       consumerID.Address,
+				HermesID: hermesID.String(),
+			},
+			ProposalID: int64(currentProposalID),
+		})
+		assert.NoError(t, err)
+		started <- &resp
+	}()
+
+	assert.Eventually(t, func() bool { return len(manager.PendingStarts()) == 1 }, 2*time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	pending := manager.PendingStarts()[0]
+	assert.Equal(t, consumerID, pending.ConsumerID)
+	assert.Equal(t, currentService.Type, pending.ServiceType)
+	assert.NotEmpty(t, pending.SessionID)
+	assert.True(t, pending.Elapsed >= 10*time.Millisecond, pending.Elapsed)
+
+	// the starts are seen from the other p2p channels of the service too.
+	other := newManager(currentService, sessionStore, publisher, engine)
+	assert.Len(t, other.PendingStarts(), 1)
+	assert.Equal(t, pending.SessionID, other.PendingStarts()[0].SessionID)
+
+	close(engine.paid)
+	resp := <-started
+	defer manager.Destroy(consumerID, resp.ID)
+	assert.Equal(t, pending.SessionID, resp.ID)
+	assert.Empty(t, manager.PendingStarts())
+	assert.Empty(t, other.PendingStarts())
+}
+
+func TestManager_ForceSettleAndDestroy(t *testing.T) {
+	final := FinalPayment{
+		R: []byte{0x1},
+		ExchangeMessage: crypto.ExchangeMessage{
+			Promise:        crypto.Promise{Amount: big.NewInt(100)},
+			AgreementTotal: big.NewInt(100),
+		},
+	}
+	newSettleManager := func(engine PaymentEngine) (*SessionManager, *SessionPool, string) {
+		publisher := mocks.NewEventBus()
+		sessionStore := NewSessionPool(publisher)
+		manager := newManager(currentService, sessionStore, publisher, engine)
+		manager.config.ForceSettleTimeout = 50 * time.Millisecond
+
+		resp, err := manager.Start(&pb.SessionRequest{
+			Consumer: &pb.ConsumerInfo{
+				Id:       consumerID.Address,
+				HermesID: hermesID.String(),
+			},
+			ProposalID: int64(currentProposalID),
+		})
+		assert.NoError(t, err)
+		return manager, sessionStore, resp.ID
+	}
+
+	t.Run("settles the final payment before destroying the session", func(t *testing.T) {
+		steps := &shutdownSteps{}
+		manager, sessionStore, sessionID := newSettleManager(&mockFinalizingPaymentEngine{
+			mockShutdownPaymentEngine: mockShutdownPaymentEngine{steps: steps},
+			final:                     final,
+		})
+		submitter := &mockPromiseSubmitter{steps: steps, submit: func(ctx context.Context) error {
+			// the session is still there while its final promise is requested.
+			assert.Len(t, sessionStore.GetAll(), 1)
+			return nil
+		}}
+
+		assert.NoError(t, manager.ForceSettleAndDestroy(context.Background(), sessionID, submitter))
+		assert.Equal(t, []string{"final payment", "promise submitted", "engine stopped"}, steps.get())
+		assert.Equal(t, final.ExchangeMessage, submitter.em)
+		assert.Equal(t, final.R, submitter.r)
+		assert.Equal(t, currentService.ProviderID, submitter.providerID)
+		assert.Equal(t, sessionID, submitter.sessionID)
+		assert.Empty(t, sessionStore.GetAll())
+	})
+
+	t.Run("destroys the session once the settlement times out", func(t *testing.T) {
+		steps := &shutdownSteps{}
+		manager, sessionStore, sessionID := newSettleManager(&mockFinalizingPaymentEngine{
+			mockShutdownPaymentEngine: mockShutdownPaymentEngine{steps: steps},
+			final:                     final,
+		})
+		submitter := &mockPromiseSubmitter{steps: steps, submit: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}}
+
+		err := manager.ForceSettleAndDestroy(context.Background(), sessionID, submitter)
+		assert.Error(t, err)
+		assert.True(t, errors.Is(err, context.DeadlineExceeded), err)
+		assert.Empty(t, sessionStore.GetAll())
+	})
+
+	t.Run("destroys the session if the final payment fails", func(t *testing.T) {
+		steps := &shutdownSteps{}
+		paymentErr := errors.New("consumer did not pay")
+		manager, sessionStore, sessionID := newSettleManager(&mockFinalizingPaymentEngine{
+			mockShutdownPaymentEngine: mockShutdownPaymentEngine{steps: steps},
+			err:                       paymentErr,
+		})
+		submitter := &mockPromiseSubmitter{steps: steps, submit: func(ctx context.Context) error { return nil }}
+
+		err := manager.ForceSettleAndDestroy(context.Background(), sessionID, submitter)
+		assert.True(t, errors.Is(err, paymentErr), err)
+		assert.Equal(t, []string{"final payment", "engine stopped"}, steps.get())
+		assert.Empty(t, sessionStore.GetAll())
+	})
+
+	t.Run("refuses the engines without the final payment", func(t *testing.T) {
+		manager, sessionStore, sessionID := newSettleManager(&mockBalanceTracker{})
+		submitter := &mockPromiseSubmitter{steps: &shutdownSteps{}, submit: func(ctx context.Context) error { return nil }}
+
+		err := manager.ForceSettleAndDestroy(context.Background(), sessionID, submitter)
+		assert.Equal(t, ErrorFinalPaymentNotSupported, err)
+		assert.Empty(t, sessionStore.GetAll())
+	})
+
+	t.Run("returns an error for unknown sessions", func(t *testing.T) {
+		manager, _, _ := newSettleManager(&mockBalanceTracker{})
+		err := manager.ForceSettleAndDestroy(context.Background(), "unknown", &mockPromiseSubmitter{})
+		assert.True(t, errors.Is(err, ErrorSessionNotExists), err)
+	})
+}
+
+type mockFinalizingPaymentEngine struct {
+	mockShutdownPaymentEngine
+	final FinalPayment
+	err   error
+}
+
+func (m *mockFinalizingPaymentEngine) FinalPayment(_ context.Context) (FinalPayment, error) {
+	m.steps.add("final payment")
+	return m.final, m.err
+}
+
+type mockPromiseSubmitter struct {
+	steps      *shutdownSteps
+	submit     func(ctx context.Context) error
+	r          []byte
+	em         crypto.ExchangeMessage
+	providerID identity.Identity
+	sessionID  string
+}
+
+func (m *mockPromiseSubmitter) SubmitPromise(ctx context.Context, r []byte, em crypto.ExchangeMessage, providerID identity.Identity, sessionID string) error {
+	m.r, m.em, m.providerID, m.sessionID = r, em, providerID, sessionID
+	err := m.submit(ctx)
+	m.steps.add("promise submitted")
+	return err
+}
+
+func TestManager_UpdateProposal(t *testing.T) {
+	service := NewInstance(
+		identity.FromAddress(currentProposal.ProviderID),
+		currentProposal.ServiceType,
+		struct{}{},
+		currentProposal,
+		servicestate.Running,
+		&mockService{},
+		policy.NewRepository(),
+		&mockDiscovery{},
+	)
+	publisher := mocks.NewEventBus()
+	sessionStore := NewSessionPool(publisher)
+	manager := newManager(service, sessionStore, publisher, &mockBalanceTracker{})
+	manager.config.PreviousProposalWindow = 0
+	assert.Equal(t, currentProposal, manager.CurrentProposal())
+
+	request := &pb.SessionRequest{
+		Consumer: &pb.ConsumerInfo{
+			Id:       consumerID.Address,
+			HermesID: hermesID.String(),
+		},
+		ProposalID: int64(currentProposalID),
+	}
+	resp, err := manager.Start(request)
+	assert.NoError(t, err)
+	started, found := sessionStore.Find(session.ID(resp.ID))
+	assert.True(t, found)
+	assert.Equal(t, currentProposal, started.Proposal)
+	assert.NoError(t, manager.Destroy(consumerID, resp.ID))
+
+	updatedProposal := currentProposal
+	updatedProposal.ID = currentProposalID + 1
+	updatedProposal.PaymentMethod = mocks.DefaultPaymentMethod()
+
+	// the proposal can be read while it is being updated.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			manager.CurrentProposal()
+		}
+	}()
+	manager.UpdateProposal(updatedProposal)
+	<-done
+	assert.Equal(t, updatedProposal, manager.CurrentProposal())
+
+	_, err = manager.Start(request)
+	assert.Equal(t, ErrorInvalidProposal, err)
+
+	request.ProposalID = int64(updatedProposal.ID)
+	resp, err = manager.Start(request)
+	assert.NoError(t, err)
+	started, found = sessionStore.Find(session.ID(resp.ID))
+	assert.True(t, found)
+	assert.Equal(t, updatedProposal, started.Proposal)
+
+	// the other session managers of the service see the updated proposal too.
+	other := newManager(service, sessionStore, publisher, &mockBalanceTracker{})
+	assert.Equal(t, updatedProposal, other.CurrentProposal())
+}
+
+func TestManager_Start_RejectsTooManySessionsPerConsumer(t *testing.T) {
+	publisher := mocks.NewEventBus()
+	sessionStore := NewSessionPool(publisher)
+	manager := newManager(currentService, sessionStore, publisher, &mockBalanceTracker{})
+	manager.config.MaxSessionsPerConsumer = 2
+
+	request := &pb.SessionRequest{
+		Consumer: &pb.ConsumerInfo{
+			Id:       consumerID.Address,
+			HermesID: hermesID.String(),
+		},
+		ProposalID: int64(currentProposalID),
+	}
+	for _, serviceType := range []string{"wireguard", "scraping"} {
+		existing, _ := NewSession(&Instance{ID: ID(serviceType)}, request, trace.NewTracer(""))
+		existing.Proposal.ServiceType = serviceType
+		sessionStore.Add(existing)
+	}
+
+	_, err := manager.Start(request)
+	assert.Equal(t, ErrorTooManySessions, err)
+	assert.Len(t, manager.ActiveSessions(), 0)
+
+	manager.config.MaxSessionsPerConsumer = 3
+	_, err = manager.Start(request)
+	assert.NoError(t, err)
+
+	// restarting the same service replaces the stale session, so it is not counted.
+	_, err = manager.Start(request)
+	assert.NoError(t, err)
+}
+
+func TestManager_Start_MaxSessionDuration(t *testing.T) {
+	request := &pb.SessionRequest{
+		Consumer: &pb.ConsumerInfo{
+			Id:       consumerID.Address,
+			HermesID: hermesID.String(),
+		},
+		ProposalID: int64(currentProposalID),
+	}
+	expiredEvents := func(publisher *mocks.EventBus) int {
+		count := 0
+		for _, v := range publisher.GetEventHistory() {
+			if e, ok := v.Event.(sessionEvent.AppEventSession); ok && e.Status == sessionEvent.ExpiredStatus {
+				count++
+			}
+		}
+		return count
+	}
+
+	publisher := mocks.NewEventBus()
+	sessionStore := NewSessionPool(publisher)
+	manager := newManager(currentService, sessionStore, publisher, &mockBalanceTracker{})
+	manager.config.MaxSessionDuration = 50 * time.Millisecond
+
+	resp, err := manager.Start(request)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		_, found := sessionStore.Find(session.ID(resp.ID))
+		return !found && expiredEvents(publisher) == 1
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// destroying the session before it expires cancels the expiry.
+	publisher = mocks.NewEventBus()
+	sessionStore = NewSessionPool(publisher)
+	manager = newManager(currentService, sessionStore, publisher, &mockBalanceTracker{})
+	manager.config.MaxSessionDuration = 50 * time.Millisecond
+
+	resp, err = manager.Start(request)
+	assert.NoError(t, err)
+	assert.NoError(t, manager.Destroy(consumerID, resp.ID))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, expiredEvents(publisher))
+}
+
+func TestManager_Start_ValidatesCurrency(t *testing.T) {
+	proposal := currentProposal
+	proposal.PaymentMethod = mocks.DefaultPaymentMethod()
+	service := NewInstance(
+		identity.FromAddress(proposal.ProviderID),
+		proposal.ServiceType,
+		struct{}{},
+		proposal,
+		servicestate.Running,
+		&mockService{},
+		policy.NewRepository(),
+		&mockDiscovery{},
+	)
+	request := &pb.SessionRequest{
+		Consumer: &pb.ConsumerInfo{
+			Id:       consumerID.Address,
+			HermesID: hermesID.String(),
+		},
+		ProposalID: int64(currentProposalID),
+	}
+	chainID := config.GetInt64(config.FlagChainID)
+
+	tests := map[string]struct {
+		currencies map[int64][]money.Currency
+		wantErr    bool
+	}{
+		"matching currency": {
+			currencies: map[int64][]money.Currency{chainID: {money.CurrencyMystt, money.CurrencyMyst}},
+		},
+		"mismatched currency": {
+			currencies: map[int64][]money.Currency{chainID: {money.CurrencyMystt}},
+			wantErr:    true,
+		},
+		"unknown chain": {
+			currencies: map[int64][]money.Currency{chainID + 1: {money.CurrencyMystt}},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			publisher := mocks.NewEventBus()
+			manager := newManager(service, NewSessionPool(publisher), publisher, &mockBalanceTracker{})
+			manager.config.ChainCurrencies = tt.currencies
+
+			_, err := manager.Start(request)
+			if !tt.wantErr {
+				assert.NoError(t, err)
+				return
+			}
+			assert.True(t, errors.Is(err, ErrorUnsupportedCurrency))
+			assert.Equal(t, &UnsupportedCurrencyError{Currency: money.CurrencyMyst, ChainID: chainID}, err)
+		})
+	}
+}
+
+type MockNatEventTracker struct {
+}
+
+func (mnet *MockNatEventTracker) LastEvent() *event.Event {
+	return &event.Event{}
+}
+
+type mockNatEventGetter struct {
+	last *event.Event
+}
+
+func (m *mockNatEventGetter) LastEvent() *event.Event {
+	return m.last
+}
+
+func TestManager_Start_PublishesNATTraversal(t *testing.T) {
+	request := &pb.SessionRequest{
+		Consumer: &pb.ConsumerInfo{
+			Id:       consumerID.Address,
+			HermesID: hermesID.String(),
+		},
+		ProposalID: int64(currentProposalID),
+	}
+	createdTraversal := func(publisher *mocks.EventBus) (*sessionEvent.NATTraversalContext, bool) {
+		for _, v := range publisher.GetEventHistory() {
+			e, ok := v.Event.(sessionEvent.AppEventSession)
+			if ok && e.Status == sessionEvent.CreatedStatus {
+				return e.Session.NATTraversal, true
+			}
+		}
+		return nil, false
+	}
+
+	publisher := mocks.NewEventBus()
+	sessionStore := NewSessionPool(publisher)
+	manager := newManager(currentService, sessionStore, publisher, &mockBalanceTracker{})
+	manager.natEventGetter = &mockNatEventGetter{last: &event.Event{Stage: "hole_punching", Error: errors.New("timeout")}}
+
+	resp, err := manager.Start(request)
+	assert.NoError(t, err)
+
+	expected := &sessionEvent.NATTraversalContext{Stage: "hole_punching", Successful: false, Error: "timeout"}
+	started, _ := sessionStore.Find(session.ID(resp.ID))
+	assert.Equal(t, expected, started.NATTraversal)
+	traversal, found := createdTraversal(publisher)
+	assert.True(t, found)
+	assert.Equal(t, expected, traversal)
+
+	// traversal info is not available.
+	publisher = mocks.NewEventBus()
+	sessionStore = NewSessionPool(publisher)
+	manager = newManager(currentService, sessionStore, publisher, &mockBalanceTracker{})
+	manager.natEventGetter = &mockNatEventGetter{}
+
+	_, err = manager.Start(request)
+	assert.NoError(t, err)
+	traversal, found = createdTraversal(publisher)
+	assert.True(t, found)
+	assert.Nil(t, traversal)
+}
+
+func TestManager_Start_WithoutPaymentEngine(t *testing.T) {
+	publisher := mocks.NewEventBus()
+	sessionStore := NewSessionPool(publisher)
+	manager := NewSessionManager(
+		currentService,
+		sessionStore,
+		func(_, _ identity.Identity, _ int64, _ common.Address, _ string, _ chan crypto.ExchangeMessage) (PaymentEngine, error) {
+			return nil, nil
+		},
+		&MockNatEventTracker{},
+		publisher,
+		&mockP2PChannel{tracer: trace.NewTracer("Provider connect")},
+		DefaultConfig(),
+	)
+
+	_, err := manager.Start(&pb.SessionRequest{
+		Consumer: &pb.ConsumerInfo{
+			Id:       consumerID.Address,
+			HermesID: hermesID.String(),
+		},
+		ProposalID: int64(currentProposalID),
+	})
+	assert.Exactly(t, ErrorNoPaymentEngine, err)
+	assert.Empty(t, sessionStore.GetAll())
+}
+
+func TestManager_Start_WithoutNATEventGetter(t *testing.T) {
+	publisher := mocks.NewEventBus()
+	sessionStore := NewSessionPool(publisher)
+	manager := NewSessionManager(
+		currentService,
+		sessionStore,
+		func(_, _ identity.Identity, _ int64, _ common.Address, _ string, _ chan crypto.ExchangeMessage) (PaymentEngine, error) {
+			return &mockBalanceTracker{}, nil
+		},
+		nil,
+		publisher,
+		&mockP2PChannel{tracer: trace.NewTracer("Provider connect")},
+		DefaultConfig(),
+	)
+
+	resp, err := manager.Start(&pb.SessionRequest{
+		Consumer: &pb.ConsumerInfo{
+			Id:       consumerID.Address,
+			HermesID: hermesID.String(),
+		},
+		ProposalID: int64(currentProposalID),
+	})
+	assert.NoError(t, err)
+
+	started, found := sessionStore.Find(session.ID(resp.ID))
+	assert.True(t, found)
+	assert.Nil(t, started.NATTraversal)
+}
+
+func TestManager_Stats(t *testing.T) {
+	publisher := mocks.NewEventBus()
+	sessionStore := NewSessionPool(publisher)
+	manager := newManager(currentService, sessionStore, publisher, &mockBalanceTracker{})
+	request := &pb.SessionRequest{
+		Consumer: &pb.ConsumerInfo{
+			Id:       consumerID.Address,
+			HermesID: hermesID.String(),
+		},
+		ProposalID: int64(currentProposalID),
+	}
+
+	started, err := manager.Start(request)
+	assert.NoError(t, err)
+	assert.Equal(t, Stats{Started: 1, Active: 1}, manager.Stats())
+
+	assert.NoError(t, manager.Acknowledge(consumerID, started.ID))
+	assert.NoError(t, manager.Destroy(consumerID, started.ID))
+	assert.Equal(t, Stats{Started: 1, Acknowledged: 1, Destroyed: 1}, manager.Stats())
+
+	manager.paymentEngineFactory = func(_, _ identity.Identity, _ int64, _ common.Address, _ string, _ chan crypto.ExchangeMessage) (PaymentEngine, error) {
+		return &mockBalanceTracker{firstPaymentError: errors.New("timed out")}, nil
+	}
+	_, err = manager.Start(request)
+	assert.Error(t, err)
+	assert.Equal(t, Stats{Started: 1, Acknowledged: 1, Destroyed: 2, FirstInvoiceTimeouts: 1}, manager.Stats())
+}
+
+func TestManager_AcknowledgeSession_RejectsUnknown(t *testing.T) {
+	publisher := mocks.NewEventBus()
+	sessionStore := NewSessionPool(publisher)
+	manager := newManager(currentService, sessionStore, publisher, &mockBalanceTracker{})
+
+	err := manager.Acknowledge(consumerID, "")
+	assert.Exactly(t, err, ErrorSessionNotExists)
+}
+
+func TestManager_AcknowledgeSession_RejectsBadClient(t *testing.T) {
+	publisher := mocks.NewEventBus()
+	sessionStore := NewSessionPool(mocks.NewEventBus())
+	manager := newManager(currentService, sessionStore, publisher, &mockBalanceTracker{})
+
+	session, err := manager.Start(&pb.SessionRequest{
+		Consumer: &pb.ConsumerInfo{
+			Id:       consumerID.Address,
+			HermesID: hermesID.String(),
+		},
+		ProposalID: int64(currentProposalID),
+	})
+	assert.Nil(t, err)
+
+	err = manager.Acknowledge(identity.FromAddress("some other id"), string(session.ID))
+	assert.Exactly(t, ErrorWrongSessionOwner, err)
+}
+
+func TestManager_AcknowledgeSession_PublishesEvent(t *testing.T) {
+	publisher := mocks.NewEventBus()
+
+	sessionStore := NewSessionPool(publisher)
+	session, _ := NewSession(
+		currentService,
+		&pb.SessionRequest{Consumer: &pb.ConsumerInfo{Id: consumerID.Address}},
+		trace.NewTracer(""),
+	)
+	sessionStore.Add(session)
+
+	manager := newManager(currentService, sessionStore, publisher, &mockBalanceTracker{})
+
+	err := manager.Acknowledge(consumerID, string(session.ID))
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		// Check that state event with StateIPNotChanged status was called.
+		history := publisher.GetEventHistory()
+		for _, v := range history {
+			if v.Topic == sessionEvent.AppTopicSession && v.Event.(sessionEvent.AppEventSession).Status == sessionEvent.AcknowledgedStatus {
+				return true
+			}
+		}
+		return false
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// the consumer may repeat the acknowledgement.
+	assert.NoError(t, manager.Acknowledge(consumerID, string(session.ID)))
+	assert.Equal(t, StateAcknowledged, session.State())
+}
+
+func TestManager_KeepAlive_IgnoresFailuresDuringGracePeriod(t *testing.T) {
+	channel := &mockP2PChannel{
+		tracer:  trace.NewTracer(""),
+		sendErr: errors.New("consumer not ready"),
+	}
+	manager := newManager(currentService, NewSessionPool(mocks.NewEventBus()), mocks.NewEventBus(), &mockBalanceTracker{})
+	manager.config.KeepAlive = KeepAliveConfig{
+		SendInterval:       10 * time.Millisecond,
+		SendTimeout:        10 * time.Millisecond,
+		MaxSendErrCount:    2,
+		InitialGracePeriod: 200 * time.Millisecond,
+	}
+
+	session, err := NewSession(currentService, &pb.SessionRequest{Consumer: &pb.ConsumerInfo{Id: consumerID.Address}}, trace.NewTracer(""))
+	assert.NoError(t, err)
+	go manager.keepAliveLoop(session, channel)
+
+	assert.Eventually(t, func() bool {
+		return channel.getSends() > 2
+	}, 2*time.Second, 5*time.Millisecond)
+	assert.Equal(t, 0, channel.getCloses())
+
+	assert.Eventually(t, func() bool {
+		return channel.getCloses() == 1
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+type mockBrokenHandlerP2PChannel struct {
+	mockP2PChannel
+}
+
+func (m *mockBrokenHandlerP2PChannel) Handle(topic string, handler p2p.HandlerFunc) {
+	panic("handlers are not supported")
+}
+
+func TestManager_KeepAlive_HandlerRegistrationFailure(t *testing.T) {
+	publisher := mocks.NewEventBus()
+	sessionStore := NewSessionPool(publisher)
+	manager := newManager(currentService, sessionStore, publisher, &mockBalanceTracker{})
+
+	session, err := NewSession(currentService, &pb.SessionRequest{Consumer: &pb.ConsumerInfo{Id: consumerID.Address}}, trace.NewTracer(""))
+	assert.NoError(t, err)
+
+	manager.keepAliveLoop(session, &mockBrokenHandlerP2PChannel{})
+
+	select {
+	case <-session.Done():
+	default:
+		t.Fatal("session was not closed")
+	}
+
+	history := publisher.GetEventHistory()
+	assert.Len(t, history, 1)
+	failed := history[0].Event.(sessionEvent.AppEventSession)
+	assert.Equal(t, sessionEvent.FailedStatus, failed.Status)
+	assert.Equal(t, string(session.ID), failed.Session.ID)
+	assert.Contains(t, failed.Reason, "handlers are not supported")
+}
+
+func TestManager_KeepAlive_PublishesTimedOutEvent(t *testing.T) {
+	for _, failing := range []bool{true, false} {
+		channel := &mockP2PChannel{tracer: trace.NewTracer("")}
+		if failing {
+			channel.sendErr = errors.New("consumer gone")
+		}
+		publisher := mocks.NewEventBus()
+		manager := newManager(currentService, NewSessionPool(publisher), publisher, &mockBalanceTracker{})
+		manager.config.KeepAlive = KeepAliveConfig{
+			SendInterval:    5 * time.Millisecond,
+			SendTimeout:     5 * time.Millisecond,
+			MaxSendErrCount: 2,
+		}
+
+		session, err := NewSession(currentService, &pb.SessionRequest{Consumer: &pb.ConsumerInfo{Id: consumerID.Address}}, trace.NewTracer(""))
+		assert.NoError(t, err)
+		go manager.keepAliveLoop(session, channel)
+
+		assert.Eventually(t, func() bool {
+			if failing {
+				return channel.getCloses() == 1
+			}
+			return channel.getSends() > 3
+		}, 2*time.Second, 5*time.Millisecond)
+		session.Close()
+
+		var timedOut []sessionEvent.AppEventSession
+		for _, e := range publisher.GetEventHistory() {
+			if e.Topic != sessionEvent.AppTopicSession {
+				continue
+			}
+			if ev := e.Event.(sessionEvent.AppEventSession); ev.Status == sessionEvent.TimedOutStatus {
+				timedOut = append(timedOut, ev)
+			}
+		}
+
+		if failing {
+			assert.Len(t, timedOut, 1)
+			assert.Equal(t, string(session.ID), timedOut[0].Session.ID)
+			assert.NotEmpty(t, timedOut[0].Reason)
+		} else {
+			assert.Len(t, timedOut, 0)
+		}
+	}
+}
+
+type mockBlockingP2PChannel struct {
+	mockP2PChannel
+	sending  chan struct{}
+	returned chan struct{}
+}
+
+func (m *mockBlockingP2PChannel) Send(ctx context.Context, _ string, _ *p2p.Message) (*p2p.Message, error) {
+	close(m.sending)
+	<-ctx.Done()
+	close(m.returned)
+	return nil, ctx.Err()
+}
+
+func TestManager_KeepAlive_DestroyCancelsInFlightPing(t *testing.T) {
+	channel := &mockBlockingP2PChannel{sending: make(chan struct{}), returned: make(chan struct{})}
+	publisher := mocks.NewEventBus()
+	sessionStore := NewSessionPool(publisher)
+	manager := newManager(currentService, sessionStore, publisher, &mockBalanceTracker{})
+	manager.config.KeepAlive = KeepAliveConfig{
+		SendInterval:    time.Millisecond,
+		SendTimeout:     time.Minute,
+		MaxSendErrCount: 5,
+	}
+
+	session, err := NewSession(currentService, &pb.SessionRequest{Consumer: &pb.ConsumerInfo{Id: consumerID.Address}}, trace.NewTracer(""))
+	assert.NoError(t, err)
+	sessionStore.Add(session)
+	go manager.keepAliveLoop(session, channel)
+
+	select {
+	case <-channel.sending:
+	case <-time.After(2 * time.Second):
+		t.Fatal("keepalive ping was not sent")
+	}
+
+	assert.NoError(t, manager.Destroy(consumerID, string(session.ID)))
+
+	select {
+	case <-channel.returned:
+	case <-time.After(time.Second):
+		t.Fatal("in-flight keepalive ping was not cancelled")
+	}
+}
+
+type mockHealthProvider struct {
+	health Health
+}
+
+func (m *mockHealthProvider) Health() Health {
+	return m.health
+}
+
+type mockP2PContext struct {
+	request *p2p.Message
+	reply   *p2p.Message
+	err     error
+}
+
+func (m *mockP2PContext) Request() *p2p.Message {
+	return m.request
+}
+
+func (m *mockP2PContext) Error(err error) error {
+	m.err = err
+	return nil
+}
+
+func (m *mockP2PContext) OkWithReply(msg *p2p.Message) error {
+	m.reply = msg
+	return nil
+}
+
+func (m *mockP2PContext) OK() error {
+	return nil
+}
+
+func TestManager_KeepAlive_RepliesWithHealth(t *testing.T) {
+	publisher := mocks.NewEventBus()
+	sessionStore := NewSessionPool(publisher)
+	manager := newManager(currentService, sessionStore, publisher, &mockBalanceTracker{})
+
+	session, err := NewSession(currentService, &pb.SessionRequest{Consumer: &pb.ConsumerInfo{Id: consumerID.Address}}, trace.NewTracer(""))
+	assert.NoError(t, err)
+	sessionStore.Add(session)
+
+	otherService := NewInstance(identity.FromAddress(currentProposal.ProviderID), "other", struct{}{}, currentProposal, servicestate.Running, &mockService{}, policy.NewRepository(), &mockDiscovery{})
+	otherService.ID = "other"
+	otherSession, err := NewSession(otherService, &pb.SessionRequest{Consumer: &pb.ConsumerInfo{Id: consumerID.Address}}, trace.NewTracer(""))
+	assert.NoError(t, err)
+	sessionStore.Add(otherSession)
+
+	ping := p2p.ProtoMessage(&pb.P2PKeepAlivePing{SessionID: string(session.ID)})
+
+	// the pong carries no health without a health provider.
+	ctx := &mockP2PContext{request: ping}
+	assert.NoError(t, manager.handleKeepAlivePing(ctx))
+	var pong pb.P2PKeepAlivePong
+	assert.NoError(t, ctx.reply.UnmarshalProto(&pong))
+	assert.Equal(t, int32(0), pong.ActiveSessions)
+	assert.False(t, pong.Draining)
+
+	// only the sessions of the service are reported.
+	manager.healthProvider = ServiceSessionsHealth{Sessions: sessionStore, ServiceID: currentService.ID}
+	ctx = &mockP2PContext{request: ping}
+	assert.NoError(t, manager.handleKeepAlivePing(ctx))
+	assert.NoError(t, ctx.reply.UnmarshalProto(&pong))
+	assert.Equal(t, int32(1), pong.ActiveSessions)
+
+	manager.healthProvider = &mockHealthProvider{health: Health{Load: 0.5, ActiveSessions: 2, Draining: true}}
+	ctx = &mockP2PContext{request: ping}
+	assert.NoError(t, manager.handleKeepAlivePing(ctx))
+	assert.NoError(t, ctx.reply.UnmarshalProto(&pong))
+	assert.Equal(t, int32(2), pong.ActiveSessions)
+	assert.Equal(t, 0.5, pong.Load)
+	assert.True(t, pong.Draining)
+}
+
+func TestManager_KeepAlive_FlagsMalformedPings(t *testing.T) {
+	publisher := mocks.NewEventBus()
+	sessionStore := NewSessionPool(publisher)
+	manager := newManager(currentService, sessionStore, publisher, &mockBalanceTracker{})
+	manager.config.KeepAlive.MaxMalformedPings = 2
+
+	resp, err := manager.Start(&pb.SessionRequest{
+		Consumer: &pb.ConsumerInfo{
+			Id:       consumerID.Address,
+			HermesID: hermesID.String(),
+		},
+		ProposalID: int64(currentProposalID),
+	})
+	assert.NoError(t, err)
+	defer manager.Destroy(consumerID, resp.ID)
+
+	malformedEvents := func() []sessionEvent.AppEventMalformedKeepAlive {
+		var events []sessionEvent.AppEventMalformedKeepAlive
+		for _, e := range publisher.GetEventHistory() {
+			if e.Topic == sessionEvent.AppTopicMalformedKeepAlive {
+				events = append(events, e.Event.(sessionEvent.AppEventMalformedKeepAlive))
+			}
+		}
+		return events
+	}
+
+	for i := 0; i < 3; i++ {
+		ctx := &mockP2PContext{request: &p2p.Message{Data: []byte{0xff, 0xff, 0xff}}}
+		assert.NoError(t, manager.handleKeepAlivePing(ctx))
+		assert.Error(t, ctx.err)
+		assert.Contains(t, ctx.err.Error(), "malformed keepalive ping")
+		assert.Nil(t, ctx.reply)
+
+		if i == 0 {
+			assert.Empty(t, malformedEvents())
+		}
+	}
+
+	events := malformedEvents()
+	assert.Len(t, events, 1)
+	assert.Equal(t, string(currentService.ID), events[0].ServiceID)
+	assert.Equal(t, []string{resp.ID}, events[0].SessionIDs)
+	assert.Equal(t, uint64(2), events[0].Count)
+	assert.Error(t, events[0].Error)
+	assert.Equal(t, uint64(3), manager.Stats().MalformedPings)
+
+	// well formed pings are still replied to.
+	ctx := &mockP2PContext{request: p2p.ProtoMessage(&pb.P2PKeepAlivePing{SessionID: resp.ID})}
+	assert.NoError(t, manager.handleKeepAlivePing(ctx))
+	assert.NoError(t, ctx.err)
+	assert.NotNil(t, ctx.reply)
+}
+
+func TestManager_KeepAlive_NegotiatesCompactPings(t *testing.T) {
+	tests := []struct {
+		name           string
+		consumerOffers bool
+		providerAllows bool
+		wantCompact    bool
+	}{
+		{name: "both sides support compact pings", consumerOffers: true, providerAllows: true, wantCompact: true},
+		{name: "falls back to proto with a non-capable consumer", consumerOffers: false, providerAllows: true, wantCompact: false},
+		{name: "falls back to proto if the provider disallows compact pings", consumerOffers: true, providerAllows: false, wantCompact: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			publisher := mocks.NewEventBus()
+			sessionStore := NewSessionPool(publisher)
+			manager := newManager(currentService, sessionStore, publisher, &mockBalanceTracker{})
+			manager.config.KeepAlive.SendInterval = time.Millisecond
+			manager.config.KeepAlive.CompactPings = tt.providerAllows
+			channel := manager.channel.(*mockP2PChannel)
+
+			resp, err := manager.Start(&pb.SessionRequest{
+				Consumer: &pb.ConsumerInfo{
+					Id:               consumerID.Address,
+					HermesID:         hermesID.String(),
+					CompactKeepAlive: tt.consumerOffers,
+				},
+				ProposalID: int64(currentProposalID),
+			})
+			assert.NoError(t, err)
+			defer manager.Destroy(consumerID, resp.ID)
+			assert.Equal(t, tt.wantCompact, resp.CompactKeepAlive)
+
+			assert.Eventually(t, func() bool { return len(channel.sentMessages()) > 0 }, 2*time.Second, time.Millisecond)
+			ping := channel.sentMessages()[0]
+			if tt.wantCompact {
+				assert.Len(t, ping.Data, 17)
+			} else {
+				var protoPing pb.P2PKeepAlivePing
+				assert.NoError(t, ping.UnmarshalProto(&protoPing))
+				assert.Equal(t, resp.ID, protoPing.SessionID)
+			}
+
+			// the consumer pings are accepted in the negotiated format and always in proto.
+			ctx := &mockP2PContext{request: p2p.KeepAlivePingMessage(resp.ID, tt.wantCompact)}
+			assert.NoError(t, manager.handleKeepAlivePing(ctx))
+			assert.NoError(t, ctx.err)
+			assert.NotNil(t, ctx.reply)
+
+			ctx = &mockP2PContext{request: p2p.KeepAlivePingMessage(resp.ID, false)}
+			assert.NoError(t, manager.handleKeepAlivePing(ctx))
+			assert.NoError(t, ctx.err)
+		})
+	}
+}
+
+func TestKeepAliveConfig_nextSendInterval(t *testing.T) {
+	config := KeepAliveConfig{SendInterval: time.Second}
+	assert.Equal(t, time.Second, config.nextSendInterval())
+
+	config.SendIntervalJitter = 100 * time.Millisecond
+	for i := 0; i < 100; i++ {
+		interval := config.nextSendInterval()
+		assert.True(t, interval >= 900*time.Millisecond, interval)
+		assert.True(t, interval <= 1100*time.Millisecond, interval)
+	}
+}
+
+func newManager(service *Instance, sessions Storage, publisher publisher, paymentEngine PaymentEngine) *SessionManager {
+	return NewSessionManager(
+		service,
+		sessions,
+		func(_, _ identity.Identity, _ int64, _ common.Address, _ string, _ chan crypto.ExchangeMessage) (PaymentEngine, error) {
+			return paymentEngine, nil
+		},
+		&MockNatEventTracker{},
+		publisher,
 		&mockP2PChannel{tracer: trace.NewTracer("Provider connect")},
 		DefaultConfig(),
 	)
 }
+
+func TestNewSessionManager_ConfigHooks(t *testing.T) {
+	publisher := mocks.NewEventBus()
+	sessionStore := NewSessionPool(publisher)
+	channel := &mockP2PChannel{tracer: trace.NewTracer("")}
+
+	manager := NewSessionManager(currentService, sessionStore, nil, nil, publisher, channel, DefaultConfig())
+	assert.NotNil(t, manager.idGenerator)
+	assert.Equal(t, AllowAllConsumers{}, manager.consumerFilter)
+	assert.Nil(t, manager.healthProvider)
+	assert.Nil(t, manager.sessionFactory)
+
+	config := DefaultConfig()
+	config.IDGenerator = func() (session.ID, error) { return "generated", nil }
+	config.ConsumerFilter = &mockConsumerFilter{}
+	config.HealthProvider = &mockHealthProvider{}
+	config.SessionFactory = func() (*Session, error) {
+		return &Session{}, nil
+	}
+	manager = NewSessionManager(currentService, sessionStore, nil, nil, publisher, channel, config)
+	id, err := manager.idGenerator()
+	assert.NoError(t, err)
+	assert.Equal(t, session.ID("generated"), id)
+	assert.Equal(t, config.ConsumerFilter, manager.consumerFilter)
+	assert.Equal(t, config.HealthProvider, manager.healthProvider)
+	assert.NotNil(t, manager.sessionFactory)
+}
+
+func TestManager_AcknowledgeSession_NotBlockedByStart(t *testing.T) {
+	publisher := mocks.NewEventBus()
+	sessionStore := NewSessionPool(publisher)
+	existing, _ := NewSession(
+		currentService,
+		&pb.SessionRequest{Consumer: &pb.ConsumerInfo{Id: consumerID.Address}},
+		trace.NewTracer(""),
+	)
+	sessionStore.Add(existing)
+
+	engine := mockBlockingPaymentEngine{paid: make(chan struct{})}
+	manager := newManager(currentService, sessionStore, publisher, engine)
+
+	startErr := make(chan error)
+	go func() {
+		_, err := manager.Start(&pb.SessionRequest{
+			Consumer: &pb.ConsumerInfo{
+				Id:       identity.FromAddress("other").Address,
+				HermesID: hermesID.String(),
+			},
+			ProposalID: int64(currentProposalID),
+		})
+		startErr <- err
+	}()
+
+	// wait for the start to reach the first invoice wait.
+	assert.Eventually(t, func() bool {
+		return len(sessionStore.GetAll()) == 2
+	}, 2*time.Second, 10*time.Millisecond)
+
+	acknowledged := make(chan error)
+	go func() {
+		acknowledged <- manager.Acknowledge(consumerID, string(existing.ID))
+	}()
+	select {
+	case err := <-acknowledged:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("acknowledge is blocked by the start in progress")
+	}
+
+	close(engine.paid)
+	assert.NoError(t, <-startErr)
+}
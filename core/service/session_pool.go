@@ -20,15 +20,29 @@ package service
 import (
 	"sync"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/mysteriumnetwork/node/identity"
 	"github.com/mysteriumnetwork/node/session"
 	"github.com/mysteriumnetwork/node/session/event"
 )
 
+// Storage keeps the sessions of the running services.
+type Storage interface {
+	Add(instance *Session)
+	GetAll() []*Session
+	List() []SessionInfo
+	Find(id session.ID) (*Session, bool)
+	FindBy(opts FindOpts) (*Session, bool)
+	Remove(id session.ID)
+	WasRemoved(id session.ID) bool
+	RemoveForService(serviceID string)
+}
+
 // NewSessionPool initiates new session storage
 func NewSessionPool(publisher publisher) *SessionPool {
 	sm := &SessionPool{
 		sessions:  make(map[session.ID]*Session),
+		removed:   make(map[session.ID]struct{}),
 		lock:      sync.Mutex{},
 		publisher: publisher,
 	}
@@ -37,11 +51,16 @@ func NewSessionPool(publisher publisher) *SessionPool {
 
 // SessionPool maintains all current sessions in memory
 type SessionPool struct {
-	sessions  map[session.ID]*Session
-	lock      sync.Mutex
-	publisher publisher
+	sessions     map[session.ID]*Session
+	removed      map[session.ID]struct{}
+	removedOrder []session.ID
+	lock         sync.Mutex
+	publisher    publisher
 }
 
+// removedSessionsHistory is the number of removed session IDs remembered by the pool.
+const removedSessionsHistory = 1000
+
 // Add puts given session to storage and publishes a creation event.
 // Multiple sessions per peerID is possible in case different services are used
 func (sp *SessionPool) Add(instance *Session) {
@@ -69,6 +88,16 @@ func (sp *SessionPool) GetAll() []*Session {
 	return sessions
 }
 
+// List returns a snapshot of all sessions in storage, which is safe to use as the sessions change.
+func (sp *SessionPool) List() []SessionInfo {
+	all := sp.GetAll()
+	sessions := make([]SessionInfo, len(all))
+	for i, instance := range all {
+		sessions[i] = instance.info()
+	}
+	return sessions
+}
+
 // Find returns underlying session instance
 func (sp *SessionPool) Find(id session.ID) (*Session, bool) {
 	sp.lock.Lock()
@@ -82,6 +111,10 @@ func (sp *SessionPool) Find(id session.ID) (*Session, bool) {
 type FindOpts struct {
 	Peer        *identity.Identity
 	ServiceType string
+	// Metadata matches the sessions which have all of the given metadata key and value pairs.
+	Metadata map[string]string
+	// AccountantID matches the sessions paid through the given hermes.
+	AccountantID *common.Address
 }
 
 // FindBy returns a session by find options.
@@ -96,11 +129,26 @@ func (sp *SessionPool) FindBy(opts FindOpts) (*Session, bool) {
 		if opts.ServiceType != "" && opts.ServiceType != session.Proposal.ServiceType {
 			continue
 		}
+		if opts.AccountantID != nil && *opts.AccountantID != session.HermesID {
+			continue
+		}
+		if !matchesMetadata(session, opts.Metadata) {
+			continue
+		}
 		return session, true
 	}
 	return nil, false
 }
 
+func matchesMetadata(session *Session, metadata map[string]string) bool {
+	for key, value := range metadata {
+		if actual, ok := session.Metadata[key]; !ok || actual != value {
+			return false
+		}
+	}
+	return true
+}
+
 // Remove removes given session from underlying storage
 func (sp *SessionPool) Remove(id session.ID) {
 	sp.lock.Lock()
@@ -108,10 +156,32 @@ func (sp *SessionPool) Remove(id session.ID) {
 
 	if instance, found := sp.sessions[id]; found {
 		delete(sp.sessions, id)
+		sp.rememberRemoved(id)
 		go sp.publisher.Publish(event.AppTopicSession, instance.toEvent(event.RemovedStatus))
 	}
 }
 
+// WasRemoved returns true if the session with the given ID was recently removed from the pool.
+func (sp *SessionPool) WasRemoved(id session.ID) bool {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+
+	_, removed := sp.removed[id]
+	return removed
+}
+
+func (sp *SessionPool) rememberRemoved(id session.ID) {
+	if sp.removed == nil {
+		sp.removed = make(map[session.ID]struct{})
+	}
+	sp.removed[id] = struct{}{}
+	sp.removedOrder = append(sp.removedOrder, id)
+	if len(sp.removedOrder) > removedSessionsHistory {
+		delete(sp.removed, sp.removedOrder[0])
+		sp.removedOrder = sp.removedOrder[1:]
+	}
+}
+
 // RemoveForService removes all sessions which belong to given service
 func (sp *SessionPool) RemoveForService(serviceID string) {
 	sessions := sp.GetAll()
@@ -0,0 +1,159 @@
+/*
+ * Copyright (C) 2026 The "MysteriumNetwork/node" Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/asdine/storm/v3"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/mysteriumnetwork/node/identity"
+	"github.com/mysteriumnetwork/node/market"
+	"github.com/mysteriumnetwork/node/session"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const sessionBucketName = "provider_sessions"
+
+type persistentStorage interface {
+	Store(bucket string, data interface{}) error
+	GetAllFrom(bucket string, data interface{}) error
+	Delete(bucket string, data interface{}) error
+}
+
+// PersistentSessionPool is a session pool which keeps a copy of its sessions in the persistent storage,
+// so that the sessions which were active before a restart can be reconciled.
+type PersistentSessionPool struct {
+	*SessionPool
+	bolt persistentStorage
+}
+
+// NewPersistentSessionPool returns a new instance of the persistent session pool.
+func NewPersistentSessionPool(publisher publisher, bolt persistentStorage) *PersistentSessionPool {
+	return &PersistentSessionPool{
+		SessionPool: NewSessionPool(publisher),
+		bolt:        bolt,
+	}
+}
+
+type sessionRecord struct {
+	ID               string `storm:"id"`
+	ConsumerID       identity.Identity
+	ConsumerLocation market.Location
+	HermesID         common.Address
+	Proposal         market.ServiceProposal
+	ServiceID        string
+	CreatedAt        time.Time
+	Metadata         map[string]string
+}
+
+func newSessionRecord(instance *Session) *sessionRecord {
+	return &sessionRecord{
+		ID:               string(instance.ID),
+		ConsumerID:       instance.ConsumerID,
+		ConsumerLocation: instance.ConsumerLocation,
+		HermesID:         instance.HermesID,
+		Proposal:         instance.Proposal,
+		ServiceID:        instance.ServiceID,
+		CreatedAt:        instance.CreatedAt,
+		Metadata:         instance.Metadata,
+	}
+}
+
+// toSession restores the session from the record. The restored session has no live payment engine,
+// so it is marked for reconciliation.
+func (r *sessionRecord) toSession() *Session {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Session{
+		ID:               session.ID(r.ID),
+		ConsumerID:       r.ConsumerID,
+		ConsumerLocation: r.ConsumerLocation,
+		HermesID:         r.HermesID,
+		Proposal:         r.Proposal,
+		ServiceID:        r.ServiceID,
+		CreatedAt:        r.CreatedAt,
+		Metadata:         r.Metadata,
+		done:             make(chan struct{}),
+		ctx:              ctx,
+		cancel:           cancel,
+		cleanup:          make([]func() error, 0),
+		reconcile:        true,
+	}
+}
+
+// Add puts given session to storage, persists it and publishes a creation event.
+func (psp *PersistentSessionPool) Add(instance *Session) {
+	psp.SessionPool.Add(instance)
+
+	if err := psp.bolt.Store(sessionBucketName, newSessionRecord(instance)); err != nil {
+		log.Error().Err(err).Msgf("Failed to persist session %s", instance.ID)
+	}
+}
+
+// Remove removes given session from underlying storage
+func (psp *PersistentSessionPool) Remove(id session.ID) {
+	psp.SessionPool.Remove(id)
+
+	err := psp.bolt.Delete(sessionBucketName, &sessionRecord{ID: string(id)})
+	if err != nil && err != storm.ErrNotFound {
+		log.Error().Err(err).Msgf("Failed to delete persisted session %s", id)
+	}
+}
+
+// RemoveForService removes all sessions which belong to given service
+func (psp *PersistentSessionPool) RemoveForService(serviceID string) {
+	for _, session := range psp.GetAll() {
+		if session.ServiceID == serviceID {
+			psp.Remove(session.ID)
+		}
+	}
+}
+
+// Load repopulates the pool with the persisted sessions.
+// The loaded sessions are marked for reconciliation, records which cannot be restored are skipped.
+func (psp *PersistentSessionPool) Load() error {
+	var records []sessionRecord
+	if err := psp.bolt.GetAllFrom(sessionBucketName, &records); err != nil {
+		return errors.Wrap(err, "could not load persisted sessions")
+	}
+
+	psp.lock.Lock()
+	defer psp.lock.Unlock()
+
+	for i := range records {
+		record := &records[i]
+		if record.ID == "" {
+			log.Warn().Msg("Skipping persisted session without ID")
+			continue
+		}
+		if _, found := psp.sessions[session.ID(record.ID)]; found {
+			continue
+		}
+
+		instance := record.toSession()
+		instance.addCleanup(func() error {
+			psp.Remove(instance.ID)
+			return nil
+		})
+		psp.sessions[instance.ID] = instance
+		log.Info().Msgf("Loaded session %s for reconciliation", instance.ID)
+	}
+	return nil
+}
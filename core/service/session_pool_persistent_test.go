@@ -0,0 +1,87 @@
+/*
+ * Copyright (C) 2026 The "MysteriumNetwork/node" Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/mysteriumnetwork/node/core/storage/boltdb"
+	"github.com/mysteriumnetwork/node/mocks"
+	"github.com/mysteriumnetwork/node/pb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPersistentSessionPool_RoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "persistentSessionPoolTest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	bolt, err := boltdb.NewStorage(dir)
+	assert.NoError(t, err)
+	defer bolt.Close()
+
+	request := &pb.SessionRequest{
+		Consumer: &pb.ConsumerInfo{
+			Id:       consumerID.Address,
+			HermesID: hermesID.String(),
+			Location: &pb.LocationInfo{Country: "LT"},
+		},
+		ProposalID: int64(currentProposalID),
+	}
+	kept := newSession("kept", currentService, request, nil)
+	kept.Metadata = map[string]string{"ip": "10.0.0.2"}
+	removed := newSession("removed", currentService, request, nil)
+
+	pool := NewPersistentSessionPool(mocks.NewEventBus(), bolt)
+	pool.Add(kept)
+	pool.Add(removed)
+	pool.Remove(removed.ID)
+
+	restarted := NewPersistentSessionPool(mocks.NewEventBus(), bolt)
+	assert.NoError(t, restarted.Load())
+	assert.Len(t, restarted.GetAll(), 1)
+
+	loaded, found := restarted.Find(kept.ID)
+	assert.True(t, found)
+	assert.True(t, loaded.NeedsReconciliation())
+	assert.False(t, kept.NeedsReconciliation())
+	assert.Equal(t, kept.ConsumerID, loaded.ConsumerID)
+	assert.Equal(t, kept.ConsumerLocation, loaded.ConsumerLocation)
+	assert.Equal(t, kept.HermesID, loaded.HermesID)
+	assert.Equal(t, kept.Proposal.ID, loaded.Proposal.ID)
+	assert.Equal(t, kept.Proposal.ServiceType, loaded.Proposal.ServiceType)
+	assert.Equal(t, kept.ServiceID, loaded.ServiceID)
+	assert.True(t, kept.CreatedAt.Equal(loaded.CreatedAt))
+	assert.Equal(t, kept.Metadata, loaded.Metadata)
+
+	// loading twice does not duplicate the sessions.
+	assert.NoError(t, restarted.Load())
+	assert.Len(t, restarted.GetAll(), 1)
+
+	// the loaded session has no payment engine, but can still be paused and destroyed.
+	manager := newManager(currentService, restarted, mocks.NewEventBus(), &mockBalanceTracker{})
+	assert.NoError(t, manager.Pause(consumerID, string(kept.ID)))
+	assert.NoError(t, manager.Destroy(consumerID, string(kept.ID)))
+	<-loaded.Done()
+
+	reloaded := NewPersistentSessionPool(mocks.NewEventBus(), bolt)
+	assert.NoError(t, reloaded.Load())
+	assert.Len(t, reloaded.GetAll(), 0)
+}
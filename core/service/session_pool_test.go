@@ -22,6 +22,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/mysteriumnetwork/node/mocks"
 	"github.com/mysteriumnetwork/node/pb"
 	"github.com/mysteriumnetwork/node/session"
@@ -82,11 +83,54 @@ func TestSessionPool_Add_PublishesEvents(t *testing.T) {
 
 func TestSessionPool_FindByPeer(t *testing.T) {
 	pool := mockPool(mocks.NewEventBus(), sessionExisting)
-	session, ok := pool.FindBy(FindOpts{&sessionExisting.ConsumerID, ""})
+	session, ok := pool.FindBy(FindOpts{Peer: &sessionExisting.ConsumerID})
 	assert.True(t, ok)
 	assert.Equal(t, sessionExisting.ID, session.ID)
 }
 
+func TestSessionPool_FindByMetadata(t *testing.T) {
+	tagged, _ := NewSession(&Instance{}, &pb.SessionRequest{}, trace.NewTracer(""))
+	tagged.Metadata = map[string]string{"ip": "10.0.0.2", "tier": "gold"}
+	pool := mockPool(mocks.NewEventBus(), sessionExisting)
+	pool.Add(tagged)
+
+	session, ok := pool.FindBy(FindOpts{Metadata: map[string]string{"ip": "10.0.0.2"}})
+	assert.True(t, ok)
+	assert.Equal(t, tagged.ID, session.ID)
+
+	session, ok = pool.FindBy(FindOpts{Metadata: map[string]string{"ip": "10.0.0.2", "tier": "silver"}})
+	assert.False(t, ok)
+	assert.Nil(t, session)
+
+	_, ok = pool.FindBy(FindOpts{Peer: &sessionExisting.ConsumerID, Metadata: map[string]string{"tier": "gold"}})
+	assert.False(t, ok)
+}
+
+func TestSessionPool_FindByAccountant(t *testing.T) {
+	hermesID := common.HexToAddress("0x1")
+	paid, _ := NewSession(&Instance{}, &pb.SessionRequest{}, trace.NewTracer(""))
+	paid.HermesID = hermesID
+	pool := mockPool(mocks.NewEventBus(), sessionExisting)
+	pool.Add(paid)
+
+	session, ok := pool.FindBy(FindOpts{AccountantID: &hermesID})
+	assert.True(t, ok)
+	assert.Equal(t, paid.ID, session.ID)
+
+	otherID := common.HexToAddress("0x2")
+	session, ok = pool.FindBy(FindOpts{AccountantID: &otherID})
+	assert.False(t, ok)
+	assert.Nil(t, session)
+
+	_, ok = pool.FindBy(FindOpts{Peer: &sessionExisting.ConsumerID, AccountantID: &hermesID})
+	assert.False(t, ok)
+
+	paid.Metadata = map[string]string{"tier": "gold"}
+	session, ok = pool.FindBy(FindOpts{AccountantID: &hermesID, Metadata: map[string]string{"tier": "gold"}})
+	assert.True(t, ok)
+	assert.Equal(t, paid.ID, session.ID)
+}
+
 func TestSessionPool_GetAll(t *testing.T) {
 	sessionFirst, _ := NewSession(&Instance{}, &pb.SessionRequest{}, trace.NewTracer(""))
 	sessionSecond, _ := NewSession(&Instance{}, &pb.SessionRequest{}, trace.NewTracer(""))
@@ -103,6 +147,26 @@ func TestSessionPool_GetAll(t *testing.T) {
 	assert.Contains(t, sessions, sessionSecond)
 }
 
+func TestSessionPool_List(t *testing.T) {
+	instance, _ := NewSession(&Instance{}, &pb.SessionRequest{}, trace.NewTracer(""))
+	instance.Metadata = map[string]string{"ip": "10.0.0.2"}
+
+	pool := &SessionPool{
+		sessions: map[session.ID]*Session{
+			instance.ID: instance,
+		},
+	}
+
+	sessions := pool.List()
+	assert.Len(t, sessions, 1)
+	assert.Equal(t, instance.ID, sessions[0].ID)
+	assert.Equal(t, StateCreated, sessions[0].State)
+
+	// the listed sessions are copies.
+	sessions[0].Metadata["ip"] = "10.0.0.3"
+	assert.Equal(t, "10.0.0.2", instance.Metadata["ip"])
+}
+
 func TestSessionPool_Remove(t *testing.T) {
 	pool := mockPool(mocks.NewEventBus(), sessionExisting)
 
@@ -110,6 +174,15 @@ func TestSessionPool_Remove(t *testing.T) {
 	assert.Len(t, pool.sessions, 0)
 }
 
+func TestSessionPool_WasRemoved(t *testing.T) {
+	pool := mockPool(mocks.NewEventBus(), sessionExisting)
+	assert.False(t, pool.WasRemoved(sessionExisting.ID))
+
+	pool.Remove(sessionExisting.ID)
+	assert.True(t, pool.WasRemoved(sessionExisting.ID))
+	assert.False(t, pool.WasRemoved(session.ID("unknown-id")))
+}
+
 func TestSessionPool_RemoveNonExisting(t *testing.T) {
 	pool := &SessionPool{
 		sessions:  map[session.ID]*Session{},
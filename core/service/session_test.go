@@ -0,0 +1,141 @@
+/*
+ * Copyright (C) 2020 The "MysteriumNetwork/node" Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mysteriumnetwork/node/pb"
+	"github.com/mysteriumnetwork/node/session/event"
+	"github.com/mysteriumnetwork/node/trace"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSession_toEvent_Metadata(t *testing.T) {
+	session, err := NewSession(&Instance{}, &pb.SessionRequest{}, trace.NewTracer(""))
+	assert.NoError(t, err)
+	assert.Nil(t, session.toEvent(event.CreatedStatus).Session.Metadata)
+
+	session.Metadata = map[string]string{"ip": "10.0.0.2"}
+	ev := session.toEvent(event.CreatedStatus)
+	assert.Equal(t, map[string]string{"ip": "10.0.0.2"}, ev.Session.Metadata)
+
+	// the event holds a copy of the metadata.
+	ev.Session.Metadata["ip"] = "10.0.0.3"
+	assert.Equal(t, "10.0.0.2", session.Metadata["ip"])
+}
+
+func TestSession_KeepAliveRTT(t *testing.T) {
+	session, err := NewSession(&Instance{}, &pb.SessionRequest{}, trace.NewTracer(""))
+	assert.NoError(t, err)
+
+	last, average := session.KeepAliveRTT()
+	assert.Equal(t, time.Duration(0), last)
+	assert.Equal(t, time.Duration(0), average)
+
+	session.recordKeepAliveRTT(10 * time.Millisecond)
+	session.recordKeepAliveRTT(30 * time.Millisecond)
+	last, average = session.KeepAliveRTT()
+	assert.Equal(t, 30*time.Millisecond, last)
+	assert.Equal(t, 20*time.Millisecond, average)
+
+	// only the recent samples are averaged.
+	for i := 0; i < keepAliveRTTWindow; i++ {
+		session.recordKeepAliveRTT(5 * time.Millisecond)
+	}
+	last, average = session.KeepAliveRTT()
+	assert.Equal(t, 5*time.Millisecond, last)
+	assert.Equal(t, 5*time.Millisecond, average)
+}
+
+func TestSession_StateTransitions(t *testing.T) {
+	tests := []struct {
+		name      string
+		steps     []func(*Session) error
+		wantErr   bool
+		wantState State
+	}{
+		{
+			name:      "created session",
+			wantState: StateCreated,
+		},
+		{
+			name:      "acknowledges the created session",
+			steps:     []func(*Session) error{(*Session).markAcknowledged},
+			wantState: StateAcknowledged,
+		},
+		{
+			name:      "destroys the created session",
+			steps:     []func(*Session) error{(*Session).markDestroyed},
+			wantState: StateDestroyed,
+		},
+		{
+			name:      "destroys the acknowledged session",
+			steps:     []func(*Session) error{(*Session).markAcknowledged, (*Session).markDestroyed},
+			wantState: StateDestroyed,
+		},
+		{
+			name:      "rejects acknowledging the destroyed session",
+			steps:     []func(*Session) error{(*Session).markDestroyed, (*Session).markAcknowledged},
+			wantErr:   true,
+			wantState: StateDestroyed,
+		},
+		{
+			name:      "acknowledges the session twice",
+			steps:     []func(*Session) error{(*Session).markAcknowledged, (*Session).markAcknowledged},
+			wantState: StateAcknowledged,
+		},
+		{
+			name:      "rejects destroying the session twice",
+			steps:     []func(*Session) error{(*Session).markDestroyed, (*Session).markDestroyed},
+			wantErr:   true,
+			wantState: StateDestroyed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session, err := NewSession(&Instance{}, &pb.SessionRequest{}, trace.NewTracer(""))
+			assert.NoError(t, err)
+
+			for _, step := range tt.steps {
+				err = step(session)
+			}
+			if tt.wantErr {
+				assert.True(t, errors.Is(err, ErrorInvalidStateTransition), err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.wantState, session.State())
+		})
+	}
+}
+
+func TestSession_Close_MarksDestroyed(t *testing.T) {
+	session, err := NewSession(&Instance{}, &pb.SessionRequest{}, trace.NewTracer(""))
+	assert.NoError(t, err)
+	assert.NoError(t, session.markAcknowledged())
+
+	session.Close()
+	assert.Equal(t, StateDestroyed, session.State())
+
+	// closing again does not fail.
+	session.Close()
+	assert.Equal(t, StateDestroyed, session.State())
+}
@@ -23,6 +23,7 @@ import (
 	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/sha512"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -49,15 +50,23 @@ func NewKeystoreFilesystem(directory string, ks ethKeystore) *Keystore {
 		ethKeystore: ks,
 		loadKey:     loadStoredKey,
 		unlocked:    make(map[common.Address]*unlocked),
+		keyIDs:      make(map[common.Address]uint32),
 	}
 }
 
+// encryptionEnvelopeVersion marks the ciphertexts which are tagged with the ID of the key they were encrypted with.
+// The envelope is: version (1 byte) | key ID (4 bytes, big endian) | nonce | sealed message.
+const encryptionEnvelopeVersion byte = 1
+
+const encryptionEnvelopeHeaderSize = 5
+
 // Keystore handles everything that's related to eth accounts.
 type Keystore struct {
 	ethKeystore
 	loadKey func(addr common.Address, filename, auth string) (*ethKs.Key, error)
 
 	unlocked map[common.Address]*unlocked // Currently unlocked account (decrypted private keys)
+	keyIDs   map[common.Address]uint32    // IDs of the current encryption keys
 	mu       sync.RWMutex
 }
 
@@ -143,7 +152,8 @@ func (ks *Keystore) expire(addr common.Address, u *unlocked, timeout time.Durati
 	}
 }
 
-// Encrypt takes a derived key for the given address and encrypts the plaintext.
+// Encrypt takes the current derived key for the given address and encrypts the plaintext.
+// The ciphertext is tagged with the ID of the key, so that it can be decrypted after the key is rotated.
 func (ks *Keystore) Encrypt(addr common.Address, plaintext []byte) ([]byte, error) {
 	ks.mu.RLock()
 	defer ks.mu.RUnlock()
@@ -153,17 +163,8 @@ func (ks *Keystore) Encrypt(addr common.Address, plaintext []byte) ([]byte, erro
 		return nil, ethKs.ErrLocked
 	}
 
-	keyDerived, err := key.deriveKey()
-	if err != nil {
-		return nil, err
-	}
-
-	c, err := aes.NewCipher(keyDerived)
-	if err != nil {
-		return nil, err
-	}
-
-	gcm, err := cipher.NewGCM(c)
+	keyID := ks.keyIDs[addr]
+	gcm, err := key.cipher(keyID)
 	if err != nil {
 		return nil, err
 	}
@@ -173,10 +174,15 @@ func (ks *Keystore) Encrypt(addr common.Address, plaintext []byte) ([]byte, erro
 		return nil, err
 	}
 
-	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+	envelope := make([]byte, encryptionEnvelopeHeaderSize, encryptionEnvelopeHeaderSize+len(nonce)+len(plaintext)+gcm.Overhead())
+	envelope[0] = encryptionEnvelopeVersion
+	binary.BigEndian.PutUint32(envelope[1:encryptionEnvelopeHeaderSize], keyID)
+	envelope = append(envelope, nonce...)
+	return gcm.Seal(envelope, nonce, plaintext, nil), nil
 }
 
-// Decrypt takes a derived key for the given address and decrypts the encrypted message.
+// Decrypt takes the derived key the message was encrypted with and decrypts the encrypted message.
+// Messages encrypted before the keys were tagged are decrypted with the initial key of the address.
 func (ks *Keystore) Decrypt(addr common.Address, encrypted []byte) ([]byte, error) {
 	ks.mu.RLock()
 	defer ks.mu.RUnlock()
@@ -186,28 +192,28 @@ func (ks *Keystore) Decrypt(addr common.Address, encrypted []byte) ([]byte, erro
 		return nil, ethKs.ErrLocked
 	}
 
-	keyDerived, err := key.deriveKey()
-	if err != nil {
-		return nil, err
+	if len(encrypted) > encryptionEnvelopeHeaderSize && encrypted[0] == encryptionEnvelopeVersion {
+		keyID := binary.BigEndian.Uint32(encrypted[1:encryptionEnvelopeHeaderSize])
+		if decrypted, err := key.open(keyID, encrypted[encryptionEnvelopeHeaderSize:]); err == nil {
+			return decrypted, nil
+		}
 	}
 
-	c, err := aes.NewCipher(keyDerived)
-	if err != nil {
-		return nil, err
-	}
+	return key.open(0, encrypted)
+}
 
-	gcm, err := cipher.NewGCM(c)
-	if err != nil {
-		return nil, err
-	}
+// RotateKey starts encrypting messages for the given address with a new derived key.
+// Messages encrypted with the previous keys can still be decrypted.
+func (ks *Keystore) RotateKey(addr common.Address) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
 
-	nonceSize := gcm.NonceSize()
-	if len(encrypted) < nonceSize {
-		return nil, errors.New("ciphertext too short")
+	if _, found := ks.unlocked[addr]; !found {
+		return ethKs.ErrLocked
 	}
 
-	nonce, encrypted := encrypted[:nonceSize], encrypted[nonceSize:]
-	return gcm.Open(nil, nonce, encrypted, nil)
+	ks.keyIDs[addr]++
+	return nil
 }
 
 // SignHash calculates a ECDSA signature for the given hash. The produced
@@ -238,14 +244,49 @@ type unlocked struct {
 	abort chan struct{}
 }
 
-func (u *unlocked) deriveKey() ([]byte, error) {
+func (u *unlocked) deriveKey(keyID uint32) ([]byte, error) {
+	var info []byte
+	if keyID > 0 {
+		info = make([]byte, 4)
+		binary.BigEndian.PutUint32(info, keyID)
+	}
+
 	hashFunc := sha512.New
-	hkdfDerived := hkdf.New(hashFunc, u.Key.PrivateKey.D.Bytes(), nil, nil)
+	hkdfDerived := hkdf.New(hashFunc, u.Key.PrivateKey.D.Bytes(), nil, info)
 	key := make([]byte, 32)
 	_, err := io.ReadFull(hkdfDerived, key)
 	return key, err
 }
 
+func (u *unlocked) cipher(keyID uint32) (cipher.AEAD, error) {
+	keyDerived, err := u.deriveKey(keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := aes.NewCipher(keyDerived)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(c)
+}
+
+func (u *unlocked) open(keyID uint32, encrypted []byte) ([]byte, error) {
+	gcm, err := u.cipher(keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	nonceSize := gcm.NonceSize()
+	if len(encrypted) < nonceSize {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	nonce, encrypted := encrypted[:nonceSize], encrypted[nonceSize:]
+	return gcm.Open(nil, nonce, encrypted, nil)
+}
+
 func loadStoredKey(addr common.Address, filename, auth string) (*ethKs.Key, error) {
 	// Load the key from the keystore and decrypt its contents
 	keyjson, err := ioutil.ReadFile(filename)
@@ -73,6 +73,40 @@ func Test_DerivedEncryption(t *testing.T) {
 		_, err = ks.Decrypt(encryptionAddress, encrypted)
 		assert.Error(t, err)
 	})
+
+	t.Run("Decrypts messages encrypted before the keys were tagged", func(t *testing.T) {
+		gcm, err := ks.unlocked[encryptionAddress].cipher(0)
+		assert.NoError(t, err)
+		nonce := make([]byte, gcm.NonceSize())
+		legacy := gcm.Seal(nonce, nonce, []byte(secretMessage), nil)
+
+		decrypted, err := ks.Decrypt(encryptionAddress, legacy)
+		assert.NoError(t, err)
+		assert.Equal(t, secretMessage, string(decrypted))
+	})
+
+	t.Run("Decrypts messages encrypted before the key rotation", func(t *testing.T) {
+		before, err := ks.Encrypt(encryptionAddress, []byte(secretMessage))
+		assert.NoError(t, err)
+
+		err = ks.RotateKey(encryptionAddress)
+		assert.NoError(t, err)
+
+		after, err := ks.Encrypt(encryptionAddress, []byte(secretMessage))
+		assert.NoError(t, err)
+		assert.NotEqual(t, before[:encryptionEnvelopeHeaderSize], after[:encryptionEnvelopeHeaderSize])
+
+		for _, encrypted := range [][]byte{before, after} {
+			decrypted, err := ks.Decrypt(encryptionAddress, encrypted)
+			assert.NoError(t, err)
+			assert.Equal(t, secretMessage, string(decrypted))
+		}
+	})
+
+	t.Run("Fails to rotate the key if account is locked", func(t *testing.T) {
+		err := ks.RotateKey(common.HexToAddress("0x1"))
+		assert.Equal(t, ethKs.ErrLocked, err)
+	})
 }
 
 var result []byte
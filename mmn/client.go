@@ -19,6 +19,7 @@ package mmn
 
 import (
 	"io/ioutil"
+	"sync"
 
 	"github.com/rs/zerolog/log"
 
@@ -49,8 +50,24 @@ func NewClient(httpClient *requests.HTTPClient, mmnAddress string, signer identi
 
 type client struct {
 	httpClient *requests.HTTPClient
-	mmnAddress string
 	signer     identity.SignerFactory
+
+	addressLock sync.RWMutex
+	mmnAddress  string
+}
+
+func (m *client) address() string {
+	m.addressLock.RLock()
+	defer m.addressLock.RUnlock()
+
+	return m.mmnAddress
+}
+
+func (m *client) setAddress(mmnAddress string) {
+	m.addressLock.Lock()
+	defer m.addressLock.Unlock()
+
+	m.mmnAddress = mmnAddress
 }
 
 // RegisterNode does an HTTP call to MMN and registers node
@@ -58,7 +75,7 @@ func (m *client) RegisterNode(info *NodeInformationDto) error {
 	log.Debug().Msgf("Registering node to MMN: %+v", *info)
 
 	id := identity.FromAddress(info.Identity)
-	req, err := requests.NewSignedPostRequest(m.mmnAddress, "node", info, m.signer(id))
+	req, err := requests.NewSignedPostRequest(m.address(), "node", info, m.signer(id))
 	if err != nil {
 		return err
 	}
@@ -69,7 +86,7 @@ func (m *client) RegisterNode(info *NodeInformationDto) error {
 // GetReport does an HTTP call to MMN and fetches node report
 func (m *client) GetReport(identityStr string) (string, error) {
 	id := identity.FromAddress(identityStr)
-	req, err := requests.NewSignedGetRequest(m.mmnAddress, "node/report?identity="+identityStr, m.signer(id))
+	req, err := requests.NewSignedGetRequest(m.address(), "node/report?identity="+identityStr, m.signer(id))
 	if err != nil {
 		return "", err
 	}
@@ -24,6 +24,7 @@ import (
 	"os/exec"
 	"runtime"
 	"strings"
+	"time"
 
 	nodevent "github.com/mysteriumnetwork/node/core/node/event"
 	"github.com/mysteriumnetwork/node/core/service/servicestate"
@@ -41,24 +42,69 @@ type MMN struct {
 	client     *client
 	ipResolver ip.Resolver
 
+	subscribeAttempts int
+	subscribeBackoff  time.Duration
+
 	lastIP       string
 	lastIdentity string
 }
 
 // NewMMN creates new instance of MMN
 func NewMMN(resolver ip.Resolver, client *client) *MMN {
-	return &MMN{client: client, ipResolver: resolver}
+	return &MMN{
+		client:            client,
+		ipResolver:        resolver,
+		subscribeAttempts: 5,
+		subscribeBackoff:  time.Second,
+	}
+}
+
+// SetAddress changes the MMN API address used for the further requests.
+func (m *MMN) SetAddress(address string) {
+	m.client.setAddress(address)
 }
 
-// Subscribe subscribes to node events and reports them to MMN
+// Subscribe subscribes to node events and reports them to MMN.
+// Failed subscriptions are retried with a backoff, a node warning is published if they still fail.
 func (m *MMN) Subscribe(eventBus eventbus.EventBus) error {
-	if err := eventBus.SubscribeAsync(nodevent.AppTopicNode, m.handleNodeStart); err != nil {
-		return err
+	subscriptions := []struct {
+		topic string
+		fn    interface{}
+	}{
+		{topic: nodevent.AppTopicNode, fn: m.handleNodeStart},
+		{topic: identity.AppTopicIdentityUnlock, fn: m.handleIdentityUnlock},
+		{topic: servicestate.AppTopicServiceStatus, fn: m.handleServiceStart},
+	}
+	for _, s := range subscriptions {
+		if err := m.subscribeWithRetry(eventBus, s.topic, s.fn); err != nil {
+			eventBus.Publish(nodevent.AppTopicNodeWarning, nodevent.WarningPayload{
+				Warning: nodevent.WarningTelemetryUnavailable,
+				Reason:  err.Error(),
+			})
+			return err
+		}
 	}
-	if err := eventBus.SubscribeAsync(identity.AppTopicIdentityUnlock, m.handleIdentityUnlock); err != nil {
-		return err
+	return nil
+}
+
+func (m *MMN) subscribeWithRetry(eventBus eventbus.EventBus, topic string, fn interface{}) (err error) {
+	attempts := m.subscribeAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	backoff := m.subscribeBackoff
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err = eventBus.SubscribeAsync(topic, fn); err == nil {
+			return nil
+		}
+		log.Warn().Err(err).Msgf("Failed to subscribe MMN to %q, attempt %d/%d", topic, attempt, attempts)
+		if attempt < attempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
 	}
-	return eventBus.SubscribeAsync(servicestate.AppTopicServiceStatus, m.handleServiceStart)
+	return fmt.Errorf("could not subscribe MMN to %q: %w", topic, err)
 }
 
 // handleNodeStart handles node state change and fetches the IP accordingly.
@@ -0,0 +1,79 @@
+/*
+ * Copyright (C) 2020 The "MysteriumNetwork/node" Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mmn
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	nodevent "github.com/mysteriumnetwork/node/core/node/event"
+	"github.com/mysteriumnetwork/node/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockFailingEventBus struct {
+	*mocks.EventBus
+	failures   int
+	subscribed []string
+}
+
+func (m *mockFailingEventBus) SubscribeAsync(topic string, fn interface{}) error {
+	if m.failures > 0 {
+		m.failures--
+		return errors.New("subscribe failed")
+	}
+	m.subscribed = append(m.subscribed, topic)
+	return nil
+}
+
+func TestMMN_Subscribe_RetriesFailedSubscription(t *testing.T) {
+	bus := &mockFailingEventBus{EventBus: mocks.NewEventBus(), failures: 1}
+	m := NewMMN(nil, NewClient(nil, "http://mmn", nil))
+	m.subscribeBackoff = time.Millisecond
+
+	err := m.Subscribe(bus)
+	assert.NoError(t, err)
+	assert.Len(t, bus.subscribed, 3)
+	assert.Len(t, bus.GetEventHistory(), 0)
+}
+
+func TestMMN_Subscribe_PublishesWarning(t *testing.T) {
+	bus := &mockFailingEventBus{EventBus: mocks.NewEventBus(), failures: 10}
+	m := NewMMN(nil, NewClient(nil, "http://mmn", nil))
+	m.subscribeAttempts = 2
+	m.subscribeBackoff = time.Millisecond
+
+	err := m.Subscribe(bus)
+	assert.Error(t, err)
+	assert.Equal(t, 8, bus.failures)
+
+	history := bus.GetEventHistory()
+	assert.Len(t, history, 1)
+	assert.Equal(t, nodevent.AppTopicNodeWarning, history[0].Topic)
+	warning := history[0].Event.(nodevent.WarningPayload)
+	assert.Equal(t, nodevent.WarningTelemetryUnavailable, warning.Warning)
+}
+
+func TestMMN_SetAddress(t *testing.T) {
+	m := NewMMN(nil, NewClient(nil, "http://mmn", nil))
+	assert.Equal(t, "http://mmn", m.client.address())
+
+	m.SetAddress("http://other-mmn")
+	assert.Equal(t, "http://other-mmn", m.client.address())
+}
@@ -23,6 +23,8 @@ import (
 	"net/textproto"
 	"strconv"
 
+	"github.com/gofrs/uuid"
+	"github.com/mysteriumnetwork/node/pb"
 	"github.com/rs/zerolog/log"
 	"google.golang.org/protobuf/proto"
 )
@@ -75,6 +77,47 @@ func ProtoMessage(m proto.Message) *Message {
 	return &Message{Data: pbBytes}
 }
 
+// compactKeepAliveMarker starts the compact keep-alive ping. Proto messages never start with it, as it would be
+// the tag of the field number 0, so the compact pings can not be mistaken for the proto ones of the same size.
+const compactKeepAliveMarker byte = 0x00
+
+// compactKeepAliveSize is the size of the compact keep-alive ping, which is the marker followed by the raw session UUID.
+const compactKeepAliveSize = 1 + uuid.Size
+
+// KeepAlivePingMessage returns the keep-alive ping of the session. The compact ping carries the marker and the raw bytes
+// of the session UUID instead of the P2PKeepAlivePing proto and must only be sent to the peers which negotiated it
+// at the session start. The proto ping is returned if the session ID is not a UUID.
+func KeepAlivePingMessage(sessionID string, compact bool) *Message {
+	if compact {
+		id, err := uuid.FromString(sessionID)
+		if err == nil {
+			return &Message{Data: append([]byte{compactKeepAliveMarker}, id.Bytes()...)}
+		}
+		log.Warn().Err(err).Msgf("Could not encode compact keepalive ping, sending proto. SessionID=%s", sessionID)
+	}
+	return ProtoMessage(&pb.P2PKeepAlivePing{
+		SessionID: sessionID,
+	})
+}
+
+// UnmarshalKeepAlivePing returns the session ID of the keep-alive ping. The compact pings are only accepted
+// if they were negotiated, the proto ones are always accepted.
+func (m *Message) UnmarshalKeepAlivePing(compact bool) (string, error) {
+	if compact && len(m.Data) == compactKeepAliveSize && m.Data[0] == compactKeepAliveMarker {
+		id, err := uuid.FromBytes(m.Data[1:])
+		if err != nil {
+			return "", err
+		}
+		return id.String(), nil
+	}
+
+	var ping pb.P2PKeepAlivePing
+	if err := m.UnmarshalProto(&ping); err != nil {
+		return "", err
+	}
+	return ping.SessionID, nil
+}
+
 const (
 	headerFieldRequestID = "Request-ID"
 	headerFieldTopic     = "Topic"
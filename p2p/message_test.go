@@ -0,0 +1,59 @@
+/*
+ * Copyright (C) 2020 The "MysteriumNetwork/node" Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package p2p
+
+import (
+	"testing"
+
+	"github.com/mysteriumnetwork/node/pb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeepAlivePingMessage(t *testing.T) {
+	sessionID := "f04d5a3f-3b8c-4bde-9e5a-8b1a3b0b5f7e"
+
+	compact := KeepAlivePingMessage(sessionID, true)
+	assert.Len(t, compact.Data, compactKeepAliveSize)
+	id, err := compact.UnmarshalKeepAlivePing(true)
+	assert.NoError(t, err)
+	assert.Equal(t, sessionID, id)
+
+	// proto pings are accepted whether compact pings were negotiated or not.
+	full := KeepAlivePingMessage(sessionID, false)
+	var ping pb.P2PKeepAlivePing
+	assert.NoError(t, full.UnmarshalProto(&ping))
+	assert.Equal(t, sessionID, ping.SessionID)
+	for _, negotiated := range []bool{true, false} {
+		id, err = full.UnmarshalKeepAlivePing(negotiated)
+		assert.NoError(t, err)
+		assert.Equal(t, sessionID, id)
+	}
+
+	// session IDs which are not UUIDs are sent in proto.
+	fallback := KeepAlivePingMessage("session", true)
+	id, err = fallback.UnmarshalKeepAlivePing(true)
+	assert.NoError(t, err)
+	assert.Equal(t, "session", id)
+
+	// the proto pings of the same size as the compact ones are not mistaken for them.
+	sameSize := KeepAlivePingMessage("session-0123456", false)
+	assert.Len(t, sameSize.Data, compactKeepAliveSize)
+	id, err = sameSize.UnmarshalKeepAlivePing(true)
+	assert.NoError(t, err)
+	assert.Equal(t, "session-0123456", id)
+}
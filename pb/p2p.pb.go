@@ -237,6 +237,69 @@ func (x *P2PKeepAlivePing) GetSessionID() string {
 	return ""
 }
 
+type P2PKeepAlivePong struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	ActiveSessions int32   `protobuf:"varint,1,opt,name=activeSessions,proto3" json:"activeSessions,omitempty"` // Number of active sessions of the provider.
+	Load           float64 `protobuf:"fixed64,2,opt,name=load,proto3" json:"load,omitempty"`                    // System load average of the provider.
+	Draining       bool    `protobuf:"varint,3,opt,name=draining,proto3" json:"draining,omitempty"`             // Set when the provider is shutting down and does not accept new sessions.
+}
+
+func (x *P2PKeepAlivePong) Reset() {
+	*x = P2PKeepAlivePong{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pb_p2p_proto_msgTypes[4]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *P2PKeepAlivePong) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*P2PKeepAlivePong) ProtoMessage() {}
+
+func (x *P2PKeepAlivePong) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_p2p_proto_msgTypes[4]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use P2PKeepAlivePong.ProtoReflect.Descriptor instead.
+func (*P2PKeepAlivePong) Descriptor() ([]byte, []int) {
+	return file_pb_p2p_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *P2PKeepAlivePong) GetActiveSessions() int32 {
+	if x != nil {
+		return x.ActiveSessions
+	}
+	return 0
+}
+
+func (x *P2PKeepAlivePong) GetLoad() float64 {
+	if x != nil {
+		return x.Load
+	}
+	return 0
+}
+
+func (x *P2PKeepAlivePong) GetDraining() bool {
+	if x != nil {
+		return x.Draining
+	}
+	return false
+}
+
 type P2PChannelHandlersReady struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -248,7 +311,7 @@ type P2PChannelHandlersReady struct {
 func (x *P2PChannelHandlersReady) Reset() {
 	*x = P2PChannelHandlersReady{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_pb_p2p_proto_msgTypes[4]
+		mi := &file_pb_p2p_proto_msgTypes[5]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -261,7 +324,7 @@ func (x *P2PChannelHandlersReady) String() string {
 func (*P2PChannelHandlersReady) ProtoMessage() {}
 
 func (x *P2PChannelHandlersReady) ProtoReflect() protoreflect.Message {
-	mi := &file_pb_p2p_proto_msgTypes[4]
+	mi := &file_pb_p2p_proto_msgTypes[5]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -274,7 +337,7 @@ func (x *P2PChannelHandlersReady) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use P2PChannelHandlersReady.ProtoReflect.Descriptor instead.
 func (*P2PChannelHandlersReady) Descriptor() ([]byte, []int) {
-	return file_pb_p2p_proto_rawDescGZIP(), []int{4}
+	return file_pb_p2p_proto_rawDescGZIP(), []int{5}
 }
 
 func (x *P2PChannelHandlersReady) GetValue() string {
@@ -305,11 +368,18 @@ var file_pb_p2p_proto_rawDesc = []byte{
 	0x02, 0x20, 0x03, 0x28, 0x05, 0x52, 0x05, 0x70, 0x6f, 0x72, 0x74, 0x73, 0x22, 0x30, 0x0a, 0x10,
 	0x50, 0x32, 0x50, 0x4b, 0x65, 0x65, 0x70, 0x41, 0x6c, 0x69, 0x76, 0x65, 0x50, 0x69, 0x6e, 0x67,
 	0x12, 0x1c, 0x0a, 0x09, 0x73, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x49, 0x44, 0x18, 0x01, 0x20,
-	0x01, 0x28, 0x09, 0x52, 0x09, 0x73, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x49, 0x44, 0x22, 0x2f,
-	0x0a, 0x17, 0x50, 0x32, 0x50, 0x43, 0x68, 0x61, 0x6e, 0x6e, 0x65, 0x6c, 0x48, 0x61, 0x6e, 0x64,
-	0x6c, 0x65, 0x72, 0x73, 0x52, 0x65, 0x61, 0x64, 0x79, 0x12, 0x14, 0x0a, 0x05, 0x76, 0x61, 0x6c,
-	0x75, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x42,
-	0x06, 0x5a, 0x04, 0x2e, 0x3b, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x01, 0x28, 0x09, 0x52, 0x09, 0x73, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x49, 0x44, 0x22, 0x6a,
+	0x0a, 0x10, 0x50, 0x32, 0x50, 0x4b, 0x65, 0x65, 0x70, 0x41, 0x6c, 0x69, 0x76, 0x65, 0x50, 0x6f,
+	0x6e, 0x67, 0x12, 0x26, 0x0a, 0x0e, 0x61, 0x63, 0x74, 0x69, 0x76, 0x65, 0x53, 0x65, 0x73, 0x73,
+	0x69, 0x6f, 0x6e, 0x73, 0x18, 0x01, 0x20, 0x01, 0x28, 0x05, 0x52, 0x0e, 0x61, 0x63, 0x74, 0x69,
+	0x76, 0x65, 0x53, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x73, 0x12, 0x12, 0x0a, 0x04, 0x6c, 0x6f,
+	0x61, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x01, 0x52, 0x04, 0x6c, 0x6f, 0x61, 0x64, 0x12, 0x1a,
+	0x0a, 0x08, 0x64, 0x72, 0x61, 0x69, 0x6e, 0x69, 0x6e, 0x67, 0x18, 0x03, 0x20, 0x01, 0x28, 0x08,
+	0x52, 0x08, 0x64, 0x72, 0x61, 0x69, 0x6e, 0x69, 0x6e, 0x67, 0x22, 0x2f, 0x0a, 0x17, 0x50, 0x32,
+	0x50, 0x43, 0x68, 0x61, 0x6e, 0x6e, 0x65, 0x6c, 0x48, 0x61, 0x6e, 0x64, 0x6c, 0x65, 0x72, 0x73,
+	0x52, 0x65, 0x61, 0x64, 0x79, 0x12, 0x14, 0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x01,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x42, 0x06, 0x5a, 0x04, 0x2e,
+	0x3b, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -324,13 +394,14 @@ func file_pb_p2p_proto_rawDescGZIP() []byte {
 	return file_pb_p2p_proto_rawDescData
 }
 
-var file_pb_p2p_proto_msgTypes = make([]protoimpl.MessageInfo, 5)
+var file_pb_p2p_proto_msgTypes = make([]protoimpl.MessageInfo, 6)
 var file_pb_p2p_proto_goTypes = []interface{}{
 	(*P2PSignedMsg)(nil),            // 0: pb.P2PSignedMsg
 	(*P2PConfigExchangeMsg)(nil),    // 1: pb.P2PConfigExchangeMsg
 	(*P2PConnectConfig)(nil),        // 2: pb.P2PConnectConfig
 	(*P2PKeepAlivePing)(nil),        // 3: pb.P2PKeepAlivePing
-	(*P2PChannelHandlersReady)(nil), // 4: pb.P2PChannelHandlersReady
+	(*P2PKeepAlivePong)(nil),        // 4: pb.P2PKeepAlivePong
+	(*P2PChannelHandlersReady)(nil), // 5: pb.P2PChannelHandlersReady
 }
 var file_pb_p2p_proto_depIdxs = []int32{
 	0, // [0:0] is the sub-list for method output_type
@@ -395,6 +466,18 @@ func file_pb_p2p_proto_init() {
 			}
 		}
 		file_pb_p2p_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*P2PKeepAlivePong); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pb_p2p_proto_msgTypes[5].Exporter = func(v interface{}, i int) interface{} {
 			switch v := v.(*P2PChannelHandlersReady); i {
 			case 0:
 				return &v.state
@@ -413,7 +496,7 @@ func file_pb_p2p_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_pb_p2p_proto_rawDesc,
 			NumEnums:      0,
-			NumMessages:   5,
+			NumMessages:   6,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
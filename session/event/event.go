@@ -33,8 +33,34 @@ const (
 	AppTopicDataTransferred = "Session data transferred"
 	// AppTopicTokensEarned is a topic for publish events about tokens earned as a provider.
 	AppTopicTokensEarned = "SessionTokensEarned"
+	// AppTopicSessionCapacity is a topic for publish events about services reaching and leaving their session capacity.
+	AppTopicSessionCapacity = "Session capacity"
+	// AppTopicMalformedKeepAlive is a topic for publish events about consumers sending malformed keepalive pings.
+	AppTopicMalformedKeepAlive = "Session malformed keepalive"
 )
 
+// AppEventMalformedKeepAlive is published once the consumer sends too many malformed keepalive pings,
+// which usually means the consumer speaks another version of the protocol.
+type AppEventMalformedKeepAlive struct {
+	ServiceID string
+	// SessionIDs are the sessions started over the p2p channel which carried the malformed pings.
+	SessionIDs []string
+	// Count is the number of malformed pings received over the channel.
+	Count uint64
+	// Error is the error of the last malformed ping.
+	Error error
+}
+
+// AppEventSessionCapacity is published once the service reaches its maximum number of concurrent sessions
+// and once a session slot frees up again.
+type AppEventSessionCapacity struct {
+	ServiceID string
+	Active    int
+	Max       int
+	// Full is true if the service does not accept new sessions.
+	Full bool
+}
+
 // AppEventDataTransferred represents the data transfer event
 type AppEventDataTransferred struct {
 	ID       string
@@ -45,7 +71,13 @@ type AppEventDataTransferred struct {
 type AppEventTokensEarned struct {
 	ProviderID identity.Identity
 	SessionID  string
-	Total      *big.Int
+	// HermesID is the hermes which issued the promise for the earned tokens.
+	HermesID common.Address
+	Total    *big.Int
+	// Delta is the amount earned since the previous promise of the same agreement.
+	Delta *big.Int
+	// DryRun is true if the tokens were earned by a promise handler in dry-run mode.
+	DryRun bool
 }
 
 // Status represents the different actions that might happen on a session
@@ -56,8 +88,28 @@ const (
 	CreatedStatus Status = "CreatedStatus"
 	// RemovedStatus indicates a session has been removed
 	RemovedStatus Status = "RemovedStatus"
+	// StartedStatus indicates the consumer has paid the first invoice of a created session
+	StartedStatus Status = "StartedStatus"
 	// AcknowledgedStatus indicates a session has been reported as a success from consumer side
 	AcknowledgedStatus Status = "AcknowledgedStatus"
+	// FailedStatus indicates a session has failed and is going to be removed
+	FailedStatus Status = "FailedStatus"
+	// TimedOutStatus indicates a session has lost the connection with consumer due to failed keep-alive pings
+	TimedOutStatus Status = "TimedOutStatus"
+	// ExpiredStatus indicates a session has reached its maximum duration and is going to be removed
+	ExpiredStatus Status = "ExpiredStatus"
+	// IdleStatus indicates a session has carried no traffic for too long and is going to be removed
+	IdleStatus Status = "IdleStatus"
+)
+
+// FailureReason describes why a session has failed
+type FailureReason string
+
+const (
+	// PaymentEngineFailure indicates the provider side payment engine has failed
+	PaymentEngineFailure FailureReason = "PaymentEngineFailure"
+	// FirstInvoiceTimeoutFailure indicates the consumer has not paid the first invoice in time
+	FirstInvoiceTimeoutFailure FailureReason = "FirstInvoiceTimeoutFailure"
 )
 
 // AppEventSession represents the session change payload
@@ -65,6 +117,12 @@ type AppEventSession struct {
 	Status  Status
 	Service ServiceContext
 	Session SessionContext
+	// Reason explains the status change, if any.
+	Reason string
+	// FailureReason tells why the session has failed, set only for some of the failed sessions.
+	FailureReason FailureReason
+	// Error is the original error which caused the session failure, if any.
+	Error error
 }
 
 // ServiceContext holds service context metadata
@@ -80,4 +138,25 @@ type SessionContext struct {
 	ConsumerLocation market.Location
 	HermesID         common.Address
 	Proposal         market.ServiceProposal
+	// NATTraversal is the last known NAT traversal outcome when the session was created, nil if unknown.
+	NATTraversal *NATTraversalContext
+	// Duration is the total duration of the session, set once the session is removed.
+	Duration time.Duration
+	// Usage is the total usage of the session, set once the session is removed if the payment engine reports it.
+	Usage *UsageContext
+	// Metadata holds the service specific metadata attached to the session at start.
+	Metadata map[string]string
+}
+
+// UsageContext holds the session usage metadata
+type UsageContext struct {
+	Up, Down uint64
+	Tokens   *big.Int
+}
+
+// NATTraversalContext holds the NAT traversal outcome metadata
+type NATTraversalContext struct {
+	Stage      string
+	Successful bool
+	Error      string
 }
@@ -0,0 +1,89 @@
+/*
+ * Copyright (C) 2020 The "MysteriumNetwork/node" Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package pingpong
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/mysteriumnetwork/node/identity"
+	"github.com/mysteriumnetwork/payments/crypto"
+)
+
+// defaultChannelIDCacheSize is the number of provider and hermes pairs the channel ID cache keeps.
+const defaultChannelIDCacheSize = 64
+
+type channelIDKey struct {
+	provider identity.Identity
+	hermesID common.Address
+}
+
+type channelIDEntry struct {
+	key       channelIDKey
+	channelID string
+}
+
+// channelIDCache keeps the recently used provider channel IDs, evicting the least recently used ones.
+type channelIDCache struct {
+	lock    sync.Mutex
+	size    int
+	order   *list.List
+	entries map[channelIDKey]*list.Element
+}
+
+func newChannelIDCache(size int) *channelIDCache {
+	return &channelIDCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[channelIDKey]*list.Element),
+	}
+}
+
+// Get returns the channel ID of the given provider and hermes, generating it if it is not cached.
+func (c *channelIDCache) Get(provider identity.Identity, hermesID common.Address) (string, error) {
+	key := channelIDKey{provider: provider, hermesID: hermesID}
+
+	c.lock.Lock()
+	if element, ok := c.entries[key]; ok {
+		c.order.MoveToFront(element)
+		c.lock.Unlock()
+		return element.Value.(*channelIDEntry).channelID, nil
+	}
+	c.lock.Unlock()
+
+	channelID, err := crypto.GenerateProviderChannelID(provider.Address, hermesID.Hex())
+	if err != nil {
+		return "", err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.order.MoveToFront(element)
+		return channelID, nil
+	}
+	c.entries[key] = c.order.PushFront(&channelIDEntry{key: key, channelID: channelID})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*channelIDEntry).key)
+	}
+	return channelID, nil
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright (C) 2020 The "MysteriumNetwork/node" Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package pingpong
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/mysteriumnetwork/node/identity"
+	"github.com/mysteriumnetwork/payments/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChannelIDCache(t *testing.T) {
+	cache := newChannelIDCache(2)
+	provider := identity.FromAddress("0x0000000000000000000000000000000000000001")
+	hermes1 := common.HexToAddress("0x00000000000000000000000000000000000000a1")
+	hermes2 := common.HexToAddress("0x00000000000000000000000000000000000000a2")
+	hermes3 := common.HexToAddress("0x00000000000000000000000000000000000000a3")
+
+	for _, hermesID := range []common.Address{hermes1, hermes2, hermes1, hermes3} {
+		channelID, err := cache.Get(provider, hermesID)
+		assert.NoError(t, err)
+
+		expected, err := crypto.GenerateProviderChannelID(provider.Address, hermesID.Hex())
+		assert.NoError(t, err)
+		assert.Equal(t, expected, channelID)
+	}
+
+	// hermes2 is the least recently used one, so it is evicted.
+	assert.Len(t, cache.entries, 2)
+	assert.Contains(t, cache.entries, channelIDKey{provider: provider, hermesID: hermes1})
+	assert.Contains(t, cache.entries, channelIDKey{provider: provider, hermesID: hermes3})
+}
+
+func Benchmark_GenerateProviderChannelID(b *testing.B) {
+	provider := identity.FromAddress("0x0000000000000000000000000000000000000001")
+	hermesID := common.HexToAddress("0x00000000000000000000000000000000000000a1")
+
+	for i := 0; i < b.N; i++ {
+		_, _ = crypto.GenerateProviderChannelID(provider.Address, hermesID.Hex())
+	}
+}
+
+func Benchmark_ChannelIDCache_HotProvider(b *testing.B) {
+	cache := newChannelIDCache(defaultChannelIDCacheSize)
+	provider := identity.FromAddress("0x0000000000000000000000000000000000000001")
+	hermesID := common.HexToAddress("0x00000000000000000000000000000000000000a1")
+
+	for i := 0; i < b.N; i++ {
+		_, _ = cache.Get(provider, hermesID)
+	}
+}
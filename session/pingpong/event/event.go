@@ -34,10 +34,51 @@ const (
 	AppTopicEarningsChanged = "earnings_change"
 	// AppTopicInvoicePaid is a topic for publish events exchange message send to provider as a consumer.
 	AppTopicInvoicePaid = "invoice_paid"
+	// AppTopicHermesPromiseQueue represents a topic to which we send hermes promise queue backup events.
+	AppTopicHermesPromiseQueue = "hermes_promise_queue_backed_up"
+	// AppTopicHermesPromiseRevealFailed represents a topic to which we send events about promises whose R could not be revealed.
+	AppTopicHermesPromiseRevealFailed = "hermes_promise_reveal_failed"
+	// AppTopicHermesHealth represents the hermes reachability check results.
+	AppTopicHermesHealth = "hermes_health"
 	// AppTopicSettlementRequest forces the settlement of promises for given provider/hermes.
 	AppTopicSettlementRequest = "settlement_request"
+	// AppTopicRRecoveryExhausted represents a topic to which we send events about promise requests which ran out of R recovery attempts.
+	AppTopicRRecoveryExhausted = "hermes_r_recovery_exhausted"
+	// AppTopicRRecovery represents a topic to which we send events about the R recoveries hermes asked for.
+	AppTopicRRecovery = "hermes_r_recovery"
+	// AppTopicSuspiciousPromise represents a topic to which we send events about promise requests rejected for an anomalous amount.
+	AppTopicSuspiciousPromise = "hermes_promise_suspicious"
 )
 
+// AppEventSuspiciousPromise represents the payload that is sent on the AppTopicSuspiciousPromise.
+type AppEventSuspiciousPromise struct {
+	HermesID    common.Address
+	ProviderID  identity.Identity
+	SessionID   string
+	AgreementID *big.Int
+	// Previous is the agreement total of the previously stored promise of the agreement.
+	Previous *big.Int
+	// Requested is the agreement total of the rejected exchange message.
+	Requested *big.Int
+}
+
+// AppEventRRecovery represents the payload that is sent on the AppTopicRRecovery.
+type AppEventRRecovery struct {
+	HermesID   common.Address
+	ProviderID identity.Identity
+	// Recovered is true if R was recovered and revealed to hermes.
+	Recovered bool
+	// Error explains why R could not be recovered.
+	Error string
+}
+
+// AppEventRRecoveryExhausted represents the payload that is sent on the AppTopicRRecoveryExhausted.
+type AppEventRRecoveryExhausted struct {
+	HermesID   common.Address
+	ProviderID identity.Identity
+	Attempts   int
+}
+
 // AppEventSettlementRequest represents the payload that is sent on the AppTopicSettlementRequest topic.
 type AppEventSettlementRequest struct {
 	HermesID   common.Address
@@ -45,11 +86,38 @@ type AppEventSettlementRequest struct {
 	ChainID    int64
 }
 
+// AppEventHermesHealth represents the payload that is sent on the AppTopicHermesHealth.
+type AppEventHermesHealth struct {
+	HermesID common.Address
+	Online   bool
+	// Reason explains why hermes is not online.
+	Reason string
+}
+
 // AppEventHermesPromise represents the payload that is sent on the AppTopicHermesPromise.
 type AppEventHermesPromise struct {
 	Promise    crypto.Promise
 	HermesID   common.Address
 	ProviderID identity.Identity
+	// DryRun is true if the promise was not issued by hermes, but imitated by a promise handler in dry-run mode.
+	DryRun bool
+	// IsFirst is true if it is the first promise of the agreement, i.e. the first payment received in the session.
+	IsFirst bool
+}
+
+// AppEventHermesPromiseRevealFailed represents the payload that is sent on the AppTopicHermesPromiseRevealFailed.
+type AppEventHermesPromiseRevealFailed struct {
+	ChannelID   string
+	Promise     crypto.Promise
+	AgreementID *big.Int
+	HermesID    common.Address
+	ProviderID  identity.Identity
+}
+
+// AppEventHermesPromiseQueue represents the payload that is sent on the AppTopicHermesPromiseQueue.
+type AppEventHermesPromiseQueue struct {
+	Depth    int
+	Capacity int
 }
 
 // AppEventBalanceChanged represents a balance change event
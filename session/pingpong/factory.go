@@ -51,6 +51,9 @@ const (
 
 	// DefaultHermesFailureCount defines how many times we're allowed to fail to reach hermes in a row before announcing the failure.
 	DefaultHermesFailureCount uint64 = 10
+
+	// DefaultQueueFullCount defines how many times in a row the promise queue is allowed to be full before the session is ended.
+	DefaultQueueFullCount uint64 = 5
 )
 
 var gb = big.NewInt(1024 * 1024 * 1024)
@@ -138,6 +141,7 @@ func InvoiceFactoryCreator(
 			ProvidersHermesID:          providersHermes,
 			Registry:                   registryAddress,
 			MaxHermesFailureCount:      maxHermesFailureCount,
+			MaxQueueFullCount:          DefaultQueueFullCount,
 			MaxAllowedHermesFee:        maxAllowedHermesFee,
 			BlockchainHelper:           blockchainHelper,
 			EventBus:                   eventBus,
@@ -26,6 +26,7 @@ import (
 	"io/ioutil"
 	"math/big"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
@@ -63,6 +64,29 @@ func (aer HermesErrorResponse) Data() string {
 	return aer.ErrorData
 }
 
+// Code returns the error code hermes responded with
+func (aer HermesErrorResponse) Code() HermesErrorCode {
+	return HermesErrorCode(aer.CausedBy)
+}
+
+// HermesErrorCode represents the error codes that hermes returns
+type HermesErrorCode string
+
+// HermesCodeFromError returns the hermes error code if the given error is a hermes error response.
+func HermesCodeFromError(err error) (HermesErrorCode, bool) {
+	var aer HermesErrorResponse
+	if errors.As(err, &aer) {
+		return aer.Code(), true
+	}
+
+	var aerPtr *HermesErrorResponse
+	if errors.As(err, &aerPtr) && aerPtr != nil {
+		return aerPtr.Code(), true
+	}
+
+	return "", false
+}
+
 // UnmarshalJSON unmarshals given data to HermesErrorResponse
 func (aer *HermesErrorResponse) UnmarshalJSON(data []byte) error {
 	var s struct {
@@ -98,16 +122,66 @@ type hermesError interface {
 type HermesCaller struct {
 	transport     *requests.HTTPClient
 	hermesBaseURI string
+	retries       uint64
+}
+
+// DefaultHermesCallerRetries is the default number of times the rate limited hermes requests are retried.
+const DefaultHermesCallerRetries = 3
+
+// HermesCallerConfig configures the connectivity to hermes.
+type HermesCallerConfig struct {
+	// Timeout is the timeout of a single request. The timeout of the shared HTTP client is used if zero.
+	Timeout time.Duration
+	// Retries is the number of times the rate limited requests are retried. DefaultHermesCallerRetries is used if zero.
+	Retries uint64
+	// ProxyURL is the proxy the requests are sent through. Optional.
+	ProxyURL string
 }
 
 // NewHermesCaller returns a new instance of hermes caller.
 func NewHermesCaller(transport *requests.HTTPClient, hermesBaseURI string) *HermesCaller {
+	return NewHermesCallerWithConfig(transport, hermesBaseURI, HermesCallerConfig{})
+}
+
+// NewHermesCallerWithConfig returns a new instance of hermes caller which retries the requests as configured.
+// The transport should be built by NewHermesHTTPClient with the same config.
+func NewHermesCallerWithConfig(transport *requests.HTTPClient, hermesBaseURI string, config HermesCallerConfig) *HermesCaller {
+	retries := config.Retries
+	if retries == 0 {
+		retries = DefaultHermesCallerRetries
+	}
+
 	return &HermesCaller{
 		transport:     transport,
 		hermesBaseURI: hermesBaseURI,
+		retries:       retries,
 	}
 }
 
+// NewHermesHTTPClient returns the HTTP client to reach hermes with.
+// The shared client is returned unless the config sets a timeout or a proxy,
+// in which case a dedicated client is built on a copy of the shared transport.
+func NewHermesHTTPClient(client *requests.HTTPClient, transport *http.Transport, config HermesCallerConfig) (*requests.HTTPClient, error) {
+	if config.Timeout == 0 && config.ProxyURL == "" {
+		return client, nil
+	}
+
+	dedicated := transport.Clone()
+	if config.ProxyURL != "" {
+		proxyURL, err := url.Parse(config.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse hermes proxy URL: %w", err)
+		}
+		dedicated.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	timeout := config.Timeout
+	if timeout == 0 {
+		timeout = requests.DefaultTimeout
+	}
+	return requests.NewHTTPClientWithTransport(dedicated, timeout), nil
+}
+
 // RequestPromise represents the request for a new hermes promise
 type RequestPromise struct {
 	ExchangeMessage crypto.ExchangeMessage `json:"exchange_message"`
@@ -116,15 +190,16 @@ type RequestPromise struct {
 }
 
 // RequestPromise requests a promise from hermes.
-func (ac *HermesCaller) RequestPromise(rp RequestPromise) (crypto.Promise, error) {
+func (ac *HermesCaller) RequestPromise(ctx context.Context, rp RequestPromise) (crypto.Promise, error) {
 	req, err := requests.NewPostRequest(ac.hermesBaseURI, "request_promise", rp)
 	if err != nil {
 		return crypto.Promise{}, fmt.Errorf("could not form request_promise request: %w", err)
 	}
 
 	eback := backoff.NewConstantBackOff(time.Millisecond * 500)
-	boff := backoff.WithMaxRetries(eback, 3)
-	ctx, cancel := context.WithCancel(context.Background())
+	boff := backoff.WithMaxRetries(eback, ac.retries)
+	ctx, cancel := context.WithCancel(ctx)
+	req = req.WithContext(ctx)
 	defer cancel()
 	boff = backoff.WithContext(boff, ctx)
 
@@ -152,7 +227,7 @@ type SetPromiseFeeRequest struct {
 }
 
 // UpdatePromiseFee calls hermes to update its promise with new fee.
-func (ac *HermesCaller) UpdatePromiseFee(promise crypto.Promise, newFee *big.Int) (crypto.Promise, error) {
+func (ac *HermesCaller) UpdatePromiseFee(ctx context.Context, promise crypto.Promise, newFee *big.Int) (crypto.Promise, error) {
 	req, err := requests.NewPostRequest(ac.hermesBaseURI, "change_promise_fee", SetPromiseFeeRequest{
 		HermesPromise: promise,
 		NewFee:        newFee,
@@ -162,7 +237,7 @@ func (ac *HermesCaller) UpdatePromiseFee(promise crypto.Promise, newFee *big.Int
 	}
 
 	res := crypto.Promise{}
-	return res, ac.doRequest(req, &res)
+	return res, ac.doRequest(req.WithContext(ctx), &res)
 }
 
 // RevealObject represents the reveal request object.
@@ -172,8 +247,11 @@ type RevealObject struct {
 	AgreementID *big.Int
 }
 
+// RevealRequest represents a single reveal of a batched reveal request.
+type RevealRequest = RevealObject
+
 // RevealR reveals hashlock key 'r' from 'provider' to the hermes for the agreement identified by 'agreementID'.
-func (ac *HermesCaller) RevealR(r, provider string, agreementID *big.Int) error {
+func (ac *HermesCaller) RevealR(ctx context.Context, r, provider string, agreementID *big.Int) error {
 	req, err := requests.NewPostRequest(ac.hermesBaseURI, "reveal_r", RevealObject{
 		R:           r,
 		Provider:    provider,
@@ -184,9 +262,10 @@ func (ac *HermesCaller) RevealR(r, provider string, agreementID *big.Int) error
 	}
 
 	eback := backoff.NewConstantBackOff(time.Millisecond * 500)
-	boff := backoff.WithMaxRetries(eback, 3)
-	ctx, cancel := context.WithCancel(context.Background())
+	boff := backoff.WithMaxRetries(eback, ac.retries)
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
+	req = req.WithContext(ctx)
 	boff = backoff.WithContext(boff, ctx)
 	return backoff.Retry(func() error {
 		err = ac.doRequest(req, &RevealSuccess{})
@@ -203,6 +282,25 @@ func (ac *HermesCaller) RevealR(r, provider string, agreementID *big.Int) error
 	}, boff)
 }
 
+// Ping checks if hermes is reachable. Any response which is not a server error means hermes is online.
+func (ac *HermesCaller) Ping(ctx context.Context) error {
+	req, err := requests.NewGetRequest(ac.hermesBaseURI, "", nil)
+	if err != nil {
+		return fmt.Errorf("could not form ping request: %w", err)
+	}
+
+	resp, err := ac.transport.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("could not reach hermes: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("hermes responded with status %v", resp.StatusCode)
+	}
+	return nil
+}
+
 // GetConsumerData gets consumer data from hermes
 func (ac *HermesCaller) GetConsumerData(chainID int64, id string) (ConsumerData, error) {
 	req, err := requests.NewGetRequest(ac.hermesBaseURI, fmt.Sprintf("data/consumer/%v", id), nil)
@@ -364,6 +462,9 @@ var ErrTooManyRequests = errors.New("too many simultaneous requests")
 // ErrConsumerUnregistered indicates that the consumer is not registered.
 var ErrConsumerUnregistered = errors.New("consumer unregistered")
 
+// ErrHermesTransactorFeeTooLow indicates that the transactor fee of the promise request is below the fee hermes currently accepts.
+var ErrHermesTransactorFeeTooLow = errors.New("transactor fee too low")
+
 var hermesCauseToError = map[string]error{
 	ErrHermesInvalidSignature.Error():         ErrHermesInvalidSignature,
 	ErrHermesInternal.Error():                 ErrHermesInternal,
@@ -379,6 +480,7 @@ var hermesCauseToError = map[string]error{
 	ErrNeedsRRecovery.Error():                 ErrNeedsRRecovery,
 	ErrTooManyRequests.Error():                ErrTooManyRequests,
 	ErrConsumerUnregistered.Error():           ErrConsumerUnregistered,
+	ErrHermesTransactorFeeTooLow.Error():      ErrHermesTransactorFeeTooLow,
 }
 
 type rRecoveryDetails struct {
@@ -18,6 +18,7 @@
 package pingpong
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -52,7 +53,7 @@ func TestHermesCaller_RequestPromise_OK(t *testing.T) {
 
 	c := requests.NewHTTPClient("0.0.0.0", time.Second)
 	caller := NewHermesCaller(c, server.URL)
-	p, err := caller.RequestPromise(RequestPromise{})
+	p, err := caller.RequestPromise(context.Background(), RequestPromise{})
 	assert.Nil(t, err)
 
 	assert.EqualValues(t, promise, p)
@@ -66,7 +67,7 @@ func TestHermesCaller_RequestPromise_Error(t *testing.T) {
 
 	c := requests.NewHTTPClient("0.0.0.0", time.Second)
 	caller := NewHermesCaller(c, server.URL)
-	_, err := caller.RequestPromise(RequestPromise{})
+	_, err := caller.RequestPromise(context.Background(), RequestPromise{})
 	assert.NotNil(t, err)
 }
 
@@ -78,7 +79,7 @@ func TestHermesCaller_RevealR_Error(t *testing.T) {
 
 	c := requests.NewHTTPClient("0.0.0.0", time.Second)
 	caller := NewHermesCaller(c, server.URL)
-	err := caller.RevealR("r", "provider", big.NewInt(1))
+	err := caller.RevealR(context.Background(), "r", "provider", big.NewInt(1))
 	assert.NotNil(t, err)
 }
 
@@ -94,7 +95,7 @@ func TestHermesCaller_RevealR_OK(t *testing.T) {
 
 	c := requests.NewHTTPClient("0.0.0.0", time.Second)
 	caller := NewHermesCaller(c, server.URL)
-	err := caller.RevealR("r", "provider", big.NewInt(1))
+	err := caller.RevealR(context.Background(), "r", "provider", big.NewInt(1))
 	assert.Nil(t, err)
 }
 
@@ -124,12 +125,29 @@ func TestHermesCaller_UnmarshalsErrors(t *testing.T) {
 
 		c := requests.NewHTTPClient("0.0.0.0", time.Second)
 		caller := NewHermesCaller(c, server.URL)
-		err := caller.RevealR("r", "provider", big.NewInt(1))
+		err := caller.RevealR(context.Background(), "r", "provider", big.NewInt(1))
 		assert.EqualError(t, errors.Unwrap(err), v.Error())
+		assert.True(t, errors.Is(err, v))
+
+		code, ok := HermesCodeFromError(err)
+		assert.True(t, ok)
+		assert.Equal(t, HermesErrorCode(k), code)
 		server.Close()
 	}
 }
 
+func TestHermesCodeFromError(t *testing.T) {
+	_, ok := HermesCodeFromError(errors.New("not a hermes error"))
+	assert.False(t, ok)
+
+	_, ok = HermesCodeFromError(nil)
+	assert.False(t, ok)
+
+	code, ok := HermesCodeFromError(fmt.Errorf("wrapped: %w", &HermesErrorResponse{CausedBy: "overspend"}))
+	assert.True(t, ok)
+	assert.Equal(t, HermesErrorCode("overspend"), code)
+}
+
 func TestHermesGetConsumerData_OK(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -237,3 +255,56 @@ func TestLatestPromise_isValid(t *testing.T) {
 		})
 	}
 }
+
+func TestHermesCaller_Ping(t *testing.T) {
+	for _, tc := range []struct {
+		status      int
+		expectedErr bool
+	}{
+		{status: http.StatusOK},
+		{status: http.StatusNotFound},
+		{status: http.StatusBadGateway, expectedErr: true},
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tc.status)
+		}))
+
+		caller := NewHermesCaller(requests.NewHTTPClient("0.0.0.0", time.Second), server.URL)
+		err := caller.Ping(context.Background())
+		assert.Equal(t, tc.expectedErr, err != nil, tc.status)
+		server.Close()
+	}
+}
+
+func TestNewHermesCallerWithConfig(t *testing.T) {
+	shared := requests.NewHTTPClient("0.0.0.0", time.Second)
+	transport := requests.NewTransport(requests.NewDialer("0.0.0.0").DialContext)
+
+	client, err := NewHermesHTTPClient(shared, transport, HermesCallerConfig{})
+	assert.NoError(t, err)
+	assert.Equal(t, shared, client)
+
+	caller := NewHermesCallerWithConfig(client, "http://hermes", HermesCallerConfig{})
+	assert.Equal(t, uint64(DefaultHermesCallerRetries), caller.retries)
+	caller = NewHermesCallerWithConfig(client, "http://hermes", HermesCallerConfig{Retries: 5})
+	assert.Equal(t, uint64(5), caller.retries)
+
+	_, err = NewHermesHTTPClient(shared, transport, HermesCallerConfig{ProxyURL: "://bad"})
+	assert.Error(t, err)
+
+	var proxiedHost string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxiedHost = r.URL.Host
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxy.Close()
+
+	client, err = NewHermesHTTPClient(shared, transport, HermesCallerConfig{ProxyURL: proxy.URL, Timeout: time.Second})
+	assert.NoError(t, err)
+	assert.NotEqual(t, shared, client)
+	assert.Nil(t, transport.Proxy)
+
+	caller = NewHermesCallerWithConfig(client, "http://hermes.test", HermesCallerConfig{})
+	assert.NoError(t, caller.Ping(context.Background()))
+	assert.Equal(t, "hermes.test", proxiedHost)
+}
@@ -18,13 +18,20 @@
 package pingpong
 
 import (
+	"bytes"
+	"context"
 	"encoding/hex"
 	"encoding/json"
 	stdErr "errors"
 	"fmt"
 	"math/big"
+	"runtime/debug"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/cenkalti/backoff/v4"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/mysteriumnetwork/node/config"
 	"github.com/mysteriumnetwork/node/core/node/event"
@@ -34,13 +41,27 @@ import (
 	"github.com/mysteriumnetwork/node/identity/registry"
 	sessionEvent "github.com/mysteriumnetwork/node/session/event"
 	pinge "github.com/mysteriumnetwork/node/session/pingpong/event"
+	"github.com/mysteriumnetwork/payments/client"
 	"github.com/mysteriumnetwork/payments/crypto"
 	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
 type hermesPromiseStorage interface {
 	Store(promise HermesPromise) error
+	Get(chainID int64, channelID string) (HermesPromise, error)
+	ListUnrevealed(chainID int64) ([]HermesPromise, error)
+}
+
+type pendingPromiseRequestStorage interface {
+	Store(request PendingPromiseRequest) error
+	List() ([]PendingPromiseRequest, error)
+	Delete(request PendingPromiseRequest) error
+}
+
+type rRecoveryStorage interface {
+	Store(providerID identity.Identity, hermesID common.Address, agreementID *big.Int, encrypted []byte) error
 }
 
 type feeProvider interface {
@@ -49,9 +70,20 @@ type feeProvider interface {
 
 // HermesHTTPRequester represents HTTP requests to Hermes.
 type HermesHTTPRequester interface {
-	RequestPromise(rp RequestPromise) (crypto.Promise, error)
-	RevealR(r string, provider string, agreementID *big.Int) error
-	UpdatePromiseFee(promise crypto.Promise, newFee *big.Int) (crypto.Promise, error)
+	RequestPromise(ctx context.Context, rp RequestPromise) (crypto.Promise, error)
+	RevealR(ctx context.Context, r string, provider string, agreementID *big.Int) error
+	UpdatePromiseFee(ctx context.Context, promise crypto.Promise, newFee *big.Int) (crypto.Promise, error)
+	Ping(ctx context.Context) error
+}
+
+// HermesBatchRevealer is implemented by the hermes callers which are able to reveal multiple R in a single request.
+type HermesBatchRevealer interface {
+	RevealRBatch(ctx context.Context, reveals []RevealRequest) error
+}
+
+// HermesRevealConfirmer is implemented by the hermes callers which are able to confirm that hermes has processed the revealed R.
+type HermesRevealConfirmer interface {
+	RRevealed(ctx context.Context, agreementID *big.Int) (bool, error)
 }
 
 type encryption interface {
@@ -65,108 +97,1370 @@ type HermesCallerFactory func(url string) HermesHTTPRequester
 // HermesPromiseHandlerDeps represents the HermesPromiseHandler dependencies.
 type HermesPromiseHandlerDeps struct {
 	HermesPromiseStorage hermesPromiseStorage
-	FeeProvider          feeProvider
-	Encryption           encryption
-	EventBus             eventbus.Publisher
-	HermesURLGetter      hermesURLGetter
-	HermesCallerFactory  HermesCallerFactory
+	// PendingRequestStorage keeps the queued requests across restarts. Optional.
+	PendingRequestStorage pendingPromiseRequestStorage
+	FeeProvider           feeProvider
+	Encryption            encryption
+	EventBus              eventbus.Publisher
+	HermesURLGetter       hermesURLGetter
+	HermesCallerFactory   HermesCallerFactory
+	// PromiseRetry configures the retries of promise requests that failed due to transient errors.
+	PromiseRetry PromiseRetryConfig
+	// QueueSize is the capacity of the promise request queue.
+	QueueSize int
+	// Workers is the number of goroutines processing the promise request queue concurrently. Defaults to DefaultWorkers.
+	// The requests of the same provider and agreement are never processed concurrently, they wait for each other.
+	Workers int
+	// QueueHighWaterMark is the fraction of the queue capacity after which the queue is considered backed up.
+	QueueHighWaterMark float64
+	// AllowedChainIDs are the chains the node operates on. Requests for other chains are rejected. Optional, all chains are allowed if empty.
+	AllowedChainIDs []int64
+	// RevealSweepInterval is the interval at which the stored promises with unrevealed R are revealed again.
+	RevealSweepInterval time.Duration
+	// HealthCheckInterval is the interval at which the hermes reachability is checked and published. Checks are disabled if negative.
+	HealthCheckInterval time.Duration
+	// FeeRefreshInterval is the interval at which the cached transactor fees are refreshed. Refreshes are disabled if negative.
+	FeeRefreshInterval time.Duration
+	// RevealBatchSize is the maximum number of R revealed in a single request, if the hermes caller supports batched reveals.
+	RevealBatchSize int
+	// RevealConfirmPolls is the number of times hermes is polled for the confirmation of the revealed R,
+	// if the hermes caller supports it. Defaults to DefaultRevealConfirmPolls.
+	RevealConfirmPolls int
+	// RevealConfirmInterval is the interval between the reveal confirmation polls. Defaults to DefaultRevealConfirmInterval.
+	RevealConfirmInterval time.Duration
+	// Clock returns the current time. Defaults to time.Now.
+	Clock func() time.Time
+	// DryRun runs the promise requests through the whole pipeline without touching hermes or the storages.
+	// Promises are imitated instead of requested from hermes, R is not revealed and
+	// neither the promises nor the pending requests are stored. The published events are marked as dry-run.
+	DryRun bool
+	// RequestObserver is called for every dequeued promise request before it is processed, whether it ends up succeeding,
+	// failing or being skipped as cancelled.
+	// It is called in a separate goroutine, so it can not block the handler. Optional.
+	RequestObserver func(RequestInfo)
+	// HermesSignerGetter resolves the address which signs the promises of hermes.
+	// Optional, the promises are expected to be signed by the hermes address itself if not set.
+	HermesSignerGetter hermesSignerGetter
+	// AutoSettle enables requesting the settlement once the unsettled value of a channel reaches the SettleThreshold.
+	AutoSettle bool
+	// SettleThreshold is the unsettled value of a channel after which the settlement is requested.
+	SettleThreshold *big.Int
+	// ProviderChannelGetter provides the amount already settled on-chain for the channels first seen by the handler.
+	// Optional, the first promise of a channel seen by the handler is considered settled if not set.
+	ProviderChannelGetter providerChannelGetter
+	// HermesPolicies are the promise amount policies of the individual hermes. Optional.
+	HermesPolicies map[common.Address]HermesPolicy
+	// StartTimeout is the time a promise request waits for the handler to start consuming the queue.
+	// The request fails with ErrHandlerNotStarted if the handler is not started in time.
+	// Optional, the requests are queued without waiting if not set.
+	StartTimeout time.Duration
+	// MaxRecoveryAttempts is the number of times R is recovered within a single promise request or reveal,
+	// hermes asking for more recoveries fails the request with ErrRecoveryAttemptsExhausted.
+	// Defaults to DefaultMaxRecoveryAttempts, unlimited if negative.
+	MaxRecoveryAttempts int
+	// RequestTimeout is the deadline of a promise request across all of its steps, from the fee fetch to the reveal of R.
+	// The hermes calls in flight are cancelled once it passes. Defaults to DefaultRequestTimeout, disabled if negative.
+	RequestTimeout time.Duration
+	// RekeyRRecovery enables storing the recovered R details encrypted again under the current key of the provider,
+	// so that the recovery data does not stay tied to old key material. Requires RRecoveryStorage.
+	RekeyRRecovery bool
+	// RRecoveryStorage keeps the re-encrypted R recovery details. Optional.
+	RRecoveryStorage rRecoveryStorage
+	// PlaintextRecovery sends the R recovery details to hermes unencrypted, prefixed with PlaintextRecoveryPrefix,
+	// so that no key material is needed to recover R from a local test hermes.
+	// It must never be enabled in production, as anyone who gets hold of the recovery data can reveal R.
+	PlaintextRecovery bool
+	// MaxAgreementTotalGrowth is the multiple of the agreement total of the previously stored promise of the agreement
+	// which the next exchange message may not exceed. A bigger jump is treated as an inflated amount, the request fails
+	// with ErrAnomalousAgreementTotal and the AppTopicSuspiciousPromise event is published. Disabled if not positive.
+	MaxAgreementTotalGrowth int64
+	// DeferReveal stores the promises with unrevealed R and leaves their reveal to the reveal sweep,
+	// so that the promises can be collected and revealed at different times.
+	// The settlement of the deferred promises is not requested, as it needs R to be revealed.
+	DeferReveal bool
+}
+
+// PlaintextRecoveryPrefix flags the R recovery data which is not encrypted.
+// It is not hex, so the hermeses expecting the encrypted data reject it instead of storing it.
+const PlaintextRecoveryPrefix = "plaintext:"
+
+// HermesPolicy holds the promise amounts preferred by a hermes.
+type HermesPolicy struct {
+	// MinPromiseAmount is the smallest amount a promise is requested for, on top of the previous promise of the agreement.
+	// Smaller amounts are not worth the fees, the promise is requested once the amount accumulates.
+	MinPromiseAmount *big.Int
+	// SettleThreshold overrides the SettleThreshold of the handler for the channels of the hermes.
+	SettleThreshold *big.Int
+}
+
+// RequestInfo describes the promise request passed to the request observer.
+type RequestInfo struct {
+	ProviderID     identity.Identity
+	SessionID      string
+	HermesID       common.Address
+	AgreementID    *big.Int
+	AgreementTotal *big.Int
+}
+
+// DefaultQueueSize is the default capacity of the promise request queue.
+const DefaultQueueSize = 100
+
+// DefaultWorkers is the default number of goroutines processing the promise request queue.
+const DefaultWorkers = 1
+
+// DefaultQueueHighWaterMark is the default fraction of queue capacity after which the queue is considered backed up.
+const DefaultQueueHighWaterMark = 0.8
+
+// DefaultRevealSweepInterval is the default interval at which the unrevealed promises are revealed again.
+const DefaultRevealSweepInterval = 10 * time.Minute
+
+// DefaultHealthCheckInterval is the default interval at which the hermes reachability is checked.
+const DefaultHealthCheckInterval = time.Minute
+
+// DefaultFeeRefreshInterval is the default interval at which the cached transactor fees are refreshed.
+const DefaultFeeRefreshInterval = 5 * time.Minute
+
+// DefaultRevealConfirmPolls is the default number of times hermes is polled for the confirmation of the revealed R.
+const DefaultRevealConfirmPolls = 5
+
+// DefaultRevealConfirmInterval is the default interval between the reveal confirmation polls.
+const DefaultRevealConfirmInterval = time.Second
+
+// DefaultMaxRecoveryAttempts is the default number of times R is recovered within a single promise request.
+const DefaultMaxRecoveryAttempts = 3
+
+// DefaultRequestTimeout is the default deadline of a promise request.
+const DefaultRequestTimeout = 2 * time.Minute
+
+// DefaultRevealBatchSize is the default maximum number of R revealed in a single request.
+const DefaultRevealBatchSize = 20
+
+// PromiseRetryConfig represents the retry configuration for promise requests.
+type PromiseRetryConfig struct {
+	MaxRetries uint64
+	BaseDelay  time.Duration
+}
+
+// DefaultPromiseRetryConfig returns the default promise retry configuration.
+func DefaultPromiseRetryConfig() PromiseRetryConfig {
+	return PromiseRetryConfig{
+		MaxRetries: 3,
+		BaseDelay:  time.Second,
+	}
 }
 
 // HermesPromiseHandler handles the hermes promises for ongoing sessions.
+//
+// The handler starts consuming the request queue once the service reaches the running state.
+// Requests made before that are queued and processed after the start, see Ready.
 type HermesPromiseHandler struct {
-	deps          HermesPromiseHandlerDeps
-	queue         chan enqueuedRequest
-	stop          chan struct{}
-	stopOnce      sync.Once
-	startOnce     sync.Once
-	transactorFee registry.FeesResponse
+	deps      HermesPromiseHandlerDeps
+	queue     chan enqueuedRequest
+	stop      chan struct{}
+	stopOnce  sync.Once
+	startOnce sync.Once
+	ready     chan struct{}
+	readyOnce sync.Once
+	markReady sync.Once
+	closing   chan struct{}
+	closeOnce sync.Once
+	// processLock is held for reading while requests are processed, so that the shutdown can wait for them.
+	processLock sync.RWMutex
+
+	transactorFees     map[int64]registry.FeesResponse
+	transactorFeesLock sync.Mutex
+
+	queueBackedUp     bool
+	queueBackedUpLock sync.Mutex
+
+	// inflight are the outstanding requests by provider and agreement, with the duplicates coalesced into them.
+	inflight     map[promiseRequestKey][]*inflightRequest
+	inflightLock sync.Mutex
+	// agreementLocks keep the requests of the same provider and agreement from being processed concurrently.
+	agreementLocks     map[promiseRequestKey]*agreementLock
+	agreementLocksLock sync.Mutex
+
+	// queued tracks the requests waiting in the queue by session, marking the cancelled ones.
+	queued     map[string]map[chan error]bool
+	queuedLock sync.Mutex
+	// processing counts the requests being processed by session, guarded by the queuedLock.
+	processing map[string]int
+	// sessionsChanged is closed once a request leaves the queue or is processed, guarded by the queuedLock.
+	sessionsChanged chan struct{}
+
+	channelIDs     *channelIDCache
+	channelIDsOnce sync.Once
+
+	// settledAmounts are the promise amounts of the channels at the time their settlement was last requested.
+	settledAmounts     map[string]*big.Int
+	settledAmountsLock sync.Mutex
+
+	// lastHermesErrors are the errors of the last failed interaction with each hermes, cleared once it succeeds.
+	lastHermesErrors     map[common.Address]HermesErrorInfo
+	lastHermesErrorsLock sync.Mutex
+
+	stats promiseHandlerStats
+}
+
+// HermesErrorInfo describes the last failed interaction with a hermes.
+type HermesErrorInfo struct {
+	Error string
+	Time  time.Time
+}
+
+// LastHermesErrors returns the errors of the last failed interaction with each hermes.
+// The hermeses whose last interaction succeeded are not included.
+func (aph *HermesPromiseHandler) LastHermesErrors() map[common.Address]HermesErrorInfo {
+	aph.lastHermesErrorsLock.Lock()
+	defer aph.lastHermesErrorsLock.Unlock()
+
+	result := make(map[common.Address]HermesErrorInfo, len(aph.lastHermesErrors))
+	for hermesID, info := range aph.lastHermesErrors {
+		result[hermesID] = info
+	}
+	return result
+}
+
+// recordHermesError remembers the error of the interaction with the hermes, or forgets the previous one on success.
+func (aph *HermesPromiseHandler) recordHermesError(hermesID common.Address, err error) {
+	aph.lastHermesErrorsLock.Lock()
+	defer aph.lastHermesErrorsLock.Unlock()
+
+	if err == nil {
+		delete(aph.lastHermesErrors, hermesID)
+		return
+	}
+	if aph.lastHermesErrors == nil {
+		aph.lastHermesErrors = make(map[common.Address]HermesErrorInfo)
+	}
+	aph.lastHermesErrors[hermesID] = HermesErrorInfo{Error: err.Error(), Time: aph.now()}
+}
+
+// HermesPromiseHandlerStats are the counters of the hermes promise handler.
+type HermesPromiseHandlerStats struct {
+	// RecoveryAttempts is the number of R recoveries hermes asked for, a spike usually means lost or undecryptable R.
+	RecoveryAttempts uint64
+	// RecoverySuccesses is the number of R recoveries which ended with the R revealed to hermes.
+	RecoverySuccesses uint64
+}
+
+type promiseHandlerStats struct {
+	recoveryAttempts  uint64
+	recoverySuccesses uint64
+}
+
+// Stats returns a snapshot of the hermes promise handler counters. It is safe to call concurrently.
+func (aph *HermesPromiseHandler) Stats() HermesPromiseHandlerStats {
+	return HermesPromiseHandlerStats{
+		RecoveryAttempts:  atomic.LoadUint64(&aph.stats.recoveryAttempts),
+		RecoverySuccesses: atomic.LoadUint64(&aph.stats.recoverySuccesses),
+	}
 }
 
 // NewHermesPromiseHandler returns a new instance of hermes promise handler.
 func NewHermesPromiseHandler(deps HermesPromiseHandlerDeps) *HermesPromiseHandler {
+	if deps.PromiseRetry == (PromiseRetryConfig{}) {
+		deps.PromiseRetry = DefaultPromiseRetryConfig()
+	}
+	if deps.QueueSize == 0 {
+		deps.QueueSize = DefaultQueueSize
+	}
+	if deps.Workers == 0 {
+		deps.Workers = DefaultWorkers
+	}
+	if deps.QueueHighWaterMark == 0 {
+		deps.QueueHighWaterMark = DefaultQueueHighWaterMark
+	}
+	if deps.RevealSweepInterval == 0 {
+		deps.RevealSweepInterval = DefaultRevealSweepInterval
+	}
+	if deps.HealthCheckInterval == 0 {
+		deps.HealthCheckInterval = DefaultHealthCheckInterval
+	}
+	if deps.FeeRefreshInterval == 0 {
+		deps.FeeRefreshInterval = DefaultFeeRefreshInterval
+	}
+	if deps.RevealBatchSize == 0 {
+		deps.RevealBatchSize = DefaultRevealBatchSize
+	}
+	if deps.RequestTimeout == 0 {
+		deps.RequestTimeout = DefaultRequestTimeout
+	}
+	if deps.MaxRecoveryAttempts == 0 {
+		deps.MaxRecoveryAttempts = DefaultMaxRecoveryAttempts
+	}
+	if deps.Clock == nil {
+		deps.Clock = time.Now
+	}
+	if deps.PlaintextRecovery {
+		log.Warn().Msg("R recovery details are sent to hermes unencrypted, this must only be used with a local test hermes")
+	}
+	if deps.DeferReveal && deps.RevealSweepInterval < 0 {
+		log.Warn().Msg("R reveal is deferred while the reveal sweep is disabled, R will not be revealed")
+	}
+
 	return &HermesPromiseHandler{
-		deps:  deps,
-		queue: make(chan enqueuedRequest, 100),
-		stop:  make(chan struct{}),
+		deps:    deps,
+		queue:   make(chan enqueuedRequest, deps.QueueSize),
+		stop:    make(chan struct{}),
+		closing: make(chan struct{}),
 	}
 }
 
 type enqueuedRequest struct {
+	ctx        context.Context
 	errChan    chan error
+	resultChan chan RequestPromiseResult
 	r          []byte
 	em         crypto.ExchangeMessage
 	providerID identity.Identity
 	sessionID  string
+	// final is set for the final promise of the session, which is never skipped.
+	final bool
+}
+
+type hermesSignerGetter interface {
+	GetHermesOperator(chainID int64, hermesID common.Address) (common.Address, error)
+}
+
+type providerChannelGetter interface {
+	GetProviderChannel(chainID int64, hermesAddress common.Address, addressToCheck common.Address, pending bool) (client.ProviderChannel, error)
 }
 
 type hermesURLGetter interface {
 	GetHermesURL(address common.Address) (string, error)
 }
 
+// ErrInvalidPromiseSignature indicates that the promise returned by hermes is not signed by hermes.
+var ErrInvalidPromiseSignature = stdErr.New("promise is not signed by hermes")
+
+// ErrHandlerStopped indicates that the promise handler is stopped and no longer processes requests.
+var ErrHandlerStopped = stdErr.New("hermes promise handler stopped")
+
+// ErrRevealNotConfirmed indicates that hermes did not confirm the revealed R in time.
+var ErrRevealNotConfirmed = stdErr.New("reveal of R not confirmed by hermes")
+
+// ErrChainNotAllowed indicates that the exchange message is for a chain the node does not operate on.
+var ErrChainNotAllowed = stdErr.New("chain is not allowed")
+
+// ErrHandlerNotStarted indicates that the promise handler did not start consuming the queue in time.
+var ErrHandlerNotStarted = stdErr.New("hermes promise handler not started")
+
+// ErrRequestCancelled indicates that the promise request was cancelled before it was processed.
+var ErrRequestCancelled = stdErr.New("hermes promise request cancelled")
+
+// ErrRequestTimeout indicates that the promise request did not go through all of its steps before the deadline.
+var ErrRequestTimeout = stdErr.New("hermes promise request timed out")
+
+// ErrRecoveryAttemptsExhausted indicates that hermes kept asking to recover R after the allowed number of recoveries.
+var ErrRecoveryAttemptsExhausted = stdErr.New("r recovery attempts exhausted")
+
+// ErrQueueFull indicates that the promise request queue is full and the request was not accepted.
+var ErrQueueFull = stdErr.New("hermes promise queue is full")
+
+// ErrPlaintextRecoveryDisabled indicates that hermes returned unencrypted R recovery data while the plaintext recovery is disabled.
+var ErrPlaintextRecoveryDisabled = stdErr.New("plaintext R recovery is disabled")
+
+// ErrInvalidAgreementID indicates that the exchange message has no agreement ID or it is not positive.
+var ErrInvalidAgreementID = stdErr.New("agreement ID must be positive")
+
+// ErrAnomalousAgreementTotal indicates that the agreement total of the exchange message grew implausibly since the previous promise.
+var ErrAnomalousAgreementTotal = stdErr.New("anomalous agreement total")
+
 // RequestPromise adds the request to the queue.
 func (aph *HermesPromiseHandler) RequestPromise(r []byte, em crypto.ExchangeMessage, providerID identity.Identity, sessionID string) <-chan error {
-	er := enqueuedRequest{
+	return aph.RequestPromiseCtx(context.Background(), r, em, providerID, sessionID)
+}
+
+// RequestPromiseCtx adds the request to the queue.
+// If the context is cancelled while waiting for the queue or for the request to be processed,
+// the returned channel yields the context error and is closed.
+func (aph *HermesPromiseHandler) RequestPromiseCtx(ctx context.Context, r []byte, em crypto.ExchangeMessage, providerID identity.Identity, sessionID string) <-chan error {
+	return aph.enqueue(newEnqueuedRequest(ctx, r, em, providerID, sessionID))
+}
+
+// RequestPromiseResult represents the outcome of a promise request.
+type RequestPromiseResult struct {
+	Promise  crypto.Promise
+	Revealed bool
+	// Skipped is true if the promise was not requested at all, SkipReason tells why.
+	Skipped    bool
+	SkipReason string
+	Err        error
+}
+
+// RequestPromiseWithResult adds the request to the queue.
+// The returned channel yields a single result once the request is processed and is closed.
+func (aph *HermesPromiseHandler) RequestPromiseWithResult(ctx context.Context, r []byte, em crypto.ExchangeMessage, providerID identity.Identity, sessionID string) <-chan RequestPromiseResult {
+	return aph.requestPromiseWithResult(newEnqueuedRequest(ctx, r, em, providerID, sessionID))
+}
+
+func (aph *HermesPromiseHandler) requestPromiseWithResult(er enqueuedRequest) <-chan RequestPromiseResult {
+	er.resultChan = make(chan RequestPromiseResult, 1)
+	errChan := aph.enqueue(er)
+
+	results := make(chan RequestPromiseResult, 1)
+	go func() {
+		defer close(results)
+
+		var firstErr error
+		for err := range errChan {
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+
+		var result RequestPromiseResult
+		select {
+		case result = <-er.resultChan:
+		default:
+		}
+		if result.Err == nil {
+			result.Err = firstErr
+		}
+		results <- result
+	}()
+	return results
+}
+
+// SubmitPromise requests the promise and waits until it is processed or the context is done.
+// It lets the session manager settle the final payment of a session, see service.PromiseSubmitter.
+// The final promise is never skipped as dust.
+func (aph *HermesPromiseHandler) SubmitPromise(ctx context.Context, r []byte, em crypto.ExchangeMessage, providerID identity.Identity, sessionID string) error {
+	er := newEnqueuedRequest(ctx, r, em, providerID, sessionID)
+	er.final = true
+	result := <-aph.requestPromiseWithResult(er)
+	return result.Err
+}
+
+func (aph *HermesPromiseHandler) enqueue(er enqueuedRequest) <-chan error {
+	if aph.isClosing() {
+		return newErrChan(ErrHandlerStopped)
+	}
+	if err := aph.waitReady(er.ctx); err != nil {
+		return newErrChan(err)
+	}
+
+	ctx := er.ctx
+	if !aph.joinInflight(er) {
+		aph.trackQueued(er)
+		select {
+		case aph.queue <- er:
+			aph.checkQueueDepth()
+		case <-ctx.Done():
+			aph.untrackQueued(er)
+			go aph.finishRequest(er, RequestPromiseResult{Err: ctx.Err()})
+		}
+	}
+
+	if ctx.Done() == nil {
+		return er.errChan
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		defer close(result)
+		select {
+		case err, more := <-er.errChan:
+			if more {
+				result <- err
+			}
+		case <-ctx.Done():
+			result <- ctx.Err()
+			// make sure the handler does not get stuck on reporting the result.
+			go drainErrChan(er.errChan)
+		}
+	}()
+	return result
+}
+
+// TryRequestPromise adds the request to the queue without blocking.
+// If the queue is full, the returned channel yields ErrQueueFull and is closed.
+func (aph *HermesPromiseHandler) TryRequestPromise(r []byte, em crypto.ExchangeMessage, providerID identity.Identity, sessionID string) <-chan error {
+	if aph.isClosing() {
+		return newErrChan(ErrHandlerStopped)
+	}
+
+	er := newEnqueuedRequest(context.Background(), r, em, providerID, sessionID)
+	if !aph.joinInflight(er) {
+		aph.trackQueued(er)
+		select {
+		case aph.queue <- er:
+			aph.checkQueueDepth()
+		default:
+			aph.untrackQueued(er)
+			go aph.finishRequest(er, RequestPromiseResult{Err: ErrQueueFull})
+		}
+	}
+	return er.errChan
+}
+
+type promiseRequestKey struct {
+	providerID  identity.Identity
+	agreementID string
+}
+
+type inflightRequest struct {
+	owner   chan error
+	em      crypto.ExchangeMessage
+	final   bool
+	waiters []enqueuedRequest
+}
+
+type agreementLock struct {
+	lock sync.Mutex
+	refs int
+}
+
+func newPromiseRequestKey(er enqueuedRequest) (promiseRequestKey, bool) {
+	if er.em.AgreementID == nil {
+		return promiseRequestKey{}, false
+	}
+	return promiseRequestKey{
+		providerID:  er.providerID,
+		agreementID: er.em.AgreementID.String(),
+	}, true
+}
+
+// joinInflight coalesces the request with an in-flight duplicate of it, a request for the same provider,
+// agreement total and promise. It returns true if the request was attached to an in-flight one and should not be enqueued.
+// The requests with a different agreement total are enqueued, so that their own total is requested from hermes.
+func (aph *HermesPromiseHandler) joinInflight(er enqueuedRequest) bool {
+	key, ok := newPromiseRequestKey(er)
+	if !ok {
+		return false
+	}
+
+	aph.inflightLock.Lock()
+	defer aph.inflightLock.Unlock()
+
+	if aph.inflight == nil {
+		aph.inflight = make(map[promiseRequestKey][]*inflightRequest)
+	}
+
+	for _, existing := range aph.inflight[key] {
+		// a final request can not wait on a request which may be skipped as dust.
+		if isDuplicateRequest(existing.em, er.em) && (existing.final || !er.final) {
+			existing.waiters = append(existing.waiters, er)
+			return true
+		}
+	}
+
+	aph.inflight[key] = append(aph.inflight[key], &inflightRequest{owner: er.errChan, em: er.em, final: er.final})
+	return false
+}
+
+// releaseInflight removes the in-flight request and returns the requests waiting on its result.
+func (aph *HermesPromiseHandler) releaseInflight(er enqueuedRequest) []enqueuedRequest {
+	key, ok := newPromiseRequestKey(er)
+	if !ok {
+		return nil
+	}
+
+	aph.inflightLock.Lock()
+	defer aph.inflightLock.Unlock()
+
+	requests := aph.inflight[key]
+	for i, existing := range requests {
+		if existing.owner != er.errChan {
+			continue
+		}
+
+		requests = append(requests[:i:i], requests[i+1:]...)
+		if len(requests) == 0 {
+			delete(aph.inflight, key)
+		} else {
+			aph.inflight[key] = requests
+		}
+		return existing.waiters
+	}
+	return nil
+}
+
+// isDuplicateRequest returns true if the exchange messages are for the same agreement total and promise.
+func isDuplicateRequest(a, b crypto.ExchangeMessage) bool {
+	if !equalAmounts(a.AgreementTotal, b.AgreementTotal) {
+		return false
+	}
+	if a.Promise.Amount == nil || a.Promise.Fee == nil || b.Promise.Amount == nil || b.Promise.Fee == nil {
+		return equalAmounts(a.Promise.Amount, b.Promise.Amount) && bytes.Equal(a.Promise.Hashlock, b.Promise.Hashlock)
+	}
+	return bytes.Equal(a.Promise.GetHash(), b.Promise.GetHash())
+}
+
+func equalAmounts(a, b *big.Int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Cmp(b) == 0
+}
+
+// lockAgreement waits until no other request of the same provider and agreement is processed.
+// The returned function releases the agreement.
+func (aph *HermesPromiseHandler) lockAgreement(er enqueuedRequest) func() {
+	key, ok := newPromiseRequestKey(er)
+	if !ok {
+		return func() {}
+	}
+	return aph.lockAgreementKey(key)
+}
+
+// lockPromiseAgreement waits until no request of the provider and agreement of the stored promise is processed.
+// The returned function releases the agreement.
+func (aph *HermesPromiseHandler) lockPromiseAgreement(promise HermesPromise) func() {
+	if promise.AgreementID == nil {
+		return func() {}
+	}
+	return aph.lockAgreementKey(promiseRequestKey{
+		providerID:  promise.Identity,
+		agreementID: promise.AgreementID.String(),
+	})
+}
+
+func (aph *HermesPromiseHandler) lockAgreementKey(key promiseRequestKey) func() {
+	aph.agreementLocksLock.Lock()
+	if aph.agreementLocks == nil {
+		aph.agreementLocks = make(map[promiseRequestKey]*agreementLock)
+	}
+	lock, ok := aph.agreementLocks[key]
+	if !ok {
+		lock = &agreementLock{}
+		aph.agreementLocks[key] = lock
+	}
+	lock.refs++
+	aph.agreementLocksLock.Unlock()
+
+	lock.lock.Lock()
+	return func() {
+		lock.lock.Unlock()
+
+		aph.agreementLocksLock.Lock()
+		defer aph.agreementLocksLock.Unlock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(aph.agreementLocks, key)
+		}
+	}
+}
+
+// finishRequest reports the result to the request and to all the requests coalesced with it.
+func (aph *HermesPromiseHandler) finishRequest(er enqueuedRequest, result RequestPromiseResult) {
+	for _, waiter := range aph.releaseInflight(er) {
+		go reportResult(waiter, result)
+	}
+	reportResult(er, result)
+}
+
+func reportResult(er enqueuedRequest, result RequestPromiseResult) {
+	defer close(er.errChan)
+
+	if er.resultChan != nil {
+		er.resultChan <- result
+	}
+	if result.Err != nil {
+		er.errChan <- result.Err
+	}
+}
+
+func newEnqueuedRequest(ctx context.Context, r []byte, em crypto.ExchangeMessage, providerID identity.Identity, sessionID string) enqueuedRequest {
+	return enqueuedRequest{
+		ctx:        ctx,
 		r:          r,
 		em:         em,
 		providerID: providerID,
 		errChan:    make(chan error),
 		sessionID:  sessionID,
 	}
-	aph.queue <- er
-	return er.errChan
 }
 
-func (aph *HermesPromiseHandler) updateFee() {
-	fees, err := aph.deps.FeeProvider.FetchSettleFees(config.GetInt64(config.FlagChainID))
+// newErrChan returns a closed channel holding the given error.
+func newErrChan(err error) <-chan error {
+	errChan := make(chan error, 1)
+	errChan <- err
+	close(errChan)
+	return errChan
+}
+
+func drainErrChan(errChan <-chan error) {
+	for range errChan {
+	}
+}
+
+// CancelSession cancels the queued promise requests of the given session.
+// The cancelled requests are skipped when dequeued and fail with ErrRequestCancelled.
+// The request that is already being processed is not affected.
+func (aph *HermesPromiseHandler) CancelSession(sessionID string) {
+	aph.queuedLock.Lock()
+	defer aph.queuedLock.Unlock()
+
+	for errChan := range aph.queued[sessionID] {
+		aph.queued[sessionID][errChan] = true
+	}
+}
+
+func (aph *HermesPromiseHandler) trackQueued(er enqueuedRequest) {
+	aph.queuedLock.Lock()
+	defer aph.queuedLock.Unlock()
+
+	if aph.queued == nil {
+		aph.queued = make(map[string]map[chan error]bool)
+	}
+	if aph.queued[er.sessionID] == nil {
+		aph.queued[er.sessionID] = make(map[chan error]bool)
+	}
+	aph.queued[er.sessionID][er.errChan] = false
+}
+
+// untrackQueued stops tracking the dequeued request and returns true if it was cancelled.
+func (aph *HermesPromiseHandler) untrackQueued(er enqueuedRequest) bool {
+	aph.queuedLock.Lock()
+	defer aph.queuedLock.Unlock()
+
+	return aph.untrackQueuedLocked(er)
+}
+
+func (aph *HermesPromiseHandler) untrackQueuedLocked(er enqueuedRequest) bool {
+	defer aph.notifySessionsChanged()
+
+	requests, ok := aph.queued[er.sessionID]
+	if !ok {
+		return false
+	}
+
+	cancelled := requests[er.errChan]
+	delete(requests, er.errChan)
+	if len(requests) == 0 {
+		delete(aph.queued, er.sessionID)
+	}
+	return cancelled
+}
+
+// startProcessing moves the dequeued request from the queued requests to the processed ones
+// and returns true if it was cancelled, in which case it is not processed.
+func (aph *HermesPromiseHandler) startProcessing(er enqueuedRequest) bool {
+	aph.queuedLock.Lock()
+	defer aph.queuedLock.Unlock()
+
+	if aph.untrackQueuedLocked(er) {
+		return true
+	}
+	if aph.processing == nil {
+		aph.processing = make(map[string]int)
+	}
+	aph.processing[er.sessionID]++
+	return false
+}
+
+func (aph *HermesPromiseHandler) finishProcessing(er enqueuedRequest) {
+	aph.queuedLock.Lock()
+	defer aph.queuedLock.Unlock()
+
+	aph.processing[er.sessionID]--
+	if aph.processing[er.sessionID] <= 0 {
+		delete(aph.processing, er.sessionID)
+	}
+	aph.notifySessionsChanged()
+}
+
+// notifySessionsChanged wakes up the callers draining the sessions, must be called with the queuedLock held.
+func (aph *HermesPromiseHandler) notifySessionsChanged() {
+	if aph.sessionsChanged != nil {
+		close(aph.sessionsChanged)
+		aph.sessionsChanged = nil
+	}
+}
+
+// DrainSessions waits until the queued and the processed promise requests of the given sessions are finished
+// or the context is done, so that the sessions can be destroyed without losing their last promises.
+// The handler keeps accepting new requests meanwhile, the callers are expected to stop requesting promises for the sessions first.
+func (aph *HermesPromiseHandler) DrainSessions(ctx context.Context, sessionIDs []string) error {
+	for {
+		aph.queuedLock.Lock()
+		pending := 0
+		for _, id := range sessionIDs {
+			pending += len(aph.queued[id]) + aph.processing[id]
+		}
+		if aph.sessionsChanged == nil {
+			aph.sessionsChanged = make(chan struct{})
+		}
+		changed := aph.sessionsChanged
+		aph.queuedLock.Unlock()
+
+		if pending == 0 {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return fmt.Errorf("could not drain %d promise requests of the sessions: %w", pending, ctx.Err())
+		}
+	}
+}
+
+// QueueDepth returns the number of requests waiting in the queue.
+func (aph *HermesPromiseHandler) QueueDepth() int {
+	return len(aph.queue)
+}
+
+// checkQueueDepth publishes an event once the queue crosses the high water mark.
+func (aph *HermesPromiseHandler) checkQueueDepth() {
+	capacity := cap(aph.queue)
+	if capacity == 0 || aph.deps.QueueHighWaterMark == 0 {
+		return
+	}
+
+	depth := aph.QueueDepth()
+	threshold := int(float64(capacity) * aph.deps.QueueHighWaterMark)
+
+	aph.queueBackedUpLock.Lock()
+	defer aph.queueBackedUpLock.Unlock()
+
+	backedUp := depth >= threshold
+	if backedUp == aph.queueBackedUp {
+		return
+	}
+
+	aph.queueBackedUp = backedUp
+	if !backedUp {
+		return
+	}
+
+	log.Warn().Msgf("Hermes promise queue is backing up: %v/%v", depth, capacity)
+	aph.publish(pinge.AppTopicHermesPromiseQueue, pinge.AppEventHermesPromiseQueue{
+		Depth:    depth,
+		Capacity: capacity,
+	})
+}
+
+func (aph *HermesPromiseHandler) updateFee(chainID int64) error {
+	fees, err := aph.deps.FeeProvider.FetchSettleFees(chainID)
+	if err != nil {
+		log.Warn().Err(err).Msg("could not fetch fees, ignoring")
+		return err
+	}
+
+	aph.transactorFeesLock.Lock()
+	defer aph.transactorFeesLock.Unlock()
+
+	if aph.transactorFees == nil {
+		aph.transactorFees = make(map[int64]registry.FeesResponse)
+	}
+	aph.transactorFees[chainID] = fees
+	return nil
+}
+
+// getTransactorFee returns the cached transactor fee for the given chain, refreshing it if it has expired.
+func (aph *HermesPromiseHandler) getTransactorFee(chainID int64) *big.Int {
+	fees, ok := aph.cachedFee(chainID)
+	if !ok || !aph.isFeeValid(fees) {
+		aph.updateFee(chainID)
+		fees, _ = aph.cachedFee(chainID)
+	}
+	return fees.Fee
+}
+
+// isFeeValid returns false if the fee has already expired and should be re-requested.
+func (aph *HermesPromiseHandler) isFeeValid(fees registry.FeesResponse) bool {
+	return aph.now().UTC().Before(fees.ValidUntil.UTC())
+}
+
+func (aph *HermesPromiseHandler) now() time.Time {
+	if aph.deps.Clock == nil {
+		return time.Now()
+	}
+	return aph.deps.Clock()
+}
+
+// refreshFees periodically refreshes the fees of the cached chains, so that the requests don't have to wait for them.
+func (aph *HermesPromiseHandler) refreshFees() {
+	if aph.deps.FeeRefreshInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(aph.deps.FeeRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-aph.stop:
+			return
+		case <-ticker.C:
+			for _, chainID := range aph.cachedFeeChains() {
+				aph.updateFee(chainID)
+			}
+		}
+	}
+}
+
+func (aph *HermesPromiseHandler) cachedFeeChains() []int64 {
+	aph.transactorFeesLock.Lock()
+	defer aph.transactorFeesLock.Unlock()
+
+	chainIDs := make([]int64, 0, len(aph.transactorFees))
+	for chainID := range aph.transactorFees {
+		chainIDs = append(chainIDs, chainID)
+	}
+	return chainIDs
+}
+
+func (aph *HermesPromiseHandler) cachedFee(chainID int64) (registry.FeesResponse, bool) {
+	aph.transactorFeesLock.Lock()
+	defer aph.transactorFeesLock.Unlock()
+
+	fees, ok := aph.transactorFees[chainID]
+	return fees, ok
+}
+
+// Ready returns true once the handler consumes the request queue.
+func (aph *HermesPromiseHandler) Ready() bool {
+	select {
+	case <-aph.readyChan():
+		return true
+	default:
+		return false
+	}
+}
+
+func (aph *HermesPromiseHandler) readyChan() chan struct{} {
+	aph.readyOnce.Do(func() {
+		aph.ready = make(chan struct{})
+	})
+	return aph.ready
+}
+
+// waitReady waits for the handler to start if the start timeout is configured.
+func (aph *HermesPromiseHandler) waitReady(ctx context.Context) error {
+	if aph.deps.StartTimeout <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(aph.deps.StartTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-aph.readyChan():
+		return nil
+	case <-aph.closing:
+		return ErrHandlerStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return ErrHandlerNotStarted
+	}
+}
+
+func (aph *HermesPromiseHandler) handleRequests() {
+	aph.markReady.Do(func() {
+		close(aph.readyChan())
+	})
+
+	workers := aph.deps.Workers
+	if workers < 1 {
+		workers = DefaultWorkers
+	}
+
+	log.Debug().Msgf("hermes promise handler started with %v workers", workers)
+	defer log.Debug().Msgf("hermes promise handler stopped")
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			aph.consumeQueue()
+		}()
+	}
+	wg.Wait()
+}
+
+func (aph *HermesPromiseHandler) consumeQueue() {
+	for {
+		select {
+		case <-aph.stop:
+			return
+		case entry := <-aph.queue:
+			aph.checkQueueDepth()
+			aph.processRequest(entry)
+		}
+	}
+}
+
+func (aph *HermesPromiseHandler) processRequest(er enqueuedRequest) {
+	aph.observeRequest(er)
+
+	if aph.startProcessing(er) {
+		log.Debug().Msgf("Skipping cancelled promise request. SessionID=%s", er.sessionID)
+		go aph.finishRequest(er, RequestPromiseResult{Err: ErrRequestCancelled})
+		return
+	}
+	defer aph.finishProcessing(er)
+
+	unlock := aph.lockAgreement(er)
+	defer unlock()
+
+	aph.processLock.RLock()
+	defer aph.processLock.RUnlock()
+
+	aph.requestPromise(er)
+}
+
+// channelID returns the provider channel ID for the given hermes, caching it for the subsequent requests.
+func (aph *HermesPromiseHandler) channelID(providerID identity.Identity, hermesID common.Address) (string, error) {
+	aph.channelIDsOnce.Do(func() {
+		aph.channelIDs = newChannelIDCache(defaultChannelIDCacheSize)
+	})
+	return aph.channelIDs.Get(providerID, hermesID)
+}
+
+func (aph *HermesPromiseHandler) observeRequest(er enqueuedRequest) {
+	if aph.deps.RequestObserver == nil {
+		return
+	}
+
+	go aph.deps.RequestObserver(RequestInfo{
+		ProviderID:     er.providerID,
+		SessionID:      er.sessionID,
+		HermesID:       common.HexToAddress(er.em.HermesID),
+		AgreementID:    er.em.AgreementID,
+		AgreementTotal: er.em.AgreementTotal,
+	})
+}
+
+// Shutdown stops accepting new requests and processes the queued ones until the queue is drained or the context is done.
+// The requests that could not be processed in time are persisted if a pending request storage is available,
+// otherwise they fail with ErrHandlerStopped.
+func (aph *HermesPromiseHandler) Shutdown(ctx context.Context) error {
+	aph.closeOnce.Do(func() {
+		close(aph.closing)
+	})
+	defer aph.doStop()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("could not drain hermes promise queue: %w", err)
+		}
+
+		select {
+		case entry := <-aph.queue:
+			aph.processRequest(entry)
+		default:
+			return aph.waitForProcessing(ctx)
+		}
+	}
+}
+
+// waitForProcessing waits for the requests that are currently being processed to finish.
+func (aph *HermesPromiseHandler) waitForProcessing(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		aph.processLock.Lock()
+		defer aph.processLock.Unlock()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("could not wait for hermes promise request to finish: %w", ctx.Err())
+	}
+}
+
+func (aph *HermesPromiseHandler) isClosing() bool {
+	select {
+	case <-aph.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// Subscribe subscribes HermesPromiseHandler to relevant events.
+func (aph *HermesPromiseHandler) Subscribe(bus eventbus.Subscriber) error {
+	err := bus.SubscribeAsync(event.AppTopicNode, aph.handleNodeStopEvents)
+	if err != nil {
+		return fmt.Errorf("could not subscribe to node events: %w", err)
+	}
+
+	err = bus.SubscribeAsync(servicestate.AppTopicServiceStatus, aph.handleServiceEvent)
+	if err != nil {
+		return fmt.Errorf("could not subscribe to service events: %w", err)
+	}
+
+	err = bus.SubscribeAsync(sessionEvent.AppTopicSession, aph.handleSessionEvent)
+	if err != nil {
+		return fmt.Errorf("could not subscribe to session events: %w", err)
+	}
+	return nil
+}
+
+func (aph *HermesPromiseHandler) handleSessionEvent(ev sessionEvent.AppEventSession) {
+	if ev.Status == sessionEvent.RemovedStatus {
+		aph.CancelSession(ev.Session.ID)
+	}
+}
+
+func (aph *HermesPromiseHandler) handleServiceEvent(ev servicestate.AppEventServiceStatus) {
+	if ev.Status == string(servicestate.Running) {
+		aph.startOnce.Do(
+			func() {
+				aph.updateFee(config.GetInt64(config.FlagChainID))
+				go aph.replayPendingRequests()
+				go aph.sweepUnrevealed()
+				go aph.refreshFees()
+				go aph.checkHermesHealth()
+				aph.handleRequests()
+			})
+	}
+}
+
+func (aph *HermesPromiseHandler) doStop() {
+	aph.stopOnce.Do(func() {
+		close(aph.stop)
+		aph.flushQueue()
+	})
+}
+
+// flushQueue empties the queue after the handler is stopped.
+// If a pending request storage is available, the requests are stored so they can be replayed on the next start.
+func (aph *HermesPromiseHandler) flushQueue() {
+	for {
+		select {
+		case er := <-aph.queue:
+			if aph.untrackQueued(er) {
+				go aph.finishRequest(er, RequestPromiseResult{Err: ErrRequestCancelled})
+				continue
+			}
+			if aph.deps.PendingRequestStorage == nil || aph.deps.DryRun {
+				go aph.finishRequest(er, RequestPromiseResult{Err: ErrHandlerStopped})
+				continue
+			}
+
+			err := aph.deps.PendingRequestStorage.Store(PendingPromiseRequest{
+				R:               er.r,
+				ExchangeMessage: er.em,
+				ProviderID:      er.providerID,
+				SessionID:       er.sessionID,
+			})
+			if err != nil {
+				go aph.finishRequest(er, RequestPromiseResult{Err: fmt.Errorf("could not persist pending promise request: %w", err)})
+				continue
+			}
+			go aph.finishRequest(er, RequestPromiseResult{})
+		default:
+			return
+		}
+	}
+}
+
+// replayPendingRequests enqueues the requests that were persisted when the node was last stopped.
+// A persisted request is deleted only once it is processed successfully, the failed ones are replayed on the next start.
+func (aph *HermesPromiseHandler) replayPendingRequests() {
+	if aph.deps.PendingRequestStorage == nil {
+		return
+	}
+
+	pending, err := aph.deps.PendingRequestStorage.List()
+	if err != nil {
+		log.Err(err).Msg("Could not load pending promise requests")
+		return
+	}
+
+	if len(pending) > 0 {
+		log.Info().Msgf("Replaying %v pending promise requests", len(pending))
+	}
+
+	for _, p := range pending {
+		result := aph.RequestPromiseWithResult(context.Background(), p.R, p.ExchangeMessage, p.ProviderID, p.SessionID)
+		go func(p PendingPromiseRequest) {
+			if res := <-result; res.Err != nil {
+				log.Err(res.Err).Msgf("Replayed promise request failed, will replay it on the next start. SessionID=%s", p.SessionID)
+				return
+			}
+			if err := aph.deps.PendingRequestStorage.Delete(p); err != nil {
+				log.Err(err).Msgf("Could not delete replayed promise request. SessionID=%s", p.SessionID)
+			}
+		}(p)
+	}
+}
+
+// sweepUnrevealed periodically reveals the R of stored promises that failed to be revealed.
+func (aph *HermesPromiseHandler) sweepUnrevealed() {
+	if aph.deps.RevealSweepInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(aph.deps.RevealSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-aph.stop:
+			return
+		case <-ticker.C:
+			for _, chainID := range aph.sweptChainIDs() {
+				aph.revealUnrevealed(chainID)
+			}
+		}
+	}
+}
+
+// sweptChainIDs returns the chains which promises are swept, the allowed chains or the configured chain if all are allowed.
+func (aph *HermesPromiseHandler) sweptChainIDs() []int64 {
+	if len(aph.deps.AllowedChainIDs) == 0 {
+		return []int64{config.GetInt64(config.FlagChainID)}
+	}
+	return aph.deps.AllowedChainIDs
+}
+
+// CheckHermes checks if the given hermes is reachable.
+func (aph *HermesPromiseHandler) CheckHermes(hermesID common.Address) error {
+	hermesCaller, err := aph.getHermesCaller(hermesID)
+	if err != nil {
+		return fmt.Errorf("could not get hermes caller: %w", err)
+	}
+	return hermesCaller.Ping(context.Background())
+}
+
+// checkHermesHealth periodically checks the reachability of the hermes in use and publishes the results.
+func (aph *HermesPromiseHandler) checkHermesHealth() {
+	if aph.deps.HealthCheckInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(aph.deps.HealthCheckInterval)
+	defer ticker.Stop()
+
+	hermesID := common.HexToAddress(config.GetString(config.FlagHermesID))
+	for {
+		aph.publishHermesHealth(hermesID)
+
+		select {
+		case <-aph.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (aph *HermesPromiseHandler) publishHermesHealth(hermesID common.Address) {
+	health := pinge.AppEventHermesHealth{
+		HermesID: hermesID,
+		Online:   true,
+	}
+	if err := aph.CheckHermes(hermesID); err != nil {
+		log.Warn().Err(err).Msgf("Hermes %v is not reachable", hermesID.Hex())
+		health.Online = false
+		health.Reason = err.Error()
+	}
+	aph.publish(pinge.AppTopicHermesHealth, health)
+}
+
+func (aph *HermesPromiseHandler) revealUnrevealed(chainID int64) {
+	if aph.deps.DryRun {
+		return
+	}
+
+	promises, err := aph.deps.HermesPromiseStorage.ListUnrevealed(chainID)
+	if err != nil {
+		log.Err(err).Msg("Could not list unrevealed hermes promises")
+		return
+	}
+
+	byHermes := make(map[common.Address][]HermesPromise)
+	hermesIDs := make([]common.Address, 0)
+	for _, promise := range promises {
+		if _, ok := byHermes[promise.HermesID]; !ok {
+			hermesIDs = append(hermesIDs, promise.HermesID)
+		}
+		byHermes[promise.HermesID] = append(byHermes[promise.HermesID], promise)
+	}
+
+	for _, hermesID := range hermesIDs {
+		aph.revealForHermes(hermesID, byHermes[hermesID])
+	}
+}
+
+// revealForHermes reveals the R of the given promises in batches if hermes supports it, one by one otherwise.
+func (aph *HermesPromiseHandler) revealForHermes(hermesID common.Address, promises []HermesPromise) {
+	hermesCaller, err := aph.getHermesCaller(hermesID)
 	if err != nil {
-		log.Warn().Err(err).Msg("could not fetch fees, ignoring")
+		log.Warn().Err(err).Msgf("Could not get hermes caller for %v, will retry later", hermesID.Hex())
 		return
 	}
 
-	aph.transactorFee = fees
-}
+	batchRevealer, ok := hermesCaller.(HermesBatchRevealer)
+	if !ok || aph.deps.RevealBatchSize <= 1 {
+		aph.revealEach(promises)
+		return
+	}
 
-func (aph *HermesPromiseHandler) handleRequests() {
-	log.Debug().Msgf("hermes promise handler started")
-	defer log.Debug().Msgf("hermes promise handler stopped")
-	for {
-		select {
-		case <-aph.stop:
-			return
-		case entry := <-aph.queue:
-			aph.requestPromise(entry)
+	for start := 0; start < len(promises); start += aph.deps.RevealBatchSize {
+		end := start + aph.deps.RevealBatchSize
+		if end > len(promises) {
+			end = len(promises)
+		}
+
+		batch := promises[start:end]
+		if err := aph.revealBatch(batchRevealer, batch); err != nil {
+			log.Warn().Err(err).Msgf("Could not reveal %d R in a batch, will reveal them one by one", len(batch))
+			aph.revealEach(batch)
 		}
 	}
 }
 
-// Subscribe subscribes HermesPromiseHandler to relevant events.
-func (aph *HermesPromiseHandler) Subscribe(bus eventbus.Subscriber) error {
-	err := bus.SubscribeAsync(event.AppTopicNode, aph.handleNodeStopEvents)
-	if err != nil {
-		return fmt.Errorf("could not subscribe to node events: %w", err)
+// revealContext returns the context of a reveal made by the sweep, bounded by the request timeout.
+func (aph *HermesPromiseHandler) revealContext() (context.Context, context.CancelFunc) {
+	ctx := withRecoveryAttempts(context.Background())
+	if aph.deps.RequestTimeout > 0 {
+		return context.WithTimeout(ctx, aph.deps.RequestTimeout)
 	}
+	return context.WithCancel(ctx)
+}
 
-	err = bus.SubscribeAsync(servicestate.AppTopicServiceStatus, aph.handleServiceEvent)
-	if err != nil {
-		return fmt.Errorf("could not subscribe to service events: %w", err)
+// revealEach reveals the R of the promises one by one, each while no request of its agreement is processed.
+func (aph *HermesPromiseHandler) revealEach(promises []HermesPromise) {
+	for _, promise := range promises {
+		logger := promiseLogger("", promise.AgreementID, promise.Identity, promise.HermesID)
+		unlock := aph.lockPromiseAgreement(promise)
+		ctx, cancel := aph.revealContext()
+		err := aph.revealR(ctx, promise, logger)
+		cancel()
+		unlock()
+		if err != nil {
+			logger.Warn().Err(err).Msgf("Could not reveal R for channel %v, will retry later", promise.ChannelID)
+		}
 	}
-	return nil
 }
 
-func (aph *HermesPromiseHandler) handleServiceEvent(ev servicestate.AppEventServiceStatus) {
-	if ev.Status == string(servicestate.Running) {
-		aph.startOnce.Do(
-			func() {
-				aph.updateFee()
-				aph.handleRequests()
-			})
+// revealBatch reveals the R of the promises in a single call, storing each revealed promise while no request of its agreement is processed.
+func (aph *HermesPromiseHandler) revealBatch(batchRevealer HermesBatchRevealer, promises []HermesPromise) error {
+	reveals := make([]RevealRequest, len(promises))
+	for i, promise := range promises {
+		reveals[i] = RevealRequest{
+			R:           promise.R.Reveal(),
+			Provider:    promise.Identity.Address,
+			AgreementID: promise.AgreementID,
+		}
 	}
-}
 
-func (aph *HermesPromiseHandler) doStop() {
-	aph.stopOnce.Do(func() {
-		close(aph.stop)
-	})
+	ctx, cancel := aph.revealContext()
+	defer cancel()
+	if err := batchRevealer.RevealRBatch(ctx, reveals); err != nil {
+		return fmt.Errorf("could not reveal R batch: %w", err)
+	}
+
+	for _, promise := range promises {
+		promise.Revealed = true
+		unlock := aph.lockPromiseAgreement(promise)
+		err := aph.storePromise(promise, log.Logger)
+		unlock()
+		if err != nil {
+			log.Err(err).Msgf("Could not store revealed hermes promise for channel %v", promise.ChannelID)
+		}
+	}
+	return nil
 }
 
 func (aph *HermesPromiseHandler) handleNodeStopEvents(e event.Payload) {
@@ -177,18 +1471,57 @@ func (aph *HermesPromiseHandler) handleNodeStopEvents(e event.Payload) {
 }
 
 func (aph *HermesPromiseHandler) requestPromise(er enqueuedRequest) {
-	defer close(er.errChan)
+	aph.finishRequest(er, aph.processPromiseRequest(er))
+}
+
+// processPromiseRequest goes through the steps of the promise request within the request deadline.
+func (aph *HermesPromiseHandler) processPromiseRequest(er enqueuedRequest) RequestPromiseResult {
+	if err := er.ctx.Err(); err != nil {
+		return RequestPromiseResult{Err: fmt.Errorf("promise request cancelled: %w", err)}
+	}
+
+	ctx, cancel := er.ctx, context.CancelFunc(func() {})
+	if aph.deps.RequestTimeout > 0 {
+		ctx, cancel = context.WithTimeout(er.ctx, aph.deps.RequestTimeout)
+	}
+	defer cancel()
+	ctx = withRecoveryAttempts(ctx)
+
+	result := aph.promiseRequestSteps(ctx, er)
+	if result.Err != nil && er.ctx.Err() == nil && stdErr.Is(ctx.Err(), context.DeadlineExceeded) {
+		result.Err = fmt.Errorf("%w after %v: %v", ErrRequestTimeout, aph.deps.RequestTimeout, result.Err)
+	}
+	return result
+}
+
+func (aph *HermesPromiseHandler) promiseRequestSteps(ctx context.Context, er enqueuedRequest) RequestPromiseResult {
+	// the agreement ID ends up in the R recovery details and in the reveal of R, neither of them makes sense without it.
+	if er.em.AgreementID == nil || er.em.AgreementID.Sign() <= 0 {
+		return RequestPromiseResult{Err: fmt.Errorf("could not request promise for agreement %v: %w", er.em.AgreementID, ErrInvalidAgreementID)}
+	}
+	if !aph.isChainAllowed(er.em.ChainID) {
+		return RequestPromiseResult{Err: fmt.Errorf("could not request promise for chain %v: %w", er.em.ChainID, ErrChainNotAllowed)}
+	}
 
 	providerID := er.providerID
 	hermesID := common.HexToAddress(er.em.HermesID)
-	channelID, err := crypto.GenerateProviderChannelID(providerID.Address, hermesID.Hex())
+	logger := promiseLogger(er.sessionID, er.em.AgreementID, providerID, hermesID)
+	channelID, err := aph.channelID(providerID, hermesID)
 	if err != nil {
-		er.errChan <- fmt.Errorf("could not generate provider channel address: %w", err)
-		return
+		return RequestPromiseResult{Err: fmt.Errorf("could not generate provider channel address: %w", err)}
 	}
 
-	if !aph.transactorFee.IsValid() {
-		aph.updateFee()
+	previous := aph.previousPromise(HermesPromise{
+		ChannelID:   channelID,
+		AgreementID: er.em.AgreementID,
+		Promise:     crypto.Promise{ChainID: er.em.ChainID},
+	}, logger)
+	if reason, skip := aph.skipDust(er, hermesID, previous); skip {
+		logger.Debug().Msgf("Not requesting hermes promise: %s", reason)
+		return RequestPromiseResult{Skipped: true, SkipReason: reason}
+	}
+	if err := aph.checkAgreementTotal(er, hermesID, previous, logger); err != nil {
+		return RequestPromiseResult{Err: err}
 	}
 
 	details := rRecoveryDetails{
@@ -198,71 +1531,387 @@ func (aph *HermesPromiseHandler) requestPromise(er enqueuedRequest) {
 
 	bytes, err := json.Marshal(details)
 	if err != nil {
-		er.errChan <- fmt.Errorf("could not marshal R recovery details: %w", err)
-		return
+		return RequestPromiseResult{Err: fmt.Errorf("could not marshal R recovery details: %w", err)}
 	}
 
-	encrypted, err := aph.deps.Encryption.Encrypt(providerID.ToCommonAddress(), bytes)
+	recoveryData, err := aph.encodeRecoveryData(providerID, bytes)
 	if err != nil {
-		er.errChan <- fmt.Errorf("could not encrypt R: %w", err)
-		return
+		return RequestPromiseResult{Err: err}
 	}
 
 	request := RequestPromise{
 		ExchangeMessage: er.em,
-		TransactorFee:   aph.transactorFee.Fee,
-		RRecoveryData:   hex.EncodeToString(encrypted),
+		TransactorFee:   aph.getTransactorFee(er.em.ChainID),
+		RRecoveryData:   recoveryData,
+	}
+	// the fee fetch and the encryption can not be cancelled, the deadline is checked once they are done.
+	if err := ctx.Err(); err != nil {
+		return RequestPromiseResult{Err: fmt.Errorf("could not prepare promise request: %w", err)}
 	}
 
-	hermesCaller, err := aph.getHermesCaller(hermesID)
-	if err != nil {
-		er.errChan <- fmt.Errorf("could not get hermes caller: %w", err)
-		return
+	promise, err := aph.requestPromiseFrom(ctx, hermesID, request, logger)
+	if stdErr.Is(err, ErrHermesTransactorFeeTooLow) {
+		logger.Warn().Err(err).Msgf("Hermes rejected the transactor fee %v, refreshing the fee and retrying", request.TransactorFee)
+		if err := aph.updateFee(er.em.ChainID); err != nil {
+			return RequestPromiseResult{Err: fmt.Errorf("could not refresh the rejected transactor fee: %w", err)}
+		}
+		request.TransactorFee = aph.getTransactorFee(er.em.ChainID)
+		promise, err = aph.requestPromiseFrom(ctx, hermesID, request, logger)
+	}
+	for stdErr.Is(err, ErrNeedsRRecovery) {
+		if err := aph.handleHermesError(ctx, err, providerID, hermesID, logger); err != nil {
+			return RequestPromiseResult{Err: fmt.Errorf("hermes request promise error: %w", err)}
+		}
+		// hermes issues the promise once R of the previous promise is recovered.
+		promise, err = aph.requestPromiseFrom(ctx, hermesID, request, logger)
 	}
-	promise, err := hermesCaller.RequestPromise(request)
-	err = aph.handleHermesError(err, providerID, hermesID)
+	err = aph.handleHermesError(ctx, err, providerID, hermesID, logger)
 	if err != nil {
-		er.errChan <- fmt.Errorf("hermes request promise error: %w", err)
-		return
+		return RequestPromiseResult{Err: fmt.Errorf("hermes request promise error: %w", err)}
 	}
 
 	if promise.ChainID != request.ExchangeMessage.ChainID {
-		log.Debug().Msgf("Received promise with wrong chain id from hermes. Expected %v, got %v", request.ExchangeMessage.ChainID, promise.ChainID)
+		logger.Debug().Msgf("Received promise with wrong chain id from hermes. Expected %v, got %v", request.ExchangeMessage.ChainID, promise.ChainID)
+	}
+
+	if err := aph.validatePromiseSignature(promise, er.em.ChainID, hermesID); err != nil {
+		return RequestPromiseResult{Err: fmt.Errorf("hermes issued an invalid promise: %w", err)}
 	}
 
 	ap := HermesPromise{
-		ChannelID:   channelID,
-		Identity:    providerID,
-		HermesID:    hermesID,
-		Promise:     promise,
-		R:           hex.EncodeToString(er.r),
-		Revealed:    false,
-		AgreementID: er.em.AgreementID,
+		ChannelID:      channelID,
+		Identity:       providerID,
+		HermesID:       hermesID,
+		Promise:        promise,
+		R:              SecretR(hex.EncodeToString(er.r)),
+		Revealed:       false,
+		AgreementID:    er.em.AgreementID,
+		AgreementTotal: er.em.AgreementTotal,
 	}
 
-	err = aph.deps.HermesPromiseStorage.Store(ap)
-	if err != nil && !stdErr.Is(err, ErrAttemptToOverwrite) {
-		er.errChan <- fmt.Errorf("could not store hermes promise: %w", err)
-		return
+	// the requests of the same agreement are not processed concurrently, so the previous promise can not be stored in between.
+	delta := earnedDelta(ap, previous)
+	if !aph.deps.DryRun {
+		if err := aph.storePromise(ap, logger); err != nil {
+			return RequestPromiseResult{Promise: promise, Err: fmt.Errorf("could not store hermes promise: %w", err)}
+		}
 	}
 
-	aph.deps.EventBus.Publish(pinge.AppTopicHermesPromise, pinge.AppEventHermesPromise{
+	aph.publish(pinge.AppTopicHermesPromise, pinge.AppEventHermesPromise{
 		Promise:    promise,
 		HermesID:   hermesID,
 		ProviderID: providerID,
+		DryRun:     aph.deps.DryRun,
+		IsFirst:    previous == nil,
 	})
-	aph.deps.EventBus.Publish(sessionEvent.AppTopicTokensEarned, sessionEvent.AppEventTokensEarned{
+	aph.publish(sessionEvent.AppTopicTokensEarned, sessionEvent.AppEventTokensEarned{
 		ProviderID: providerID,
 		SessionID:  er.sessionID,
+		HermesID:   hermesID,
 		Total:      er.em.AgreementTotal,
+		Delta:      delta,
+		DryRun:     aph.deps.DryRun,
 	})
 
-	err = aph.revealR(ap)
-	err = aph.handleHermesError(err, providerID, hermesID)
+	if aph.deps.DeferReveal {
+		logger.Debug().Msg("Leaving the reveal of R to the reveal sweep")
+		return RequestPromiseResult{Promise: promise}
+	}
+
+	err = aph.revealR(ctx, ap, logger)
+	err = aph.handleHermesError(ctx, err, providerID, hermesID, logger)
 	if err != nil {
-		er.errChan <- fmt.Errorf("hermes reveal r error: %w", err)
+		aph.publishRevealFailed(ap)
+		return RequestPromiseResult{Promise: promise, Err: fmt.Errorf("hermes reveal r error: %w", err)}
+	}
+
+	aph.requestSettlementIfNeeded(ap, logger)
+
+	return RequestPromiseResult{Promise: promise, Revealed: true}
+}
+
+// requestSettlementIfNeeded requests the settlement of the promise channel once the value accumulated
+// since the previous settlement request reaches the threshold.
+// The channels first seen by the handler, e.g. after a restart, are seeded with the amount settled on-chain,
+// or with the amount of their first promise if it is not known.
+func (aph *HermesPromiseHandler) requestSettlementIfNeeded(hermesPromise HermesPromise, logger zerolog.Logger) {
+	threshold := aph.deps.SettleThreshold
+	if policy, ok := aph.deps.HermesPolicies[hermesPromise.HermesID]; ok && policy.SettleThreshold != nil {
+		threshold = policy.SettleThreshold
+	}
+	amount := hermesPromise.Promise.Amount
+	if !aph.deps.AutoSettle || aph.deps.DryRun || threshold == nil || amount == nil {
+		return
+	}
+
+	if _, ok := aph.settledAmount(hermesPromise.ChannelID); !ok {
+		aph.seedSettledAmount(hermesPromise, logger)
+	}
+
+	aph.settledAmountsLock.Lock()
+	settled := aph.settledAmounts[hermesPromise.ChannelID]
+	unsettled := new(big.Int).Sub(amount, settled)
+	if unsettled.Cmp(threshold) < 0 {
+		aph.settledAmountsLock.Unlock()
 		return
 	}
+	aph.settledAmounts[hermesPromise.ChannelID] = new(big.Int).Set(amount)
+	aph.settledAmountsLock.Unlock()
+
+	logger.Info().Msgf("Unsettled value %v reached the threshold %v, requesting settlement", unsettled, threshold)
+	aph.publish(pinge.AppTopicSettlementRequest, pinge.AppEventSettlementRequest{
+		HermesID:   hermesPromise.HermesID,
+		ProviderID: hermesPromise.Identity,
+		ChainID:    hermesPromise.Promise.ChainID,
+	})
+}
+
+func (aph *HermesPromiseHandler) settledAmount(channelID string) (*big.Int, bool) {
+	aph.settledAmountsLock.Lock()
+	defer aph.settledAmountsLock.Unlock()
+
+	settled, ok := aph.settledAmounts[channelID]
+	return settled, ok
+}
+
+// seedSettledAmount sets the settled amount of the channel seen for the first time,
+// unless another promise of the channel has seeded it in the meantime.
+func (aph *HermesPromiseHandler) seedSettledAmount(hermesPromise HermesPromise, logger zerolog.Logger) {
+	seed := new(big.Int).Set(hermesPromise.Promise.Amount)
+	if aph.deps.ProviderChannelGetter != nil {
+		channel, err := aph.deps.ProviderChannelGetter.GetProviderChannel(hermesPromise.Promise.ChainID, hermesPromise.HermesID, hermesPromise.Identity.ToCommonAddress(), false)
+		if err != nil {
+			logger.Warn().Err(err).Msg("Could not get the settled amount of the channel, using the amount of the promise")
+		} else if channel.Settled != nil {
+			seed = new(big.Int).Set(channel.Settled)
+		}
+	}
+
+	aph.settledAmountsLock.Lock()
+	defer aph.settledAmountsLock.Unlock()
+
+	if aph.settledAmounts == nil {
+		aph.settledAmounts = make(map[string]*big.Int)
+	}
+	if _, ok := aph.settledAmounts[hermesPromise.ChannelID]; !ok {
+		aph.settledAmounts[hermesPromise.ChannelID] = seed
+	}
+}
+
+// skipDust returns true and the reason if the amount earned since the previous promise of the agreement
+// is below the minimum promise amount of the hermes. The skipped amount is carried by the next promise of the agreement.
+// The first promise of an agreement and the final promise of a session are never skipped, as nothing would carry their amount.
+func (aph *HermesPromiseHandler) skipDust(er enqueuedRequest, hermesID common.Address, previous *HermesPromise) (string, bool) {
+	policy, ok := aph.deps.HermesPolicies[hermesID]
+	if !ok || policy.MinPromiseAmount == nil || er.em.AgreementTotal == nil || er.final || previous == nil {
+		return "", false
+	}
+
+	delta := earnedDelta(HermesPromise{AgreementTotal: er.em.AgreementTotal}, previous)
+	if delta.Cmp(policy.MinPromiseAmount) >= 0 {
+		return "", false
+	}
+	return fmt.Sprintf("amount %v is below the minimum promise amount %v of hermes %v", delta, policy.MinPromiseAmount, hermesID.Hex()), true
+}
+
+// checkAgreementTotal fails the request if its agreement total jumps beyond MaxAgreementTotalGrowth times
+// the agreement total of the previously stored promise of the agreement, as it is either a bug or an inflated amount.
+func (aph *HermesPromiseHandler) checkAgreementTotal(er enqueuedRequest, hermesID common.Address, previous *HermesPromise, logger zerolog.Logger) error {
+	if aph.deps.MaxAgreementTotalGrowth <= 0 || er.em.AgreementTotal == nil {
+		return nil
+	}
+
+	// a zero total can not be multiplied, there is nothing to compare the jump to.
+	if previous == nil || previous.AgreementTotal == nil || previous.AgreementTotal.Sign() <= 0 {
+		return nil
+	}
+
+	limit := new(big.Int).Mul(previous.AgreementTotal, big.NewInt(aph.deps.MaxAgreementTotalGrowth))
+	if er.em.AgreementTotal.Cmp(limit) <= 0 {
+		return nil
+	}
+
+	logger.Warn().Msgf("Agreement total jumped from %v to %v, rejecting the promise request", previous.AgreementTotal, er.em.AgreementTotal)
+	aph.publish(pinge.AppTopicSuspiciousPromise, pinge.AppEventSuspiciousPromise{
+		HermesID:    hermesID,
+		ProviderID:  er.providerID,
+		SessionID:   er.sessionID,
+		AgreementID: new(big.Int).Set(er.em.AgreementID),
+		Previous:    new(big.Int).Set(previous.AgreementTotal),
+		Requested:   new(big.Int).Set(er.em.AgreementTotal),
+	})
+	return fmt.Errorf("agreement total %v exceeds %v times the previous total %v: %w",
+		er.em.AgreementTotal, aph.deps.MaxAgreementTotalGrowth, previous.AgreementTotal, ErrAnomalousAgreementTotal)
+}
+
+// previousPromise returns the stored promise of the same channel and agreement, or nil if there is none.
+func (aph *HermesPromiseHandler) previousPromise(hermesPromise HermesPromise, logger zerolog.Logger) *HermesPromise {
+	previous, err := aph.deps.HermesPromiseStorage.Get(hermesPromise.Promise.ChainID, hermesPromise.ChannelID)
+	if err != nil {
+		if !stdErr.Is(err, ErrNotFound) {
+			logger.Warn().Err(err).Msg("Could not get previous hermes promise, will treat the promise as the first of the agreement")
+		}
+		return nil
+	}
+
+	sameAgreement := previous.AgreementID != nil && hermesPromise.AgreementID != nil && previous.AgreementID.Cmp(hermesPromise.AgreementID) == 0
+	if !sameAgreement {
+		return nil
+	}
+	return &previous
+}
+
+// earnedDelta returns the amount earned since the previous promise of the same agreement.
+func earnedDelta(hermesPromise HermesPromise, previous *HermesPromise) *big.Int {
+	total := hermesPromise.AgreementTotal
+	if total == nil {
+		return nil
+	}
+
+	if previous == nil || previous.AgreementTotal == nil {
+		return new(big.Int).Set(total)
+	}
+	return new(big.Int).Sub(total, previous.AgreementTotal)
+}
+
+// publish publishes the event, recovering the panics of the synchronous subscribers,
+// so that a misbehaving subscriber can not crash the handler.
+func (aph *HermesPromiseHandler) publish(topic string, payload interface{}) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error().Msgf("Subscriber of %q panicked on %T: %v\n%s", topic, payload, r, debug.Stack())
+		}
+	}()
+
+	aph.deps.EventBus.Publish(topic, payload)
+}
+
+func (aph *HermesPromiseHandler) publishRevealFailed(hermesPromise HermesPromise) {
+	aph.publish(pinge.AppTopicHermesPromiseRevealFailed, pinge.AppEventHermesPromiseRevealFailed{
+		ChannelID:   hermesPromise.ChannelID,
+		Promise:     hermesPromise.Promise,
+		AgreementID: hermesPromise.AgreementID,
+		HermesID:    hermesPromise.HermesID,
+		ProviderID:  hermesPromise.Identity,
+	})
+}
+
+func (aph *HermesPromiseHandler) isChainAllowed(chainID int64) bool {
+	if len(aph.deps.AllowedChainIDs) == 0 {
+		return true
+	}
+
+	for _, allowed := range aph.deps.AllowedChainIDs {
+		if allowed == chainID {
+			return true
+		}
+	}
+	return false
+}
+
+func (aph *HermesPromiseHandler) requestPromiseFrom(ctx context.Context, hermesID common.Address, request RequestPromise, logger zerolog.Logger) (crypto.Promise, error) {
+	if aph.deps.DryRun {
+		return dryRunPromise(request), nil
+	}
+
+	hermesCaller, err := aph.getHermesCaller(hermesID)
+	if err != nil {
+		return crypto.Promise{}, fmt.Errorf("could not get hermes caller: %w", err)
+	}
+	return aph.requestPromiseWithRetry(ctx, hermesCaller, request, logger)
+}
+
+// validatePromiseSignature checks that the promise is signed by the given hermes, so that it can be redeemed.
+func (aph *HermesPromiseHandler) validatePromiseSignature(promise crypto.Promise, chainID int64, hermesID common.Address) error {
+	if aph.deps.DryRun {
+		return nil
+	}
+
+	signer := hermesID
+	if aph.deps.HermesSignerGetter != nil {
+		operator, err := aph.deps.HermesSignerGetter.GetHermesOperator(chainID, hermesID)
+		if err != nil {
+			return fmt.Errorf("could not get signer of hermes %v: %w", hermesID.Hex(), err)
+		}
+		signer = operator
+	}
+
+	if promise.Amount == nil || promise.Fee == nil || !promise.IsPromiseValid(signer) {
+		return fmt.Errorf("expected signer %v: %w", signer.Hex(), ErrInvalidPromiseSignature)
+	}
+	return nil
+}
+
+// promiseLogger returns a logger carrying the fields needed to trace the promise flow of a session.
+// R is secret and must never be added to it.
+func promiseLogger(sessionID string, agreementID *big.Int, providerID identity.Identity, hermesID common.Address) zerolog.Logger {
+	logCtx := log.With().Str("provider", providerID.Address).Str("hermes_id", hermesID.Hex())
+	if sessionID != "" {
+		logCtx = logCtx.Str("session_id", sessionID)
+	}
+	if agreementID != nil {
+		logCtx = logCtx.Str("agreement_id", agreementID.String())
+	}
+	return logCtx.Logger()
+}
+
+// dryRunPromise imitates the promise hermes would issue for the given request.
+func dryRunPromise(request RequestPromise) crypto.Promise {
+	promise := request.ExchangeMessage.Promise
+	promise.ChainID = request.ExchangeMessage.ChainID
+	promise.Fee = request.TransactorFee
+	return promise
+}
+
+func (aph *HermesPromiseHandler) requestPromiseWithRetry(ctx context.Context, hermesCaller HermesHTTPRequester, request RequestPromise, logger zerolog.Logger) (crypto.Promise, error) {
+	eback := backoff.NewExponentialBackOff()
+	eback.InitialInterval = aph.deps.PromiseRetry.BaseDelay
+	eback.RandomizationFactor = 0
+	eback.Multiplier = 2
+	eback.MaxElapsedTime = 0
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-aph.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	boff := backoff.WithContext(backoff.WithMaxRetries(eback, aph.deps.PromiseRetry.MaxRetries), ctx)
+
+	var promise crypto.Promise
+	err := backoff.Retry(func() error {
+		p, err := hermesCaller.RequestPromise(ctx, request)
+		if err != nil {
+			if !isTransientHermesError(err) {
+				return backoff.Permanent(err)
+			}
+			logger.Warn().Err(err).Msg("Could not request promise from hermes, will retry")
+			return err
+		}
+		promise = p
+		return nil
+	}, boff)
+	return promise, err
+}
+
+// isTransientHermesError returns true if the given error might go away on its own,
+// e.g. a network failure or an overloaded hermes. Other hermes errors are final.
+func isTransientHermesError(err error) bool {
+	if stdErr.Is(err, ErrHermesInternal) || stdErr.Is(err, ErrTooManyRequests) {
+		return true
+	}
+
+	for _, hermesErr := range hermesCauseToError {
+		if stdErr.Is(err, hermesErr) {
+			return false
+		}
+	}
+	return true
 }
 
 func (aph *HermesPromiseHandler) getHermesCaller(hermesID common.Address) (HermesHTTPRequester, error) {
@@ -270,11 +1919,49 @@ func (aph *HermesPromiseHandler) getHermesCaller(hermesID common.Address) (Herme
 	if err != nil {
 		return nil, fmt.Errorf("could not get hermes URL: %w", err)
 	}
+	if err := validateHermesURL(addr); err != nil {
+		return nil, fmt.Errorf("could not get hermes %v caller: %w", hermesID.Hex(), err)
+	}
 	return aph.deps.HermesCallerFactory(addr), nil
 }
 
-func (aph *HermesPromiseHandler) revealR(hermesPromise HermesPromise) error {
-	if hermesPromise.Revealed {
+// confirmReveal polls hermes until it confirms the revealed R of the agreement, up to the configured number of polls.
+// The promise stays unrevealed if the reveal is not confirmed, so that it is revealed again by the sweep.
+func (aph *HermesPromiseHandler) confirmReveal(ctx context.Context, confirmer HermesRevealConfirmer, agreementID *big.Int, logger zerolog.Logger) error {
+	polls := aph.deps.RevealConfirmPolls
+	if polls <= 0 {
+		polls = DefaultRevealConfirmPolls
+	}
+	interval := aph.deps.RevealConfirmInterval
+	if interval <= 0 {
+		interval = DefaultRevealConfirmInterval
+	}
+
+	for i := 0; i < polls; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(interval):
+			case <-aph.stop:
+				return ErrHandlerStopped
+			case <-ctx.Done():
+				return fmt.Errorf("could not confirm reveal of R: %w", ctx.Err())
+			}
+		}
+
+		revealed, err := confirmer.RRevealed(ctx, agreementID)
+		if err != nil {
+			logger.Warn().Err(err).Msgf("Could not check if R is revealed, poll %v/%v", i+1, polls)
+			continue
+		}
+		if revealed {
+			return nil
+		}
+	}
+	return ErrRevealNotConfirmed
+}
+
+func (aph *HermesPromiseHandler) revealR(ctx context.Context, hermesPromise HermesPromise, logger zerolog.Logger) error {
+	if hermesPromise.Revealed || aph.deps.DryRun {
 		return nil
 	}
 
@@ -283,22 +1970,54 @@ func (aph *HermesPromiseHandler) revealR(hermesPromise HermesPromise) error {
 		return fmt.Errorf("could not get hermes caller: %w", err)
 	}
 
-	err = hermesCaller.RevealR(hermesPromise.R, hermesPromise.Identity.Address, hermesPromise.AgreementID)
-	handledErr := aph.handleHermesError(err, hermesPromise.Identity, hermesPromise.HermesID)
+	err = hermesCaller.RevealR(ctx, hermesPromise.R.Reveal(), hermesPromise.Identity.Address, hermesPromise.AgreementID)
+	handledErr := aph.handleHermesError(ctx, err, hermesPromise.Identity, hermesPromise.HermesID, logger)
 	if handledErr != nil {
 		return fmt.Errorf("could not reveal R: %w", err)
 	}
 
+	// the promise is optimistically marked as revealed if hermes can not confirm it.
+	if confirmer, ok := hermesCaller.(HermesRevealConfirmer); ok {
+		if err := aph.confirmReveal(ctx, confirmer, hermesPromise.AgreementID, logger); err != nil {
+			return err
+		}
+	}
+
 	hermesPromise.Revealed = true
-	err = aph.deps.HermesPromiseStorage.Store(hermesPromise)
-	if err != nil && !stdErr.Is(err, ErrAttemptToOverwrite) {
+	if err := aph.storePromise(hermesPromise, logger); err != nil {
 		return fmt.Errorf("could not store hermes promise: %w", err)
 	}
 
 	return nil
 }
 
-func (aph *HermesPromiseHandler) handleHermesError(err error, providerID identity.Identity, hermesID common.Address) error {
+// storePromise stores the promise, ignoring the duplicates of the stored promise.
+// A promise older than the stored one is not stored, so that the newer promise is kept.
+func (aph *HermesPromiseHandler) storePromise(promise HermesPromise, logger zerolog.Logger) error {
+	err := aph.deps.HermesPromiseStorage.Store(promise)
+	switch {
+	case err == nil, stdErr.Is(err, ErrDuplicatePromise):
+		return nil
+	case stdErr.Is(err, ErrStalePromise):
+		logger.Warn().Msgf("Not storing hermes promise of amount %v for channel %v, a newer promise is already stored", promise.Promise.Amount, promise.ChannelID)
+		return nil
+	case stdErr.Is(err, ErrAttemptToOverwrite):
+		// storages which do not tell the duplicates from the stale promises.
+		return nil
+	default:
+		return err
+	}
+}
+
+// handleHermesError resolves the hermes error and keeps the outcome as the last error of the hermes.
+func (aph *HermesPromiseHandler) handleHermesError(ctx context.Context, err error, providerID identity.Identity, hermesID common.Address, logger zerolog.Logger) error {
+	err = aph.resolveHermesError(ctx, err, providerID, hermesID, logger)
+	aph.recordHermesError(hermesID, err)
+	return err
+}
+
+// resolveHermesError handles the errors hermes expects the provider to act on, returning the errors which are left.
+func (aph *HermesPromiseHandler) resolveHermesError(ctx context.Context, err error, providerID identity.Identity, hermesID common.Address, logger zerolog.Logger) error {
 	if err == nil {
 		return nil
 	}
@@ -310,29 +2029,64 @@ func (aph *HermesPromiseHandler) handleHermesError(err error, providerID identit
 		if !ok {
 			return errors.New("could not cast errNeedsRecovery to hermesError")
 		}
-		recoveryErr := aph.recoverR(aer, providerID, hermesID)
+		if attempts, ok := aph.takeRecoveryAttempt(ctx); !ok {
+			logger.Warn().Msgf("Hermes asked to recover R once again after %d recoveries, giving up", attempts)
+			aph.publish(pinge.AppTopicRRecoveryExhausted, pinge.AppEventRRecoveryExhausted{
+				HermesID:   hermesID,
+				ProviderID: providerID,
+				Attempts:   attempts,
+			})
+			return fmt.Errorf("could not recover R: %w", ErrRecoveryAttemptsExhausted)
+		}
+		atomic.AddUint64(&aph.stats.recoveryAttempts, 1)
+		recoveryErr := aph.recoverR(ctx, aer, providerID, hermesID, logger)
+		recovery := pinge.AppEventRRecovery{
+			HermesID:   hermesID,
+			ProviderID: providerID,
+			Recovered:  recoveryErr == nil,
+		}
 		if recoveryErr != nil {
-			return recoveryErr
+			recovery.Error = recoveryErr.Error()
+		} else {
+			atomic.AddUint64(&aph.stats.recoverySuccesses, 1)
 		}
-		return nil
+		aph.publish(pinge.AppTopicRRecovery, recovery)
+		return recoveryErr
 	case stdErr.Is(err, ErrHermesNoPreviousPromise):
-		log.Info().Msg("no previous promise on hermes, will mark R as revealed")
+		logger.Info().Msg("no previous promise on hermes, will mark R as revealed")
 		return nil
 	default:
 		return err
 	}
 }
 
-func (aph *HermesPromiseHandler) recoverR(aerr hermesError, providerID identity.Identity, hermesID common.Address) error {
-	log.Info().Msg("Recovering R...")
-	decoded, err := hex.DecodeString(aerr.Data())
-	if err != nil {
-		return fmt.Errorf("could not decode R recovery details: %w", err)
+type recoveryAttemptsKey struct{}
+
+// withRecoveryAttempts returns a context counting the R recoveries of a single promise request or reveal.
+func withRecoveryAttempts(ctx context.Context) context.Context {
+	return context.WithValue(ctx, recoveryAttemptsKey{}, new(int32))
+}
+
+// takeRecoveryAttempt counts the R recovery and returns false with the number of the recoveries made
+// if no more recoveries are allowed for the request of the context.
+func (aph *HermesPromiseHandler) takeRecoveryAttempt(ctx context.Context) (int, bool) {
+	attempts, ok := ctx.Value(recoveryAttemptsKey{}).(*int32)
+	if !ok || aph.deps.MaxRecoveryAttempts <= 0 {
+		return 0, true
 	}
 
-	decrypted, err := aph.deps.Encryption.Decrypt(providerID.ToCommonAddress(), decoded)
+	taken := int(atomic.AddInt32(attempts, 1))
+	if taken > aph.deps.MaxRecoveryAttempts {
+		return taken - 1, false
+	}
+	return taken, true
+}
+
+func (aph *HermesPromiseHandler) recoverR(ctx context.Context, aerr hermesError, providerID identity.Identity, hermesID common.Address, logger zerolog.Logger) error {
+	logger.Info().Msg("Recovering R...")
+	decrypted, encrypted, err := aph.decodeRecoveryData(providerID, aerr.Data())
 	if err != nil {
-		return fmt.Errorf("could not decrypt R details: %w", err)
+		return err
 	}
 
 	res := rRecoveryDetails{}
@@ -341,17 +2095,72 @@ func (aph *HermesPromiseHandler) recoverR(aerr hermesError, providerID identity.
 		return fmt.Errorf("could not unmarshal R details: %w", err)
 	}
 
-	log.Info().Msg("R recovered, will reveal...")
+	logger.Info().Msg("R recovered, will reveal...")
 	hermesCaller, err := aph.getHermesCaller(hermesID)
 	if err != nil {
 		return fmt.Errorf("could not get hermes caller: %w", err)
 	}
 
-	err = hermesCaller.RevealR(res.R, providerID.Address, res.AgreementID)
+	err = hermesCaller.RevealR(ctx, res.R, providerID.Address, res.AgreementID)
 	if err != nil {
 		return fmt.Errorf("could not reveal R: %w", err)
 	}
 
-	log.Info().Msg("R recovered successfully")
+	logger.Info().Msg("R recovered successfully")
+	if encrypted && aph.deps.RekeyRRecovery && aph.deps.RRecoveryStorage != nil {
+		if err := aph.rekeyRRecovery(decrypted, providerID, hermesID, res.AgreementID); err != nil {
+			logger.Warn().Err(err).Msg("Could not store the re-encrypted R recovery details")
+		}
+	}
 	return nil
 }
+
+// encodeRecoveryData returns the R recovery data of the promise request, hex encoded.
+// The details are encrypted with the key of the provider unless the plaintext recovery is enabled.
+func (aph *HermesPromiseHandler) encodeRecoveryData(providerID identity.Identity, details []byte) (string, error) {
+	if aph.deps.PlaintextRecovery {
+		return PlaintextRecoveryPrefix + hex.EncodeToString(details), nil
+	}
+
+	encrypted, err := aph.deps.Encryption.Encrypt(providerID.ToCommonAddress(), details)
+	if err != nil {
+		return "", fmt.Errorf("could not encrypt R: %w", err)
+	}
+	return hex.EncodeToString(encrypted), nil
+}
+
+// decodeRecoveryData returns the R recovery details from the recovery data returned by hermes and whether they were encrypted.
+// The unencrypted details are only accepted if the plaintext recovery is enabled.
+func (aph *HermesPromiseHandler) decodeRecoveryData(providerID identity.Identity, data string) ([]byte, bool, error) {
+	if strings.HasPrefix(data, PlaintextRecoveryPrefix) {
+		if !aph.deps.PlaintextRecovery {
+			return nil, false, fmt.Errorf("could not recover R: %w", ErrPlaintextRecoveryDisabled)
+		}
+		details, err := hex.DecodeString(strings.TrimPrefix(data, PlaintextRecoveryPrefix))
+		if err != nil {
+			return nil, false, fmt.Errorf("could not decode R recovery details: %w", err)
+		}
+		return details, false, nil
+	}
+
+	decoded, err := hex.DecodeString(data)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not decode R recovery details: %w", err)
+	}
+
+	decrypted, err := aph.deps.Encryption.Decrypt(providerID.ToCommonAddress(), decoded)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not decrypt R details: %w", err)
+	}
+	return decrypted, true, nil
+}
+
+// rekeyRRecovery encrypts the recovered R details under the current key of the provider and stores them.
+func (aph *HermesPromiseHandler) rekeyRRecovery(details []byte, providerID identity.Identity, hermesID common.Address, agreementID *big.Int) error {
+	encrypted, err := aph.deps.Encryption.Encrypt(providerID.ToCommonAddress(), details)
+	if err != nil {
+		return fmt.Errorf("could not encrypt R recovery details: %w", err)
+	}
+
+	return aph.deps.RRecoveryStorage.Store(providerID, hermesID, agreementID, encrypted)
+}
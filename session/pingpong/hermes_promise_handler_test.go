@@ -18,15 +18,36 @@
 package pingpong
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/mysteriumnetwork/node/config"
 	"github.com/mysteriumnetwork/node/core/node/event"
+	"github.com/mysteriumnetwork/node/core/service"
 	"github.com/mysteriumnetwork/node/core/service/servicestate"
+	"github.com/mysteriumnetwork/node/core/storage/boltdb"
 	"github.com/mysteriumnetwork/node/eventbus"
 	"github.com/mysteriumnetwork/node/identity"
 	"github.com/mysteriumnetwork/node/identity/registry"
+	"github.com/mysteriumnetwork/node/mocks"
+	sessionEvent "github.com/mysteriumnetwork/node/session/event"
+	pinge "github.com/mysteriumnetwork/node/session/pingpong/event"
+	"github.com/mysteriumnetwork/payments/client"
 	"github.com/mysteriumnetwork/payments/crypto"
 	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/assert"
@@ -43,6 +64,7 @@ func TestHermesPromiseHandler_RequestPromise(t *testing.T) {
 			EventBus:             eventbus.New(),
 			HermesPromiseStorage: &mockHermesPromiseStorage{},
 			FeeProvider:          &mockFeeProvider{},
+			HermesSignerGetter:   &mockHermesSignerGetter{},
 		},
 		queue: make(chan enqueuedRequest),
 		stop:  make(chan struct{}),
@@ -58,7 +80,8 @@ func TestHermesPromiseHandler_RequestPromise(t *testing.T) {
 
 	r := []byte{0x0, 0x1}
 	em := crypto.ExchangeMessage{
-		Promise: crypto.Promise{},
+		Promise:     crypto.Promise{},
+		AgreementID: big.NewInt(1),
 	}
 
 	ch := aph.RequestPromise(r, em, identity.FromAddress("0x0000000000000000000000000000000000000001"), "session")
@@ -68,6 +91,42 @@ func TestHermesPromiseHandler_RequestPromise(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestHermesPromiseHandler_RequestPromise_ValidatesAgreementID(t *testing.T) {
+	tests := []struct {
+		name        string
+		agreementID *big.Int
+	}{
+		{name: "nil agreement ID", agreementID: nil},
+		{name: "zero agreement ID", agreementID: big.NewInt(0)},
+		{name: "negative agreement ID", agreementID: big.NewInt(-1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			caller := &mockFlakyHermesCaller{}
+			aph := &HermesPromiseHandler{
+				deps: HermesPromiseHandlerDeps{
+					HermesURLGetter:      &mockHermesURLGetter{},
+					HermesCallerFactory:  func(url string) HermesHTTPRequester { return caller },
+					Encryption:           &mockEncryptor{},
+					EventBus:             mocks.NewEventBus(),
+					HermesPromiseStorage: &mockHermesPromiseStorage{},
+					FeeProvider:          &mockFeeProvider{},
+					HermesSignerGetter:   &mockHermesSignerGetter{},
+				},
+			}
+			em := crypto.ExchangeMessage{
+				Promise:        crypto.Promise{Amount: big.NewInt(10), Fee: big.NewInt(0)},
+				AgreementID:    tt.agreementID,
+				AgreementTotal: big.NewInt(10),
+			}
+
+			err := processRequest(aph, newEnqueuedRequest(context.Background(), []byte{0x0}, em, identity.FromAddress("0x0000000000000000000000000000000000000001"), "session"))
+			assert.True(t, errors.Is(err, ErrInvalidAgreementID), err)
+			assert.Equal(t, 0, caller.getCalls())
+		})
+	}
+}
+
 func TestHermesPromiseHandler_RequestPromise_BubblesErrors(t *testing.T) {
 	bus := eventbus.New()
 	mockFactory := &mockHermesCallerFactory{
@@ -202,13 +261,213 @@ func TestHermesPromiseHandler_recoverR(t *testing.T) {
 			it := &HermesPromiseHandler{
 				deps: tt.fields.deps,
 			}
-			if err := it.recoverR(tt.err, tt.fields.providerID, tt.fields.hermesID); (err != nil) != tt.wantErr {
+			if err := it.recoverR(context.Background(), tt.err, tt.fields.providerID, tt.fields.hermesID, log.Logger); (err != nil) != tt.wantErr {
 				t.Errorf("HermesPromiseHandler.recoverR() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
 	}
 }
 
+func TestHermesPromiseHandler_recoverR_Rekeys(t *testing.T) {
+	oldKey, currentKey := byte(1), byte(2)
+	encryption := &mockRotatingEncryptor{current: currentKey, keys: []byte{oldKey, currentKey}}
+	details, err := json.Marshal(rRecoveryDetails{R: "abcd", AgreementID: big.NewInt(123456)})
+	assert.NoError(t, err)
+	oldBlob := encryption.encryptWith(oldKey, details)
+
+	storage := &mockRRecoveryStorage{}
+	aph := &HermesPromiseHandler{
+		deps: HermesPromiseHandlerDeps{
+			HermesCallerFactory: (&mockHermesCallerFactory{}).Get,
+			HermesURLGetter:     &mockHermesURLGetter{},
+			Encryption:          encryption,
+			RekeyRRecovery:      true,
+			RRecoveryStorage:    storage,
+		},
+	}
+	hermesID := common.HexToAddress("0x1")
+	err = aph.recoverR(context.Background(), HermesErrorResponse{ErrorData: hex.EncodeToString(oldBlob)}, identity.FromAddress("0x0"), hermesID, log.Logger)
+	assert.NoError(t, err)
+
+	assert.Len(t, storage.stored, 1)
+	stored := storage.stored[0]
+	assert.Equal(t, hermesID, stored.hermesID)
+	assert.Equal(t, big.NewInt(123456), stored.agreementID)
+
+	decrypted, err := encryption.decryptWith(currentKey, stored.encrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, details, decrypted)
+	_, err = encryption.decryptWith(oldKey, stored.encrypted)
+	assert.Error(t, err)
+
+	// not re-stored unless enabled.
+	aph.deps.RekeyRRecovery = false
+	err = aph.recoverR(context.Background(), HermesErrorResponse{ErrorData: hex.EncodeToString(oldBlob)}, identity.FromAddress("0x0"), hermesID, log.Logger)
+	assert.NoError(t, err)
+	assert.Len(t, storage.stored, 1)
+}
+
+// mockRotatingEncryptor encrypts with the current key and decrypts with any of the known keys.
+type mockRotatingEncryptor struct {
+	current byte
+	keys    []byte
+}
+
+func (mre *mockRotatingEncryptor) Encrypt(addr common.Address, plaintext []byte) ([]byte, error) {
+	return mre.encryptWith(mre.current, plaintext), nil
+}
+
+func (mre *mockRotatingEncryptor) Decrypt(addr common.Address, encrypted []byte) ([]byte, error) {
+	for _, key := range mre.keys {
+		if decrypted, err := mre.decryptWith(key, encrypted); err == nil {
+			return decrypted, nil
+		}
+	}
+	return nil, errors.New("no key to decrypt with")
+}
+
+func (mre *mockRotatingEncryptor) encryptWith(key byte, plaintext []byte) []byte {
+	encrypted := []byte{key}
+	for _, b := range plaintext {
+		encrypted = append(encrypted, b^key)
+	}
+	return encrypted
+}
+
+func (mre *mockRotatingEncryptor) decryptWith(key byte, encrypted []byte) ([]byte, error) {
+	if len(encrypted) == 0 || encrypted[0] != key {
+		return nil, errors.New("encrypted with another key")
+	}
+	decrypted := make([]byte, 0, len(encrypted)-1)
+	for _, b := range encrypted[1:] {
+		decrypted = append(decrypted, b^key)
+	}
+	return decrypted, nil
+}
+
+type storedRRecovery struct {
+	providerID  identity.Identity
+	hermesID    common.Address
+	agreementID *big.Int
+	encrypted   []byte
+}
+
+type mockRRecoveryStorage struct {
+	stored []storedRRecovery
+}
+
+func (mrs *mockRRecoveryStorage) Store(providerID identity.Identity, hermesID common.Address, agreementID *big.Int, encrypted []byte) error {
+	mrs.stored = append(mrs.stored, storedRRecovery{providerID: providerID, hermesID: hermesID, agreementID: agreementID, encrypted: encrypted})
+	return nil
+}
+
+func TestHermesPromiseHandler_LimitsRecoveryAttempts(t *testing.T) {
+	details, err := json.Marshal(rRecoveryDetails{R: "abcd", AgreementID: big.NewInt(1)})
+	assert.NoError(t, err)
+	needsRecovery := HermesErrorResponse{c: ErrNeedsRRecovery, CausedBy: ErrNeedsRRecovery.Error(), ErrorData: hex.EncodeToString(details)}
+	errs := make([]error, 10)
+	for i := range errs {
+		errs[i] = needsRecovery
+	}
+
+	caller := &mockFlakyHermesCaller{errs: errs}
+	bus := mocks.NewEventBus()
+	aph := &HermesPromiseHandler{
+		deps: HermesPromiseHandlerDeps{
+			HermesURLGetter:      &mockHermesURLGetter{},
+			HermesCallerFactory:  func(url string) HermesHTTPRequester { return caller },
+			Encryption:           &mockEncryptor{},
+			EventBus:             bus,
+			HermesPromiseStorage: &mockRecordingHermesPromiseStorage{},
+			FeeProvider:          &mockFeeProvider{},
+			HermesSignerGetter:   &mockHermesSignerGetter{},
+			MaxRecoveryAttempts:  2,
+		},
+	}
+
+	em := crypto.ExchangeMessage{
+		Promise:        crypto.Promise{Amount: big.NewInt(10), Fee: big.NewInt(0)},
+		AgreementID:    big.NewInt(2),
+		AgreementTotal: big.NewInt(10),
+	}
+	err = processRequest(aph, newEnqueuedRequest(context.Background(), []byte{0x0}, em, identity.FromAddress("0x0000000000000000000000000000000000000001"), "session"))
+	assert.True(t, errors.Is(err, ErrRecoveryAttemptsExhausted), err)
+	assert.Equal(t, 3, caller.getCalls())
+	assert.Equal(t, 2, caller.getReveals())
+
+	var exhausted []pinge.AppEventRRecoveryExhausted
+	for _, e := range bus.GetEventHistory() {
+		if e.Topic == pinge.AppTopicRRecoveryExhausted {
+			exhausted = append(exhausted, e.Event.(pinge.AppEventRRecoveryExhausted))
+		}
+	}
+	assert.Len(t, exhausted, 1)
+	assert.Equal(t, 2, exhausted[0].Attempts)
+}
+
+func TestHermesPromiseHandler_PlaintextRecovery(t *testing.T) {
+	em := crypto.ExchangeMessage{
+		Promise:        crypto.Promise{Amount: big.NewInt(10), Fee: big.NewInt(0)},
+		AgreementID:    big.NewInt(2),
+		AgreementTotal: big.NewInt(10),
+	}
+	provider := identity.FromAddress("0x0000000000000000000000000000000000000001")
+	details, err := json.Marshal(rRecoveryDetails{R: "00", AgreementID: em.AgreementID})
+	assert.NoError(t, err)
+
+	newHandler := func(caller HermesHTTPRequester, encryptor encryption, plaintext bool) *HermesPromiseHandler {
+		return &HermesPromiseHandler{
+			deps: HermesPromiseHandlerDeps{
+				HermesURLGetter:      &mockHermesURLGetter{},
+				HermesCallerFactory:  func(url string) HermesHTTPRequester { return caller },
+				Encryption:           encryptor,
+				EventBus:             mocks.NewEventBus(),
+				HermesPromiseStorage: &mockHermesPromiseStorage{},
+				FeeProvider:          &mockFeeProvider{},
+				HermesSignerGetter:   &mockHermesSignerGetter{},
+				PlaintextRecovery:    plaintext,
+			},
+		}
+	}
+	recoveryError := func(data string) error {
+		return HermesErrorResponse{c: ErrNeedsRRecovery, CausedBy: ErrNeedsRRecovery.Error(), ErrorData: data}
+	}
+
+	t.Run("encrypts the recovery data by default", func(t *testing.T) {
+		caller := &mockFlakyHermesCaller{}
+		aph := newHandler(caller, &mockRotatingEncryptor{current: 1, keys: []byte{1}}, false)
+
+		err := processRequest(aph, newEnqueuedRequest(context.Background(), []byte{0x0}, em, provider, "session"))
+		assert.NoError(t, err)
+		data := caller.getLastRequest().RRecoveryData
+		assert.False(t, strings.HasPrefix(data, PlaintextRecoveryPrefix))
+		assert.NotEqual(t, hex.EncodeToString(details), data)
+
+		reveals := caller.getReveals()
+		assert.NoError(t, aph.handleHermesError(context.Background(), recoveryError(data), provider, common.Address{}, log.Logger))
+		assert.Equal(t, reveals+1, caller.getReveals())
+
+		// the unencrypted recovery data is refused.
+		err = aph.handleHermesError(context.Background(), recoveryError(PlaintextRecoveryPrefix+hex.EncodeToString(details)), provider, common.Address{}, log.Logger)
+		assert.True(t, errors.Is(err, ErrPlaintextRecoveryDisabled), err)
+		assert.Equal(t, reveals+1, caller.getReveals())
+	})
+
+	t.Run("sends the recovery data unencrypted without key material", func(t *testing.T) {
+		caller := &mockFlakyHermesCaller{}
+		aph := newHandler(caller, &mockEncryptor{errToReturn: errors.New("no key material")}, true)
+
+		err := processRequest(aph, newEnqueuedRequest(context.Background(), []byte{0x0}, em, provider, "session"))
+		assert.NoError(t, err)
+		data := caller.getLastRequest().RRecoveryData
+		assert.Equal(t, PlaintextRecoveryPrefix+hex.EncodeToString(details), data)
+
+		reveals := caller.getReveals()
+		assert.NoError(t, aph.handleHermesError(context.Background(), recoveryError(data), provider, common.Address{}, log.Logger))
+		assert.Equal(t, reveals+1, caller.getReveals())
+	})
+}
+
 func TestHermesPromiseHandler_handleHermesError(t *testing.T) {
 	merr := errors.New("this is a test")
 	mockFactory := &mockHermesCallerFactory{}
@@ -256,7 +515,7 @@ func TestHermesPromiseHandler_handleHermesError(t *testing.T) {
 			aph := &HermesPromiseHandler{
 				deps: tt.deps,
 			}
-			err := aph.handleHermesError(tt.err, tt.providerID, tt.hermesID)
+			err := aph.handleHermesError(context.Background(), tt.err, tt.providerID, tt.hermesID, log.Logger)
 			if tt.wantErr == nil {
 				assert.NoError(t, err, tt.name)
 			} else {
@@ -267,30 +526,2477 @@ func TestHermesPromiseHandler_handleHermesError(t *testing.T) {
 	}
 }
 
-type mockFeeProvider struct {
-	toReturn    registry.FeesResponse
-	errToReturn error
+func TestHermesPromiseHandler_LastHermesErrors(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	aph := &HermesPromiseHandler{
+		deps: HermesPromiseHandlerDeps{
+			Clock: func() time.Time { return now },
+		},
+	}
+	providerID := identity.FromAddress("0x0000000000000000000000000000000000000001")
+	hermesID := common.HexToAddress("0x2")
+	otherHermesID := common.HexToAddress("0x3")
+	assert.Empty(t, aph.LastHermesErrors())
+
+	hermesErr := HermesErrorResponse{c: ErrHermesInternal, CausedBy: "boom"}
+	err := aph.handleHermesError(context.Background(), hermesErr, providerID, hermesID, log.Logger)
+	assert.Equal(t, hermesErr, err)
+	now = now.Add(time.Minute)
+	err = aph.handleHermesError(context.Background(), errors.New("unreachable"), providerID, otherHermesID, log.Logger)
+	assert.Error(t, err)
+	assert.Equal(t, map[common.Address]HermesErrorInfo{
+		hermesID:      {Error: hermesErr.Error(), Time: now.Add(-time.Minute)},
+		otherHermesID: {Error: "unreachable", Time: now},
+	}, aph.LastHermesErrors())
+
+	// the handled errors count as a success.
+	err = aph.handleHermesError(context.Background(), ErrHermesNoPreviousPromise, providerID, hermesID, log.Logger)
+	assert.NoError(t, err)
+	assert.Equal(t, map[common.Address]HermesErrorInfo{
+		otherHermesID: {Error: "unreachable", Time: now},
+	}, aph.LastHermesErrors())
+
+	err = aph.handleHermesError(context.Background(), nil, providerID, otherHermesID, log.Logger)
+	assert.NoError(t, err)
+	assert.Empty(t, aph.LastHermesErrors())
 }
 
-func (mfp *mockFeeProvider) FetchSettleFees(chainID int64) (registry.FeesResponse, error) {
-	return mfp.toReturn, mfp.errToReturn
+func TestHermesPromiseHandler_handleHermesError_CountsRecoveries(t *testing.T) {
+	details, err := json.Marshal(rRecoveryDetails{R: "abcd", AgreementID: big.NewInt(1)})
+	assert.NoError(t, err)
+	needsRecovery := HermesErrorResponse{c: ErrNeedsRRecovery, CausedBy: ErrNeedsRRecovery.Error(), ErrorData: hex.EncodeToString(details)}
+	decryptErr := errors.New("bad key")
+
+	bus := mocks.NewEventBus()
+	encryptor := &mockEncryptor{}
+	aph := &HermesPromiseHandler{
+		deps: HermesPromiseHandlerDeps{
+			HermesURLGetter:     &mockHermesURLGetter{},
+			HermesCallerFactory: func(url string) HermesHTTPRequester { return &mockFlakyHermesCaller{} },
+			Encryption:          encryptor,
+			EventBus:            bus,
+		},
+	}
+	providerID := identity.FromAddress("0x0000000000000000000000000000000000000001")
+	hermesID := common.HexToAddress("0x2")
+
+	err = aph.handleHermesError(context.Background(), needsRecovery, providerID, hermesID, log.Logger)
+	assert.NoError(t, err)
+	assert.Equal(t, HermesPromiseHandlerStats{RecoveryAttempts: 1, RecoverySuccesses: 1}, aph.Stats())
+
+	encryptor.errToReturn = decryptErr
+	err = aph.handleHermesError(context.Background(), needsRecovery, providerID, hermesID, log.Logger)
+	assert.True(t, errors.Is(err, decryptErr), err)
+	assert.Equal(t, HermesPromiseHandlerStats{RecoveryAttempts: 2, RecoverySuccesses: 1}, aph.Stats())
+
+	err = aph.handleHermesError(context.Background(), ErrHermesNoPreviousPromise, providerID, hermesID, log.Logger)
+	assert.NoError(t, err)
+	assert.Equal(t, HermesPromiseHandlerStats{RecoveryAttempts: 2, RecoverySuccesses: 1}, aph.Stats())
+
+	var recoveries []pinge.AppEventRRecovery
+	for _, e := range bus.GetEventHistory() {
+		if e.Topic == pinge.AppTopicRRecovery {
+			recoveries = append(recoveries, e.Event.(pinge.AppEventRRecovery))
+		}
+	}
+	if assert.Len(t, recoveries, 2) {
+		assert.Equal(t, pinge.AppEventRRecovery{HermesID: hermesID, ProviderID: providerID, Recovered: true}, recoveries[0])
+		assert.False(t, recoveries[1].Recovered)
+		assert.Contains(t, recoveries[1].Error, decryptErr.Error())
+	}
 }
 
-type mockHermesCallerFactory struct {
-	errToReturn error
+func TestHermesPromiseHandler_requestPromiseWithRetry(t *testing.T) {
+	transientErr := errors.New("connection reset by peer")
+	tests := []struct {
+		name      string
+		caller    *mockFlakyHermesCaller
+		wantErr   error
+		wantCalls int
+	}{
+		{
+			name: "retries transient errors until success",
+			caller: &mockFlakyHermesCaller{
+				errs: []error{transientErr, transientErr},
+			},
+			wantErr:   nil,
+			wantCalls: 3,
+		},
+		{
+			name: "gives up after max retries",
+			caller: &mockFlakyHermesCaller{
+				errs: []error{transientErr, transientErr, transientErr, transientErr, transientErr},
+			},
+			wantErr:   transientErr,
+			wantCalls: 4,
+		},
+		{
+			name: "does not retry hermes business errors",
+			caller: &mockFlakyHermesCaller{
+				errs: []error{HermesErrorResponse{c: ErrHermesInvalidSignature}},
+			},
+			wantErr:   ErrHermesInvalidSignature,
+			wantCalls: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aph := &HermesPromiseHandler{
+				deps: HermesPromiseHandlerDeps{
+					PromiseRetry: PromiseRetryConfig{
+						MaxRetries: 3,
+						BaseDelay:  time.Millisecond,
+					},
+				},
+				stop: make(chan struct{}),
+			}
+
+			_, err := aph.requestPromiseWithRetry(context.Background(), tt.caller, RequestPromise{}, log.Logger)
+			if tt.wantErr == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.True(t, errors.Is(err, tt.wantErr), err)
+			}
+			assert.Equal(t, tt.wantCalls, tt.caller.getCalls())
+		})
+	}
 }
 
-func (mhcf *mockHermesCallerFactory) Get(url string) HermesHTTPRequester {
-	return &mockHermesCaller{
-		errToReturn: mhcf.errToReturn,
+func TestHermesPromiseHandler_QueueDepth(t *testing.T) {
+	bus := mocks.NewEventBus()
+	aph := &HermesPromiseHandler{
+		deps: HermesPromiseHandlerDeps{
+			EventBus:           bus,
+			QueueHighWaterMark: 0.8,
+		},
+		queue: make(chan enqueuedRequest, 5),
+		stop:  make(chan struct{}),
+	}
+
+	provider := identity.FromAddress("0x0000000000000000000000000000000000000001")
+	for i := 0; i < 3; i++ {
+		aph.RequestPromise([]byte{0x0}, crypto.ExchangeMessage{}, provider, "session")
 	}
+	assert.Equal(t, 3, aph.QueueDepth())
+	assert.Len(t, bus.GetEventHistory(), 0)
+
+	aph.RequestPromise([]byte{0x0}, crypto.ExchangeMessage{}, provider, "session")
+	aph.RequestPromise([]byte{0x0}, crypto.ExchangeMessage{}, provider, "session")
+	assert.Equal(t, 5, aph.QueueDepth())
+
+	history := bus.GetEventHistory()
+	assert.Len(t, history, 1)
+	assert.Equal(t, pinge.AppTopicHermesPromiseQueue, history[0].Topic)
+	assert.Equal(t, pinge.AppEventHermesPromiseQueue{Depth: 4, Capacity: 5}, history[0].Event)
 }
 
-type mockHermesURLGetter struct {
-	errToReturn error
-	urlToReturn string
+func TestHermesPromiseHandler_TryRequestPromise_QueueFull(t *testing.T) {
+	aph := NewHermesPromiseHandler(HermesPromiseHandlerDeps{
+		EventBus:  mocks.NewEventBus(),
+		QueueSize: 1,
+	})
+	assert.Equal(t, 1, cap(aph.queue))
+
+	provider := identity.FromAddress("0x0000000000000000000000000000000000000001")
+	aph.TryRequestPromise([]byte{0x0}, crypto.ExchangeMessage{}, provider, "session")
+	assert.Equal(t, 1, aph.QueueDepth())
+
+	ch := aph.TryRequestPromise([]byte{0x0}, crypto.ExchangeMessage{}, provider, "session")
+	err, more := <-ch
+	assert.True(t, more)
+	assert.Equal(t, ErrQueueFull, err)
+	_, more = <-ch
+	assert.False(t, more)
 }
 
-func (mhug *mockHermesURLGetter) GetHermesURL(address common.Address) (string, error) {
+func TestHermesPromiseHandler_RequestPromiseCtx_CancelledWhileEnqueuing(t *testing.T) {
+	aph := &HermesPromiseHandler{
+		queue: make(chan enqueuedRequest),
+		stop:  make(chan struct{}),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	ch := aph.RequestPromiseCtx(ctx, []byte{0x0}, crypto.ExchangeMessage{}, identity.FromAddress("0x0000000000000000000000000000000000000001"), "session")
+	err, more := <-ch
+	assert.True(t, more)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestHermesPromiseHandler_RequestPromiseCtx_CancelledWhileProcessing(t *testing.T) {
+	aph := &HermesPromiseHandler{
+		deps: HermesPromiseHandlerDeps{
+			EventBus: mocks.NewEventBus(),
+		},
+		queue: make(chan enqueuedRequest, 1),
+		stop:  make(chan struct{}),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := aph.RequestPromiseCtx(ctx, []byte{0x0}, crypto.ExchangeMessage{}, identity.FromAddress("0x0000000000000000000000000000000000000001"), "session")
+	assert.Equal(t, 1, aph.QueueDepth())
+	cancel()
+
+	err, more := <-ch
+	assert.True(t, more)
+	assert.Equal(t, context.Canceled, err)
+
+	// the handler skips the cancelled request without blocking.
+	aph.requestPromise(<-aph.queue)
+}
+
+func TestHermesPromiseHandler_ReplaysPendingRequestsAfterRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hermesPromiseHandlerReplayTest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	bolt, err := boltdb.NewStorage(dir)
+	assert.NoError(t, err)
+	defer bolt.Close()
+
+	caller := &mockFlakyHermesCaller{}
+	deps := HermesPromiseHandlerDeps{
+		HermesURLGetter:       &mockHermesURLGetter{},
+		HermesCallerFactory:   func(url string) HermesHTTPRequester { return caller },
+		Encryption:            &mockEncryptor{},
+		EventBus:              mocks.NewEventBus(),
+		HermesPromiseStorage:  &mockHermesPromiseStorage{},
+		PendingRequestStorage: NewHermesPromiseRequestStorage(bolt),
+		FeeProvider:           &mockFeeProvider{},
+		HermesSignerGetter:    &mockHermesSignerGetter{},
+	}
+
+	em := crypto.ExchangeMessage{
+		Promise:        crypto.Promise{Amount: big.NewInt(10), Fee: big.NewInt(0)},
+		AgreementID:    big.NewInt(1),
+		AgreementTotal: big.NewInt(10),
+	}
+	r := []byte{0x0, 0x1}
+
+	// enqueue a request and stop the handler before it gets processed.
+	aph := NewHermesPromiseHandler(deps)
+	ch := aph.RequestPromise(r, em, identity.FromAddress("0x0000000000000000000000000000000000000001"), "session")
+	aph.doStop()
+
+	err, more := <-ch
+	assert.False(t, more)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, caller.getCalls())
+
+	// start a new handler which should replay the persisted request.
+	aph = NewHermesPromiseHandler(deps)
+	go aph.handleServiceEvent(servicestate.AppEventServiceStatus{Status: string(servicestate.Running)})
+	defer aph.doStop()
+
+	assert.Eventually(t, func() bool {
+		return caller.getCalls() == 1
+	}, 2*time.Second, 10*time.Millisecond)
+
+	request := caller.getLastRequest()
+	assert.Equal(t, em.AgreementID, request.ExchangeMessage.AgreementID)
+	assert.Equal(t, em.AgreementTotal, request.ExchangeMessage.AgreementTotal)
+
+	decoded, err := hex.DecodeString(request.RRecoveryData)
+	assert.NoError(t, err)
+	var details rRecoveryDetails
+	assert.NoError(t, json.Unmarshal(decoded, &details))
+	assert.Equal(t, hex.EncodeToString(r), details.R)
+
+	assert.Eventually(t, func() bool {
+		pending, err := deps.PendingRequestStorage.List()
+		return err == nil && len(pending) == 0
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestHermesPromiseHandler_KeepsFailedReplayedRequests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hermesPromiseHandlerFailedReplayTest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	bolt, err := boltdb.NewStorage(dir)
+	assert.NoError(t, err)
+	defer bolt.Close()
+
+	pendingStorage := NewHermesPromiseRequestStorage(bolt)
+	err = pendingStorage.Store(PendingPromiseRequest{
+		R: []byte{0x0, 0x1},
+		ExchangeMessage: crypto.ExchangeMessage{
+			Promise:        crypto.Promise{Amount: big.NewInt(10), Fee: big.NewInt(0)},
+			AgreementID:    big.NewInt(1),
+			AgreementTotal: big.NewInt(10),
+		},
+		ProviderID: identity.FromAddress("0x0000000000000000000000000000000000000001"),
+		SessionID:  "session",
+	})
+	assert.NoError(t, err)
+
+	var observed int32
+	aph := NewHermesPromiseHandler(HermesPromiseHandlerDeps{
+		HermesURLGetter:       &mockHermesURLGetter{},
+		HermesCallerFactory:   func(url string) HermesHTTPRequester { return &mockFlakyHermesCaller{} },
+		Encryption:            &mockEncryptor{errToReturn: errors.New("no key")},
+		EventBus:              mocks.NewEventBus(),
+		HermesPromiseStorage:  &mockHermesPromiseStorage{},
+		PendingRequestStorage: pendingStorage,
+		FeeProvider:           &mockFeeProvider{},
+		RequestObserver:       func(RequestInfo) { atomic.AddInt32(&observed, 1) },
+	})
+	go aph.handleServiceEvent(servicestate.AppEventServiceStatus{Status: string(servicestate.Running)})
+	defer aph.doStop()
+
+	// the replayed request goes through the queue workers.
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&observed) == 1 }, 2*time.Second, 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+
+	pending, err := pendingStorage.List()
+	assert.NoError(t, err)
+	assert.Len(t, pending, 1)
+}
+
+func TestHermesPromiseHandler_Shutdown(t *testing.T) {
+	caller := &mockFlakyHermesCaller{}
+	aph := NewHermesPromiseHandler(HermesPromiseHandlerDeps{
+		HermesURLGetter:      &mockHermesURLGetter{},
+		HermesCallerFactory:  func(url string) HermesHTTPRequester { return caller },
+		Encryption:           &mockEncryptor{},
+		EventBus:             mocks.NewEventBus(),
+		HermesPromiseStorage: &mockHermesPromiseStorage{},
+		FeeProvider:          &mockFeeProvider{},
+		HermesSignerGetter:   &mockHermesSignerGetter{},
+	})
+
+	em := crypto.ExchangeMessage{
+		Promise:        crypto.Promise{Amount: big.NewInt(10), Fee: big.NewInt(0)},
+		AgreementID:    big.NewInt(1),
+		AgreementTotal: big.NewInt(10),
+	}
+	provider := identity.FromAddress("0x0000000000000000000000000000000000000001")
+	first := aph.RequestPromise([]byte{0x0}, em, provider, "session")
+	em.AgreementID = big.NewInt(2)
+	second := aph.RequestPromise([]byte{0x1}, em, provider, "session")
+
+	assert.NoError(t, aph.Shutdown(context.Background()))
+	assert.Equal(t, 2, caller.getCalls())
+	assert.NoError(t, <-first)
+	assert.NoError(t, <-second)
+
+	ch := aph.RequestPromise([]byte{0x2}, em, provider, "session")
+	assert.Equal(t, ErrHandlerStopped, <-ch)
+	ch = aph.TryRequestPromise([]byte{0x2}, em, provider, "session")
+	assert.Equal(t, ErrHandlerStopped, <-ch)
+	assert.Equal(t, 2, caller.getCalls())
+}
+
+func TestHermesPromiseHandler_Shutdown_FailsUnprocessedRequests(t *testing.T) {
+	aph := NewHermesPromiseHandler(HermesPromiseHandlerDeps{
+		EventBus: mocks.NewEventBus(),
+	})
+	ch := aph.RequestPromise([]byte{0x0}, crypto.ExchangeMessage{}, identity.FromAddress("0x0000000000000000000000000000000000000001"), "session")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := aph.Shutdown(ctx)
+	assert.True(t, errors.Is(err, context.Canceled))
+
+	err, more := <-ch
+	assert.True(t, more)
+	assert.Equal(t, ErrHandlerStopped, err)
+	assert.Equal(t, 0, aph.QueueDepth())
+}
+
+func TestHermesPromiseHandler_PublishesRevealFailed(t *testing.T) {
+	caller := &mockFlakyHermesCaller{
+		revealErr: errors.New("reveal failed"),
+	}
+	bus := mocks.NewEventBus()
+	aph := &HermesPromiseHandler{
+		deps: HermesPromiseHandlerDeps{
+			HermesURLGetter:      &mockHermesURLGetter{},
+			HermesCallerFactory:  func(url string) HermesHTTPRequester { return caller },
+			Encryption:           &mockEncryptor{},
+			EventBus:             bus,
+			HermesPromiseStorage: &mockHermesPromiseStorage{},
+			FeeProvider:          &mockFeeProvider{},
+			HermesSignerGetter:   &mockHermesSignerGetter{},
+		},
+	}
+
+	hermesID := common.HexToAddress("0x2")
+	provider := identity.FromAddress("0x0000000000000000000000000000000000000001")
+	em := crypto.ExchangeMessage{
+		Promise:        crypto.Promise{Amount: big.NewInt(10), Fee: big.NewInt(0)},
+		AgreementID:    big.NewInt(1),
+		AgreementTotal: big.NewInt(10),
+		HermesID:       hermesID.Hex(),
+	}
+
+	err := processRequest(aph, newEnqueuedRequest(context.Background(), []byte{0x0}, em, provider, "session"))
+	assert.Error(t, err)
+
+	var revealFailed []pinge.AppEventHermesPromiseRevealFailed
+	for _, e := range bus.GetEventHistory() {
+		if e.Topic == pinge.AppTopicHermesPromiseRevealFailed {
+			revealFailed = append(revealFailed, e.Event.(pinge.AppEventHermesPromiseRevealFailed))
+		}
+	}
+	assert.Len(t, revealFailed, 1)
+	assert.Equal(t, hermesID, revealFailed[0].HermesID)
+	assert.Equal(t, provider, revealFailed[0].ProviderID)
+	assert.Equal(t, em.AgreementID, revealFailed[0].AgreementID)
+	assert.NotEmpty(t, revealFailed[0].ChannelID)
+}
+
+func TestHermesPromiseHandler_ConfirmsReveal(t *testing.T) {
+	tests := []struct {
+		name          string
+		caller        HermesHTTPRequester
+		expectedPolls int
+		wantErr       error
+		wantRevealed  bool
+	}{
+		{
+			name: "marks revealed once hermes confirms",
+			caller: &mockRevealConfirmingHermesCaller{
+				mockFlakyHermesCaller: &mockFlakyHermesCaller{},
+				results:               []bool{false, false, true},
+			},
+			expectedPolls: 3,
+			wantRevealed:  true,
+		},
+		{
+			name: "keeps promise unrevealed if hermes does not confirm",
+			caller: &mockRevealConfirmingHermesCaller{
+				mockFlakyHermesCaller: &mockFlakyHermesCaller{},
+				errs:                  []error{errors.New("poll failed")},
+			},
+			expectedPolls: 4,
+			wantErr:       ErrRevealNotConfirmed,
+		},
+		{
+			name:         "optimistically marks revealed if hermes can not confirm",
+			caller:       &mockFlakyHermesCaller{},
+			wantRevealed: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := &mockRecordingHermesPromiseStorage{}
+			aph := &HermesPromiseHandler{
+				deps: HermesPromiseHandlerDeps{
+					HermesURLGetter:       &mockHermesURLGetter{},
+					HermesCallerFactory:   func(url string) HermesHTTPRequester { return tt.caller },
+					Encryption:            &mockEncryptor{},
+					EventBus:              mocks.NewEventBus(),
+					HermesPromiseStorage:  storage,
+					FeeProvider:           &mockFeeProvider{},
+					HermesSignerGetter:    &mockHermesSignerGetter{},
+					RevealConfirmPolls:    4,
+					RevealConfirmInterval: time.Millisecond,
+				},
+			}
+
+			em := crypto.ExchangeMessage{
+				Promise:        crypto.Promise{Amount: big.NewInt(10), Fee: big.NewInt(0)},
+				AgreementID:    big.NewInt(1),
+				AgreementTotal: big.NewInt(10),
+			}
+			provider := identity.FromAddress("0x0000000000000000000000000000000000000001")
+
+			err := processRequest(aph, newEnqueuedRequest(context.Background(), []byte{0x0}, em, provider, "session"))
+			if tt.wantErr != nil {
+				assert.True(t, errors.Is(err, tt.wantErr))
+			} else {
+				assert.NoError(t, err)
+			}
+
+			stored := storage.getStored()
+			assert.NotEmpty(t, stored)
+			assert.Equal(t, tt.wantRevealed, stored[len(stored)-1].Revealed)
+			if confirmer, ok := tt.caller.(*mockRevealConfirmingHermesCaller); ok {
+				assert.Equal(t, tt.expectedPolls, confirmer.getPolls())
+			}
+		})
+	}
+}
+
+func TestHermesPromiseHandler_RequestTimeout(t *testing.T) {
+	tests := []struct {
+		name   string
+		caller HermesHTTPRequester
+	}{
+		{
+			name:   "cancels a hanging promise request",
+			caller: &mockHangingHermesCaller{mockFlakyHermesCaller: &mockFlakyHermesCaller{}, cancelled: make(chan struct{})},
+		},
+		{
+			name: "stops confirming the reveal",
+			caller: &mockRevealConfirmingHermesCaller{
+				mockFlakyHermesCaller: &mockFlakyHermesCaller{},
+				results:               []bool{false},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aph := &HermesPromiseHandler{
+				deps: HermesPromiseHandlerDeps{
+					HermesURLGetter:       &mockHermesURLGetter{},
+					HermesCallerFactory:   func(url string) HermesHTTPRequester { return tt.caller },
+					Encryption:            &mockEncryptor{},
+					EventBus:              mocks.NewEventBus(),
+					HermesPromiseStorage:  &mockRecordingHermesPromiseStorage{},
+					FeeProvider:           &mockFeeProvider{},
+					HermesSignerGetter:    &mockHermesSignerGetter{},
+					RevealConfirmPolls:    1000,
+					RevealConfirmInterval: 10 * time.Millisecond,
+					RequestTimeout:        50 * time.Millisecond,
+				},
+			}
+
+			em := crypto.ExchangeMessage{
+				Promise:        crypto.Promise{Amount: big.NewInt(10), Fee: big.NewInt(0)},
+				AgreementID:    big.NewInt(1),
+				AgreementTotal: big.NewInt(10),
+			}
+			provider := identity.FromAddress("0x0000000000000000000000000000000000000001")
+
+			started := time.Now()
+			err := processRequest(aph, newEnqueuedRequest(context.Background(), []byte{0x0}, em, provider, "session"))
+			assert.True(t, errors.Is(err, ErrRequestTimeout), err)
+			assert.Less(t, time.Since(started).Milliseconds(), int64(time.Second/time.Millisecond))
+
+			if hanging, ok := tt.caller.(*mockHangingHermesCaller); ok {
+				select {
+				case <-hanging.cancelled:
+				default:
+					t.Error("hermes call was not cancelled")
+				}
+			}
+		})
+	}
+}
+
+func TestHermesPromiseHandler_SweepsUnrevealedPromises(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hermesPromiseHandlerSweepTest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	bolt, err := boltdb.NewStorage(dir)
+	assert.NoError(t, err)
+	defer bolt.Close()
+
+	storage := NewHermesPromiseStorage(bolt)
+	chainID := config.GetInt64(config.FlagChainID)
+	otherChainID := chainID + 1
+	for i, chain := range []int64{chainID, otherChainID} {
+		err = storage.Store(HermesPromise{
+			ChannelID:   "1",
+			Identity:    identity.FromAddress("0x0000000000000000000000000000000000000001"),
+			HermesID:    common.HexToAddress("0x2"),
+			Promise:     crypto.Promise{Amount: big.NewInt(10), Fee: big.NewInt(0), ChainID: chain},
+			R:           "00",
+			AgreementID: big.NewInt(int64(i + 1)),
+		})
+		assert.NoError(t, err)
+	}
+
+	caller := &mockFlakyHermesCaller{}
+	aph := NewHermesPromiseHandler(HermesPromiseHandlerDeps{
+		HermesURLGetter:      &mockHermesURLGetter{},
+		HermesCallerFactory:  func(url string) HermesHTTPRequester { return caller },
+		Encryption:           &mockEncryptor{},
+		EventBus:             mocks.NewEventBus(),
+		HermesPromiseStorage: storage,
+		FeeProvider:          &mockFeeProvider{},
+		RevealSweepInterval:  10 * time.Millisecond,
+		AllowedChainIDs:      []int64{chainID, otherChainID},
+	})
+	go aph.handleServiceEvent(servicestate.AppEventServiceStatus{Status: string(servicestate.Running)})
+	defer aph.doStop()
+
+	// the promises of all the allowed chains are swept.
+	assert.Eventually(t, func() bool {
+		unrevealed, err := storage.ListUnrevealed(chainID)
+		if err != nil || len(unrevealed) != 0 {
+			return false
+		}
+		unrevealed, err = storage.ListUnrevealed(otherChainID)
+		return err == nil && len(unrevealed) == 0
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 2, caller.getReveals())
+}
+
+func TestHermesPromiseHandler_DeferReveal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hermesPromiseHandlerDeferRevealTest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	bolt, err := boltdb.NewStorage(dir)
+	assert.NoError(t, err)
+	defer bolt.Close()
+
+	storage := NewHermesPromiseStorage(bolt)
+	chainID := config.GetInt64(config.FlagChainID)
+	caller := &mockFlakyHermesCaller{promise: crypto.Promise{Amount: big.NewInt(10), ChainID: chainID}}
+	aph := NewHermesPromiseHandler(HermesPromiseHandlerDeps{
+		HermesURLGetter:      &mockHermesURLGetter{},
+		HermesCallerFactory:  func(url string) HermesHTTPRequester { return caller },
+		Encryption:           &mockEncryptor{},
+		EventBus:             mocks.NewEventBus(),
+		HermesPromiseStorage: storage,
+		FeeProvider:          &mockFeeProvider{},
+		HermesSignerGetter:   &mockHermesSignerGetter{},
+		RevealSweepInterval:  time.Hour,
+		HealthCheckInterval:  -1,
+		DeferReveal:          true,
+	})
+	go aph.handleServiceEvent(servicestate.AppEventServiceStatus{Status: string(servicestate.Running)})
+	defer aph.doStop()
+
+	em := crypto.ExchangeMessage{
+		Promise:        crypto.Promise{Amount: big.NewInt(10), Fee: big.NewInt(0), ChainID: chainID},
+		AgreementID:    big.NewInt(1),
+		AgreementTotal: big.NewInt(10),
+		ChainID:        chainID,
+		HermesID:       common.HexToAddress("0x2").Hex(),
+	}
+	provider := identity.FromAddress("0x0000000000000000000000000000000000000001")
+	err = <-aph.RequestPromise([]byte{0x1}, em, provider, "session")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, caller.getCalls())
+	assert.Equal(t, 0, caller.getReveals())
+
+	unrevealed, err := storage.ListUnrevealed(chainID)
+	assert.NoError(t, err)
+	assert.Len(t, unrevealed, 1)
+
+	// the reveal sweep reveals the deferred R.
+	aph.revealUnrevealed(chainID)
+	assert.Equal(t, 1, caller.getReveals())
+	unrevealed, err = storage.ListUnrevealed(chainID)
+	assert.NoError(t, err)
+	assert.Empty(t, unrevealed)
+}
+
+func TestHermesPromiseHandler_RevealsUnrevealedInBatches(t *testing.T) {
+	for _, tc := range []struct {
+		name            string
+		batchErr        error
+		expectedBatches []int
+		expectedReveals int
+	}{
+		{name: "batches", expectedBatches: []int{2, 2, 1}},
+		{name: "falls back to individual reveals", batchErr: errors.New("batch failed"), expectedBatches: []int{2, 2, 1}, expectedReveals: 5},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "hermesPromiseHandlerBatchTest")
+			assert.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			bolt, err := boltdb.NewStorage(dir)
+			assert.NoError(t, err)
+			defer bolt.Close()
+
+			storage := NewHermesPromiseStorage(bolt)
+			chainID := config.GetInt64(config.FlagChainID)
+			for i := 1; i <= 5; i++ {
+				err = storage.Store(HermesPromise{
+					ChannelID:   fmt.Sprint(i),
+					Identity:    identity.FromAddress("0x0000000000000000000000000000000000000001"),
+					HermesID:    common.HexToAddress("0x2"),
+					Promise:     crypto.Promise{Amount: big.NewInt(10), Fee: big.NewInt(0), ChainID: chainID},
+					R:           "00",
+					AgreementID: big.NewInt(int64(i)),
+				})
+				assert.NoError(t, err)
+			}
+
+			caller := &mockBatchHermesCaller{mockFlakyHermesCaller: &mockFlakyHermesCaller{}, batchErr: tc.batchErr}
+			aph := NewHermesPromiseHandler(HermesPromiseHandlerDeps{
+				HermesURLGetter:      &mockHermesURLGetter{},
+				HermesCallerFactory:  func(url string) HermesHTTPRequester { return caller },
+				Encryption:           &mockEncryptor{},
+				EventBus:             mocks.NewEventBus(),
+				HermesPromiseStorage: storage,
+				FeeProvider:          &mockFeeProvider{},
+				RevealBatchSize:      2,
+			})
+
+			aph.revealUnrevealed(chainID)
+
+			assert.Equal(t, tc.expectedBatches, caller.batches)
+			assert.Equal(t, tc.expectedReveals, caller.getReveals())
+			unrevealed, err := storage.ListUnrevealed(chainID)
+			assert.NoError(t, err)
+			assert.Len(t, unrevealed, 0)
+		})
+	}
+}
+
+func TestHermesPromiseHandler_RevealSweepDoesNotBlockRequests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hermesPromiseHandlerSweepLockTest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	bolt, err := boltdb.NewStorage(dir)
+	assert.NoError(t, err)
+	defer bolt.Close()
+
+	storage := NewHermesPromiseStorage(bolt)
+	chainID := config.GetInt64(config.FlagChainID)
+	provider := identity.FromAddress("0x0000000000000000000000000000000000000001")
+	err = storage.Store(HermesPromise{
+		ChannelID:   "1",
+		Identity:    provider,
+		HermesID:    common.HexToAddress("0x2"),
+		Promise:     crypto.Promise{Amount: big.NewInt(10), Fee: big.NewInt(0), ChainID: chainID},
+		R:           "00",
+		AgreementID: big.NewInt(1),
+	})
+	assert.NoError(t, err)
+
+	caller := &mockSlowRevealHermesCaller{
+		mockFlakyHermesCaller: &mockFlakyHermesCaller{promise: crypto.Promise{Amount: big.NewInt(10), ChainID: chainID}},
+		revealing:             make(chan struct{}, 1),
+	}
+	aph := NewHermesPromiseHandler(HermesPromiseHandlerDeps{
+		HermesURLGetter:      &mockHermesURLGetter{},
+		HermesCallerFactory:  func(url string) HermesHTTPRequester { return caller },
+		Encryption:           &mockEncryptor{},
+		EventBus:             mocks.NewEventBus(),
+		HermesPromiseStorage: storage,
+		FeeProvider:          &mockFeeProvider{},
+		HermesSignerGetter:   &mockHermesSignerGetter{},
+		RevealSweepInterval:  time.Hour,
+		HealthCheckInterval:  -1,
+		DeferReveal:          true,
+		RequestTimeout:       500 * time.Millisecond,
+	})
+	go aph.handleServiceEvent(servicestate.AppEventServiceStatus{Status: string(servicestate.Running)})
+	defer aph.doStop()
+
+	swept := make(chan struct{})
+	go func() {
+		defer close(swept)
+		aph.revealUnrevealed(chainID)
+	}()
+	<-caller.revealing
+
+	// the requests of other agreements are processed while R is being revealed.
+	em := crypto.ExchangeMessage{
+		Promise:        crypto.Promise{Amount: big.NewInt(10), Fee: big.NewInt(0), ChainID: chainID},
+		AgreementID:    big.NewInt(2),
+		AgreementTotal: big.NewInt(10),
+		ChainID:        chainID,
+		HermesID:       common.HexToAddress("0x2").Hex(),
+	}
+	assert.NoError(t, <-aph.RequestPromise([]byte{0x1}, em, provider, "session"))
+	select {
+	case <-swept:
+		t.Fatal("expected the reveal to still be in progress")
+	default:
+	}
+
+	// the reveal is cancelled once the request timeout passes.
+	select {
+	case <-swept:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the reveal to time out")
+	}
+}
+
+func TestHermesPromiseHandler_CachesFeesPerChain(t *testing.T) {
+	feeProvider := &mockChainFeeProvider{
+		fees: map[int64]registry.FeesResponse{
+			1: {Fee: big.NewInt(10), ValidUntil: time.Now().Add(time.Hour)},
+			2: {Fee: big.NewInt(20), ValidUntil: time.Now().Add(time.Hour)},
+			3: {Fee: big.NewInt(30), ValidUntil: time.Now().Add(-time.Hour)},
+		},
+	}
+	aph := &HermesPromiseHandler{
+		deps: HermesPromiseHandlerDeps{
+			FeeProvider: feeProvider,
+		},
+	}
+
+	assert.Equal(t, big.NewInt(10), aph.getTransactorFee(1))
+	assert.Equal(t, big.NewInt(20), aph.getTransactorFee(2))
+	assert.Equal(t, big.NewInt(10), aph.getTransactorFee(1))
+	assert.Equal(t, 1, feeProvider.getCalls(1))
+	assert.Equal(t, 1, feeProvider.getCalls(2))
+
+	// expired fees are fetched again.
+	assert.Equal(t, big.NewInt(30), aph.getTransactorFee(3))
+	assert.Equal(t, big.NewInt(30), aph.getTransactorFee(3))
+	assert.Equal(t, 2, feeProvider.getCalls(3))
+}
+
+func TestHermesPromiseHandler_ValidatesPromiseSignature(t *testing.T) {
+	otherKey, err := ethcrypto.GenerateKey()
+	assert.NoError(t, err)
+
+	em := crypto.ExchangeMessage{
+		Promise:        crypto.Promise{Amount: big.NewInt(10), Fee: big.NewInt(0)},
+		AgreementID:    big.NewInt(1),
+		AgreementTotal: big.NewInt(10),
+	}
+	provider := identity.FromAddress("0x0000000000000000000000000000000000000001")
+
+	tests := []struct {
+		name string
+		// operatorKey is the key hermes is expected to sign with, the caller always signs with the test operator key.
+		operatorKey *ecdsa.PrivateKey
+		wantErr     bool
+	}{
+		{
+			name:        "accepts promise signed by hermes operator",
+			operatorKey: testHermesOperatorKey,
+		},
+		{
+			name:        "rejects promise signed by wrong key",
+			operatorKey: otherKey,
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			caller := &mockFlakyHermesCaller{promise: crypto.Promise{Amount: big.NewInt(10), Fee: big.NewInt(0)}}
+			aph := &HermesPromiseHandler{
+				deps: HermesPromiseHandlerDeps{
+					HermesURLGetter:      &mockHermesURLGetter{},
+					HermesCallerFactory:  func(url string) HermesHTTPRequester { return caller },
+					Encryption:           &mockEncryptor{},
+					EventBus:             mocks.NewEventBus(),
+					HermesPromiseStorage: &mockHermesPromiseStorage{},
+					FeeProvider:          &mockFeeProvider{},
+					HermesSignerGetter:   &mockHermesSignerGetter{key: tt.operatorKey},
+				},
+			}
+
+			err := processRequest(aph, newEnqueuedRequest(context.Background(), []byte{0x0}, em, provider, "session"))
+			if tt.wantErr {
+				assert.True(t, errors.Is(err, ErrInvalidPromiseSignature))
+				assert.Equal(t, 0, caller.getReveals())
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, 1, caller.getReveals())
+			}
+		})
+	}
+}
+
+func TestHermesPromiseHandler_ProcessesRequestsEnqueuedBeforeStart(t *testing.T) {
+	caller := &mockFlakyHermesCaller{}
+	aph := NewHermesPromiseHandler(HermesPromiseHandlerDeps{
+		HermesURLGetter:      &mockHermesURLGetter{},
+		HermesCallerFactory:  func(url string) HermesHTTPRequester { return caller },
+		Encryption:           &mockEncryptor{},
+		EventBus:             mocks.NewEventBus(),
+		HermesPromiseStorage: &mockHermesPromiseStorage{},
+		FeeProvider:          &mockFeeProvider{},
+		HermesSignerGetter:   &mockHermesSignerGetter{},
+	})
+	defer aph.doStop()
+
+	em := crypto.ExchangeMessage{
+		Promise:        crypto.Promise{Amount: big.NewInt(10), Fee: big.NewInt(0)},
+		AgreementID:    big.NewInt(1),
+		AgreementTotal: big.NewInt(10),
+	}
+	provider := identity.FromAddress("0x0000000000000000000000000000000000000001")
+
+	errChan := aph.RequestPromise([]byte{0x0}, em, provider, "session")
+	assert.False(t, aph.Ready())
+	assert.Equal(t, 1, aph.QueueDepth())
+	assert.Equal(t, 0, caller.getCalls())
+
+	go aph.handleRequests()
+
+	err, more := <-errChan
+	assert.False(t, more)
+	assert.NoError(t, err)
+	assert.True(t, aph.Ready())
+	assert.Equal(t, 1, caller.getCalls())
+}
+
+func TestHermesPromiseHandler_WaitsForStart(t *testing.T) {
+	em := crypto.ExchangeMessage{
+		Promise:        crypto.Promise{Amount: big.NewInt(10), Fee: big.NewInt(0)},
+		AgreementID:    big.NewInt(1),
+		AgreementTotal: big.NewInt(10),
+	}
+	provider := identity.FromAddress("0x0000000000000000000000000000000000000001")
+
+	newHandler := func(caller *mockFlakyHermesCaller) *HermesPromiseHandler {
+		return NewHermesPromiseHandler(HermesPromiseHandlerDeps{
+			HermesURLGetter:      &mockHermesURLGetter{},
+			HermesCallerFactory:  func(url string) HermesHTTPRequester { return caller },
+			Encryption:           &mockEncryptor{},
+			EventBus:             mocks.NewEventBus(),
+			HermesPromiseStorage: &mockHermesPromiseStorage{},
+			FeeProvider:          &mockFeeProvider{},
+			HermesSignerGetter:   &mockHermesSignerGetter{},
+			StartTimeout:         50 * time.Millisecond,
+		})
+	}
+
+	t.Run("fails if not started in time", func(t *testing.T) {
+		caller := &mockFlakyHermesCaller{}
+		aph := newHandler(caller)
+		defer aph.doStop()
+
+		err := <-aph.RequestPromise([]byte{0x0}, em, provider, "session")
+		assert.True(t, errors.Is(err, ErrHandlerNotStarted))
+		assert.Equal(t, 0, aph.QueueDepth())
+		assert.Equal(t, 0, caller.getCalls())
+	})
+
+	t.Run("proceeds once started", func(t *testing.T) {
+		caller := &mockFlakyHermesCaller{}
+		aph := newHandler(caller)
+		defer aph.doStop()
+
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			aph.handleRequests()
+		}()
+
+		err := <-aph.RequestPromise([]byte{0x0}, em, provider, "session")
+		assert.NoError(t, err)
+		assert.Equal(t, 1, caller.getCalls())
+	})
+}
+
+var _ service.PromiseDrainer = &HermesPromiseHandler{}
+
+func TestHermesPromiseHandler_DrainSessions(t *testing.T) {
+	caller := newMockBlockingHermesCaller()
+	aph := NewHermesPromiseHandler(HermesPromiseHandlerDeps{
+		HermesURLGetter:      &mockHermesURLGetter{},
+		HermesCallerFactory:  func(url string) HermesHTTPRequester { return caller },
+		Encryption:           &mockEncryptor{},
+		EventBus:             mocks.NewEventBus(),
+		HermesPromiseStorage: &mockRecordingHermesPromiseStorage{},
+		FeeProvider:          &mockFeeProvider{},
+		HermesSignerGetter:   &mockHermesSignerGetter{},
+	})
+	go aph.handleRequests()
+	defer aph.doStop()
+
+	provider := identity.FromAddress("0x0000000000000000000000000000000000000001")
+	var errChans []<-chan error
+	for i := 1; i <= 2; i++ {
+		em := crypto.ExchangeMessage{
+			Promise:        crypto.Promise{Amount: big.NewInt(10), Fee: big.NewInt(0)},
+			AgreementID:    big.NewInt(int64(i)),
+			AgreementTotal: big.NewInt(10),
+		}
+		errChans = append(errChans, aph.RequestPromise([]byte{0x0}, em, provider, "session"))
+	}
+	assert.Eventually(t, func() bool { return caller.getMaxActive() == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	// the other sessions have nothing to drain.
+	assert.NoError(t, aph.DrainSessions(context.Background(), []string{"other session"}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := aph.DrainSessions(ctx, []string{"session"})
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), err)
+
+	drained := make(chan error)
+	go func() {
+		drained <- aph.DrainSessions(context.Background(), []string{"session"})
+	}()
+	go func() {
+		for _, errChan := range errChans {
+			assert.NoError(t, <-errChan)
+		}
+	}()
+	close(caller.release)
+
+	select {
+	case err := <-drained:
+		assert.NoError(t, err)
+		assert.Equal(t, 2, caller.getCalls())
+	case <-time.After(2 * time.Second):
+		t.Fatal("sessions were not drained")
+	}
+}
+
+func TestHermesPromiseHandler_Workers(t *testing.T) {
+	provider := identity.FromAddress("0x0000000000000000000000000000000000000001")
+	newExchangeMessage := func(agreementID int64) crypto.ExchangeMessage {
+		return crypto.ExchangeMessage{
+			Promise:        crypto.Promise{Amount: big.NewInt(10), Fee: big.NewInt(0)},
+			AgreementID:    big.NewInt(agreementID),
+			AgreementTotal: big.NewInt(10),
+		}
+	}
+	newHandler := func(caller HermesHTTPRequester, workers int) *HermesPromiseHandler {
+		return NewHermesPromiseHandler(HermesPromiseHandlerDeps{
+			HermesURLGetter:      &mockHermesURLGetter{},
+			HermesCallerFactory:  func(url string) HermesHTTPRequester { return caller },
+			Encryption:           &mockEncryptor{},
+			EventBus:             mocks.NewEventBus(),
+			HermesPromiseStorage: &mockRecordingHermesPromiseStorage{},
+			FeeProvider:          &mockFeeProvider{},
+			HermesSignerGetter:   &mockHermesSignerGetter{},
+			Workers:              workers,
+		})
+	}
+
+	for _, workers := range []int{1, 4} {
+		t.Run(fmt.Sprintf("processes requests with %v workers", workers), func(t *testing.T) {
+			caller := newMockBlockingHermesCaller()
+			aph := newHandler(caller, workers)
+			go aph.handleRequests()
+			defer aph.doStop()
+
+			var errChans []<-chan error
+			for i := 1; i <= 8; i++ {
+				errChans = append(errChans, aph.RequestPromise([]byte{0x0}, newExchangeMessage(int64(i)), provider, "session"))
+			}
+
+			assert.Eventually(t, func() bool {
+				return caller.getMaxActive() == workers
+			}, 2*time.Second, 10*time.Millisecond)
+			time.Sleep(50 * time.Millisecond)
+			assert.Equal(t, workers, caller.getMaxActive())
+
+			close(caller.release)
+			for _, errChan := range errChans {
+				assert.NoError(t, <-errChan)
+			}
+			assert.Equal(t, 8, caller.getCalls())
+		})
+	}
+
+	t.Run("does not process the same agreement concurrently", func(t *testing.T) {
+		caller := newMockBlockingHermesCaller()
+		aph := newHandler(caller, 4)
+		go aph.handleRequests()
+		defer aph.doStop()
+
+		first := aph.RequestPromise([]byte{0x0}, newExchangeMessage(1), provider, "session")
+		second := aph.RequestPromise([]byte{0x0}, newExchangeMessage(1), provider, "session")
+
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(t, 1, caller.getMaxActive())
+
+		close(caller.release)
+		assert.NoError(t, <-first)
+		assert.NoError(t, <-second)
+		assert.Equal(t, 1, caller.getCalls())
+	})
+}
+
+func Benchmark_HermesPromiseHandler_Workers(b *testing.B) {
+	provider := identity.FromAddress("0x0000000000000000000000000000000000000001")
+
+	for _, workers := range []int{1, 8} {
+		b.Run(fmt.Sprintf("workers=%v", workers), func(b *testing.B) {
+			caller := &mockSlowHermesCaller{mockFlakyHermesCaller: &mockFlakyHermesCaller{}, delay: time.Millisecond}
+			aph := NewHermesPromiseHandler(HermesPromiseHandlerDeps{
+				HermesURLGetter:      &mockHermesURLGetter{},
+				HermesCallerFactory:  func(url string) HermesHTTPRequester { return caller },
+				Encryption:           &mockEncryptor{},
+				EventBus:             mocks.NewEventBus(),
+				HermesPromiseStorage: &mockRecordingHermesPromiseStorage{},
+				FeeProvider:          &mockFeeProvider{},
+				HermesSignerGetter:   &mockHermesSignerGetter{},
+				Workers:              workers,
+			})
+			go aph.handleRequests()
+			defer aph.doStop()
+
+			b.ResetTimer()
+			errChans := make([]<-chan error, 0, b.N)
+			for i := 0; i < b.N; i++ {
+				em := crypto.ExchangeMessage{
+					Promise:        crypto.Promise{Amount: big.NewInt(10), Fee: big.NewInt(0)},
+					AgreementID:    big.NewInt(int64(i)),
+					AgreementTotal: big.NewInt(10),
+				}
+				errChans = append(errChans, aph.RequestPromise([]byte{0x0}, em, provider, "session"))
+			}
+			for _, errChan := range errChans {
+				drainErrChan(errChan)
+			}
+		})
+	}
+}
+
+func TestHermesPromiseHandler_ValidatesHermesURL(t *testing.T) {
+	hermesID := common.HexToAddress("0x2")
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{url: "", wantErr: true},
+		{url: "ftp://hermes.test/api/v2", wantErr: true},
+		{url: "hermes.test/api/v2", wantErr: true},
+		{url: "http://%zz", wantErr: true},
+		{url: "http://hermes.test/api/v2"},
+		{url: "https://hermes.test/api/v2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			var created []string
+			aph := &HermesPromiseHandler{
+				deps: HermesPromiseHandlerDeps{
+					HermesURLGetter: &mockMappedHermesURLGetter{urls: map[common.Address]string{hermesID: tt.url}},
+					HermesCallerFactory: func(url string) HermesHTTPRequester {
+						created = append(created, url)
+						return &mockFlakyHermesCaller{}
+					},
+				},
+			}
+
+			caller, err := aph.getHermesCaller(hermesID)
+			if tt.wantErr {
+				assert.True(t, errors.Is(err, ErrInvalidHermesURL), err)
+				assert.Nil(t, caller)
+				assert.Empty(t, created)
+			} else {
+				assert.NoError(t, err)
+				assert.NotNil(t, caller)
+				assert.Equal(t, []string{tt.url}, created)
+			}
+		})
+	}
+}
+
+func TestHermesPromiseHandler_StoresPromise(t *testing.T) {
+	tests := []struct {
+		name     string
+		storeErr error
+		wantErr  bool
+	}{
+		{name: "stores promise"},
+		{name: "ignores duplicate promise", storeErr: ErrDuplicatePromise},
+		{name: "keeps newer promise", storeErr: ErrStalePromise},
+		{name: "fails on storage error", storeErr: errors.New("disk full"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aph := &HermesPromiseHandler{
+				deps: HermesPromiseHandlerDeps{
+					HermesURLGetter:      &mockHermesURLGetter{},
+					HermesCallerFactory:  func(url string) HermesHTTPRequester { return &mockFlakyHermesCaller{} },
+					Encryption:           &mockEncryptor{},
+					EventBus:             mocks.NewEventBus(),
+					HermesPromiseStorage: &mockHermesPromiseStorage{errToReturn: tt.storeErr},
+					FeeProvider:          &mockFeeProvider{},
+					HermesSignerGetter:   &mockHermesSignerGetter{},
+				},
+			}
+
+			em := crypto.ExchangeMessage{
+				Promise:        crypto.Promise{Amount: big.NewInt(10), Fee: big.NewInt(0)},
+				AgreementID:    big.NewInt(1),
+				AgreementTotal: big.NewInt(10),
+			}
+			provider := identity.FromAddress("0x0000000000000000000000000000000000000001")
+
+			err := processRequest(aph, newEnqueuedRequest(context.Background(), []byte{0x0}, em, provider, "session"))
+			if tt.wantErr {
+				assert.True(t, errors.Is(err, tt.storeErr), err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestHermesPromiseHandler_SurvivesPanickingSubscriber(t *testing.T) {
+	bus := eventbus.New()
+	err := bus.Subscribe(pinge.AppTopicHermesPromise, func(e pinge.AppEventHermesPromise) {
+		panic("bad subscriber")
+	})
+	assert.NoError(t, err)
+	var earned []sessionEvent.AppEventTokensEarned
+	err = bus.Subscribe(sessionEvent.AppTopicTokensEarned, func(e sessionEvent.AppEventTokensEarned) {
+		earned = append(earned, e)
+	})
+	assert.NoError(t, err)
+
+	caller := &mockFlakyHermesCaller{}
+	aph := &HermesPromiseHandler{
+		deps: HermesPromiseHandlerDeps{
+			HermesURLGetter:      &mockHermesURLGetter{},
+			HermesCallerFactory:  func(url string) HermesHTTPRequester { return caller },
+			Encryption:           &mockEncryptor{},
+			EventBus:             bus,
+			HermesPromiseStorage: &mockHermesPromiseStorage{},
+			FeeProvider:          &mockFeeProvider{},
+			HermesSignerGetter:   &mockHermesSignerGetter{},
+		},
+	}
+
+	em := crypto.ExchangeMessage{
+		Promise:        crypto.Promise{Amount: big.NewInt(10), Fee: big.NewInt(0)},
+		AgreementID:    big.NewInt(1),
+		AgreementTotal: big.NewInt(10),
+	}
+	provider := identity.FromAddress("0x0000000000000000000000000000000000000001")
+
+	err = processRequest(aph, newEnqueuedRequest(context.Background(), []byte{0x0}, em, provider, "session"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, caller.getReveals())
+	assert.Len(t, earned, 1)
+}
+
+func TestHermesPromiseHandler_RefreshesFees(t *testing.T) {
+	feeProvider := &mockChainFeeProvider{}
+	aph := NewHermesPromiseHandler(HermesPromiseHandlerDeps{
+		FeeProvider:        feeProvider,
+		EventBus:           mocks.NewEventBus(),
+		FeeRefreshInterval: 10 * time.Millisecond,
+	})
+	aph.updateFee(1)
+	aph.updateFee(2)
+
+	done := make(chan struct{})
+	go func() {
+		aph.refreshFees()
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool {
+		return feeProvider.getCalls(1) >= 3 && feeProvider.getCalls(2) >= 3
+	}, 2*time.Second, 5*time.Millisecond)
+	assert.Equal(t, 0, feeProvider.getCalls(3))
+
+	aph.doStop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("fee refresh did not stop")
+	}
+}
+
+func TestHermesPromiseHandler_CancelSession(t *testing.T) {
+	caller := &mockFlakyHermesCaller{}
+	observed := make(chan string, 2)
+	aph := NewHermesPromiseHandler(HermesPromiseHandlerDeps{
+		HermesURLGetter:      &mockHermesURLGetter{},
+		HermesCallerFactory:  func(url string) HermesHTTPRequester { return caller },
+		Encryption:           &mockEncryptor{},
+		EventBus:             mocks.NewEventBus(),
+		HermesPromiseStorage: &mockHermesPromiseStorage{},
+		FeeProvider:          &mockFeeProvider{},
+		HermesSignerGetter:   &mockHermesSignerGetter{},
+		RequestObserver: func(info RequestInfo) {
+			observed <- info.SessionID
+		},
+	})
+	defer aph.doStop()
+
+	newExchangeMessage := func(agreementID int64) crypto.ExchangeMessage {
+		return crypto.ExchangeMessage{
+			Promise:        crypto.Promise{Amount: big.NewInt(10), Fee: big.NewInt(0)},
+			AgreementID:    big.NewInt(agreementID),
+			AgreementTotal: big.NewInt(10),
+		}
+	}
+	provider := identity.FromAddress("0x0000000000000000000000000000000000000001")
+
+	cancelled := aph.RequestPromise([]byte{0x0}, newExchangeMessage(1), provider, "cancelled")
+	kept := aph.RequestPromise([]byte{0x0}, newExchangeMessage(2), provider, "kept")
+	assert.Equal(t, 2, aph.QueueDepth())
+
+	aph.CancelSession("cancelled")
+	go aph.handleRequests()
+
+	err := <-cancelled
+	assert.True(t, errors.Is(err, ErrRequestCancelled))
+	assert.NoError(t, <-kept)
+
+	assert.Equal(t, 1, caller.getCalls())
+	assert.Equal(t, big.NewInt(2), caller.getLastRequest().ExchangeMessage.AgreementID)
+
+	// the cancelled requests are observed as well.
+	var sessions []string
+	for i := 0; i < 2; i++ {
+		select {
+		case sessionID := <-observed:
+			sessions = append(sessions, sessionID)
+		case <-time.After(time.Second):
+			t.Fatal("request was not observed")
+		}
+	}
+	assert.ElementsMatch(t, []string{"cancelled", "kept"}, sessions)
+}
+
+func TestHermesPromiseHandler_RejectsNotAllowedChain(t *testing.T) {
+	caller := &mockFlakyHermesCaller{}
+	aph := &HermesPromiseHandler{
+		deps: HermesPromiseHandlerDeps{
+			HermesURLGetter:      &mockHermesURLGetter{},
+			HermesCallerFactory:  func(url string) HermesHTTPRequester { return caller },
+			Encryption:           &mockEncryptor{},
+			EventBus:             mocks.NewEventBus(),
+			HermesPromiseStorage: &mockHermesPromiseStorage{},
+			FeeProvider:          &mockFeeProvider{},
+			HermesSignerGetter:   &mockHermesSignerGetter{},
+			AllowedChainIDs:      []int64{1},
+		},
+	}
+
+	em := crypto.ExchangeMessage{
+		Promise:        crypto.Promise{Amount: big.NewInt(10), Fee: big.NewInt(0)},
+		AgreementID:    big.NewInt(1),
+		AgreementTotal: big.NewInt(10),
+		ChainID:        2,
+	}
+	provider := identity.FromAddress("0x0000000000000000000000000000000000000001")
+
+	err := processRequest(aph, newEnqueuedRequest(context.Background(), []byte{0x0}, em, provider, "session"))
+	assert.True(t, errors.Is(err, ErrChainNotAllowed))
+	assert.Equal(t, 0, caller.getCalls())
+
+	em.ChainID = 1
+	err = processRequest(aph, newEnqueuedRequest(context.Background(), []byte{0x0}, em, provider, "session"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, caller.getCalls())
+}
+
+func TestHermesPromiseHandler_RequestPromiseWithResult(t *testing.T) {
+	promise := signTestPromise(crypto.Promise{Amount: big.NewInt(10), Fee: big.NewInt(0)})
+	em := crypto.ExchangeMessage{
+		Promise:        promise,
+		AgreementID:    big.NewInt(1),
+		AgreementTotal: big.NewInt(10),
+	}
+	provider := identity.FromAddress("0x0000000000000000000000000000000000000001")
+
+	tests := []struct {
+		name         string
+		revealErr    error
+		wantRevealed bool
+		wantErr      bool
+	}{
+		{
+			name:         "reports revealed promise",
+			wantRevealed: true,
+		},
+		{
+			name:      "reports promise that failed to be revealed",
+			revealErr: errors.New("reveal failed"),
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			caller := &mockFlakyHermesCaller{promise: promise, revealErr: tt.revealErr}
+			aph := NewHermesPromiseHandler(HermesPromiseHandlerDeps{
+				HermesURLGetter:      &mockHermesURLGetter{},
+				HermesCallerFactory:  func(url string) HermesHTTPRequester { return caller },
+				Encryption:           &mockEncryptor{},
+				EventBus:             mocks.NewEventBus(),
+				HermesPromiseStorage: &mockHermesPromiseStorage{},
+				FeeProvider:          &mockFeeProvider{},
+				HermesSignerGetter:   &mockHermesSignerGetter{},
+			})
+			go aph.handleRequests()
+			defer aph.doStop()
+
+			ch := aph.RequestPromiseWithResult(context.Background(), []byte{0x0}, em, provider, "session")
+			result, more := <-ch
+			assert.True(t, more)
+			assert.Equal(t, promise, result.Promise)
+			assert.Equal(t, tt.wantRevealed, result.Revealed)
+			assert.Equal(t, tt.wantErr, result.Err != nil)
+
+			_, more = <-ch
+			assert.False(t, more)
+		})
+	}
+}
+
+var _ service.PromiseSubmitter = &HermesPromiseHandler{}
+
+func TestHermesPromiseHandler_SubmitPromise(t *testing.T) {
+	promise := signTestPromise(crypto.Promise{Amount: big.NewInt(10), Fee: big.NewInt(0)})
+	em := crypto.ExchangeMessage{
+		Promise:        promise,
+		AgreementID:    big.NewInt(1),
+		AgreementTotal: big.NewInt(10),
+	}
+	provider := identity.FromAddress("0x0000000000000000000000000000000000000001")
+
+	caller := &mockFlakyHermesCaller{promise: promise, errs: []error{HermesErrorResponse{c: ErrHermesInvalidSignature}}}
+	aph := NewHermesPromiseHandler(HermesPromiseHandlerDeps{
+		HermesURLGetter:      &mockHermesURLGetter{},
+		HermesCallerFactory:  func(url string) HermesHTTPRequester { return caller },
+		Encryption:           &mockEncryptor{},
+		EventBus:             mocks.NewEventBus(),
+		HermesPromiseStorage: &mockHermesPromiseStorage{},
+		FeeProvider:          &mockFeeProvider{},
+		HermesSignerGetter:   &mockHermesSignerGetter{},
+	})
+	go aph.handleRequests()
+	defer aph.doStop()
+
+	err := aph.SubmitPromise(context.Background(), []byte{0x0}, em, provider, "session")
+	assert.True(t, errors.Is(err, ErrHermesInvalidSignature), err)
+
+	assert.NoError(t, aph.SubmitPromise(context.Background(), []byte{0x0}, em, provider, "session"))
+	assert.Equal(t, 2, caller.getCalls())
+}
+
+func TestHermesPromiseHandler_CoalescesDuplicateRequests(t *testing.T) {
+	em := crypto.ExchangeMessage{
+		Promise:        crypto.Promise{Amount: big.NewInt(10), Fee: big.NewInt(0)},
+		AgreementID:    big.NewInt(1),
+		AgreementTotal: big.NewInt(10),
+	}
+	provider := identity.FromAddress("0x0000000000000000000000000000000000000001")
+
+	tests := []struct {
+		name    string
+		errs    []error
+		wantErr bool
+	}{
+		{
+			name: "shares success",
+		},
+		{
+			name:    "shares failure",
+			errs:    []error{ErrHermesHashlockMissmatch},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			caller := &mockFlakyHermesCaller{errs: tt.errs}
+			aph := NewHermesPromiseHandler(HermesPromiseHandlerDeps{
+				HermesURLGetter:      &mockHermesURLGetter{},
+				HermesCallerFactory:  func(url string) HermesHTTPRequester { return caller },
+				Encryption:           &mockEncryptor{},
+				EventBus:             mocks.NewEventBus(),
+				HermesPromiseStorage: &mockHermesPromiseStorage{},
+				FeeProvider:          &mockFeeProvider{},
+				HermesSignerGetter:   &mockHermesSignerGetter{},
+			})
+
+			first := aph.RequestPromise([]byte{0x0}, em, provider, "session")
+			second := aph.RequestPromise([]byte{0x0}, em, provider, "session")
+			assert.Equal(t, 1, aph.QueueDepth())
+
+			go aph.handleRequests()
+			defer aph.doStop()
+
+			var errs []error
+			for _, ch := range []<-chan error{first, second} {
+				var err error
+				for e := range ch {
+					err = e
+				}
+				errs = append(errs, err)
+			}
+
+			assert.Equal(t, 1, caller.getCalls())
+			assert.Equal(t, tt.wantErr, errs[0] != nil)
+			assert.Equal(t, errs[0], errs[1])
+
+			// once the request is done, the same agreement can be requested again.
+			ch := aph.RequestPromise([]byte{0x0}, em, provider, "session")
+			for range ch {
+			}
+			assert.Equal(t, 2, caller.getCalls())
+		})
+	}
+}
+
+func TestHermesPromiseHandler_QueuesNewerAgreementTotals(t *testing.T) {
+	em := crypto.ExchangeMessage{
+		Promise:        crypto.Promise{Amount: big.NewInt(10), Fee: big.NewInt(0)},
+		AgreementID:    big.NewInt(1),
+		AgreementTotal: big.NewInt(10),
+	}
+	newer := em
+	newer.Promise = crypto.Promise{Amount: big.NewInt(20), Fee: big.NewInt(0)}
+	newer.AgreementTotal = big.NewInt(20)
+	provider := identity.FromAddress("0x0000000000000000000000000000000000000001")
+
+	caller := &mockFlakyHermesCaller{}
+	aph := NewHermesPromiseHandler(HermesPromiseHandlerDeps{
+		HermesURLGetter:      &mockHermesURLGetter{},
+		HermesCallerFactory:  func(url string) HermesHTTPRequester { return caller },
+		Encryption:           &mockEncryptor{},
+		EventBus:             mocks.NewEventBus(),
+		HermesPromiseStorage: &mockHermesPromiseStorage{},
+		FeeProvider:          &mockFeeProvider{},
+		HermesSignerGetter:   &mockHermesSignerGetter{},
+	})
+
+	first := aph.RequestPromise([]byte{0x0}, em, provider, "session")
+	second := aph.RequestPromise([]byte{0x1}, newer, provider, "session")
+	duplicate := aph.RequestPromise([]byte{0x1}, newer, provider, "session")
+	assert.Equal(t, 2, aph.QueueDepth())
+
+	go aph.handleRequests()
+	defer aph.doStop()
+
+	for _, ch := range []<-chan error{first, second, duplicate} {
+		for err := range ch {
+			assert.NoError(t, err)
+		}
+	}
+	assert.Equal(t, 2, caller.getCalls())
+	assert.Equal(t, big.NewInt(20), caller.getLastRequest().ExchangeMessage.AgreementTotal)
+}
+
+func TestHermesPromiseHandler_RefreshesExpiredFee(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	feeProvider := &mockChainFeeProvider{
+		fees: map[int64]registry.FeesResponse{
+			1: {Fee: big.NewInt(10), ValidUntil: now.Add(time.Minute)},
+		},
+	}
+	aph := &HermesPromiseHandler{
+		deps: HermesPromiseHandlerDeps{
+			FeeProvider: feeProvider,
+			Clock:       func() time.Time { return now },
+		},
+	}
+
+	aph.getTransactorFee(1)
+	aph.getTransactorFee(1)
+	assert.Equal(t, 1, feeProvider.getCalls(1))
+
+	now = now.Add(2 * time.Minute)
+	aph.getTransactorFee(1)
+	assert.Equal(t, 2, feeProvider.getCalls(1))
+}
+
+func TestHermesPromiseHandler_RetriesWithRefreshedFee(t *testing.T) {
+	feeTooLow := HermesErrorResponse{CausedBy: ErrHermesTransactorFeeTooLow.Error(), c: ErrHermesTransactorFeeTooLow}
+	for _, tc := range []struct {
+		name          string
+		errs          []error
+		feeErr        error
+		expectedErr   error
+		expectedCalls int
+		expectedFee   *big.Int
+	}{
+		{name: "succeeds with the refreshed fee", errs: []error{feeTooLow}, expectedCalls: 2, expectedFee: big.NewInt(20)},
+		{name: "retries only once", errs: []error{feeTooLow, feeTooLow}, expectedErr: ErrHermesTransactorFeeTooLow, expectedCalls: 2, expectedFee: big.NewInt(20)},
+		{name: "fails if the fee could not be refreshed", errs: []error{feeTooLow}, feeErr: errors.New("no fees"), expectedErr: errors.New("no fees"), expectedCalls: 1, expectedFee: big.NewInt(10)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			feeProvider := &mockChainFeeProvider{
+				fees: map[int64]registry.FeesResponse{
+					1: {Fee: big.NewInt(10), ValidUntil: time.Now().Add(time.Hour)},
+				},
+			}
+			caller := &mockFlakyHermesCaller{errs: tc.errs}
+			aph := &HermesPromiseHandler{
+				deps: HermesPromiseHandlerDeps{
+					HermesURLGetter:      &mockHermesURLGetter{},
+					HermesCallerFactory:  func(url string) HermesHTTPRequester { return caller },
+					Encryption:           &mockEncryptor{},
+					EventBus:             mocks.NewEventBus(),
+					HermesPromiseStorage: &mockRecordingHermesPromiseStorage{},
+					FeeProvider:          feeProvider,
+					HermesSignerGetter:   &mockHermesSignerGetter{},
+				},
+			}
+			assert.Equal(t, big.NewInt(10), aph.getTransactorFee(1))
+
+			feeProvider.lock.Lock()
+			feeProvider.fees[1] = registry.FeesResponse{Fee: big.NewInt(20), ValidUntil: time.Now().Add(time.Hour)}
+			feeProvider.lock.Unlock()
+			feeProvider.setErr(tc.feeErr)
+
+			em := crypto.ExchangeMessage{
+				ChainID:     1,
+				AgreementID: big.NewInt(1),
+				Promise:     crypto.Promise{Amount: big.NewInt(0), Fee: big.NewInt(0)},
+			}
+			err := processRequest(aph, newEnqueuedRequest(context.Background(), []byte{0x0}, em, identity.FromAddress("0x0000000000000000000000000000000000000001"), "session"))
+			if tc.expectedErr != nil {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tc.expectedErr.Error())
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.expectedCalls, caller.getCalls())
+			assert.Equal(t, tc.expectedFee, caller.getLastRequest().TransactorFee)
+		})
+	}
+}
+
+func TestHermesPromiseHandler_DryRun(t *testing.T) {
+	bus := mocks.NewEventBus()
+	caller := &mockFlakyHermesCaller{}
+	storage := &mockRecordingHermesPromiseStorage{}
+	aph := &HermesPromiseHandler{
+		deps: HermesPromiseHandlerDeps{
+			HermesURLGetter:      &mockHermesURLGetter{},
+			HermesCallerFactory:  func(url string) HermesHTTPRequester { return caller },
+			Encryption:           &mockEncryptor{},
+			EventBus:             bus,
+			HermesPromiseStorage: storage,
+			FeeProvider:          &mockFeeProvider{toReturn: registry.FeesResponse{Fee: big.NewInt(5), ValidUntil: time.Now().Add(time.Hour)}},
+			DryRun:               true,
+		},
+	}
+
+	em := crypto.ExchangeMessage{
+		ChainID:        1,
+		AgreementID:    big.NewInt(1),
+		AgreementTotal: big.NewInt(10),
+		Promise:        crypto.Promise{Amount: big.NewInt(10), Fee: big.NewInt(0), Hashlock: []byte{0x1}},
+	}
+	err := processRequest(aph, newEnqueuedRequest(context.Background(), []byte{0x0}, em, identity.FromAddress("0x0000000000000000000000000000000000000001"), "session"))
+	assert.NoError(t, err)
+
+	assert.Equal(t, 0, caller.getCalls())
+	assert.Equal(t, 0, caller.getReveals())
+	assert.Len(t, storage.getStored(), 0)
+
+	history := bus.GetEventHistory()
+	assert.Len(t, history, 2)
+	promiseEvent := history[0].Event.(pinge.AppEventHermesPromise)
+	assert.True(t, promiseEvent.DryRun)
+	assert.Equal(t, big.NewInt(5), promiseEvent.Promise.Fee)
+	assert.Equal(t, []byte{0x1}, promiseEvent.Promise.Hashlock)
+	earnedEvent := history[1].Event.(sessionEvent.AppEventTokensEarned)
+	assert.True(t, earnedEvent.DryRun)
+}
+
+func TestHermesPromiseHandler_ObservesRequests(t *testing.T) {
+	observed := make(chan RequestInfo, 1)
+	aph := &HermesPromiseHandler{
+		deps: HermesPromiseHandlerDeps{
+			HermesURLGetter:      &mockHermesURLGetter{},
+			HermesCallerFactory:  func(url string) HermesHTTPRequester { return &mockFlakyHermesCaller{errs: []error{errors.New("boom")}} },
+			Encryption:           &mockEncryptor{},
+			EventBus:             mocks.NewEventBus(),
+			HermesPromiseStorage: &mockHermesPromiseStorage{},
+			FeeProvider:          &mockFeeProvider{},
+			RequestObserver: func(info RequestInfo) {
+				observed <- info
+			},
+		},
+	}
+
+	providerID := identity.FromAddress("0x0000000000000000000000000000000000000001")
+	em := crypto.ExchangeMessage{
+		HermesID:       "0x00000000000000000000000000000000000000a1",
+		AgreementID:    big.NewInt(7),
+		AgreementTotal: big.NewInt(100),
+		Promise:        crypto.Promise{Amount: big.NewInt(100)},
+	}
+	er := newEnqueuedRequest(context.Background(), []byte{0x0}, em, providerID, "session")
+	go aph.processRequest(er)
+	assert.Error(t, <-er.errChan)
+
+	select {
+	case info := <-observed:
+		assert.Equal(t, RequestInfo{
+			ProviderID:     providerID,
+			SessionID:      "session",
+			HermesID:       common.HexToAddress("0x00000000000000000000000000000000000000a1"),
+			AgreementID:    big.NewInt(7),
+			AgreementTotal: big.NewInt(100),
+		}, info)
+	case <-time.After(time.Second):
+		t.Fatal("request was not observed")
+	}
+}
+
+func TestHermesPromiseHandler_RequestsSettlement(t *testing.T) {
+	bus := mocks.NewEventBus()
+	aph := &HermesPromiseHandler{
+		deps: HermesPromiseHandlerDeps{
+			EventBus:        bus,
+			AutoSettle:      true,
+			SettleThreshold: big.NewInt(100),
+		},
+	}
+	providerID := identity.FromAddress("0x0000000000000000000000000000000000000001")
+	hermesID := common.HexToAddress("0x00000000000000000000000000000000000000a1")
+	promiseOf := func(amount int64) HermesPromise {
+		return HermesPromise{
+			ChannelID: "channel",
+			Identity:  providerID,
+			HermesID:  hermesID,
+			Promise:   crypto.Promise{ChainID: 1, Amount: big.NewInt(amount)},
+		}
+	}
+	settlementRequests := func() []pinge.AppEventSettlementRequest {
+		var requests []pinge.AppEventSettlementRequest
+		for _, e := range bus.GetEventHistory() {
+			if e.Topic == pinge.AppTopicSettlementRequest {
+				requests = append(requests, e.Event.(pinge.AppEventSettlementRequest))
+			}
+		}
+		return requests
+	}
+
+	// the first promise seen is considered settled, as the settled amount is not known.
+	aph.requestSettlementIfNeeded(promiseOf(500), log.Logger)
+	assert.Len(t, settlementRequests(), 0)
+
+	aph.requestSettlementIfNeeded(promiseOf(550), log.Logger)
+	assert.Len(t, settlementRequests(), 0)
+
+	aph.requestSettlementIfNeeded(promiseOf(620), log.Logger)
+	assert.Equal(t, []pinge.AppEventSettlementRequest{{HermesID: hermesID, ProviderID: providerID, ChainID: 1}}, settlementRequests())
+
+	// the value accumulated since the previous request is below the threshold.
+	aph.requestSettlementIfNeeded(promiseOf(700), log.Logger)
+	assert.Len(t, settlementRequests(), 1)
+
+	aph.requestSettlementIfNeeded(promiseOf(720), log.Logger)
+	assert.Len(t, settlementRequests(), 2)
+
+	aph.deps.AutoSettle = false
+	aph.requestSettlementIfNeeded(promiseOf(1000), log.Logger)
+	assert.Len(t, settlementRequests(), 2)
+}
+
+func TestHermesPromiseHandler_RequestsSettlementAfterRestart(t *testing.T) {
+	providerID := identity.FromAddress("0x0000000000000000000000000000000000000001")
+	hermesID := common.HexToAddress("0x00000000000000000000000000000000000000a1")
+	promiseOf := func(amount int64) HermesPromise {
+		return HermesPromise{
+			ChannelID: "channel",
+			Identity:  providerID,
+			HermesID:  hermesID,
+			Promise:   crypto.Promise{ChainID: 1, Amount: big.NewInt(amount)},
+		}
+	}
+
+	for _, tc := range []struct {
+		name      string
+		channels  providerChannelGetter
+		amounts   []int64
+		requested int
+	}{
+		{
+			name:      "seeds with the amount settled on-chain",
+			channels:  &mockProviderChannelGetter{channel: client.ProviderChannel{Settled: big.NewInt(900)}},
+			amounts:   []int64{1000, 1040},
+			requested: 1,
+		},
+		{
+			name:      "seeds with the first promise if the settled amount is not known",
+			channels:  &mockProviderChannelGetter{err: errors.New("no rpc")},
+			amounts:   []int64{1000, 1040},
+			requested: 0,
+		},
+		{
+			name:      "seeds with the first promise without the provider channel getter",
+			amounts:   []int64{1000, 1040, 1100},
+			requested: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			bus := mocks.NewEventBus()
+			// a restarted handler has not requested any settlements yet.
+			aph := &HermesPromiseHandler{
+				deps: HermesPromiseHandlerDeps{
+					EventBus:              bus,
+					AutoSettle:            true,
+					SettleThreshold:       big.NewInt(100),
+					ProviderChannelGetter: tc.channels,
+				},
+			}
+			for _, amount := range tc.amounts {
+				aph.requestSettlementIfNeeded(promiseOf(amount), log.Logger)
+			}
+
+			var requested int
+			for _, e := range bus.GetEventHistory() {
+				if e.Topic == pinge.AppTopicSettlementRequest {
+					requested++
+				}
+			}
+			assert.Equal(t, tc.requested, requested)
+		})
+	}
+}
+
+type mockProviderChannelGetter struct {
+	channel client.ProviderChannel
+	err     error
+}
+
+func (m *mockProviderChannelGetter) GetProviderChannel(chainID int64, hermesAddress common.Address, addressToCheck common.Address, pending bool) (client.ProviderChannel, error) {
+	return m.channel, m.err
+}
+
+func TestPromiseLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := promiseLogger("session", big.NewInt(7), identity.FromAddress("0x0000000000000000000000000000000000000001"), common.HexToAddress("0x2")).Output(&buf)
+	logger.Info().Msg("test")
+
+	var entry map[string]interface{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "session", entry["session_id"])
+	assert.Equal(t, "7", entry["agreement_id"])
+	assert.Equal(t, "0x0000000000000000000000000000000000000001", entry["provider"])
+	assert.Equal(t, common.HexToAddress("0x2").Hex(), entry["hermes_id"])
+
+	buf.Reset()
+	logger = promiseLogger("", nil, identity.FromAddress("0x0000000000000000000000000000000000000001"), common.HexToAddress("0x2")).Output(&buf)
+	logger.Info().Msg("test")
+	entry = nil
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.NotContains(t, entry, "session_id")
+	assert.NotContains(t, entry, "agreement_id")
+}
+
+func TestHermesPromiseHandler_CheckHermes(t *testing.T) {
+	bus := mocks.NewEventBus()
+	caller := &mockFlakyHermesCaller{}
+	aph := &HermesPromiseHandler{
+		deps: HermesPromiseHandlerDeps{
+			HermesURLGetter:     &mockHermesURLGetter{},
+			HermesCallerFactory: func(url string) HermesHTTPRequester { return caller },
+			EventBus:            bus,
+		},
+	}
+	hermesID := common.HexToAddress("0x2")
+
+	assert.NoError(t, aph.CheckHermes(hermesID))
+	aph.publishHermesHealth(hermesID)
+
+	caller.lock.Lock()
+	caller.pingErr = errors.New("connection refused")
+	caller.lock.Unlock()
+
+	assert.EqualError(t, aph.CheckHermes(hermesID), "connection refused")
+	aph.publishHermesHealth(hermesID)
+
+	history := bus.GetEventHistory()
+	assert.Len(t, history, 2)
+	assert.Equal(t, pinge.AppTopicHermesHealth, history[0].Topic)
+	assert.Equal(t, pinge.AppEventHermesHealth{HermesID: hermesID, Online: true}, history[0].Event)
+	assert.Equal(t, pinge.AppEventHermesHealth{HermesID: hermesID, Online: false, Reason: "connection refused"}, history[1].Event)
+
+	aph.deps.HermesURLGetter = &mockHermesURLGetter{errToReturn: errors.New("unknown hermes")}
+	assert.Error(t, aph.CheckHermes(hermesID))
+}
+
+func TestHermesPromiseHandler_TokensEarnedDelta(t *testing.T) {
+	bus := mocks.NewEventBus()
+	aph := &HermesPromiseHandler{
+		deps: HermesPromiseHandlerDeps{
+			HermesURLGetter:      &mockHermesURLGetter{},
+			HermesCallerFactory:  func(url string) HermesHTTPRequester { return &mockFlakyHermesCaller{} },
+			Encryption:           &mockEncryptor{},
+			EventBus:             bus,
+			HermesPromiseStorage: &mockRecordingHermesPromiseStorage{},
+			FeeProvider:          &mockFeeProvider{},
+			HermesSignerGetter:   &mockHermesSignerGetter{},
+		},
+	}
+	provider := identity.FromAddress("0x0000000000000000000000000000000000000001")
+
+	for _, em := range []crypto.ExchangeMessage{
+		{AgreementID: big.NewInt(1), AgreementTotal: big.NewInt(10)},
+		{AgreementID: big.NewInt(1), AgreementTotal: big.NewInt(25)},
+		{AgreementID: big.NewInt(2), AgreementTotal: big.NewInt(5)},
+	} {
+		em.Promise = crypto.Promise{Amount: big.NewInt(0), Fee: big.NewInt(0)}
+		err := processRequest(aph, newEnqueuedRequest(context.Background(), []byte{0x0}, em, provider, "session"))
+		assert.NoError(t, err)
+	}
+
+	var deltas []*big.Int
+	for _, e := range bus.GetEventHistory() {
+		if e.Topic == sessionEvent.AppTopicTokensEarned {
+			deltas = append(deltas, e.Event.(sessionEvent.AppEventTokensEarned).Delta)
+		}
+	}
+	assert.Equal(t, []*big.Int{big.NewInt(10), big.NewInt(15), big.NewInt(5)}, deltas)
+}
+
+func TestHermesPromiseHandler_FirstPromise(t *testing.T) {
+	provider := identity.FromAddress("0x0000000000000000000000000000000000000001")
+	firstFlags := func(bus *mocks.EventBus) []bool {
+		var flags []bool
+		for _, e := range bus.GetEventHistory() {
+			if e.Topic == pinge.AppTopicHermesPromise {
+				flags = append(flags, e.Event.(pinge.AppEventHermesPromise).IsFirst)
+			}
+		}
+		return flags
+	}
+
+	t.Run("marks the first promise of every agreement", func(t *testing.T) {
+		bus := mocks.NewEventBus()
+		aph := &HermesPromiseHandler{
+			deps: HermesPromiseHandlerDeps{
+				HermesURLGetter:      &mockHermesURLGetter{},
+				HermesCallerFactory:  func(url string) HermesHTTPRequester { return &mockFlakyHermesCaller{} },
+				Encryption:           &mockEncryptor{},
+				EventBus:             bus,
+				HermesPromiseStorage: &mockRecordingHermesPromiseStorage{},
+				FeeProvider:          &mockFeeProvider{},
+				HermesSignerGetter:   &mockHermesSignerGetter{},
+			},
+		}
+
+		for _, em := range []crypto.ExchangeMessage{
+			{AgreementID: big.NewInt(1), AgreementTotal: big.NewInt(10)},
+			{AgreementID: big.NewInt(1), AgreementTotal: big.NewInt(25)},
+			{AgreementID: big.NewInt(2), AgreementTotal: big.NewInt(5)},
+		} {
+			em.Promise = crypto.Promise{Amount: big.NewInt(0), Fee: big.NewInt(0)}
+			err := processRequest(aph, newEnqueuedRequest(context.Background(), []byte{0x0}, em, provider, "session"))
+			assert.NoError(t, err)
+		}
+
+		assert.Equal(t, []bool{true, false, true}, firstFlags(bus))
+	})
+
+	t.Run("marks a single first promise of concurrent requests", func(t *testing.T) {
+		bus := mocks.NewEventBus()
+		aph := NewHermesPromiseHandler(HermesPromiseHandlerDeps{
+			HermesURLGetter: &mockHermesURLGetter{},
+			HermesCallerFactory: func(url string) HermesHTTPRequester {
+				return &mockSlowHermesCaller{mockFlakyHermesCaller: &mockFlakyHermesCaller{}, delay: time.Millisecond}
+			},
+			Encryption:           &mockEncryptor{},
+			EventBus:             bus,
+			HermesPromiseStorage: &mockRecordingHermesPromiseStorage{},
+			FeeProvider:          &mockFeeProvider{},
+			HermesSignerGetter:   &mockHermesSignerGetter{},
+			Workers:              4,
+		})
+		go aph.handleRequests()
+		defer aph.doStop()
+
+		var wg sync.WaitGroup
+		for i := 1; i <= 10; i++ {
+			wg.Add(1)
+			go func(total int64) {
+				defer wg.Done()
+				em := crypto.ExchangeMessage{
+					Promise:        crypto.Promise{Amount: big.NewInt(total), Fee: big.NewInt(0)},
+					AgreementID:    big.NewInt(1),
+					AgreementTotal: big.NewInt(total),
+				}
+				assert.NoError(t, <-aph.RequestPromise([]byte{0x0}, em, provider, "session"))
+			}(int64(i))
+		}
+		wg.Wait()
+
+		flags := firstFlags(bus)
+		assert.NotEmpty(t, flags)
+		firsts := 0
+		for _, first := range flags {
+			if first {
+				firsts++
+			}
+		}
+		assert.Equal(t, 1, firsts)
+	})
+}
+
+func TestHermesPromiseHandler_SkipsDustPromises(t *testing.T) {
+	provider := identity.FromAddress("0x0000000000000000000000000000000000000001")
+	hermesID := common.HexToAddress("0x2")
+	otherHermesID := common.HexToAddress("0x3")
+	caller := &mockFlakyHermesCaller{}
+	storage := &mockRecordingHermesPromiseStorage{}
+	aph := &HermesPromiseHandler{
+		deps: HermesPromiseHandlerDeps{
+			HermesURLGetter:      &mockHermesURLGetter{},
+			HermesCallerFactory:  func(url string) HermesHTTPRequester { return caller },
+			Encryption:           &mockEncryptor{},
+			EventBus:             mocks.NewEventBus(),
+			HermesPromiseStorage: storage,
+			FeeProvider:          &mockFeeProvider{},
+			HermesSignerGetter:   &mockHermesSignerGetter{},
+			HermesPolicies: map[common.Address]HermesPolicy{
+				hermesID: {MinPromiseAmount: big.NewInt(100)},
+			},
+		},
+	}
+	channelID, err := aph.channelID(provider, hermesID)
+	assert.NoError(t, err)
+	// the channel already holds the promises of the earlier consumers.
+	storage.Store(HermesPromise{ChannelID: channelID, AgreementID: big.NewInt(9), AgreementTotal: big.NewInt(5000), Promise: crypto.Promise{Amount: big.NewInt(5000)}})
+
+	newRequest := func(total int64, hermesID common.Address) enqueuedRequest {
+		em := crypto.ExchangeMessage{
+			Promise:        crypto.Promise{Amount: big.NewInt(5000 + total), Fee: big.NewInt(0)},
+			AgreementID:    big.NewInt(1),
+			AgreementTotal: big.NewInt(total),
+			HermesID:       hermesID.Hex(),
+		}
+		return newEnqueuedRequest(context.Background(), []byte{0x0}, em, provider, "session")
+	}
+	request := func(total int64, hermesID common.Address) RequestPromiseResult {
+		return aph.processPromiseRequest(newRequest(total, hermesID))
+	}
+
+	// the first promise of the agreement is never skipped.
+	result := request(10, hermesID)
+	assert.NoError(t, result.Err)
+	assert.False(t, result.Skipped)
+	assert.Equal(t, 1, caller.getCalls())
+
+	result = request(50, hermesID)
+	assert.NoError(t, result.Err)
+	assert.True(t, result.Skipped)
+	assert.Contains(t, result.SkipReason, "amount 40 is below the minimum promise amount 100")
+	assert.Equal(t, 1, caller.getCalls())
+
+	// the skipped amount is carried by the next promise of the agreement.
+	result = request(110, hermesID)
+	assert.NoError(t, result.Err)
+	assert.False(t, result.Skipped)
+	assert.Equal(t, 2, caller.getCalls())
+
+	// the final promise is never skipped.
+	final := newRequest(120, hermesID)
+	final.final = true
+	result = aph.processPromiseRequest(final)
+	assert.NoError(t, result.Err)
+	assert.False(t, result.Skipped)
+	assert.Equal(t, 3, caller.getCalls())
+
+	// the other hermes has no policy.
+	result = request(121, otherHermesID)
+	assert.NoError(t, result.Err)
+	assert.False(t, result.Skipped)
+	assert.Equal(t, 4, caller.getCalls())
+}
+
+func TestHermesPromiseHandler_RejectsAnomalousAgreementTotal(t *testing.T) {
+	provider := identity.FromAddress("0x0000000000000000000000000000000000000001")
+	hermesID := common.HexToAddress("0x2")
+	caller := &mockFlakyHermesCaller{}
+	storage := &mockRecordingHermesPromiseStorage{}
+	bus := mocks.NewEventBus()
+	aph := &HermesPromiseHandler{
+		deps: HermesPromiseHandlerDeps{
+			HermesURLGetter:         &mockHermesURLGetter{},
+			HermesCallerFactory:     func(url string) HermesHTTPRequester { return caller },
+			Encryption:              &mockEncryptor{},
+			EventBus:                bus,
+			HermesPromiseStorage:    storage,
+			FeeProvider:             &mockFeeProvider{},
+			HermesSignerGetter:      &mockHermesSignerGetter{},
+			MaxAgreementTotalGrowth: 10,
+		},
+	}
+	channelID, err := aph.channelID(provider, hermesID)
+	assert.NoError(t, err)
+	storage.Store(HermesPromise{ChannelID: channelID, AgreementID: big.NewInt(1), AgreementTotal: big.NewInt(100)})
+
+	request := func(agreementID, total int64) RequestPromiseResult {
+		em := crypto.ExchangeMessage{
+			Promise:        crypto.Promise{Amount: big.NewInt(total), Fee: big.NewInt(0)},
+			AgreementID:    big.NewInt(agreementID),
+			AgreementTotal: big.NewInt(total),
+			HermesID:       hermesID.Hex(),
+		}
+		return aph.processPromiseRequest(newEnqueuedRequest(context.Background(), []byte{0x0}, em, provider, "session"))
+	}
+	suspicious := func() []pinge.AppEventSuspiciousPromise {
+		var events []pinge.AppEventSuspiciousPromise
+		for _, e := range bus.GetEventHistory() {
+			if e.Topic == pinge.AppTopicSuspiciousPromise {
+				events = append(events, e.Event.(pinge.AppEventSuspiciousPromise))
+			}
+		}
+		return events
+	}
+
+	// growth up to the multiple is normal.
+	result := request(1, 1000)
+	assert.NoError(t, result.Err)
+	assert.Equal(t, 1, caller.getCalls())
+	assert.Empty(t, suspicious())
+
+	// the first promise of an agreement has nothing to compare to.
+	result = request(2, 1000000)
+	assert.NoError(t, result.Err)
+	assert.Equal(t, 2, caller.getCalls())
+	assert.Empty(t, suspicious())
+
+	storage.Store(HermesPromise{ChannelID: channelID, AgreementID: big.NewInt(1), AgreementTotal: big.NewInt(1000)})
+	result = request(1, 10001)
+	assert.True(t, errors.Is(result.Err, ErrAnomalousAgreementTotal), result.Err)
+	assert.Equal(t, 2, caller.getCalls())
+
+	events := suspicious()
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, pinge.AppEventSuspiciousPromise{
+			HermesID:    hermesID,
+			ProviderID:  provider,
+			SessionID:   "session",
+			AgreementID: big.NewInt(1),
+			Previous:    big.NewInt(1000),
+			Requested:   big.NewInt(10001),
+		}, events[0])
+	}
+}
+
+func TestHermesPromiseHandler_HermesPolicySettleThreshold(t *testing.T) {
+	hermesID := common.HexToAddress("0x2")
+	bus := mocks.NewEventBus()
+	aph := &HermesPromiseHandler{
+		deps: HermesPromiseHandlerDeps{
+			EventBus:        bus,
+			AutoSettle:      true,
+			SettleThreshold: big.NewInt(1000),
+			HermesPolicies: map[common.Address]HermesPolicy{
+				hermesID: {SettleThreshold: big.NewInt(10)},
+			},
+			ProviderChannelGetter: &mockProviderChannelGetter{channel: client.ProviderChannel{Settled: big.NewInt(0)}},
+		},
+	}
+
+	aph.requestSettlementIfNeeded(HermesPromise{ChannelID: "0x1", HermesID: hermesID, Promise: crypto.Promise{Amount: big.NewInt(20)}}, log.Logger)
+	aph.requestSettlementIfNeeded(HermesPromise{ChannelID: "0x2", HermesID: common.HexToAddress("0x3"), Promise: crypto.Promise{Amount: big.NewInt(20)}}, log.Logger)
+
+	var requests []pinge.AppEventSettlementRequest
+	for _, e := range bus.GetEventHistory() {
+		if e.Topic == pinge.AppTopicSettlementRequest {
+			requests = append(requests, e.Event.(pinge.AppEventSettlementRequest))
+		}
+	}
+	assert.Len(t, requests, 1)
+	assert.Equal(t, hermesID, requests[0].HermesID)
+}
+
+// processRequest processes the given request synchronously and returns the first reported error.
+func processRequest(aph *HermesPromiseHandler, er enqueuedRequest) error {
+	go aph.requestPromise(er)
+	return <-er.errChan
+}
+
+type mockMappedHermesURLGetter struct {
+	urls map[common.Address]string
+}
+
+func (mmhug *mockMappedHermesURLGetter) GetHermesURL(address common.Address) (string, error) {
+	url, ok := mmhug.urls[address]
+	if !ok {
+		return "", errors.New("unknown hermes")
+	}
+	return url, nil
+}
+
+type mockRecordingHermesPromiseStorage struct {
+	lock   sync.Mutex
+	stored []HermesPromise
+}
+
+func (mrhps *mockRecordingHermesPromiseStorage) Store(promise HermesPromise) error {
+	mrhps.lock.Lock()
+	defer mrhps.lock.Unlock()
+	mrhps.stored = append(mrhps.stored, promise)
+	return nil
+}
+
+func (mrhps *mockRecordingHermesPromiseStorage) Get(chainID int64, channelID string) (HermesPromise, error) {
+	mrhps.lock.Lock()
+	defer mrhps.lock.Unlock()
+
+	for i := len(mrhps.stored) - 1; i >= 0; i-- {
+		if mrhps.stored[i].ChannelID == channelID {
+			return mrhps.stored[i], nil
+		}
+	}
+	return HermesPromise{}, ErrNotFound
+}
+
+func (mrhps *mockRecordingHermesPromiseStorage) ListUnrevealed(_ int64) ([]HermesPromise, error) {
+	return nil, nil
+}
+
+func (mrhps *mockRecordingHermesPromiseStorage) getStored() []HermesPromise {
+	mrhps.lock.Lock()
+	defer mrhps.lock.Unlock()
+	return append([]HermesPromise{}, mrhps.stored...)
+}
+
+var testHermesOperatorKey, _ = ethcrypto.GenerateKey()
+
+// signTestPromise signs the promise the way hermes does, with the test operator key.
+func signTestPromise(promise crypto.Promise) crypto.Promise {
+	return signTestPromiseWith(promise, testHermesOperatorKey)
+}
+
+func signTestPromiseWith(promise crypto.Promise, key *ecdsa.PrivateKey) crypto.Promise {
+	if promise.Amount == nil {
+		promise.Amount = big.NewInt(0)
+	}
+	if promise.Fee == nil {
+		promise.Fee = big.NewInt(0)
+	}
+
+	signature, err := ethcrypto.Sign(promise.GetHash(), key)
+	if err != nil {
+		panic(err)
+	}
+	if err := crypto.ReformatSignatureVForBC(signature); err != nil {
+		panic(err)
+	}
+	promise.Signature = signature
+	return promise
+}
+
+type mockHermesSignerGetter struct {
+	key *ecdsa.PrivateKey
+	err error
+}
+
+func (mhsg *mockHermesSignerGetter) GetHermesOperator(chainID int64, hermesID common.Address) (common.Address, error) {
+	key := mhsg.key
+	if key == nil {
+		key = testHermesOperatorKey
+	}
+	return ethcrypto.PubkeyToAddress(key.PublicKey), mhsg.err
+}
+
+type mockFlakyHermesCaller struct {
+	lock        sync.Mutex
+	errs        []error
+	calls       int
+	lastRequest RequestPromise
+	revealErr   error
+	pingErr     error
+	reveals     int
+	promise     crypto.Promise
+}
+
+func (mfhc *mockFlakyHermesCaller) RequestPromise(ctx context.Context, rp RequestPromise) (crypto.Promise, error) {
+	mfhc.lock.Lock()
+	defer mfhc.lock.Unlock()
+
+	mfhc.calls++
+	mfhc.lastRequest = rp
+	if len(mfhc.errs) == 0 {
+		return signTestPromise(mfhc.promise), nil
+	}
+
+	err := mfhc.errs[0]
+	mfhc.errs = mfhc.errs[1:]
+	return crypto.Promise{}, err
+}
+
+func (mfhc *mockFlakyHermesCaller) RevealR(ctx context.Context, r string, provider string, agreementID *big.Int) error {
+	mfhc.lock.Lock()
+	defer mfhc.lock.Unlock()
+
+	mfhc.reveals++
+	return mfhc.revealErr
+}
+
+func (mfhc *mockFlakyHermesCaller) UpdatePromiseFee(ctx context.Context, promise crypto.Promise, newFee *big.Int) (crypto.Promise, error) {
+	return promise, nil
+}
+
+func (mfhc *mockFlakyHermesCaller) Ping(ctx context.Context) error {
+	mfhc.lock.Lock()
+	defer mfhc.lock.Unlock()
+	return mfhc.pingErr
+}
+
+func (mfhc *mockFlakyHermesCaller) getCalls() int {
+	mfhc.lock.Lock()
+	defer mfhc.lock.Unlock()
+	return mfhc.calls
+}
+
+func (mfhc *mockFlakyHermesCaller) getReveals() int {
+	mfhc.lock.Lock()
+	defer mfhc.lock.Unlock()
+	return mfhc.reveals
+}
+
+func (mfhc *mockFlakyHermesCaller) getLastRequest() RequestPromise {
+	mfhc.lock.Lock()
+	defer mfhc.lock.Unlock()
+	return mfhc.lastRequest
+}
+
+type mockSlowRevealHermesCaller struct {
+	*mockFlakyHermesCaller
+	revealing chan struct{}
+}
+
+func (msrhc *mockSlowRevealHermesCaller) RevealR(ctx context.Context, r string, provider string, agreementID *big.Int) error {
+	msrhc.revealing <- struct{}{}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+type mockBatchHermesCaller struct {
+	*mockFlakyHermesCaller
+	batchErr error
+	batches  []int
+}
+
+func (mbhc *mockBatchHermesCaller) RevealRBatch(ctx context.Context, reveals []RevealRequest) error {
+	mbhc.batches = append(mbhc.batches, len(reveals))
+	return mbhc.batchErr
+}
+
+type mockRevealConfirmingHermesCaller struct {
+	*mockFlakyHermesCaller
+	results []bool
+	errs    []error
+	polls   int
+}
+
+func (mrchc *mockRevealConfirmingHermesCaller) RRevealed(ctx context.Context, agreementID *big.Int) (bool, error) {
+	mrchc.lock.Lock()
+	defer mrchc.lock.Unlock()
+
+	mrchc.polls++
+	if len(mrchc.errs) > 0 {
+		err := mrchc.errs[0]
+		mrchc.errs = mrchc.errs[1:]
+		return false, err
+	}
+	if len(mrchc.results) == 0 {
+		return false, nil
+	}
+	result := mrchc.results[0]
+	mrchc.results = mrchc.results[1:]
+	return result, nil
+}
+
+func (mrchc *mockRevealConfirmingHermesCaller) getPolls() int {
+	mrchc.lock.Lock()
+	defer mrchc.lock.Unlock()
+	return mrchc.polls
+}
+
+// mockBlockingHermesCaller blocks the promise requests until released, tracking how many of them run concurrently.
+type mockBlockingHermesCaller struct {
+	*mockFlakyHermesCaller
+	release chan struct{}
+
+	activeLock sync.Mutex
+	active     int
+	maxActive  int
+}
+
+func newMockBlockingHermesCaller() *mockBlockingHermesCaller {
+	return &mockBlockingHermesCaller{
+		mockFlakyHermesCaller: &mockFlakyHermesCaller{},
+		release:               make(chan struct{}),
+	}
+}
+
+func (mbhc *mockBlockingHermesCaller) RequestPromise(ctx context.Context, rp RequestPromise) (crypto.Promise, error) {
+	mbhc.activeLock.Lock()
+	mbhc.active++
+	if mbhc.active > mbhc.maxActive {
+		mbhc.maxActive = mbhc.active
+	}
+	mbhc.activeLock.Unlock()
+
+	<-mbhc.release
+
+	mbhc.activeLock.Lock()
+	mbhc.active--
+	mbhc.activeLock.Unlock()
+	return mbhc.mockFlakyHermesCaller.RequestPromise(ctx, rp)
+}
+
+func (mbhc *mockBlockingHermesCaller) getMaxActive() int {
+	mbhc.activeLock.Lock()
+	defer mbhc.activeLock.Unlock()
+	return mbhc.maxActive
+}
+
+// mockHangingHermesCaller never responds to the promise requests, until they are cancelled.
+type mockHangingHermesCaller struct {
+	*mockFlakyHermesCaller
+	cancelled chan struct{}
+	once      sync.Once
+}
+
+func (mhhc *mockHangingHermesCaller) RequestPromise(ctx context.Context, rp RequestPromise) (crypto.Promise, error) {
+	<-ctx.Done()
+	mhhc.once.Do(func() { close(mhhc.cancelled) })
+	return crypto.Promise{}, ctx.Err()
+}
+
+type mockSlowHermesCaller struct {
+	*mockFlakyHermesCaller
+	delay time.Duration
+}
+
+func (mshc *mockSlowHermesCaller) RequestPromise(ctx context.Context, rp RequestPromise) (crypto.Promise, error) {
+	time.Sleep(mshc.delay)
+	return mshc.mockFlakyHermesCaller.RequestPromise(ctx, rp)
+}
+
+type mockFeeProvider struct {
+	toReturn    registry.FeesResponse
+	errToReturn error
+}
+
+func (mfp *mockFeeProvider) FetchSettleFees(chainID int64) (registry.FeesResponse, error) {
+	return mfp.toReturn, mfp.errToReturn
+}
+
+type mockChainFeeProvider struct {
+	lock  sync.Mutex
+	fees  map[int64]registry.FeesResponse
+	calls map[int64]int
+	err   error
+}
+
+func (mcfp *mockChainFeeProvider) FetchSettleFees(chainID int64) (registry.FeesResponse, error) {
+	mcfp.lock.Lock()
+	defer mcfp.lock.Unlock()
+
+	if mcfp.calls == nil {
+		mcfp.calls = make(map[int64]int)
+	}
+	mcfp.calls[chainID]++
+	return mcfp.fees[chainID], mcfp.err
+}
+
+func (mcfp *mockChainFeeProvider) setErr(err error) {
+	mcfp.lock.Lock()
+	defer mcfp.lock.Unlock()
+	mcfp.err = err
+}
+
+func (mcfp *mockChainFeeProvider) getCalls(chainID int64) int {
+	mcfp.lock.Lock()
+	defer mcfp.lock.Unlock()
+	return mcfp.calls[chainID]
+}
+
+type mockHermesCallerFactory struct {
+	errToReturn error
+}
+
+func (mhcf *mockHermesCallerFactory) Get(url string) HermesHTTPRequester {
+	return &mockHermesCaller{
+		errToReturn: mhcf.errToReturn,
+	}
+}
+
+type mockHermesURLGetter struct {
+	errToReturn error
+	urlToReturn string
+}
+
+func (mhug *mockHermesURLGetter) GetHermesURL(address common.Address) (string, error) {
+	if mhug.urlToReturn == "" {
+		return "http://hermes.test/api/v2", mhug.errToReturn
+	}
 	return mhug.urlToReturn, mhug.errToReturn
 }
@@ -0,0 +1,88 @@
+/*
+ * Copyright (C) 2020 The "MysteriumNetwork/node" Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package pingpong
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/asdine/storm/v3"
+	"github.com/mysteriumnetwork/node/core/storage/boltdb"
+	"github.com/mysteriumnetwork/node/identity"
+	"github.com/mysteriumnetwork/payments/crypto"
+)
+
+const hermesPromiseRequestBucketName = "hermes_promise_requests"
+
+// PendingPromiseRequest represents a promise request that was not processed before the node stopped.
+type PendingPromiseRequest struct {
+	ID              int `storm:"id,increment"`
+	R               []byte
+	ExchangeMessage crypto.ExchangeMessage
+	ProviderID      identity.Identity
+	SessionID       string
+}
+
+// HermesPromiseRequestStorage allows for storing of pending hermes promise requests.
+type HermesPromiseRequestStorage struct {
+	lock sync.Mutex
+	bolt *boltdb.Bolt
+}
+
+// NewHermesPromiseRequestStorage returns a new instance of the hermes promise request storage.
+func NewHermesPromiseRequestStorage(bolt *boltdb.Bolt) *HermesPromiseRequestStorage {
+	return &HermesPromiseRequestStorage{
+		bolt: bolt,
+	}
+}
+
+// Store stores the given pending request.
+func (hprs *HermesPromiseRequestStorage) Store(request PendingPromiseRequest) error {
+	hprs.lock.Lock()
+	defer hprs.lock.Unlock()
+
+	if err := hprs.bolt.Store(hermesPromiseRequestBucketName, &request); err != nil {
+		return fmt.Errorf("could not store pending promise request: %w", err)
+	}
+	return nil
+}
+
+// List returns all the stored pending requests.
+func (hprs *HermesPromiseRequestStorage) List() ([]PendingPromiseRequest, error) {
+	hprs.lock.Lock()
+	defer hprs.lock.Unlock()
+
+	var result []PendingPromiseRequest
+	err := hprs.bolt.GetAllFrom(hermesPromiseRequestBucketName, &result)
+	if err != nil && !errors.Is(err, storm.ErrNotFound) {
+		return nil, fmt.Errorf("could not list pending promise requests: %w", err)
+	}
+	return result, nil
+}
+
+// Delete removes the given pending request.
+func (hprs *HermesPromiseRequestStorage) Delete(request PendingPromiseRequest) error {
+	hprs.lock.Lock()
+	defer hprs.lock.Unlock()
+
+	if err := hprs.bolt.Delete(hermesPromiseRequestBucketName, &request); err != nil {
+		return fmt.Errorf("could not delete pending promise request: %w", err)
+	}
+	return nil
+}
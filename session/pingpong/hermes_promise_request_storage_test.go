@@ -0,0 +1,71 @@
+/*
+ * Copyright (C) 2020 The "MysteriumNetwork/node" Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package pingpong
+
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+
+	"github.com/mysteriumnetwork/node/core/storage/boltdb"
+	"github.com/mysteriumnetwork/node/identity"
+	"github.com/mysteriumnetwork/payments/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHermesPromiseRequestStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hermesPromiseRequestStorageTest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	bolt, err := boltdb.NewStorage(dir)
+	assert.NoError(t, err)
+	defer bolt.Close()
+
+	storage := NewHermesPromiseRequestStorage(bolt)
+
+	requests, err := storage.List()
+	assert.NoError(t, err)
+	assert.Len(t, requests, 0)
+
+	request := PendingPromiseRequest{
+		R: []byte{0x1, 0x2},
+		ExchangeMessage: crypto.ExchangeMessage{
+			Promise:        crypto.Promise{Amount: big.NewInt(10), Fee: big.NewInt(1), ChainID: 1},
+			AgreementID:    big.NewInt(123),
+			AgreementTotal: big.NewInt(10),
+			HermesID:       "0x000000acc1",
+			ChainID:        1,
+		},
+		ProviderID: identity.FromAddress("0x44440954558C5bFA0D4153B0002B1d1E3E3f5Ff5"),
+		SessionID:  "session",
+	}
+	assert.NoError(t, storage.Store(request))
+
+	requests, err = storage.List()
+	assert.NoError(t, err)
+	assert.Len(t, requests, 1)
+	request.ID = requests[0].ID
+	assert.EqualValues(t, request, requests[0])
+
+	assert.NoError(t, storage.Delete(requests[0]))
+	requests, err = storage.List()
+	assert.NoError(t, err)
+	assert.Len(t, requests, 0)
+}
@@ -18,6 +18,7 @@
 package pingpong
 
 import (
+	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -281,7 +282,7 @@ func (aps *hermesPromiseSettler) handleHermesPromiseReceived(apep event.AppEvent
 }
 
 func (aps *hermesPromiseSettler) initiateSettling(channel HermesChannel) {
-	hexR, err := hex.DecodeString(channel.lastPromise.R)
+	hexR, err := hex.DecodeString(channel.lastPromise.R.Reveal())
 	if err != nil {
 		log.Error().Err(fmt.Errorf("could encode R: %w", err))
 		return
@@ -325,7 +326,7 @@ func (aps *hermesPromiseSettler) SettleIntoStake(chainID int64, providerID ident
 		return ErrNothingToSettle
 	}
 
-	hexR, err := hex.DecodeString(channel.lastPromise.R)
+	hexR, err := hex.DecodeString(channel.lastPromise.R.Reveal())
 	if err != nil {
 		return fmt.Errorf("could not decode R: %w", err)
 	}
@@ -351,7 +352,7 @@ func (aps *hermesPromiseSettler) ForceSettle(chainID int64, providerID identity.
 		return ErrNothingToSettle
 	}
 
-	hexR, err := hex.DecodeString(channel.lastPromise.R)
+	hexR, err := hex.DecodeString(channel.lastPromise.R.Reveal())
 	if err != nil {
 		return fmt.Errorf("could not decode R: %w", err)
 	}
@@ -375,7 +376,7 @@ func (aps *hermesPromiseSettler) SettleWithBeneficiary(chainID int64, providerID
 		return ErrNothingToSettle
 	}
 
-	hexR, err := hex.DecodeString(channel.lastPromise.R)
+	hexR, err := hex.DecodeString(channel.lastPromise.R.Reveal())
 	if err != nil {
 		return fmt.Errorf("could not decode R: %w", err)
 	}
@@ -407,7 +408,7 @@ func (aps *hermesPromiseSettler) updatePromiseWithLatestFee(hermesID common.Addr
 		return crypto.Promise{}, fmt.Errorf("could not fetch settle fees: %w", err)
 	}
 
-	updatedPromise, err := hermesCaller.UpdatePromiseFee(promise, fees.Fee)
+	updatedPromise, err := hermesCaller.UpdatePromiseFee(context.Background(), promise, fees.Fee)
 	if err != nil {
 		return crypto.Promise{}, fmt.Errorf("could not update promise fee: %w", err)
 	}
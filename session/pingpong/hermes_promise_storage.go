@@ -18,6 +18,7 @@
 package pingpong
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"math/big"
@@ -36,6 +37,33 @@ const hermesPromiseBucketName = "hermes_promises"
 // ErrAttemptToOverwrite occurs when a promise with lower value is attempted to be overwritten on top of an existing promise.
 var ErrAttemptToOverwrite = errors.New("attempted to overwrite a promise with and equal or lower value")
 
+// ErrDuplicatePromise occurs when the stored promise is attempted to be stored again, which is harmless.
+// It wraps ErrAttemptToOverwrite.
+var ErrDuplicatePromise = fmt.Errorf("%w: promise is already stored", ErrAttemptToOverwrite)
+
+// ErrStalePromise occurs when a promise older than the stored one is attempted to be stored,
+// which would lose the newer promise. It wraps ErrAttemptToOverwrite.
+var ErrStalePromise = fmt.Errorf("%w: promise is older than the stored one", ErrAttemptToOverwrite)
+
+// HermesPromiseNotFoundError occurs when the requested hermes promise is not stored.
+type HermesPromiseNotFoundError struct {
+	ChainID     int64
+	ChannelID   string
+	AgreementID *big.Int
+}
+
+func (e *HermesPromiseNotFoundError) Error() string {
+	if e.AgreementID != nil {
+		return fmt.Sprintf("hermes promise for agreement %v on chain %v does not exist", e.AgreementID, e.ChainID)
+	}
+	return fmt.Sprintf("hermes promise for channel %v on chain %v does not exist", e.ChannelID, e.ChainID)
+}
+
+// Unwrap returns ErrNotFound, so that the error can be checked with errors.Is.
+func (e *HermesPromiseNotFoundError) Unwrap() error {
+	return ErrNotFound
+}
+
 // HermesPromiseStorage allows for storing of hermes promises.
 type HermesPromiseStorage struct {
 	lock sync.Mutex
@@ -55,12 +83,83 @@ type HermesPromise struct {
 	Identity    identity.Identity
 	HermesID    common.Address
 	Promise     crypto.Promise
-	R           string
+	R           SecretR
 	Revealed    bool
 	AgreementID *big.Int
+	// AgreementTotal is the total amount of the agreement at the time of the promise.
+	AgreementTotal *big.Int
+}
+
+// redactedR is printed and marshalled instead of the secret R.
+const redactedR = "[redacted]"
+
+// SecretR is the hex encoded secret R of a promise hashlock.
+// It is redacted when printed or marshalled, Reveal must be called explicitly to get the value.
+type SecretR string
+
+// Reveal returns the hex encoded R.
+func (r SecretR) Reveal() string {
+	return string(r)
+}
+
+// String returns the redacted R.
+func (r SecretR) String() string {
+	return redactedR
+}
+
+// GoString returns the redacted R.
+func (r SecretR) GoString() string {
+	return redactedR
+}
+
+// MarshalJSON marshals the redacted R.
+func (r SecretR) MarshalJSON() ([]byte, error) {
+	return json.Codec.Marshal(redactedR)
+}
+
+// hermesPromiseRecord is the stored form of the HermesPromise, it keeps the R unredacted.
+type hermesPromiseRecord struct {
+	ChannelID      string
+	Identity       identity.Identity
+	HermesID       common.Address
+	Promise        crypto.Promise
+	R              string
+	Revealed       bool
+	AgreementID    *big.Int
+	AgreementTotal *big.Int
+}
+
+func newHermesPromiseRecord(promise HermesPromise) hermesPromiseRecord {
+	return hermesPromiseRecord{
+		ChannelID:      promise.ChannelID,
+		Identity:       promise.Identity,
+		HermesID:       promise.HermesID,
+		Promise:        promise.Promise,
+		R:              promise.R.Reveal(),
+		Revealed:       promise.Revealed,
+		AgreementID:    promise.AgreementID,
+		AgreementTotal: promise.AgreementTotal,
+	}
+}
+
+func (r hermesPromiseRecord) toPromise() HermesPromise {
+	return HermesPromise{
+		ChannelID:      r.ChannelID,
+		Identity:       r.Identity,
+		HermesID:       r.HermesID,
+		Promise:        r.Promise,
+		R:              SecretR(r.R),
+		Revealed:       r.Revealed,
+		AgreementID:    r.AgreementID,
+		AgreementTotal: r.AgreementTotal,
+	}
 }
 
-// Store stores the given promise.
+// Store stores the given promise, replacing the stored promise of the channel.
+//
+// Promise amounts of a channel only grow, so a promise is newer than the stored one if its amount is greater.
+// A promise with the same amount, agreement and hashlock as the stored one is a duplicate and fails with ErrDuplicatePromise,
+// unless it marks the stored promise as revealed. Any other promise fails with ErrStalePromise.
 func (aps *HermesPromiseStorage) Store(promise HermesPromise) error {
 	aps.lock.Lock()
 	defer aps.lock.Unlock()
@@ -74,27 +173,42 @@ func (aps *HermesPromiseStorage) Store(promise HermesPromise) error {
 		promise.Promise.Amount = big.NewInt(0)
 	}
 
-	if previousPromise.Promise.Amount != nil && previousPromise.Promise.Amount.Cmp(promise.Promise.Amount) >= 0 {
-		return ErrAttemptToOverwrite
+	if previousPromise.Promise.Amount != nil {
+		cmp := previousPromise.Promise.Amount.Cmp(promise.Promise.Amount)
+		switch {
+		case cmp > 0:
+			return ErrStalePromise
+		case cmp == 0 && !isSamePromise(previousPromise, promise):
+			return ErrStalePromise
+		case cmp == 0 && !(promise.Revealed && !previousPromise.Revealed):
+			// marking the same promise as revealed is the only allowed overwrite with an equal value.
+			return ErrDuplicatePromise
+		}
 	}
 
-	if err := aps.bolt.SetValue(aps.getBucketName(promise.Promise.ChainID), promise.ChannelID, promise); err != nil {
+	if err := aps.bolt.SetValue(aps.getBucketName(promise.Promise.ChainID), promise.ChannelID, newHermesPromiseRecord(promise)); err != nil {
 		return fmt.Errorf("could not store hermes promise: %w", err)
 	}
 	return nil
 }
 
+func isSamePromise(a, b HermesPromise) bool {
+	sameAgreement := a.AgreementID == nil && b.AgreementID == nil ||
+		a.AgreementID != nil && b.AgreementID != nil && a.AgreementID.Cmp(b.AgreementID) == 0
+	return sameAgreement && bytes.Equal(a.Promise.Hashlock, b.Promise.Hashlock)
+}
+
 func (aps *HermesPromiseStorage) get(chainID int64, channelID string) (HermesPromise, error) {
-	result := &HermesPromise{}
+	result := &hermesPromiseRecord{}
 	err := aps.bolt.GetValue(aps.getBucketName(chainID), channelID, result)
 	if err != nil {
 		if err.Error() == errBoltNotFound {
-			err = ErrNotFound
+			err = &HermesPromiseNotFoundError{ChainID: chainID, ChannelID: channelID}
 		} else {
 			err = fmt.Errorf("could not get hermes promise: %w", err)
 		}
 	}
-	return *result, err
+	return result.toPromise(), err
 }
 
 // Get fetches the promise by channel ID identifier.
@@ -104,6 +218,38 @@ func (aps *HermesPromiseStorage) Get(chainID int64, channelID string) (HermesPro
 	return aps.get(chainID, channelID)
 }
 
+// GetByAgreement fetches the promise by the agreement ID.
+// Only the latest promise of each channel is stored, so the promises of the previous agreements are not found.
+func (aps *HermesPromiseStorage) GetByAgreement(chainID int64, agreementID *big.Int) (HermesPromise, error) {
+	promises, err := aps.List(HermesPromiseFilter{ChainID: chainID})
+	if err != nil {
+		return HermesPromise{}, err
+	}
+
+	for _, promise := range promises {
+		if agreementID != nil && promise.AgreementID != nil && promise.AgreementID.Cmp(agreementID) == 0 {
+			return promise, nil
+		}
+	}
+	return HermesPromise{}, &HermesPromiseNotFoundError{ChainID: chainID, AgreementID: agreementID}
+}
+
+// ListUnrevealed fetches the promises on the given chain which R is not yet revealed.
+func (aps *HermesPromiseStorage) ListUnrevealed(chainID int64) ([]HermesPromise, error) {
+	promises, err := aps.List(HermesPromiseFilter{ChainID: chainID})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]HermesPromise, 0)
+	for _, promise := range promises {
+		if !promise.Revealed {
+			result = append(result, promise)
+		}
+	}
+	return result, nil
+}
+
 // HermesPromiseFilter defines all flags for filtering in promises in storage.
 type HermesPromiseFilter struct {
 	Identity *identity.Identity
@@ -132,10 +278,11 @@ func (aps *HermesPromiseStorage) List(filter HermesPromiseFilter) ([]HermesPromi
 				return nil
 			}
 
-			var entry HermesPromise
-			if err := json.Codec.Unmarshal(v, &entry); err != nil {
+			var record hermesPromiseRecord
+			if err := json.Codec.Unmarshal(v, &record); err != nil {
 				return err
 			}
+			entry := record.toPromise()
 
 			if filter.Identity != nil {
 				if *filter.Identity != entry.Identity {
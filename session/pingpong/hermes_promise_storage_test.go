@@ -18,6 +18,9 @@
 package pingpong
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"math/big"
 	"os"
@@ -65,7 +68,13 @@ func TestHermesPromiseStorage(t *testing.T) {
 
 	// check if errors are wrapped correctly
 	_, err = hermesStorage.Get(1, "unknown_id")
-	assert.Equal(t, ErrNotFound, err)
+	assert.True(t, errors.Is(err, ErrNotFound))
+	var notFound *HermesPromiseNotFoundError
+	assert.True(t, errors.As(err, &notFound))
+	assert.Equal(t, "unknown_id", notFound.ChannelID)
+
+	_, err = hermesStorage.GetByAgreement(1, big.NewInt(123))
+	assert.True(t, errors.Is(err, ErrNotFound))
 
 	promises, err := hermesStorage.List(HermesPromiseFilter{})
 	assert.Equal(t, []HermesPromise{}, promises)
@@ -99,8 +108,117 @@ func TestHermesPromiseStorage(t *testing.T) {
 	assert.Equal(t, []HermesPromise{firstPromise, secondPromise}, promises)
 	assert.NoError(t, err)
 
+	promise, err = hermesStorage.GetByAgreement(1, big.NewInt(1234))
+	assert.NoError(t, err)
+	assert.EqualValues(t, secondPromise, promise)
+
+	_, err = hermesStorage.GetByAgreement(2, big.NewInt(1234))
+	assert.True(t, errors.As(err, &notFound))
+	assert.Equal(t, big.NewInt(1234), notFound.AgreementID)
+
 	overwritingPromise := firstPromise
 	overwritingPromise.Promise.Amount = big.NewInt(0)
 	err = hermesStorage.Store(overwritingPromise)
-	assert.Equal(t, err, ErrAttemptToOverwrite)
+	assert.True(t, errors.Is(err, ErrStalePromise))
+	assert.True(t, errors.Is(err, ErrAttemptToOverwrite))
+
+	// mark the promise as revealed, check that it is no longer listed as unrevealed
+	promises, err = hermesStorage.ListUnrevealed(1)
+	assert.NoError(t, err)
+	assert.Equal(t, []HermesPromise{firstPromise, secondPromise}, promises)
+
+	revealedPromise := firstPromise
+	revealedPromise.Revealed = true
+	err = hermesStorage.Store(revealedPromise)
+	assert.NoError(t, err)
+
+	promises, err = hermesStorage.ListUnrevealed(1)
+	assert.NoError(t, err)
+	assert.Equal(t, []HermesPromise{secondPromise}, promises)
+
+	err = hermesStorage.Store(revealedPromise)
+	assert.True(t, errors.Is(err, ErrDuplicatePromise))
+	assert.True(t, errors.Is(err, ErrAttemptToOverwrite))
+}
+
+func TestHermesPromiseStorage_OverwritePolicy(t *testing.T) {
+	stored := HermesPromise{
+		ChannelID:   "1",
+		Identity:    identity.FromAddress("0x44440954558C5bFA0D4153B0002B1d1E3E3f5Ff5"),
+		Promise:     crypto.Promise{Amount: big.NewInt(10), Fee: big.NewInt(1), ChainID: 1, Hashlock: []byte{0x1}},
+		R:           "some r",
+		AgreementID: big.NewInt(1),
+	}
+	withAmount := func(amount int64) HermesPromise {
+		promise := stored
+		promise.Promise.Amount = big.NewInt(amount)
+		promise.Promise.Hashlock = []byte{0x2}
+		return promise
+	}
+	otherAgreement := stored
+	otherAgreement.AgreementID = big.NewInt(2)
+	otherHashlock := stored
+	otherHashlock.Promise.Hashlock = []byte{0x2}
+	revealed := stored
+	revealed.Revealed = true
+
+	tests := []struct {
+		name    string
+		promise HermesPromise
+		wantErr error
+	}{
+		{name: "stores newer promise", promise: withAmount(11)},
+		{name: "stores revealed duplicate", promise: revealed},
+		{name: "rejects duplicate", promise: stored, wantErr: ErrDuplicatePromise},
+		{name: "rejects equal promise of other agreement", promise: otherAgreement, wantErr: ErrStalePromise},
+		{name: "rejects equal promise with other hashlock", promise: otherHashlock, wantErr: ErrStalePromise},
+		{name: "rejects older promise", promise: withAmount(9), wantErr: ErrStalePromise},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "hermesPromiseStorageOverwriteTest")
+			assert.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			bolt, err := boltdb.NewStorage(dir)
+			assert.NoError(t, err)
+			defer bolt.Close()
+
+			hermesStorage := NewHermesPromiseStorage(bolt)
+			assert.NoError(t, hermesStorage.Store(stored))
+
+			err = hermesStorage.Store(tt.promise)
+			promise, getErr := hermesStorage.Get(1, stored.ChannelID)
+			assert.NoError(t, getErr)
+			if tt.wantErr != nil {
+				assert.True(t, errors.Is(err, tt.wantErr), err)
+				assert.EqualValues(t, stored, promise)
+			} else {
+				assert.NoError(t, err)
+				assert.EqualValues(t, tt.promise, promise)
+			}
+		})
+	}
+}
+
+func TestSecretR_Redaction(t *testing.T) {
+	secret := "6c6f6f6b206174206d65"
+	promise := HermesPromise{ChannelID: "1", R: SecretR(secret), AgreementID: big.NewInt(1)}
+
+	for _, format := range []string{"%v", "%+v", "%#v", "%s"} {
+		assert.NotContains(t, fmt.Sprintf(format, promise), secret, format)
+		assert.NotContains(t, fmt.Sprintf(format, promise.R), secret, format)
+	}
+	assert.NotContains(t, fmt.Sprint(promise), secret)
+
+	marshalled, err := json.Marshal(promise)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(marshalled), secret)
+	assert.Contains(t, string(marshalled), redactedR)
+
+	assert.Equal(t, secret, promise.R.Reveal())
+
+	recovery, err := json.Marshal(rRecoveryDetails{R: promise.R.Reveal(), AgreementID: promise.AgreementID})
+	assert.NoError(t, err)
+	assert.Contains(t, string(recovery), secret)
 }
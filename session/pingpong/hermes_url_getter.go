@@ -18,6 +18,7 @@
 package pingpong
 
 import (
+	"errors"
 	"fmt"
 	"net/url"
 	"sync"
@@ -52,6 +53,28 @@ type bc interface {
 
 const suffix = "api/v2"
 
+// ErrInvalidHermesURL indicates that the hermes URL is empty, malformed or has an unsupported scheme.
+var ErrInvalidHermesURL = errors.New("invalid hermes URL")
+
+// validateHermesURL checks that the hermes URL is an absolute http or https URL.
+func validateHermesURL(address string) error {
+	if address == "" {
+		return fmt.Errorf("%w: URL is empty", ErrInvalidHermesURL)
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidHermesURL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: unsupported scheme %q of %v", ErrInvalidHermesURL, u.Scheme, address)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%w: no host in %v", ErrInvalidHermesURL, address)
+	}
+	return nil
+}
+
 func (hug *HermesURLGetter) normalizeAddress(address string) (string, error) {
 	u, err := url.ParseRequestURI(address)
 	if err != nil {
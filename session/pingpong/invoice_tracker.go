@@ -32,6 +32,7 @@ import (
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/mysteriumnetwork/node/config"
+	"github.com/mysteriumnetwork/node/core/service"
 	"github.com/mysteriumnetwork/node/eventbus"
 	"github.com/mysteriumnetwork/node/identity"
 	"github.com/mysteriumnetwork/node/market"
@@ -86,6 +87,11 @@ type promiseHandler interface {
 	RequestPromise(r []byte, em crypto.ExchangeMessage, providerID identity.Identity, sessionID string) <-chan error
 }
 
+// tryPromiseHandler is a promise handler which rejects the requests with ErrQueueFull instead of blocking when it can not accept more of them.
+type tryPromiseHandler interface {
+	TryRequestPromise(r []byte, em crypto.ExchangeMessage, providerID identity.Identity, sessionID string) <-chan error
+}
+
 type sentInvoice struct {
 	invoice    crypto.Invoice
 	r          []byte
@@ -107,6 +113,7 @@ type InvoiceTracker struct {
 	promiseErrors          chan error
 	invoiceChannel         chan bool
 	hermesFailureCount     uint64
+	queueFullCount         uint64
 	hermesFailureCountLock sync.Mutex
 
 	notReceivedExchangeMessageCount uint64
@@ -124,6 +131,7 @@ type InvoiceTracker struct {
 	deps                           InvoiceTrackerDeps
 
 	dataTransferred     DataTransferred
+	lastActivity        time.Time
 	dataTransferredLock sync.Mutex
 
 	criticalInvoiceErrors chan error
@@ -132,6 +140,10 @@ type InvoiceTracker struct {
 
 	lastExchangeMessage     crypto.ExchangeMessage
 	lastExchangeMessageLock sync.Mutex
+
+	// rebound is signalled once the tracker is moved to another p2p channel of the consumer.
+	rebound  chan struct{}
+	bindLock sync.Mutex
 }
 
 // InvoiceTrackerDeps contains all the deps needed for invoice tracker.
@@ -150,6 +162,7 @@ type InvoiceTrackerDeps struct {
 	ProvidersHermesID          common.Address
 	Registry                   string
 	MaxHermesFailureCount      uint64
+	MaxQueueFullCount          uint64
 	MaxAllowedHermesFee        uint16
 	BlockchainHelper           bcHelper
 	EventBus                   eventbus.EventBus
@@ -173,6 +186,7 @@ func NewInvoiceTracker(
 			AgreementTotal: new(big.Int),
 		},
 		stop:                           make(chan struct{}),
+		rebound:                        make(chan struct{}, 1),
 		deps:                           itd,
 		maxNotReceivedExchangeMessages: calculateMaxNotReceivedExchangeMessageCount(itd.ChargePeriodLeeway, itd.ChargePeriod),
 		maxNotSentExchangeMessages:     calculateMaxNotSentExchangeMessageCount(itd.ChargePeriodLeeway, itd.ChargePeriod),
@@ -221,17 +235,47 @@ func (it *InvoiceTracker) getMarkedInvoice(hashlock []byte) (invoice sentInvoice
 func (it *InvoiceTracker) listenForExchangeMessages() error {
 	for {
 		select {
-		case pm := <-it.deps.ExchangeMessageChan:
+		case pm := <-it.exchangeMessageChan():
 			err := it.handleExchangeMessage(pm)
 			if err != nil && err != ErrInvoiceExpired {
 				return err
 			}
+		case <-it.rebound:
+			log.Debug().Msgf("Listening for exchange messages on the new p2p channel of session %s", it.deps.SessionID)
 		case <-it.stop:
 			return nil
 		}
 	}
 }
 
+// Rebind moves the tracker to another p2p channel of the consumer, e.g. when a suspended session is resumed.
+// The invoices are sent over the given channel and the exchange messages are read from the given exchange channel.
+func (it *InvoiceTracker) Rebind(channel p2p.ChannelSender, exchangeChan chan crypto.ExchangeMessage) {
+	it.bindLock.Lock()
+	it.deps.PeerInvoiceSender = NewInvoiceSender(channel)
+	it.deps.ExchangeMessageChan = exchangeChan
+	it.bindLock.Unlock()
+
+	select {
+	case it.rebound <- struct{}{}:
+	default:
+	}
+}
+
+func (it *InvoiceTracker) invoiceSender() PeerInvoiceSender {
+	it.bindLock.Lock()
+	defer it.bindLock.Unlock()
+
+	return it.deps.PeerInvoiceSender
+}
+
+func (it *InvoiceTracker) exchangeMessageChan() chan crypto.ExchangeMessage {
+	it.bindLock.Lock()
+	defer it.bindLock.Unlock()
+
+	return it.deps.ExchangeMessageChan
+}
+
 func (it *InvoiceTracker) generateAgreementID() {
 	it.rnd.Seed(time.Now().UnixNano())
 	agreementID := make([]byte, 32)
@@ -266,11 +310,20 @@ func (it *InvoiceTracker) handleExchangeMessage(em crypto.ExchangeMessage) error
 		return errors.Wrap(err, fmt.Sprintf("could not store r: %s", hex.EncodeToString(invoice.r)))
 	}
 
-	errChan := it.deps.PromiseHandler.RequestPromise(invoice.r, em, it.deps.ProviderID, it.deps.SessionID)
+	errChan := it.requestPromise(invoice.r, em)
 	go it.handlePromiseErrors(errChan)
 	return nil
 }
 
+// requestPromise requests the promise without blocking if the promise handler supports it.
+// A rejected request does not lose the payment, as the next exchange message carries the total amount.
+func (it *InvoiceTracker) requestPromise(r []byte, em crypto.ExchangeMessage) <-chan error {
+	if handler, ok := it.deps.PromiseHandler.(tryPromiseHandler); ok {
+		return handler.TryRequestPromise(r, em, it.deps.ProviderID, it.deps.SessionID)
+	}
+	return it.deps.PromiseHandler.RequestPromise(r, em, it.deps.ProviderID, it.deps.SessionID)
+}
+
 // Start stars the invoice tracker
 func (it *InvoiceTracker) Start() error {
 	log.Debug().Msg("Starting...")
@@ -460,7 +513,7 @@ func (it *InvoiceTracker) sendInvoice(isCritical bool) error {
 	r := it.generateR()
 	invoice := crypto.CreateInvoice(it.agreementID, shouldBe, new(big.Int), r, it.chainID())
 	invoice.Provider = it.deps.ProviderID.Address
-	err := it.deps.PeerInvoiceSender.Send(invoice)
+	err := it.invoiceSender().Send(invoice)
 	if err != nil {
 		return err
 	}
@@ -511,6 +564,13 @@ func (it *InvoiceTracker) handleHermesError(err error) error {
 	}
 
 	switch {
+	case stdErr.Is(err, ErrQueueFull):
+		// the payment is not lost, the next exchange message will carry the total amount.
+		if it.incrementQueueFullCount() > it.deps.MaxQueueFullCount {
+			return err
+		}
+		log.Warn().Err(err).Msg("promise queue is full, will retry with the next exchange message")
+		return nil
 	case
 		stdErr.Is(err, ErrHermesHashlockMissmatch),
 		stdErr.Is(err, ErrHermesPreviousRNotRevealed),
@@ -557,10 +617,19 @@ func (it *InvoiceTracker) incrementHermesFailureCount() uint64 {
 	return it.hermesFailureCount
 }
 
+func (it *InvoiceTracker) incrementQueueFullCount() uint64 {
+	it.hermesFailureCountLock.Lock()
+	defer it.hermesFailureCountLock.Unlock()
+	it.queueFullCount++
+	log.Trace().Msgf("full promise queue count %v/%v", it.queueFullCount, it.deps.MaxQueueFullCount)
+	return it.queueFullCount
+}
+
 func (it *InvoiceTracker) resetHermesFailureCount() {
 	it.hermesFailureCountLock.Lock()
 	defer it.hermesFailureCountLock.Unlock()
 	it.hermesFailureCount = 0
+	it.queueFullCount = 0
 }
 
 func (it *InvoiceTracker) validateExchangeMessage(em crypto.ExchangeMessage) error {
@@ -640,12 +709,37 @@ func (it *InvoiceTracker) updateDataTransfer(up, down uint64) {
 		newDown = down
 	}
 
+	if newUp != it.dataTransferred.Up || newDown != it.dataTransferred.Down {
+		it.lastActivity = time.Now()
+	}
 	it.dataTransferred = DataTransferred{
 		Up:   newUp,
 		Down: newDown,
 	}
 }
 
+// LastActivity returns the last time the session transferred any data, zero time if it did not transfer any yet.
+func (it *InvoiceTracker) LastActivity() time.Time {
+	it.dataTransferredLock.Lock()
+	defer it.dataTransferredLock.Unlock()
+
+	return it.lastActivity
+}
+
+// Usage returns the data transferred in the session and the total amount the consumer agreed to pay.
+func (it *InvoiceTracker) Usage() service.Usage {
+	dt := it.getDataTransferred()
+	tokens := new(big.Int)
+	if total := it.getLastExchangeMessage().AgreementTotal; total != nil {
+		tokens.Set(total)
+	}
+	return service.Usage{
+		Up:     dt.Up,
+		Down:   dt.Down,
+		Tokens: tokens,
+	}
+}
+
 func (it *InvoiceTracker) getDataTransferred() DataTransferred {
 	it.dataTransferredLock.Lock()
 	defer it.dataTransferredLock.Unlock()
@@ -18,6 +18,7 @@
 package pingpong
 
 import (
+	"context"
 	"encoding/hex"
 	"io/ioutil"
 	"math/big"
@@ -27,6 +28,7 @@ import (
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/mysteriumnetwork/node/core/service"
 	"github.com/mysteriumnetwork/node/core/storage/boltdb"
 	"github.com/mysteriumnetwork/node/identity"
 	"github.com/mysteriumnetwork/node/market"
@@ -59,18 +61,22 @@ type mockHermesCaller struct {
 	errToReturn error
 }
 
-func (mac *mockHermesCaller) RequestPromise(rp RequestPromise) (crypto.Promise, error) {
-	return crypto.Promise{}, mac.errToReturn
+func (mac *mockHermesCaller) RequestPromise(ctx context.Context, rp RequestPromise) (crypto.Promise, error) {
+	return signTestPromise(crypto.Promise{}), mac.errToReturn
 }
 
-func (mac *mockHermesCaller) RevealR(r string, provider string, agreementID *big.Int) error {
+func (mac *mockHermesCaller) RevealR(ctx context.Context, r string, provider string, agreementID *big.Int) error {
 	return mac.errToReturn
 }
 
-func (mac *mockHermesCaller) UpdatePromiseFee(promise crypto.Promise, newFee *big.Int) (crypto.Promise, error) {
+func (mac *mockHermesCaller) UpdatePromiseFee(ctx context.Context, promise crypto.Promise, newFee *big.Int) (crypto.Promise, error) {
 	return promise, nil
 }
 
+func (mac *mockHermesCaller) Ping(ctx context.Context) error {
+	return mac.errToReturn
+}
+
 func Test_InvoiceTracker_Start_Stop(t *testing.T) {
 	dir, err := ioutil.TempDir("", "invoice_tracker_test")
 	assert.Nil(t, err)
@@ -764,6 +770,53 @@ func TestInvoiceTracker_handleHermesError(t *testing.T) {
 	}
 }
 
+type mockPromiseHandler struct {
+	requests    int
+	tryRequests int
+}
+
+func (mph *mockPromiseHandler) RequestPromise(r []byte, em crypto.ExchangeMessage, providerID identity.Identity, sessionID string) <-chan error {
+	mph.requests++
+	return newErrChan(nil)
+}
+
+type mockTryPromiseHandler struct {
+	mockPromiseHandler
+}
+
+func (mtph *mockTryPromiseHandler) TryRequestPromise(r []byte, em crypto.ExchangeMessage, providerID identity.Identity, sessionID string) <-chan error {
+	mtph.tryRequests++
+	return newErrChan(ErrQueueFull)
+}
+
+func TestInvoiceTracker_requestPromise(t *testing.T) {
+	handler := &mockPromiseHandler{}
+	it := &InvoiceTracker{deps: InvoiceTrackerDeps{PromiseHandler: handler, MaxHermesFailureCount: 1}}
+	<-it.requestPromise([]byte{0x0}, crypto.ExchangeMessage{})
+	assert.Equal(t, 1, handler.requests)
+
+	tryHandler := &mockTryPromiseHandler{}
+	it = &InvoiceTracker{deps: InvoiceTrackerDeps{PromiseHandler: tryHandler, MaxQueueFullCount: 2}}
+
+	// the full queue is tolerated, as the next exchange message will retry the request.
+	for i := 0; i < 2; i++ {
+		err := <-it.requestPromise([]byte{0x0}, crypto.ExchangeMessage{})
+		assert.Equal(t, ErrQueueFull, err)
+		assert.NoError(t, it.handleHermesError(err))
+	}
+
+	// the session is ended once the queue stays full for too long.
+	err := <-it.requestPromise([]byte{0x0}, crypto.ExchangeMessage{})
+	assert.Equal(t, ErrQueueFull, it.handleHermesError(err))
+	assert.Equal(t, 3, tryHandler.tryRequests)
+	assert.Equal(t, 0, tryHandler.requests)
+	assert.Equal(t, uint64(0), it.hermesFailureCount)
+
+	// an accepted request resets the count.
+	assert.NoError(t, it.handleHermesError(nil))
+	assert.NoError(t, it.handleHermesError(ErrQueueFull))
+}
+
 type mockPaymentMethod struct {
 	price money.Money
 	t     string
@@ -812,6 +865,10 @@ func (maps *mockHermesPromiseStorage) List(_ HermesPromiseFilter) ([]HermesPromi
 	return []HermesPromise{maps.toReturn}, maps.errToReturn
 }
 
+func (maps *mockHermesPromiseStorage) ListUnrevealed(_ int64) ([]HermesPromise, error) {
+	return []HermesPromise{maps.toReturn}, maps.errToReturn
+}
+
 type mockBlockchainHelper struct {
 	feeToReturn   uint16
 	errorToReturn error
@@ -857,6 +914,52 @@ func (mp *mockPublisher) Unsubscribe(topic string, fn interface{}) error {
 	return nil
 }
 
+func TestInvoiceTracker_LastActivity(t *testing.T) {
+	it := &InvoiceTracker{}
+	assert.True(t, it.LastActivity().IsZero())
+
+	it.updateDataTransfer(10, 0)
+	first := it.LastActivity()
+	assert.False(t, first.IsZero())
+
+	// the stale counters do not count as activity.
+	it.updateDataTransfer(10, 0)
+	it.updateDataTransfer(5, 0)
+	assert.Equal(t, first, it.LastActivity())
+
+	it.updateDataTransfer(10, 1)
+	assert.True(t, it.LastActivity().After(first) || it.LastActivity().Equal(first))
+	assert.Equal(t, DataTransferred{Up: 10, Down: 1}, it.getDataTransferred())
+}
+
+func TestInvoiceTracker_Rebind(t *testing.T) {
+	oldChan := make(chan crypto.ExchangeMessage)
+	it := NewInvoiceTracker(InvoiceTrackerDeps{
+		PeerInvoiceSender:   &MockPeerInvoiceSender{},
+		ExchangeMessageChan: oldChan,
+	})
+	done := make(chan error)
+	go func() {
+		done <- it.listenForExchangeMessages()
+	}()
+
+	newChan := make(chan crypto.ExchangeMessage)
+	it.Rebind(nil, newChan)
+	assert.IsType(t, &InvoiceSender{}, it.invoiceSender())
+
+	// the messages of the new channel are read, the expired ones are skipped.
+	select {
+	case newChan <- crypto.ExchangeMessage{Promise: crypto.Promise{Hashlock: []byte{0x1}}}:
+	case <-time.After(2 * time.Second):
+		t.Fatal("exchange messages of the new channel are not read")
+	}
+
+	close(it.stop)
+	assert.NoError(t, <-done)
+}
+
+var _ service.RebindablePaymentEngine = &InvoiceTracker{}
+
 func TestInvoiceTracker_validateExchangeMessage(t *testing.T) {
 	type fields struct {
 		deps InvoiceTrackerDeps